@@ -0,0 +1,29 @@
+// Command backplane-standin runs a minimal Redis pub/sub stand-in for local multi-instance development
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"collaborative-editor/internal/backplane"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:6379", "Address to listen on")
+	flag.Parse()
+
+	standIn, err := backplane.NewStandIn(*addr)
+	if err != nil {
+		log.Fatalf("Failed to start stand-in: %v", err)
+	}
+	log.Printf("Backplane stand-in listening on %s", standIn.Addr())
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	<-sigChan
+
+	standIn.Close()
+}
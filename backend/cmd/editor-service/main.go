@@ -1,25 +1,72 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"collaborative-editor/internal/backplane"
 	"collaborative-editor/internal/editor"
+	"collaborative-editor/internal/format"
+	"collaborative-editor/internal/git"
+	"collaborative-editor/internal/lsp"
+	"collaborative-editor/internal/terminal"
+	"collaborative-editor/pkg/protocol"
 )
 
 func main() {
 	// Parse flags
 	var (
-		port = flag.String("port", "8080", "Port to listen on")
-		env  = flag.String("env", "dev", "Environment (dev, staging, prod)")
+		port         = flag.String("port", "8080", "Port to listen on")
+		env          = flag.String("env", "dev", "Environment (dev, staging, prod)")
+		nodeID       = flag.String("node-id", "", "Identity of this instance on the backplane (random if empty)")
+		backplaneURL = flag.String("backplane", "memory", "Backplane between instances: memory or redis://host:port")
+		clusterNodes = flag.String("cluster", "", "Comma separated node IDs sharing document ownership (requires -node-id)")
+		lspServers   = flag.String("lsp", "", "Comma separated language servers of workspace files as language=command, e.g. go=gopls")
+		formatters   = flag.String("format", "", "Comma separated formatters as language=command, e.g. go=gofmt -s (installed defaults if empty)")
+		formatOnSave = flag.Bool("format-on-save", false, "Format documents that have a formatter when they are saved")
+		terminals    = flag.Bool("terminal", false, "Let workspaces share a terminal running an unsandboxed shell as this server's user")
+		shell        = flag.String("terminal-shell", "", "Command the shared terminal runs (bash, or sh, if empty)")
+		gitRoot      = flag.String("git-root", "", "Folder of the local git repositories workspaces commit to (git disabled if empty)")
 	)
 	flag.Parse()
 
+	if *clusterNodes != "" && *nodeID == "" {
+		log.Fatal("-cluster requires -node-id so peers agree on document ownership")
+	}
+
+	bp, err := openBackplane(*backplaneURL)
+	if err != nil {
+		log.Fatalf("Failed to open backplane: %v", err)
+	}
+
+	languageServers, err := parseLanguageServers(*lspServers)
+	if err != nil {
+		log.Fatalf("Invalid -lsp: %v", err)
+	}
+
+	formatting, err := parseFormatters(*formatters)
+	if err != nil {
+		log.Fatalf("Invalid -format: %v", err)
+	}
+
+	var terminalConfig *terminal.Config
+	if *terminals {
+		terminalConfig = &terminal.Config{Shell: strings.Fields(*shell)}
+	}
+
+	var gitConfig *git.Config
+	if *gitRoot != "" {
+		gitConfig = &git.Config{Root: *gitRoot}
+	}
+
 	// Create editor config
 	editorConfig := &editor.Config{
 		MaxMessageSize: 512 * 1024, // 512KB
@@ -27,6 +74,15 @@ func main() {
 		ReadTimeout:    60 * time.Second,
 		PingInterval:   30 * time.Second,
 		MaxClients:     1000,
+		NodeID:         *nodeID,
+		Backplane:      bp,
+		Cluster:        splitNodes(*clusterNodes),
+
+		LanguageServers: languageServers,
+		Formatting:      formatting,
+		FormatOnSave:    *formatOnSave,
+		Terminal:        terminalConfig,
+		Git:             gitConfig,
 	}
 
 	// Initialize the editor service
@@ -49,6 +105,26 @@ func main() {
 	// WebSocket endpoint
 	mux.HandleFunc("/ws", service.HandleWebSocket)
 
+	// REST API for dashboards and integrations
+	service.RegisterRoutes(mux)
+
+	// Service metrics, including per-client queue depths
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(service.GetMetrics())
+	})
+
+	// JSON Schema of client messages, for the frontend and bots
+	mux.HandleFunc("/protocol/schema.json", func(w http.ResponseWriter, r *http.Request) {
+		schema, err := protocol.JSONSchema()
+		if err != nil {
+			http.Error(w, "Failed to generate schema", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/schema+json")
+		w.Write(schema)
+	})
+
 	// Static files (in development only)
 	if *env == "dev" {
 		fileServer := http.FileServer(http.Dir("../frontend/public"))
@@ -69,13 +145,77 @@ func main() {
 
 		log.Println("Shutting down server...")
 		service.Shutdown()
+		bp.Close()
 		server.Close()
 	}()
 
 	log.Printf("Editor service starting on port %s (env: %s)", *port, *env)
 	log.Println("Open http://localhost:" + *port + "/?doc=test-doc in multiple browsers")
+	log.Println("or http://localhost:" + *port + "/?workspace=test-project for a multi-file workspace")
 
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Server failed to start: %v", err)
 	}
 }
+
+// openBackplane creates the backplane named by the -backplane flag
+func openBackplane(url string) (backplane.Backplane, error) {
+	switch {
+	case url == "" || url == "memory":
+		return backplane.NewMemory(), nil
+	case strings.HasPrefix(url, "redis://"):
+		return backplane.DialRedis(strings.TrimPrefix(url, "redis://"), "collab:")
+	default:
+		return nil, fmt.Errorf("unknown backplane %q", url)
+	}
+}
+
+// splitNodes parses the -cluster flag
+func splitNodes(list string) []string {
+	var nodes []string
+	for _, node := range strings.Split(list, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// parseLanguageServers parses the -lsp flag. A command's arguments follow
+// it, separated by spaces: python=pylsp -v
+func parseLanguageServers(list string) ([]lsp.ServerConfig, error) {
+	var configs []lsp.ServerConfig
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		language, command, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(language) == "" || len(strings.Fields(command)) == 0 {
+			return nil, fmt.Errorf("%q is not language=command", entry)
+		}
+		configs = append(configs, lsp.ServerConfig{
+			Language: strings.TrimSpace(language),
+			Command:  strings.Fields(command),
+		})
+	}
+	return configs, nil
+}
+
+// parseFormatters parses the -format flag like -lsp: python=black -q -
+func parseFormatters(list string) (*format.Config, error) {
+	cfg := &format.Config{}
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		language, command, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(language) == "" || len(strings.Fields(command)) == 0 {
+			return nil, fmt.Errorf("%q is not language=command", entry)
+		}
+		cfg.Formatters = append(cfg.Formatters, format.Formatter{
+			Language: strings.TrimSpace(language),
+			Command:  strings.Fields(command),
+		})
+	}
+	return cfg, nil
+}
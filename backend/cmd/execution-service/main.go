@@ -0,0 +1,122 @@
+// Command execution-service runs programs in the editor's sandbox over HTTP,
+// for tools that want to run code without joining a document
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"collaborative-editor/internal/execution"
+)
+
+func main() {
+	var (
+		port          = flag.String("port", "8082", "Port to listen on")
+		env           = flag.String("env", "dev", "Environment (dev, staging, prod)")
+		timeout       = flag.Duration("timeout", execution.DefaultLimits.Timeout, "Wall clock limit of a run")
+		maxConcurrent = flag.Int("max-concurrent", execution.DefaultMaxConcurrent, "Programs running at once")
+	)
+	flag.Parse()
+
+	runner := execution.NewRunner(&execution.Config{
+		Limits:        execution.Limits{Timeout: *timeout},
+		MaxConcurrent: *maxConcurrent,
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("healthy"))
+	})
+	mux.HandleFunc("GET /languages", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"languages": runner.Languages()})
+	})
+	mux.HandleFunc("POST /execute", func(w http.ResponseWriter, r *http.Request) {
+		handleExecute(runner, w, r)
+	})
+
+	server := &http.Server{
+		Addr:    ":" + *port,
+		Handler: mux,
+	}
+
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		<-sigChan
+
+		log.Println("Shutting down execution service...")
+		server.Close()
+	}()
+
+	log.Printf("Execution service starting on port %s (env: %s, languages: %v)", *port, *env, runner.Languages())
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+}
+
+// maxRequestBody bounds a request: the source and stdin of one run
+const maxRequestBody = 1 << 20
+
+// handleExecute runs {"language", "source", "stdin"} and streams newline
+// delimited JSON events: an "output" event per chunk written, then one
+// "finished" event. Closing the request kills the program.
+func handleExecute(runner *execution.Runner, w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Language string `json:"language"`
+		Source   string `json:"source"`
+		Stdin    string `json:"stdin"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBody)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if !runner.Supports(req.Language) {
+		http.Error(w, "unsupported language", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	send := func(event map[string]interface{}) {
+		enc.Encode(event)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	result, err := runner.Run(r.Context(), execution.Request{
+		Language: req.Language,
+		Source:   req.Source,
+		Stdin:    req.Stdin,
+	}, func(out execution.Output) {
+		send(map[string]interface{}{"type": "output", "stream": out.Stream, "data": out.Data})
+	})
+
+	event := map[string]interface{}{
+		"type":       "finished",
+		"exitCode":   result.ExitCode,
+		"durationMs": result.Duration.Milliseconds(),
+		"timedOut":   result.TimedOut,
+		"canceled":   result.Canceled,
+		"truncated":  result.Truncated,
+	}
+	if err != nil {
+		event["error"] = err.Error()
+	}
+	send(event)
+}
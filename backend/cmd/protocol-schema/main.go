@@ -0,0 +1,34 @@
+// Command protocol-schema writes the JSON Schema of the client message protocol
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"collaborative-editor/pkg/protocol"
+)
+
+func main() {
+	out := flag.String("o", "", "Output file (defaults to stdout)")
+	flag.Parse()
+
+	schema, err := protocol.JSONSchema()
+	if err != nil {
+		log.Fatalf("Failed to generate schema: %v", err)
+	}
+	schema = append(schema, '\n')
+
+	if *out == "" {
+		os.Stdout.Write(schema)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(*out), 0o755); err != nil {
+		log.Fatalf("Failed to create output directory: %v", err)
+	}
+	if err := os.WriteFile(*out, schema, 0o644); err != nil {
+		log.Fatalf("Failed to write schema: %v", err)
+	}
+}
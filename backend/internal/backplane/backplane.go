@@ -0,0 +1,192 @@
+// internal/backplane/backplane.go
+// Package backplane carries document messages between editor-service instances
+package backplane
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrClosed is returned when using a backplane after Close
+var ErrClosed = errors.New("backplane closed")
+
+// Handler receives payloads published on a topic. A nil payload tells it that
+// payloads were dropped because it fell behind, so it can resynchronize.
+type Handler func(payload []byte)
+
+// Backplane is a topic based pub/sub transport shared by all editor-service instances.
+// Publishers receive their own messages too; callers filter by origin.
+type Backplane interface {
+	// Publish sends a payload to every subscriber of the topic
+	Publish(topic string, payload []byte) error
+
+	// Subscribe registers a handler for a topic. Handlers of one subscription
+	// are called sequentially, in publish order.
+	Subscribe(topic string, handler Handler) (Subscription, error)
+
+	// Close releases the backplane's resources
+	Close() error
+}
+
+// Subscription is a registered handler that can be removed
+type Subscription interface {
+	Unsubscribe() error
+
+	// Dropped returns how many payloads were dropped because the handler
+	// fell behind
+	Dropped() int64
+}
+
+// Size of each subscription's delivery queue
+const subscriptionQueueSize = 1024
+
+// Memory is an in-process backplane, for single instance deployments and for
+// connecting several services inside one process
+type Memory struct {
+	mu     sync.RWMutex
+	topics map[string]map[*memorySubscription]bool
+	closed bool
+}
+
+// delivery feeds payloads to a handler from its own goroutine,
+// so a slow handler never blocks publishers or other subscribers
+type delivery struct {
+	topic   string
+	queue   chan []byte
+	done    chan struct{}
+	stopped sync.Once
+
+	// Payloads dropped in total, and whether the handler is yet to hear of
+	// the latest drops
+	dropped atomic.Int64
+	missed  atomic.Bool
+}
+
+func newDelivery(topic string, handler Handler) *delivery {
+	d := &delivery{
+		topic: topic,
+		queue: make(chan []byte, subscriptionQueueSize),
+		done:  make(chan struct{}),
+	}
+
+	go func() {
+		for {
+			select {
+			case payload := <-d.queue:
+				handler(payload)
+				if d.missed.Swap(false) {
+					handler(nil)
+				}
+			case <-d.done:
+				return
+			}
+		}
+	}()
+
+	return d
+}
+
+// deliver queues a payload, dropping it if the handler is too far behind
+func (d *delivery) deliver(payload []byte) {
+	select {
+	case d.queue <- payload:
+	case <-d.done:
+	default:
+		d.missed.Store(true)
+		log.Printf("[BACKPLANE] Subscriber queue full on %s, dropping message (%d dropped)",
+			d.topic, d.dropped.Add(1))
+	}
+}
+
+// Dropped returns how many payloads were dropped because the handler fell behind
+func (d *delivery) Dropped() int64 {
+	return d.dropped.Load()
+}
+
+func (d *delivery) stop() {
+	d.stopped.Do(func() {
+		close(d.done)
+	})
+}
+
+// memorySubscription is a subscription to a Memory backplane
+type memorySubscription struct {
+	*delivery
+	memory *Memory
+}
+
+// NewMemory creates an in-process backplane
+func NewMemory() *Memory {
+	return &Memory{
+		topics: make(map[string]map[*memorySubscription]bool),
+	}
+}
+
+// Publish delivers a payload to every subscriber of the topic
+func (m *Memory) Publish(topic string, payload []byte) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	for sub := range m.topics[topic] {
+		sub.deliver(payload)
+	}
+	return nil
+}
+
+// Subscribe registers a handler for a topic
+func (m *Memory) Subscribe(topic string, handler Handler) (Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	sub := &memorySubscription{
+		delivery: newDelivery(topic, handler),
+		memory:   m,
+	}
+	if m.topics[topic] == nil {
+		m.topics[topic] = make(map[*memorySubscription]bool)
+	}
+	m.topics[topic][sub] = true
+
+	return sub, nil
+}
+
+// Close stops all subscriptions
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	topics := m.topics
+	m.topics = make(map[string]map[*memorySubscription]bool)
+	m.closed = true
+	m.mu.Unlock()
+
+	for _, subs := range topics {
+		for sub := range subs {
+			sub.stop()
+		}
+	}
+	return nil
+}
+
+// Unsubscribe removes the subscription and stops its delivery goroutine
+func (s *memorySubscription) Unsubscribe() error {
+	s.memory.mu.Lock()
+	if subs := s.memory.topics[s.topic]; subs != nil {
+		delete(subs, s)
+		if len(subs) == 0 {
+			delete(s.memory.topics, s.topic)
+		}
+	}
+	s.memory.mu.Unlock()
+
+	s.stop()
+	return nil
+}
@@ -0,0 +1,50 @@
+package backplane
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMemoryCountsAndReportsDroppedPayloads(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	// The handler holds up the first payload until released
+	started := make(chan struct{})
+	release := make(chan struct{})
+	received := make(chan string, subscriptionQueueSize+8)
+	sub, err := m.Subscribe("doc", func(payload []byte) {
+		if payload == nil {
+			received <- "gap"
+			return
+		}
+		if string(payload) == "0" {
+			close(started)
+			<-release
+		}
+		received <- string(payload)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Publish("doc", []byte("0"))
+	<-started
+	for i := 1; i <= subscriptionQueueSize+2; i++ {
+		m.Publish("doc", []byte(fmt.Sprint(i)))
+	}
+	if got := sub.Dropped(); got != 2 {
+		t.Fatalf("dropped %d payloads, want 2", got)
+	}
+	close(release)
+
+	// The handler hears of the gap once, and still gets every payload kept
+	expectPayload(t, received, "0")
+	expectPayload(t, received, "gap")
+	for i := 1; i <= subscriptionQueueSize; i++ {
+		expectPayload(t, received, fmt.Sprint(i))
+	}
+	m.Publish("doc", []byte("after"))
+	expectPayload(t, received, "after")
+	expectNothing(t, received)
+}
@@ -0,0 +1,324 @@
+// internal/backplane/redis.go
+package backplane
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Timeout for dialing and for publish round trips
+	redisTimeout = 5 * time.Second
+
+	// Delay between reconnection attempts of the subscriber connection
+	redisRetryDelay = time.Second
+)
+
+// Redis is a backplane speaking the Redis pub/sub protocol (RESP).
+// It keeps one connection for publishing and one in subscriber mode,
+// and resubscribes all topics when the subscriber connection drops.
+type Redis struct {
+	addr   string
+	prefix string
+
+	pubMu sync.Mutex
+	pub   net.Conn
+	pubR  *bufio.Reader
+	pubW  *bufio.Writer
+
+	// subWriteMu serializes commands on the subscriber connection, so they
+	// reach the server in the order subs changed; it is taken before subMu.
+	// subMu guards the connection and subs but is never held across network
+	// I/O, so a stalled write never blocks delivery.
+	subWriteMu sync.Mutex
+	subMu      sync.Mutex
+	sub        net.Conn
+	subW       *bufio.Writer
+	subs       map[string]map[*redisSubscription]bool
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// redisSubscription is a subscription to a Redis backplane
+type redisSubscription struct {
+	*delivery
+	redis *Redis
+}
+
+// DialRedis connects to a Redis compatible server.
+// Topics are namespaced with prefix so several deployments can share a server.
+func DialRedis(addr, prefix string) (*Redis, error) {
+	r := &Redis{
+		addr:   addr,
+		prefix: prefix,
+		subs:   make(map[string]map[*redisSubscription]bool),
+		closed: make(chan struct{}),
+	}
+
+	if err := r.connectPublisher(); err != nil {
+		return nil, err
+	}
+	if err := r.connectSubscriber(); err != nil {
+		r.pub.Close()
+		return nil, err
+	}
+
+	go r.readLoop()
+
+	log.Printf("[BACKPLANE] Connected to redis at %s", addr)
+	return r, nil
+}
+
+// connectPublisher (re)opens the publishing connection; callers hold pubMu or own r exclusively
+func (r *Redis) connectPublisher() error {
+	conn, err := net.DialTimeout("tcp", r.addr, redisTimeout)
+	if err != nil {
+		return fmt.Errorf("dial redis %s: %w", r.addr, err)
+	}
+
+	r.pub = conn
+	r.pubR = bufio.NewReader(conn)
+	r.pubW = bufio.NewWriter(conn)
+	return nil
+}
+
+// connectSubscriber (re)opens the subscriber connection and resubscribes every topic
+func (r *Redis) connectSubscriber() error {
+	conn, err := net.DialTimeout("tcp", r.addr, redisTimeout)
+	if err != nil {
+		return fmt.Errorf("dial redis %s: %w", r.addr, err)
+	}
+
+	r.subWriteMu.Lock()
+	defer r.subWriteMu.Unlock()
+
+	r.subMu.Lock()
+	r.sub = conn
+	r.subW = bufio.NewWriter(conn)
+	topics := make([]string, 0, len(r.subs))
+	for topic := range r.subs {
+		topics = append(topics, topic)
+	}
+	r.subMu.Unlock()
+
+	for _, topic := range topics {
+		if err := writeSub(conn, r.subW, []byte("SUBSCRIBE"), []byte(r.prefix+topic)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSub writes a command on the subscriber connection; callers hold
+// subWriteMu. A failed write closes the connection, so readLoop reconnects
+// and resubscribes.
+func writeSub(conn net.Conn, w *bufio.Writer, args ...[]byte) error {
+	conn.SetWriteDeadline(time.Now().Add(redisTimeout))
+	err := writeCommand(w, args...)
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+	}
+	return err
+}
+
+// Publish sends a payload to every subscriber of the topic, on any instance
+func (r *Redis) Publish(topic string, payload []byte) error {
+	select {
+	case <-r.closed:
+		return ErrClosed
+	default:
+	}
+
+	r.pubMu.Lock()
+	defer r.pubMu.Unlock()
+
+	// One retry on a fresh connection covers a server restart between publishes
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if r.pub == nil {
+			if err = r.connectPublisher(); err != nil {
+				continue
+			}
+		}
+
+		if err = r.publishOnce(topic, payload); err == nil {
+			return nil
+		}
+
+		r.pub.Close()
+		r.pub = nil
+	}
+	return fmt.Errorf("publish to %s: %w", topic, err)
+}
+
+func (r *Redis) publishOnce(topic string, payload []byte) error {
+	r.pub.SetDeadline(time.Now().Add(redisTimeout))
+	defer r.pub.SetDeadline(time.Time{})
+
+	if err := writeCommand(r.pubW, []byte("PUBLISH"), []byte(r.prefix+topic), payload); err != nil {
+		return err
+	}
+
+	reply, err := readValue(r.pubR)
+	if err != nil {
+		return err
+	}
+	if e, ok := reply.(respError); ok {
+		return e
+	}
+	return nil
+}
+
+// Subscribe registers a handler for a topic
+func (r *Redis) Subscribe(topic string, handler Handler) (Subscription, error) {
+	select {
+	case <-r.closed:
+		return nil, ErrClosed
+	default:
+	}
+
+	sub := &redisSubscription{
+		delivery: newDelivery(topic, handler),
+		redis:    r,
+	}
+
+	r.subWriteMu.Lock()
+	defer r.subWriteMu.Unlock()
+
+	r.subMu.Lock()
+	first := r.subs[topic] == nil
+	if first {
+		r.subs[topic] = make(map[*redisSubscription]bool)
+	}
+	r.subs[topic][sub] = true
+	conn, w := r.sub, r.subW
+	r.subMu.Unlock()
+
+	// A failed write is retried when readLoop reconnects and resubscribes
+	if first {
+		if err := writeSub(conn, w, []byte("SUBSCRIBE"), []byte(r.prefix+topic)); err != nil {
+			log.Printf("[BACKPLANE] Error subscribing to %s: %v", topic, err)
+		}
+	}
+	return sub, nil
+}
+
+// Unsubscribe removes the subscription, unsubscribing the topic once unused
+func (s *redisSubscription) Unsubscribe() error {
+	r := s.redis
+	s.stop()
+
+	r.subWriteMu.Lock()
+	defer r.subWriteMu.Unlock()
+
+	r.subMu.Lock()
+	subs := r.subs[s.topic]
+	if subs == nil {
+		r.subMu.Unlock()
+		return nil
+	}
+	delete(subs, s)
+	last := len(subs) == 0
+	if last {
+		delete(r.subs, s.topic)
+	}
+	conn, w := r.sub, r.subW
+	r.subMu.Unlock()
+
+	if !last {
+		return nil
+	}
+	return writeSub(conn, w, []byte("UNSUBSCRIBE"), []byte(r.prefix+s.topic))
+}
+
+// readLoop dispatches pushed messages and reconnects when the subscriber connection drops
+func (r *Redis) readLoop() {
+	for {
+		r.subMu.Lock()
+		reader := bufio.NewReader(r.sub)
+		r.subMu.Unlock()
+
+		err := r.readMessages(reader)
+
+		select {
+		case <-r.closed:
+			return
+		default:
+		}
+
+		log.Printf("[BACKPLANE] Redis subscriber connection lost: %v", err)
+		for {
+			select {
+			case <-r.closed:
+				return
+			case <-time.After(redisRetryDelay):
+			}
+
+			if err := r.connectSubscriber(); err != nil {
+				log.Printf("[BACKPLANE] Redis reconnect failed: %v", err)
+				continue
+			}
+			log.Printf("[BACKPLANE] Redis subscriber reconnected")
+			break
+		}
+	}
+}
+
+// readMessages reads pushes until the connection fails
+func (r *Redis) readMessages(reader *bufio.Reader) error {
+	for {
+		value, err := readValue(reader)
+		if err != nil {
+			return err
+		}
+
+		push, ok := value.([]interface{})
+		if !ok || len(push) != 3 || asString(push[0]) != "message" {
+			// Subscribe confirmations and the like
+			continue
+		}
+
+		channel := asString(push[1])
+		payload, _ := push[2].([]byte)
+		if len(channel) < len(r.prefix) {
+			continue
+		}
+		topic := channel[len(r.prefix):]
+
+		r.subMu.Lock()
+		for sub := range r.subs[topic] {
+			sub.deliver(payload)
+		}
+		r.subMu.Unlock()
+	}
+}
+
+// Close closes both connections and stops all subscriptions
+func (r *Redis) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+
+		r.pubMu.Lock()
+		if r.pub != nil {
+			r.pub.Close()
+		}
+		r.pubMu.Unlock()
+
+		r.subMu.Lock()
+		r.sub.Close()
+		for _, subs := range r.subs {
+			for sub := range subs {
+				sub.stop()
+			}
+		}
+		r.subs = make(map[string]map[*redisSubscription]bool)
+		r.subMu.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,275 @@
+package backplane
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPrefix = "test:"
+
+func startStandIn(t *testing.T) *StandIn {
+	t.Helper()
+	s, err := NewStandIn("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewStandIn: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func dialTestRedis(t *testing.T, s *StandIn) *Redis {
+	t.Helper()
+	r, err := DialRedis(s.Addr(), testPrefix)
+	if err != nil {
+		t.Fatalf("DialRedis: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// subscribers returns how many connections the stand-in has subscribed to a channel
+func (s *StandIn) subscribers(channel string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.channels[channel])
+}
+
+// dropConnections closes every client connection, as a server restart would
+func (s *StandIn) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		c.conn.Close()
+	}
+}
+
+// waitSubscribers waits until the stand-in has n subscribers on a topic
+func waitSubscribers(t *testing.T, s *StandIn, topic string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.subscribers(testPrefix+topic) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has %d subscribers, want %d", topic, s.subscribers(testPrefix+topic), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// collect subscribes to a topic and returns the channel its payloads arrive on
+func collect(t *testing.T, bp Backplane, topic string) (Subscription, chan string) {
+	t.Helper()
+	received := make(chan string, 16)
+	sub, err := bp.Subscribe(topic, func(payload []byte) { received <- string(payload) })
+	if err != nil {
+		t.Fatalf("Subscribe %s: %v", topic, err)
+	}
+	return sub, received
+}
+
+func expectPayload(t *testing.T, received chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-received:
+		if got != want {
+			t.Fatalf("received %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %q", want)
+	}
+}
+
+func expectNothing(t *testing.T, received chan string) {
+	t.Helper()
+	select {
+	case got := <-received:
+		t.Fatalf("received %q, want nothing", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRedisPublishSubscribe(t *testing.T) {
+	s := startStandIn(t)
+	a, b := dialTestRedis(t, s), dialTestRedis(t, s)
+
+	_, fromA := collect(t, a, "doc")
+	_, fromB := collect(t, b, "doc")
+	_, other := collect(t, b, "other")
+	waitSubscribers(t, s, "doc", 2)
+	waitSubscribers(t, s, "other", 1)
+
+	if err := a.Publish("doc", []byte("hello")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	// Publishers receive their own messages too
+	expectPayload(t, fromA, "hello")
+	expectPayload(t, fromB, "hello")
+	expectNothing(t, other)
+
+	// Handlers see a topic's messages in publish order
+	for _, payload := range []string{"1", "2", "3"} {
+		if err := b.Publish("doc", []byte(payload)); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+	for _, want := range []string{"1", "2", "3"} {
+		expectPayload(t, fromA, want)
+	}
+}
+
+func TestRedisPrefixesTopics(t *testing.T) {
+	s := startStandIn(t)
+	a := dialTestRedis(t, s)
+	b, err := DialRedis(s.Addr(), "other:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	_, received := collect(t, b, "doc")
+	deadline := time.Now().Add(5 * time.Second)
+	for s.subscribers("other:doc") != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := a.Publish("doc", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	expectNothing(t, received)
+}
+
+func TestRedisUnsubscribe(t *testing.T) {
+	s := startStandIn(t)
+	a, b := dialTestRedis(t, s), dialTestRedis(t, s)
+
+	first, fromFirst := collect(t, b, "doc")
+	second, fromSecond := collect(t, b, "doc")
+	waitSubscribers(t, s, "doc", 1)
+
+	// The topic stays subscribed while another subscription uses it
+	if err := first.Unsubscribe(); err != nil {
+		t.Fatalf("Unsubscribe: %v", err)
+	}
+	if err := a.Publish("doc", []byte("still here")); err != nil {
+		t.Fatal(err)
+	}
+	expectPayload(t, fromSecond, "still here")
+	expectNothing(t, fromFirst)
+
+	if err := second.Unsubscribe(); err != nil {
+		t.Fatalf("Unsubscribe: %v", err)
+	}
+	waitSubscribers(t, s, "doc", 0)
+	if err := a.Publish("doc", []byte("gone")); err != nil {
+		t.Fatal(err)
+	}
+	expectNothing(t, fromSecond)
+
+	// Unsubscribing twice is harmless
+	if err := second.Unsubscribe(); err != nil {
+		t.Fatalf("second Unsubscribe: %v", err)
+	}
+}
+
+func TestRedisReconnects(t *testing.T) {
+	s := startStandIn(t)
+	a, b := dialTestRedis(t, s), dialTestRedis(t, s)
+
+	_, received := collect(t, b, "doc")
+	_, other := collect(t, b, "other")
+	waitSubscribers(t, s, "doc", 1)
+	waitSubscribers(t, s, "other", 1)
+
+	s.dropConnections()
+	waitSubscribers(t, s, "doc", 0)
+
+	// The subscriber resubscribes every topic on its new connection
+	waitSubscribers(t, s, "doc", 1)
+	waitSubscribers(t, s, "other", 1)
+
+	// The publisher retries on a fresh connection
+	if err := a.Publish("doc", []byte("after restart")); err != nil {
+		t.Fatalf("Publish after restart: %v", err)
+	}
+	expectPayload(t, received, "after restart")
+
+	// Topics subscribed after the reconnect work too
+	_, late := collect(t, b, "late")
+	waitSubscribers(t, s, "late", 1)
+	if err := a.Publish("late", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	expectPayload(t, late, "hi")
+	expectNothing(t, other)
+}
+
+func TestRedisClosed(t *testing.T) {
+	s := startStandIn(t)
+	r := dialTestRedis(t, s)
+	sub, received := collect(t, r, "doc")
+	waitSubscribers(t, s, "doc", 1)
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := r.Publish("doc", []byte("x")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Publish after Close = %v, want ErrClosed", err)
+	}
+	if _, err := r.Subscribe("doc", func([]byte) {}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Subscribe after Close = %v, want ErrClosed", err)
+	}
+	waitSubscribers(t, s, "doc", 0)
+	expectNothing(t, received)
+	sub.Unsubscribe()
+}
+
+func TestRedisDeliversWhileSubscribeStalls(t *testing.T) {
+	// Nothing reads the server end, so writes to the subscriber connection block
+	client, server := net.Pipe()
+	defer server.Close()
+	r := &Redis{
+		prefix: testPrefix,
+		sub:    client,
+		subW:   bufio.NewWriter(client),
+		subs:   make(map[string]map[*redisSubscription]bool),
+		closed: make(chan struct{}),
+	}
+	received := make(chan string, 1)
+	r.subs["doc"] = map[*redisSubscription]bool{
+		{delivery: newDelivery("doc", func(p []byte) { received <- string(p) }), redis: r}: true,
+	}
+
+	subscribed := make(chan struct{})
+	go func() {
+		r.Subscribe("stalled", func([]byte) {})
+		close(subscribed)
+	}()
+
+	// Wait until Subscribe is writing its SUBSCRIBE
+	for {
+		r.subMu.Lock()
+		writing := r.subs["stalled"] != nil
+		r.subMu.Unlock()
+		if writing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	push := "*3\r\n$7\r\nmessage\r\n$8\r\ntest:doc\r\n$5\r\nhello\r\n"
+	go r.readMessages(bufio.NewReader(strings.NewReader(push)))
+	expectPayload(t, received, "hello")
+
+	select {
+	case <-subscribed:
+		t.Fatal("Subscribe returned before its write could complete")
+	default:
+	}
+	server.Close()
+	<-subscribed
+}
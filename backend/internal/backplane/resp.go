@@ -0,0 +1,105 @@
+// internal/backplane/resp.go
+package backplane
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Minimal RESP (Redis serialization protocol) codec, enough for pub/sub
+
+// respError is an error reply sent by the server
+type respError string
+
+func (e respError) Error() string { return string(e) }
+
+// writeCommand writes a command as an array of bulk strings
+func writeCommand(w *bufio.Writer, args ...[]byte) error {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n", len(arg))
+		w.Write(arg)
+		w.WriteString("\r\n")
+	}
+	return w.Flush()
+}
+
+// readValue reads one RESP value. Simple and bulk strings are returned as
+// []byte, integers as int64, arrays as []interface{}, errors as respError
+// and null bulk strings or arrays as nil.
+func readValue(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("resp: empty line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return respError(line[1:]), nil
+
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("resp: bad bulk length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("resp: bad array length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readValue(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+
+	default:
+		return nil, fmt.Errorf("resp: unexpected type byte %q", line[0])
+	}
+}
+
+// readLine reads a CRLF terminated line without the terminator
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errors.New("resp: line not terminated by CRLF")
+	}
+	return line[:len(line)-2], nil
+}
+
+// asString converts a simple or bulk string value
+func asString(v interface{}) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return ""
+}
@@ -0,0 +1,148 @@
+package backplane
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  interface{}
+	}{
+		{"simple string", "+OK\r\n", []byte("OK")},
+		{"error", "-ERR unknown command\r\n", respError("ERR unknown command")},
+		{"integer", ":42\r\n", int64(42)},
+		{"negative integer", ":-7\r\n", int64(-7)},
+		{"bulk string", "$5\r\nhello\r\n", []byte("hello")},
+		{"bulk string with CRLF", "$4\r\na\r\nb\r\n", []byte("a\r\nb")},
+		{"empty bulk string", "$0\r\n\r\n", []byte{}},
+		{"null bulk string", "$-1\r\n", nil},
+		{"null array", "*-1\r\n", nil},
+		{"empty array", "*0\r\n", []interface{}{}},
+		{
+			"pub/sub push",
+			"*3\r\n$7\r\nmessage\r\n$3\r\ndoc\r\n$2\r\n{}\r\n",
+			[]interface{}{[]byte("message"), []byte("doc"), []byte("{}")},
+		},
+		{
+			"nested array",
+			"*2\r\n:1\r\n*2\r\n+a\r\n$-1\r\n",
+			[]interface{}{int64(1), []interface{}{[]byte("a"), nil}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readValue(bufio.NewReader(strings.NewReader(tt.input)))
+			if err != nil {
+				t.Fatalf("readValue(%q): %v", tt.input, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("readValue(%q) = %#v, want %#v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadValueErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"empty input", ""},
+		{"empty line", "\r\n"},
+		{"missing CR", "+OK\n"},
+		{"unterminated line", "+OK"},
+		{"unknown type", "?what\r\n"},
+		{"bad integer", ":twelve\r\n"},
+		{"bad bulk length", "$x\r\n"},
+		{"short bulk string", "$10\r\nhello\r\n"},
+		{"bad array length", "*x\r\n"},
+		{"short array", "*2\r\n:1\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := readValue(bufio.NewReader(strings.NewReader(tt.input))); err == nil {
+				t.Fatalf("readValue(%q) = %#v, want an error", tt.input, got)
+			}
+		})
+	}
+}
+
+func TestWriteCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"no arguments", []string{"PING"}, "*1\r\n$4\r\nPING\r\n"},
+		{"publish", []string{"PUBLISH", "doc", "hi"}, "*3\r\n$7\r\nPUBLISH\r\n$3\r\ndoc\r\n$2\r\nhi\r\n"},
+		{"empty argument", []string{"SUBSCRIBE", ""}, "*2\r\n$9\r\nSUBSCRIBE\r\n$0\r\n\r\n"},
+		{"binary argument", []string{"PUBLISH", "t", "a\r\nb"}, "*3\r\n$7\r\nPUBLISH\r\n$1\r\nt\r\n$4\r\na\r\nb\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			args := make([][]byte, len(tt.args))
+			for i, arg := range tt.args {
+				args[i] = []byte(arg)
+			}
+			if err := writeCommand(bufio.NewWriter(&buf), args...); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Fatalf("wrote %q, want %q", buf.String(), tt.want)
+			}
+
+			// What is written reads back as the same command
+			got, err := readValue(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := make([]interface{}, len(args))
+			for i, arg := range args {
+				want[i] = arg
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("read back %#v, want %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestWriteValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{"simple string", "PONG", "+PONG\r\n"},
+		{"error", respError("ERR nope"), "-ERR nope\r\n"},
+		{"integer", int64(3), ":3\r\n"},
+		{"bulk string", []byte("hi"), "$2\r\nhi\r\n"},
+		{
+			"push with string elements",
+			[]interface{}{"subscribe", "doc", int64(1)},
+			"*3\r\n$9\r\nsubscribe\r\n$3\r\ndoc\r\n:1\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := bufio.NewWriter(&buf)
+			writeValue(w, tt.value)
+			w.Flush()
+			if buf.String() != tt.want {
+				t.Fatalf("wrote %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
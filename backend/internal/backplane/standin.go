@@ -0,0 +1,226 @@
+// internal/backplane/standin.go
+package backplane
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// StandIn is a minimal in-process server speaking the Redis pub/sub protocol.
+// It supports PING, PUBLISH, SUBSCRIBE, UNSUBSCRIBE and QUIT, which is all the
+// Redis backplane needs, so multi-instance setups can run without a real Redis.
+type StandIn struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	channels map[string]map[*standInConn]bool
+	conns    map[*standInConn]bool
+}
+
+// standInConn is one client connection to the stand-in
+type standInConn struct {
+	conn     net.Conn
+	writeMu  sync.Mutex
+	writer   *bufio.Writer
+	channels map[string]bool
+}
+
+// NewStandIn starts a stand-in server on addr; use "127.0.0.1:0" for a free port
+func NewStandIn(addr string) (*StandIn, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &StandIn{
+		listener: listener,
+		channels: make(map[string]map[*standInConn]bool),
+		conns:    make(map[*standInConn]bool),
+	}
+	go s.accept()
+
+	return s, nil
+}
+
+// Addr returns the address the stand-in listens on
+func (s *StandIn) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the listener and drops every connection
+func (s *StandIn) Close() error {
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	for c := range s.conns {
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+
+	return err
+}
+
+func (s *StandIn) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		c := &standInConn{
+			conn:     conn,
+			writer:   bufio.NewWriter(conn),
+			channels: make(map[string]bool),
+		}
+		s.mu.Lock()
+		s.conns[c] = true
+		s.mu.Unlock()
+
+		go s.serve(c)
+	}
+}
+
+// serve executes commands from one connection until it closes
+func (s *StandIn) serve(c *standInConn) {
+	defer s.drop(c)
+
+	reader := bufio.NewReader(c.conn)
+	for {
+		value, err := readValue(reader)
+		if err != nil {
+			return
+		}
+
+		args, ok := value.([]interface{})
+		if !ok || len(args) == 0 {
+			c.reply(respError("ERR expected command array"))
+			continue
+		}
+
+		switch strings.ToUpper(asString(args[0])) {
+		case "PING":
+			c.reply("PONG")
+
+		case "PUBLISH":
+			if len(args) != 3 {
+				c.reply(respError("ERR wrong number of arguments for 'publish'"))
+				continue
+			}
+			payload, _ := args[2].([]byte)
+			c.reply(int64(s.publish(asString(args[1]), payload)))
+
+		case "SUBSCRIBE":
+			for _, arg := range args[1:] {
+				channel := asString(arg)
+				c.reply([]interface{}{"subscribe", channel, int64(s.subscribe(c, channel))})
+			}
+
+		case "UNSUBSCRIBE":
+			for _, arg := range args[1:] {
+				channel := asString(arg)
+				c.reply([]interface{}{"unsubscribe", channel, int64(s.unsubscribe(c, channel))})
+			}
+
+		case "QUIT":
+			c.reply("OK")
+			return
+
+		default:
+			c.reply(respError(fmt.Sprintf("ERR unknown command '%s'", asString(args[0]))))
+		}
+	}
+}
+
+// publish pushes a message to every subscriber and returns how many received it
+func (s *StandIn) publish(channel string, payload []byte) int {
+	s.mu.Lock()
+	subscribers := make([]*standInConn, 0, len(s.channels[channel]))
+	for c := range s.channels[channel] {
+		subscribers = append(subscribers, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range subscribers {
+		c.reply([]interface{}{"message", channel, payload})
+	}
+	return len(subscribers)
+}
+
+func (s *StandIn) subscribe(c *standInConn, channel string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.channels[channel] == nil {
+		s.channels[channel] = make(map[*standInConn]bool)
+	}
+	s.channels[channel][c] = true
+	c.channels[channel] = true
+	return len(c.channels)
+}
+
+func (s *StandIn) unsubscribe(c *standInConn, channel string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.channels[channel], c)
+	if len(s.channels[channel]) == 0 {
+		delete(s.channels, channel)
+	}
+	delete(c.channels, channel)
+	return len(c.channels)
+}
+
+// drop forgets a closed connection and its subscriptions
+func (s *StandIn) drop(c *standInConn) {
+	s.mu.Lock()
+	for channel := range c.channels {
+		delete(s.channels[channel], c)
+		if len(s.channels[channel]) == 0 {
+			delete(s.channels, channel)
+		}
+	}
+	delete(s.conns, c)
+	s.mu.Unlock()
+
+	c.conn.Close()
+}
+
+// reply writes a value: strings as simple strings, []byte as bulk strings
+func (c *standInConn) reply(value interface{}) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	writeValue(c.writer, value)
+	if err := c.writer.Flush(); err != nil {
+		log.Printf("[BACKPLANE] Stand-in write failed: %v", err)
+	}
+}
+
+// writeValue encodes a reply value
+func writeValue(w *bufio.Writer, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case respError:
+		fmt.Fprintf(w, "-%s\r\n", string(v))
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n", len(v))
+		w.Write(v)
+		w.WriteString("\r\n")
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				// Array elements are bulk strings in pub/sub pushes
+				item = []byte(s)
+			}
+			writeValue(w, item)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// internal/cluster/membership.go
+package cluster
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"collaborative-editor/internal/backplane"
+)
+
+const (
+	// Backplane topic carrying heartbeats and leave announcements
+	membershipTopic = "cluster"
+
+	// How often each node announces itself
+	defaultHeartbeatInterval = 2 * time.Second
+
+	// Number of missed heartbeats after which a node is considered gone
+	missedHeartbeats = 3
+)
+
+// membershipEvent is published on the membership topic
+type membershipEvent struct {
+	Kind string `json:"kind"` // "heartbeat" or "leave"
+	Node string `json:"node"`
+}
+
+// Membership tracks which configured nodes are alive and owns the ring built from them.
+// Every node starts out assuming all configured nodes are alive so that all of
+// them agree on ownership from the first request; nodes that stop heartbeating
+// or announce that they leave are taken off the ring, handing their documents
+// to the next node.
+type Membership struct {
+	self       string
+	configured map[string]bool
+	bp         backplane.Backplane
+	interval   time.Duration
+
+	mu       sync.RWMutex
+	ring     *Ring
+	lastSeen map[string]time.Time
+
+	// Called with the new node list whenever the ring changes
+	OnChange func(nodes []string)
+
+	sub  backplane.Subscription
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewMembership creates the membership of self within the configured node list.
+// self is always a member, even if missing from nodes.
+func NewMembership(self string, nodes []string, bp backplane.Backplane) *Membership {
+	configured := map[string]bool{self: true}
+	for _, node := range nodes {
+		configured[node] = true
+	}
+
+	now := time.Now()
+	lastSeen := make(map[string]time.Time, len(configured))
+	members := make([]string, 0, len(configured))
+	for node := range configured {
+		lastSeen[node] = now
+		members = append(members, node)
+	}
+
+	return &Membership{
+		self:       self,
+		configured: configured,
+		bp:         bp,
+		interval:   defaultHeartbeatInterval,
+		ring:       NewRing(defaultReplicas, members...),
+		lastSeen:   lastSeen,
+		stop:       make(chan struct{}),
+	}
+}
+
+// Start subscribes to membership events and begins heartbeating
+func (m *Membership) Start() error {
+	sub, err := m.bp.Subscribe(membershipTopic, m.handleEvent)
+	if err != nil {
+		return err
+	}
+	m.sub = sub
+
+	m.announce("heartbeat")
+	go m.loop()
+
+	log.Printf("[CLUSTER] Node %s joined cluster %v", m.self, m.Nodes())
+	return nil
+}
+
+// Stop announces that this node leaves so peers hand its documents over immediately
+func (m *Membership) Stop() {
+	m.once.Do(func() {
+		close(m.stop)
+		m.announce("leave")
+		if m.sub != nil {
+			m.sub.Unsubscribe()
+		}
+	})
+}
+
+// Self returns this node's ID
+func (m *Membership) Self() string {
+	return m.self
+}
+
+// Owner returns the node owning a document
+func (m *Membership) Owner(docID string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.ring.Owner(docID)
+}
+
+// IsOwner reports whether this node owns a document
+func (m *Membership) IsOwner(docID string) bool {
+	return m.Owner(docID) == m.self
+}
+
+// Nodes returns the nodes currently on the ring
+func (m *Membership) Nodes() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.ring.Nodes()
+}
+
+// loop heartbeats and expires silent nodes
+func (m *Membership) loop() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.announce("heartbeat")
+			m.expire()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func (m *Membership) announce(kind string) {
+	payload, _ := json.Marshal(membershipEvent{Kind: kind, Node: m.self})
+	if err := m.bp.Publish(membershipTopic, payload); err != nil {
+		log.Printf("[CLUSTER] Error publishing %s: %v", kind, err)
+	}
+}
+
+func (m *Membership) handleEvent(payload []byte) {
+	var event membershipEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return
+	}
+	if event.Node == m.self || !m.configured[event.Node] {
+		return
+	}
+
+	switch event.Kind {
+	case "heartbeat":
+		m.mu.Lock()
+		m.lastSeen[event.Node] = time.Now()
+		m.mu.Unlock()
+		m.setAlive(event.Node, true)
+
+	case "leave":
+		m.setAlive(event.Node, false)
+	}
+}
+
+// expire removes nodes whose heartbeats stopped
+func (m *Membership) expire() {
+	deadline := time.Now().Add(-missedHeartbeats * m.interval)
+
+	m.mu.RLock()
+	var silent []string
+	for node, seen := range m.lastSeen {
+		if node != m.self && seen.Before(deadline) {
+			silent = append(silent, node)
+		}
+	}
+	m.mu.RUnlock()
+
+	for _, node := range silent {
+		m.setAlive(node, false)
+	}
+}
+
+// setAlive adds or removes a node from the ring, notifying OnChange on changes
+func (m *Membership) setAlive(node string, alive bool) {
+	m.mu.Lock()
+	present := m.ring.nodes[node]
+	if alive == present {
+		m.mu.Unlock()
+		return
+	}
+
+	if alive {
+		m.ring.Add(node)
+		log.Printf("[CLUSTER] Node %s is back, taking its documents", node)
+	} else {
+		m.ring.Remove(node)
+		log.Printf("[CLUSTER] Node %s left, handing over its documents", node)
+	}
+	nodes := m.ring.Nodes()
+	m.mu.Unlock()
+
+	if m.OnChange != nil {
+		m.OnChange(nodes)
+	}
+}
@@ -0,0 +1,187 @@
+package cluster
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"collaborative-editor/internal/backplane"
+)
+
+const testInterval = 20 * time.Millisecond
+
+// testNode is a membership that records the node lists it was told about
+type testNode struct {
+	*Membership
+
+	mu      sync.Mutex
+	changes [][]string
+}
+
+// startNode starts a member of nodes heartbeating every interval
+func startNode(t *testing.T, bp backplane.Backplane, self string, nodes []string, interval time.Duration) *testNode {
+	t.Helper()
+	n := &testNode{Membership: NewMembership(self, nodes, bp)}
+	n.interval = interval
+	n.OnChange = func(nodes []string) {
+		n.mu.Lock()
+		n.changes = append(n.changes, nodes)
+		n.mu.Unlock()
+	}
+	if err := n.Start(); err != nil {
+		t.Fatalf("Start %s: %v", self, err)
+	}
+	t.Cleanup(n.Stop)
+	return n
+}
+
+// crash stops heartbeating without announcing that the node leaves
+func (n *testNode) crash() {
+	n.once.Do(func() {
+		close(n.stop)
+		n.sub.Unsubscribe()
+	})
+}
+
+func (n *testNode) lastChange() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.changes) == 0 {
+		return nil
+	}
+	return n.changes[len(n.changes)-1]
+}
+
+// waitNodes waits until a node's ring holds exactly the given nodes
+func waitNodes(t *testing.T, n *testNode, want ...string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !reflect.DeepEqual(n.Nodes(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s sees %v, want %v", n.Self(), n.Nodes(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// agree checks that every node places every key on the same owner
+func agree(t *testing.T, nodes ...*testNode) {
+	t.Helper()
+	for _, key := range testKeys(500) {
+		owner := nodes[0].Owner(key)
+		for _, n := range nodes[1:] {
+			if n.Owner(key) != owner {
+				t.Fatalf("%s owned by %s according to %s and %s according to %s",
+					key, owner, nodes[0].Self(), n.Owner(key), n.Self())
+			}
+		}
+	}
+}
+
+func TestMembershipStartsWithEveryConfiguredNode(t *testing.T) {
+	bp := backplane.NewMemory()
+	defer bp.Close()
+	nodes := []string{"n1", "n2", "n3"}
+
+	// Nodes agree on ownership before any heartbeat arrives
+	n1 := NewMembership("n1", nodes, bp)
+	n2 := NewMembership("n2", []string{"n3", "n1"}, bp)
+	for _, key := range testKeys(500) {
+		if n1.Owner(key) != n2.Owner(key) {
+			t.Fatalf("%s owned by %s and %s", key, n1.Owner(key), n2.Owner(key))
+		}
+	}
+	if !reflect.DeepEqual(n2.Nodes(), nodes) {
+		t.Fatalf("Nodes = %v, want %v", n2.Nodes(), nodes)
+	}
+	if !n1.IsOwner(firstKeyOwnedBy(t, n1, "n1")) {
+		t.Fatal("IsOwner disagrees with Owner")
+	}
+}
+
+// firstKeyOwnedBy returns a test key a node owns
+func firstKeyOwnedBy(t *testing.T, m *Membership, node string) string {
+	t.Helper()
+	for _, key := range testKeys(500) {
+		if m.Owner(key) == node {
+			return key
+		}
+	}
+	t.Fatalf("%s owns none of the test keys", node)
+	return ""
+}
+
+func TestMembershipExpiresSilentNodes(t *testing.T) {
+	bp := backplane.NewMemory()
+	defer bp.Close()
+	nodes := []string{"n1", "n2", "n3"}
+	n1 := startNode(t, bp, "n1", nodes, testInterval)
+	n2 := startNode(t, bp, "n2", nodes, testInterval)
+	n3 := startNode(t, bp, "n3", nodes, testInterval)
+
+	key := firstKeyOwnedBy(t, n1.Membership, "n3")
+
+	// Heartbeats keep every node on the ring
+	time.Sleep(5 * testInterval)
+	agree(t, n1, n2, n3)
+	if got := n1.Nodes(); !reflect.DeepEqual(got, nodes) {
+		t.Fatalf("Nodes = %v while all heartbeat", got)
+	}
+
+	// A node that stops heartbeating is taken off after the missed heartbeats
+	n3.crash()
+	waitNodes(t, n1, "n1", "n2")
+	waitNodes(t, n2, "n1", "n2")
+	agree(t, n1, n2)
+	if !reflect.DeepEqual(n1.lastChange(), []string{"n1", "n2"}) {
+		t.Fatalf("OnChange last told %v", n1.lastChange())
+	}
+
+	// Its documents go to the remaining nodes
+	if owner := n1.Owner(key); owner == "n3" || owner == "" {
+		t.Fatalf("%s still owned by %q", key, owner)
+	}
+
+	// It takes them back once it heartbeats again
+	back := startNode(t, bp, "n3", nodes, testInterval)
+	waitNodes(t, n1, nodes...)
+	waitNodes(t, n2, nodes...)
+	agree(t, n1, n2, back)
+	if owner := n1.Owner(key); owner != "n3" {
+		t.Fatalf("%s owned by %s after n3 came back", key, owner)
+	}
+}
+
+func TestMembershipLeaveHandsOverAtOnce(t *testing.T) {
+	bp := backplane.NewMemory()
+	defer bp.Close()
+	nodes := []string{"n1", "n2"}
+	// Heartbeats are too rare for n2 to expire during the test
+	n1 := startNode(t, bp, "n1", nodes, time.Hour)
+	n2 := startNode(t, bp, "n2", nodes, time.Hour)
+	key := firstKeyOwnedBy(t, n1.Membership, "n2")
+
+	n2.Stop()
+	waitNodes(t, n1, "n1")
+	if !n1.IsOwner(key) {
+		t.Fatalf("%s owned by %s after n2 left", key, n1.Owner(key))
+	}
+}
+
+func TestMembershipIgnoresUnconfiguredNodes(t *testing.T) {
+	bp := backplane.NewMemory()
+	defer bp.Close()
+	n1 := startNode(t, bp, "n1", []string{"n1", "n2"}, testInterval)
+	startNode(t, bp, "n2", []string{"n1", "n2"}, testInterval)
+	stranger := startNode(t, bp, "n9", []string{"n9"}, testInterval)
+
+	time.Sleep(5 * testInterval)
+	if got := n1.Nodes(); !reflect.DeepEqual(got, []string{"n1", "n2"}) {
+		t.Fatalf("Nodes = %v, want the configured ones", got)
+	}
+	if got := stranger.Nodes(); !reflect.DeepEqual(got, []string{"n9"}) {
+		t.Fatalf("stranger's Nodes = %v", got)
+	}
+}
@@ -0,0 +1,118 @@
+package cluster
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// testKeys returns document IDs to place on rings
+func testKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("workspace-%d:file-%d", i%17, i)
+	}
+	return keys
+}
+
+func TestRingEmpty(t *testing.T) {
+	r := NewRing(0)
+	if owner := r.Owner("doc"); owner != "" {
+		t.Fatalf("Owner on an empty ring = %q, want none", owner)
+	}
+	if nodes := r.Nodes(); len(nodes) != 0 {
+		t.Fatalf("Nodes = %v, want none", nodes)
+	}
+}
+
+func TestRingPlacementIsDeterministic(t *testing.T) {
+	a := NewRing(0, "n1", "n2", "n3")
+	b := NewRing(0, "n3", "n1", "n2", "n1")
+
+	if !reflect.DeepEqual(a.Nodes(), []string{"n1", "n2", "n3"}) || !reflect.DeepEqual(b.Nodes(), a.Nodes()) {
+		t.Fatalf("Nodes = %v and %v", a.Nodes(), b.Nodes())
+	}
+	for _, key := range testKeys(1000) {
+		if a.Owner(key) != b.Owner(key) {
+			t.Fatalf("%s owned by %s on one ring and %s on the other", key, a.Owner(key), b.Owner(key))
+		}
+	}
+}
+
+func TestRingSpreadsKeys(t *testing.T) {
+	nodes := []string{"n1", "n2", "n3", "n4"}
+	r := NewRing(0, nodes...)
+
+	keys := testKeys(4000)
+	owned := make(map[string]int)
+	for _, key := range keys {
+		owned[r.Owner(key)]++
+	}
+
+	// Every node gets a fair share, within a wide margin
+	for _, node := range nodes {
+		if share := float64(owned[node]) / float64(len(keys)); share < 0.1 || share > 0.4 {
+			t.Errorf("%s owns %.0f%% of the keys", node, share*100)
+		}
+	}
+	if len(owned) != len(nodes) {
+		t.Errorf("keys owned by %v, want only %v", owned, nodes)
+	}
+}
+
+func TestRingRemoveOnlyMovesRemovedNodesKeys(t *testing.T) {
+	r := NewRing(0, "n1", "n2", "n3")
+	keys := testKeys(2000)
+	before := make(map[string]string, len(keys))
+	for _, key := range keys {
+		before[key] = r.Owner(key)
+	}
+
+	r.Remove("n2")
+	r.Remove("n2")
+	if !reflect.DeepEqual(r.Nodes(), []string{"n1", "n3"}) {
+		t.Fatalf("Nodes after Remove = %v", r.Nodes())
+	}
+	for _, key := range keys {
+		owner := r.Owner(key)
+		if owner == "n2" {
+			t.Fatalf("%s still owned by the removed node", key)
+		}
+		if before[key] != "n2" && owner != before[key] {
+			t.Fatalf("%s moved from %s to %s although its owner stayed", key, before[key], owner)
+		}
+	}
+
+	// Adding the node back returns exactly its keys
+	r.Add("n2")
+	for _, key := range keys {
+		if r.Owner(key) != before[key] {
+			t.Fatalf("%s owned by %s after n2 came back, want %s", key, r.Owner(key), before[key])
+		}
+	}
+}
+
+func TestRingAddOnlyTakesKeysForNewNode(t *testing.T) {
+	r := NewRing(0, "n1", "n2")
+	keys := testKeys(2000)
+	before := make(map[string]string, len(keys))
+	for _, key := range keys {
+		before[key] = r.Owner(key)
+	}
+
+	r.Add("n3")
+	moved := 0
+	for _, key := range keys {
+		owner := r.Owner(key)
+		if owner == before[key] {
+			continue
+		}
+		if owner != "n3" {
+			t.Fatalf("%s moved from %s to %s, not to the new node", key, before[key], owner)
+		}
+		moved++
+	}
+	if moved == 0 {
+		t.Fatal("the new node took no keys")
+	}
+}
@@ -0,0 +1,203 @@
+// internal/editor/anchors.go
+package editor
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"collaborative-editor/pkg/ot"
+)
+
+// Anchor is the range of a comment thread, suggestion or lock, sent when edits move it
+type Anchor struct {
+	ID    string `json:"id"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// anchored is what a rangeStore needs of the items it keeps, implemented on
+// pointers to them
+type anchored[T any] interface {
+	*T
+
+	// anchor returns the item's ID and range
+	anchor() Anchor
+
+	// setRange moves the item to another range
+	setRange(start, end int)
+
+	// created orders items starting at the same position
+	created() time.Time
+
+	// collapses reports whether the item goes once edits empty its range
+	collapses() bool
+
+	// clone returns a copy sharing nothing with the item
+	clone() T
+}
+
+// rangeStore holds items anchored to ranges of a document and moves them
+// through every operation applied to it. The comment, suggestion and lock
+// stores build on it.
+type rangeStore[T any, P anchored[T]] struct {
+	mu    sync.RWMutex
+	items map[string]*T
+
+	// Set when an operation moved an item since the last TakeMoved, and the
+	// items dropped meanwhile
+	moved   bool
+	dropped []T
+}
+
+// newRangeStore creates an empty store
+func newRangeStore[T any, P anchored[T]]() rangeStore[T, P] {
+	return rangeStore[T, P]{items: make(map[string]*T)}
+}
+
+// Get returns an item
+func (rs *rangeStore[T, P]) Get(id string) (T, bool) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	item, ok := rs.items[id]
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	return P(item).clone(), true
+}
+
+// Put stores an item as another node reported it
+func (rs *rangeStore[T, P]) Put(item T) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.put(item)
+}
+
+// put stores a copy of an item; callers hold rs.mu
+func (rs *rangeStore[T, P]) put(item T) {
+	stored := P(&item).clone()
+	rs.items[P(&stored).anchor().ID] = &stored
+}
+
+// Remove drops an item another node deleted; it reports whether it was known
+func (rs *rangeStore[T, P]) Remove(id string) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	_, ok := rs.items[id]
+	delete(rs.items, id)
+	return ok
+}
+
+// Merge stores items from a peer's snapshot and returns those that were new.
+// Items already known are only replaced when the peer's anchors are
+// authoritative, i.e. its content was adopted.
+func (rs *rangeStore[T, P]) Merge(items []T, replace bool) []T {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	var added []T
+	for _, item := range items {
+		_, known := rs.items[P(&item).anchor().ID]
+		if !known {
+			added = append(added, item)
+		}
+		if replace || !known {
+			rs.put(item)
+		}
+	}
+	return added
+}
+
+// Transform moves every item through an operation applied to the document
+func (rs *rangeStore[T, P]) Transform(op ot.Operation) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for id, item := range rs.items {
+		a := P(item).anchor()
+		start, end := ot.TransformRange(a.Start, a.End, op)
+		if start == a.Start && end == a.End {
+			continue
+		}
+		rs.moved = true
+
+		if start == end && P(item).collapses() {
+			delete(rs.items, id)
+			rs.dropped = append(rs.dropped, *item)
+			continue
+		}
+		P(item).setRange(start, end)
+	}
+}
+
+// TakeMoved reports whether any item moved since the last call and returns
+// those dropped meanwhile
+func (rs *rangeStore[T, P]) TakeMoved() (bool, []T) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	moved, dropped := rs.moved, rs.dropped
+	rs.moved, rs.dropped = false, nil
+	return moved, dropped
+}
+
+// List returns all items in document order
+func (rs *rangeStore[T, P]) List() []T {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	items := make([]T, 0, len(rs.items))
+	for _, item := range rs.items {
+		items = append(items, P(item).clone())
+	}
+	sort.Slice(items, func(i, j int) bool {
+		a, b := P(&items[i]), P(&items[j])
+		if a.anchor().Start != b.anchor().Start {
+			return a.anchor().Start < b.anchor().Start
+		}
+		return a.created().Before(b.created())
+	})
+	return items
+}
+
+// Anchors returns the range of every item
+func (rs *rangeStore[T, P]) Anchors() []Anchor {
+	items := rs.List()
+	anchors := make([]Anchor, len(items))
+	for i := range items {
+		anchors[i] = P(&items[i]).anchor()
+	}
+	return anchors
+}
+
+// Len returns the number of items
+func (rs *rangeStore[T, P]) Len() int {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	return len(rs.items)
+}
+
+// MarshalJSON persists the items as a list
+func (rs *rangeStore[T, P]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(rs.List())
+}
+
+// UnmarshalJSON restores persisted items
+func (rs *rangeStore[T, P]) UnmarshalJSON(data []byte) error {
+	var items []T
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+
+	rs.mu.Lock()
+	rs.items = make(map[string]*T, len(items))
+	rs.mu.Unlock()
+	rs.Merge(items, true)
+	return nil
+}
@@ -0,0 +1,585 @@
+// internal/editor/api.go
+package editor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"collaborative-editor/pkg/protocol"
+)
+
+// Client ID edits made through the REST API are attributed to
+const apiClientID = "api"
+
+// maxRequestBody bounds a REST request body, as maxMessageSize bounds a
+// WebSocket message
+const maxRequestBody = maxMessageSize
+
+// RegisterRoutes adds the editor's REST API to a mux
+func (s *Service) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/documents/{id}/presence", s.handleGetPresence)
+	mux.HandleFunc("GET /api/documents/{id}/chat", s.handleExportChat)
+	mux.HandleFunc("GET /api/workspaces/{id}", s.handleGetWorkspace)
+	mux.HandleFunc("POST /api/workspaces/{id}/files", s.handleCreateFile)
+	mux.HandleFunc("PATCH /api/workspaces/{id}/files/{fileId}", s.handleUpdateFile)
+	mux.HandleFunc("DELETE /api/workspaces/{id}/files/{fileId}", s.handleDeleteFile)
+	mux.HandleFunc("GET /api/execution/languages", s.handleListLanguages)
+	mux.HandleFunc("POST /api/documents/{id}/executions", s.handleRunDocument)
+	mux.HandleFunc("DELETE /api/documents/{id}/executions/{executionId}", s.handleCancelRun)
+	mux.HandleFunc("POST /api/documents/{id}/format", s.handleFormatDocument)
+	mux.HandleFunc("GET /api/documents/{id}/metadata", s.handleGetMetadata)
+	mux.HandleFunc("PATCH /api/documents/{id}/metadata", s.handleSetMetadata)
+	mux.HandleFunc("POST /api/documents/{id}/search", s.handleSearchDocument)
+	mux.HandleFunc("POST /api/documents/{id}/replace", s.handleReplaceDocument)
+	mux.HandleFunc("POST /api/workspaces/{id}/search", s.handleSearchWorkspace)
+	mux.HandleFunc("POST /api/workspaces/{id}/replace", s.handleReplaceWorkspace)
+	mux.HandleFunc("GET /api/workspaces/{id}/terminal", s.handleGetTerminal)
+	mux.HandleFunc("GET /api/workspaces/{id}/terminal/recordings", s.handleListRecordings)
+	mux.HandleFunc("GET /api/workspaces/{id}/terminal/recordings/{recordingId}", s.handleGetRecording)
+	mux.HandleFunc("GET /api/workspaces/{id}/git", s.handleGetGit)
+	mux.HandleFunc("GET /api/workspaces/{id}/git/diff", s.handleGitDiff)
+	mux.HandleFunc("GET /api/workspaces/{id}/git/branches", s.handleGitBranches)
+}
+
+// handleGetPresence lists the users of a document and their status
+func (s *Service) handleGetPresence(w http.ResponseWriter, r *http.Request) {
+	docID := r.PathValue("id")
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"documentId": docID,
+		"users":      s.GetPresence(docID),
+	})
+}
+
+// GetPresence returns the presence list of a document, empty if nobody has opened it
+func (s *Service) GetPresence(docID string) []PresenceEntry {
+	s.mu.RLock()
+	doc, exists := s.documents[docID]
+	s.mu.RUnlock()
+
+	if !exists {
+		return []PresenceEntry{}
+	}
+	return doc.Presence.List()
+}
+
+// handleExportChat exports a document's chat log, as JSON or, with
+// ?format=text, as a plain transcript
+func (s *Service) handleExportChat(w http.ResponseWriter, r *http.Request) {
+	docID := r.PathValue("id")
+	messages := s.GetChat(docID)
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"documentId": docID,
+			"messages":   messages,
+		})
+
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", docID+"-chat.txt"))
+		for _, m := range messages {
+			fmt.Fprintf(w, "[%s] %s: %s\n", m.CreatedAt.UTC().Format(time.RFC3339), m.Author, m.Body)
+		}
+
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format must be json or text"})
+	}
+}
+
+// GetChat returns a document's chat log, empty if nobody has opened it
+func (s *Service) GetChat(docID string) []ChatEntry {
+	s.mu.RLock()
+	doc, exists := s.documents[docID]
+	s.mu.RUnlock()
+
+	if !exists {
+		return []ChatEntry{}
+	}
+	return doc.Chat.Recent(0)
+}
+
+// handleGetWorkspace lists a workspace's files and folders
+func (s *Service) handleGetWorkspace(w http.ResponseWriter, r *http.Request) {
+	ws, ok := s.lookupWorkspace(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"workspaceId": ws.ID,
+		"files":       ws.Files(),
+	})
+}
+
+// handleCreateFile creates a file or folder from {"kind", "name", "parentId"}
+func (s *Service) handleCreateFile(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Kind     string `json:"kind"`
+		Name     string `json:"name"`
+		ParentID string `json:"parentId"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	file, err := s.GetWorkspace(r.PathValue("id")).Create("", req.Kind, req.Name, req.ParentID)
+	if err != nil {
+		writeWorkspaceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, file)
+}
+
+// handleUpdateFile renames and/or moves a file or folder from {"name",
+// "parentId"}; a null or missing parentId leaves it where it is
+func (s *Service) handleUpdateFile(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name     string  `json:"name"`
+		ParentID *string `json:"parentId"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	ws, ok := s.lookupWorkspace(w, r)
+	if !ok {
+		return
+	}
+	fileID := r.PathValue("fileId")
+	file, ok := ws.File(fileID)
+	if !ok {
+		writeWorkspaceError(w, ErrUnknownFile)
+		return
+	}
+
+	var err error
+	if req.ParentID != nil && *req.ParentID != file.ParentID {
+		if file, err = ws.Move("", fileID, *req.ParentID); err != nil {
+			writeWorkspaceError(w, err)
+			return
+		}
+	}
+	if req.Name != "" && req.Name != file.Name {
+		if file, err = ws.Rename("", fileID, req.Name); err != nil {
+			writeWorkspaceError(w, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, file)
+}
+
+// handleDeleteFile deletes a file, or a folder and everything in it
+func (s *Service) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	ws, ok := s.lookupWorkspace(w, r)
+	if !ok {
+		return
+	}
+	removed, err := ws.Delete("", r.PathValue("fileId"))
+	if err != nil {
+		writeWorkspaceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"removed": removed})
+}
+
+// handleListLanguages lists the languages documents can be run as
+func (s *Service) handleListLanguages(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"languages": s.runner.Languages(),
+	})
+}
+
+// handleRunDocument runs a document's content from {"language", "stdin"}.
+// Collaborators see the output stream in; the response holds all of it
+// once the program exits.
+func (s *Service) handleRunDocument(w http.ResponseWriter, r *http.Request) {
+	var req protocol.CodeRun
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if req.Language == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "language is required"})
+		return
+	}
+
+	run, err := s.runInDocument(r.Context(), r.PathValue("id"), req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch runErrorCode(err) {
+		case "unsupported_language":
+			status = http.StatusBadRequest
+		case "execution_running":
+			status = http.StatusConflict
+		case "execution_busy":
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error(), "code": runErrorCode(err)})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"executionId": run.executionID,
+		"exitCode":    run.result.ExitCode,
+		"durationMs":  run.result.Duration.Milliseconds(),
+		"timedOut":    run.result.TimedOut,
+		"canceled":    run.result.Canceled,
+		"truncated":   run.result.Truncated,
+		"stdout":      run.result.Stdout,
+		"stderr":      run.result.Stderr,
+	})
+}
+
+// handleCancelRun stops a document's running program
+func (s *Service) handleCancelRun(w http.ResponseWriter, r *http.Request) {
+	if err := s.cancelInDocument(r.PathValue("id"), r.PathValue("executionId")); err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error(), "code": runErrorCode(err)})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSearchDocument searches a document with the body of a search message
+func (s *Service) handleSearchDocument(w http.ResponseWriter, r *http.Request) {
+	payload, ok := decodeMessageBody(w, r, "search")
+	if !ok {
+		return
+	}
+	req := payload.(*protocol.Search)
+	re, err := compileSearch(req.Data)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	docID := r.PathValue("id")
+	matches, truncated, version := []SearchMatch{}, false, 0
+	if doc, ok := s.loadedDocument(docID); ok {
+		var content string
+		content, version = doc.OTManager.GetDocument()
+		matches, truncated = searchDocument(re, docID, content, maxSearchMatches)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"documentId": docID,
+		"version":    version,
+		"matches":    matches,
+		"truncated":  truncated,
+	})
+}
+
+// handleFormatDocument formats a document with the formatter of its file
+// name, or of the language in an optional {"language"} body
+func (s *Service) handleFormatDocument(w http.ResponseWriter, r *http.Request) {
+	var req protocol.FormatRequest
+	if r.ContentLength != 0 {
+		if !decodeBody(w, r, &req) {
+			return
+		}
+	}
+
+	result, err := s.formatInDocument(r.Context(), r.PathValue("id"), req.Language)
+	if err != nil {
+		status := http.StatusInternalServerError
+		code := formatErrorCode(err)
+		switch {
+		case errors.Is(err, ErrRegionLocked):
+			status, code = http.StatusConflict, "region_locked"
+		case code == "no_formatter":
+			status = http.StatusBadRequest
+		case code == "format_failed":
+			status = http.StatusUnprocessableEntity
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error(), "code": code})
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleGetMetadata returns a document's metadata
+func (s *Service) handleGetMetadata(w http.ResponseWriter, r *http.Request) {
+	metadata, err := s.metadataOf(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, metadata)
+}
+
+// handleSetMetadata changes the metadata fields in the body, as a
+// set_metadata message's data, and returns the result
+func (s *Service) handleSetMetadata(w http.ResponseWriter, r *http.Request) {
+	payload, ok := decodeMessageBody(w, r, "set_metadata")
+	if !ok {
+		return
+	}
+
+	metadata, err := s.setMetadataOf(r.PathValue("id"), payload.(*protocol.SetMetadata).Data)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, metadata)
+}
+
+// handleReplaceDocument replaces every match of a search in a document as one edit
+func (s *Service) handleReplaceDocument(w http.ResponseWriter, r *http.Request) {
+	payload, ok := decodeMessageBody(w, r, "replace_all")
+	if !ok {
+		return
+	}
+	req := payload.(*protocol.ReplaceAll)
+	if _, err := compileSearch(req.Data.Search()); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	result, err := s.replaceInDocument(r.PathValue("id"), apiClientID, req.Data)
+	if errors.Is(err, ErrRegionLocked) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error(), "code": "region_locked"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleSearchWorkspace searches every file of a workspace
+func (s *Service) handleSearchWorkspace(w http.ResponseWriter, r *http.Request) {
+	payload, ok := decodeMessageBody(w, r, "search")
+	if !ok {
+		return
+	}
+	req := payload.(*protocol.Search)
+
+	ws, ok := s.lookupWorkspace(w, r)
+	if !ok {
+		return
+	}
+	matches, truncated, err := ws.Search(req.Data)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"workspaceId": ws.ID,
+		"matches":     matches,
+		"truncated":   truncated,
+	})
+}
+
+// handleReplaceWorkspace replaces every match of a search in each file of a
+// workspace, one edit per document
+func (s *Service) handleReplaceWorkspace(w http.ResponseWriter, r *http.Request) {
+	payload, ok := decodeMessageBody(w, r, "replace_all")
+	if !ok {
+		return
+	}
+	req := payload.(*protocol.ReplaceAll)
+
+	ws, ok := s.lookupWorkspace(w, r)
+	if !ok {
+		return
+	}
+	results, err := ws.ReplaceAll(apiClientID, req.Data)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"workspaceId": ws.ID,
+		"results":     results,
+	})
+}
+
+// handleGetTerminal describes a workspace's shared terminal, if one runs
+func (s *Service) handleGetTerminal(w http.ResponseWriter, r *http.Request) {
+	ws, ok := s.lookupWorkspace(w, r)
+	if !ok {
+		return
+	}
+	state, running := ws.terminalInfo()
+	if !running {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"workspaceId": ws.ID, "running": false})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"workspaceId": ws.ID,
+		"running":     true,
+		"terminal":    state,
+	})
+}
+
+// handleListRecordings lists the recordings of the terminals a workspace ran
+// on this node
+func (s *Service) handleListRecordings(w http.ResponseWriter, r *http.Request) {
+	ws, ok := s.lookupWorkspace(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"workspaceId": ws.ID,
+		"recordings":  ws.recordingInfos(),
+	})
+}
+
+// handleGetRecording downloads a terminal recording as an asciicast v2 file,
+// which terminal players replay
+func (s *Service) handleGetRecording(w http.ResponseWriter, r *http.Request) {
+	ws, ok := s.lookupWorkspace(w, r)
+	if !ok {
+		return
+	}
+	rec, err := ws.recording(r.PathValue("recordingId"))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error(), "code": "unknown_recording"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", rec.ID+".cast"))
+	if err := rec.WriteCast(w); err != nil {
+		log.Printf("[API] Error writing recording %s: %v", rec.ID, err)
+	}
+}
+
+// handleGetGit describes a workspace's repository, if one is configured
+func (s *Service) handleGetGit(w http.ResponseWriter, r *http.Request) {
+	ws, ok := s.lookupWorkspace(w, r)
+	if !ok {
+		return
+	}
+	state, configured := ws.gitInfo()
+	if !configured {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"workspaceId": ws.ID, "configured": false})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"workspaceId": ws.ID,
+		"configured":  true,
+		"git":         state,
+	})
+}
+
+// handleGitDiff shows how a workspace's files differ from HEAD
+func (s *Service) handleGitDiff(w http.ResponseWriter, r *http.Request) {
+	ws, ok := s.lookupWorkspace(w, r)
+	if !ok {
+		return
+	}
+	state, diff, err := ws.Diff()
+	if err != nil {
+		writeGitError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"workspaceId": ws.ID,
+		"branch":      state.Branch,
+		"head":        state.Head,
+		"diff":        diff,
+	})
+}
+
+// handleGitBranches lists the branches of a workspace's repository
+func (s *Service) handleGitBranches(w http.ResponseWriter, r *http.Request) {
+	ws, ok := s.lookupWorkspace(w, r)
+	if !ok {
+		return
+	}
+	branches, err := ws.Branches()
+	if err != nil {
+		writeGitError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"workspaceId": ws.ID,
+		"branches":    branches,
+	})
+}
+
+// lookupWorkspace returns the workspace a request is about. Unlike
+// GetWorkspace it creates none, answering 404 for an unknown ID; only
+// creating a file starts a workspace.
+func (s *Service) lookupWorkspace(w http.ResponseWriter, r *http.Request) (*Workspace, bool) {
+	ws := s.workspace(r.PathValue("id"))
+	if ws == nil {
+		writeWorkspaceError(w, ErrUnknownWorkspace)
+		return nil, false
+	}
+	return ws, true
+}
+
+// decodeBody reads a JSON request body of at most maxRequestBody bytes,
+// answering the request itself when it cannot
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBody)
+	err := json.NewDecoder(r.Body).Decode(v)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "request body too large"})
+		return false
+	case err != nil:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return false
+	}
+	return true
+}
+
+// decodeMessageBody reads the data of a message from the request body and
+// decodes and validates it as the WebSocket would
+func decodeMessageBody(w http.ResponseWriter, r *http.Request, msgType string) (interface{}, bool) {
+	var data json.RawMessage
+	if !decodeBody(w, r, &data) {
+		return nil, false
+	}
+
+	raw, _ := json.Marshal(map[string]interface{}{"type": msgType, "data": data})
+	_, payload, err := protocol.Decode(protocol.JSON, raw)
+	if err == nil {
+		err = protocol.Validate(payload, protocol.ValidationContext{})
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	return payload, true
+}
+
+// writeWorkspaceError maps a workspace error to an HTTP status
+func writeWorkspaceError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch err {
+	case ErrUnknownFile, ErrUnknownWorkspace:
+		status = http.StatusNotFound
+	case ErrNameTaken:
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error(), "code": workspaceErrorCode(err)})
+}
+
+// writeGitError maps a git error to an HTTP status
+func writeGitError(w http.ResponseWriter, err error) {
+	code := gitErrorCode(err)
+	status := http.StatusInternalServerError
+	if code == "git_disabled" || code == "no_repository" {
+		status = http.StatusNotFound
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error(), "code": code})
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[API] Error writing response: %v", err)
+	}
+}
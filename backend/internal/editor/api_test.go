@@ -0,0 +1,94 @@
+package editor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveAPI sends one request to a service's REST API
+func serveAPI(t *testing.T, s *Service, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+func TestSearchBodiesAreValidatedAsMessages(t *testing.T) {
+	s := NewService(&Config{})
+	if _, _, err := s.UpdateDocument("doc", "one two one", "c1", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path, body string
+		status     int
+	}{
+		{"/api/documents/doc/search", `{"query":"one"}`, http.StatusOK},
+		{"/api/documents/doc/search", `{"query":""}`, http.StatusBadRequest},
+		{"/api/documents/doc/search", `{"query":"(","regex":true}`, http.StatusBadRequest},
+		{"/api/documents/doc/search", `{"query":"one","scope":"galaxy"}`, http.StatusBadRequest},
+		{"/api/documents/doc/search", `{"query":1}`, http.StatusBadRequest},
+		{"/api/documents/doc/search", `not json`, http.StatusBadRequest},
+		{"/api/documents/doc/replace", `{"query":"[","regex":true,"replacement":"x"}`, http.StatusBadRequest},
+		{"/api/workspaces/ws/search", `{}`, http.StatusBadRequest},
+		{"/api/workspaces/ws/replace", `{"query":"a)","regex":true}`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if rec := serveAPI(t, s, http.MethodPost, c.path, c.body); rec.Code != c.status {
+			t.Errorf("POST %s %s = %d %s, want %d", c.path, c.body, rec.Code, rec.Body, c.status)
+		}
+	}
+
+	rec := serveAPI(t, s, http.MethodPost, "/api/documents/doc/search", `{"query":"ONE"}`)
+	var result struct {
+		Matches []SearchMatch `json:"matches"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Matches) != 2 {
+		t.Fatalf("found %d matches, want 2", len(result.Matches))
+	}
+}
+
+func TestOversizedBodiesAreRefused(t *testing.T) {
+	s := NewService(&Config{})
+	huge := `{"name":"` + strings.Repeat("a", maxRequestBody) + `"}`
+
+	for _, path := range []string{"/api/workspaces/ws/files", "/api/documents/doc/executions", "/api/documents/doc/search"} {
+		if rec := serveAPI(t, s, http.MethodPost, path, huge); rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("POST %s with %d bytes = %d, want 413", path, len(huge), rec.Code)
+		}
+	}
+	if rec := serveAPI(t, s, http.MethodPost, "/api/workspaces/ws/files", `{"kind":"file","name":"small.txt"}`); rec.Code != http.StatusCreated {
+		t.Errorf("a small body was refused with %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestUnknownWorkspacesAreNotCreated(t *testing.T) {
+	s := NewService(&Config{})
+	for _, path := range []string{
+		"/api/workspaces/nope", "/api/workspaces/nope/terminal", "/api/workspaces/nope/terminal/recordings",
+		"/api/workspaces/nope/git", "/api/workspaces/nope/git/diff", "/api/workspaces/nope/git/branches",
+	} {
+		if rec := serveAPI(t, s, http.MethodGet, path, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", path, rec.Code)
+		}
+	}
+	if rec := serveAPI(t, s, http.MethodDelete, "/api/workspaces/nope/files/f1", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE of a file in an unknown workspace = %d, want 404", rec.Code)
+	}
+	if s.workspace("nope") != nil {
+		t.Fatal("looking at an unknown workspace created it")
+	}
+
+	serveAPI(t, s, http.MethodPost, "/api/workspaces/ws/files", `{"kind":"file","name":"main.go"}`)
+	if rec := serveAPI(t, s, http.MethodGet, "/api/workspaces/ws", ""); rec.Code != http.StatusOK {
+		t.Fatalf("GET of a created workspace = %d", rec.Code)
+	}
+}
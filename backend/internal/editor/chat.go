@@ -0,0 +1,236 @@
+// internal/editor/chat.go
+package editor
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"collaborative-editor/pkg/protocol"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Messages kept per document; older ones are discarded
+	chatLogLimit = 1000
+
+	// Messages sent to a client when it joins
+	chatHistorySize = 50
+)
+
+// Mention is a user named in a chat message
+type Mention struct {
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
+}
+
+// ChatEntry is one message in a document's chat
+type ChatEntry struct {
+	ID        string    `json:"id"`
+	AuthorID  string    `json:"authorId"`
+	Author    string    `json:"author"`
+	Color     string    `json:"color"`
+	AuthorKey string    `json:"authorKey"`
+	Body      string    `json:"body"`
+	Mentions  []Mention `json:"mentions,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ChatLog is a document's chat history, oldest first
+type ChatLog struct {
+	mu      sync.RWMutex
+	entries []ChatEntry
+	ids     map[string]bool
+}
+
+// NewChatLog creates an empty chat log
+func NewChatLog() *ChatLog {
+	return &ChatLog{ids: make(map[string]bool)}
+}
+
+// Add appends a message, ignoring one already logged, such as a message
+// relayed back by a peer's snapshot. It reports whether it was added.
+func (cl *ChatLog) Add(entry ChatEntry) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.ids[entry.ID] {
+		return false
+	}
+	cl.ids[entry.ID] = true
+	cl.entries = append(cl.entries, entry)
+
+	// Messages from other nodes may arrive late
+	if n := len(cl.entries); n > 1 && entry.CreatedAt.Before(cl.entries[n-2].CreatedAt) {
+		sort.SliceStable(cl.entries, func(i, j int) bool {
+			return cl.entries[i].CreatedAt.Before(cl.entries[j].CreatedAt)
+		})
+	}
+
+	if over := len(cl.entries) - chatLogLimit; over > 0 {
+		for _, old := range cl.entries[:over] {
+			delete(cl.ids, old.ID)
+		}
+		cl.entries = append([]ChatEntry(nil), cl.entries[over:]...)
+	}
+	return true
+}
+
+// Recent returns the last n messages, or all of them if n <= 0
+func (cl *ChatLog) Recent(n int) []ChatEntry {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+
+	entries := cl.entries
+	if n > 0 && len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return append([]ChatEntry{}, entries...)
+}
+
+// Len returns the number of logged messages
+func (cl *ChatLog) Len() int {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+
+	return len(cl.entries)
+}
+
+// MarshalJSON persists the log as a list
+func (cl *ChatLog) MarshalJSON() ([]byte, error) {
+	return json.Marshal(cl.Recent(0))
+}
+
+// UnmarshalJSON restores a persisted log
+func (cl *ChatLog) UnmarshalJSON(data []byte) error {
+	var entries []ChatEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	cl.mu.Lock()
+	cl.entries, cl.ids = nil, make(map[string]bool, len(entries))
+	cl.mu.Unlock()
+	for _, entry := range entries {
+		cl.Add(entry)
+	}
+	return nil
+}
+
+// findMentions returns the users named as @username in a message. Longer
+// names win, so "@Ann Lee" mentions Ann Lee rather than Ann.
+func findMentions(body string, users []PresenceEntry) []Mention {
+	sort.Slice(users, func(i, j int) bool {
+		return len(users[i].Username) > len(users[j].Username)
+	})
+
+	lower := strings.ToLower(body)
+	var mentions []Mention
+	seen := make(map[string]bool)
+	for _, u := range users {
+		if u.Username == "" || seen[u.UserID] {
+			continue
+		}
+		tag := "@" + strings.ToLower(u.Username)
+		for i := strings.Index(lower, tag); i >= 0; {
+			end := i + len(tag)
+			if r, _ := utf8.DecodeRuneInString(lower[end:]); end == len(lower) || !isNameRune(r) {
+				mentions = append(mentions, Mention{UserID: u.UserID, Username: u.Username})
+				seen[u.UserID] = true
+				// Blank out the tag so a shorter name does not match inside it
+				lower = lower[:i] + strings.Repeat(" ", len(tag)) + lower[end:]
+				break
+			}
+			next := strings.Index(lower[end:], tag)
+			if next < 0 {
+				break
+			}
+			i = end + next
+		}
+	}
+	return mentions
+}
+
+// isNameRune reports whether a character can continue a username
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_'
+}
+
+// handleChatMessage logs a chat message and sends it to everyone in the document
+func (s *DocumentSession) handleChatMessage(client *Client, msg *protocol.ChatMessage) {
+	author := commentBy(client, s.id, msg.Data.Body)
+	entry := ChatEntry{
+		ID:        uuid.New().String()[:8],
+		AuthorID:  author.AuthorID,
+		Author:    author.Author,
+		Color:     author.Color,
+		AuthorKey: author.AuthorKey,
+		Body:      author.Body,
+		Mentions:  findMentions(author.Body, s.doc.Presence.List()),
+		CreatedAt: time.Now(),
+	}
+	if entry.Body == "" {
+		s.sendErrorCode(client, "Chat message is empty", "invalid_message", "data.body")
+		return
+	}
+	s.doc.Chat.Add(entry)
+
+	chat := Message{
+		Type:       "chat_message",
+		ClientID:   client.id,
+		DocumentID: s.id,
+		Data:       entry,
+	}
+	s.broadcast(messageFrame(chat), "")
+	s.relay(chat)
+
+	if len(entry.Mentions) > 0 {
+		log.Printf("[SESSION] Chat message %s on %s mentions %d users", entry.ID, s.id, len(entry.Mentions))
+	}
+}
+
+// applyRemoteChat logs a chat message posted on another node
+func (s *DocumentSession) applyRemoteChat(msg *Message) {
+	var entry ChatEntry
+	if err := decodeData(msg.Data, &entry); err != nil {
+		log.Printf("[SESSION] Bad chat message for %s: %v", s.id, err)
+		return
+	}
+	if s.doc.Chat.Add(entry) {
+		s.broadcast(messageFrame(*msg), "")
+	}
+}
+
+// sendChatHistory sends a joining client the latest chat messages
+func (s *DocumentSession) sendChatHistory(client *Client) {
+	client.queue(messageFrame(Message{
+		Type:       "chat_history",
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"messages": s.doc.Chat.Recent(chatHistorySize),
+		},
+	}))
+}
+
+// mergeChat logs the messages of a peer's snapshot and, if any were new,
+// sends local clients the history again
+func (s *DocumentSession) mergeChat(entries []ChatEntry) {
+	added := false
+	for _, entry := range entries {
+		if s.doc.Chat.Add(entry) {
+			added = true
+		}
+	}
+	if !added {
+		return
+	}
+	for c := range s.clients {
+		s.sendChatHistory(c)
+	}
+}
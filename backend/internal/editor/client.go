@@ -3,11 +3,14 @@ package editor
 
 import (
 	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
+	"collaborative-editor/pkg/protocol"
+
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
@@ -24,6 +27,13 @@ const (
 
 	// Maximum message size allowed from peer
 	maxMessageSize = 512 * 1024 // 512KB
+
+	// Upper bounds on how much queued output is batched into one frame
+	maxBatchMessages = 64
+	maxBatchBytes    = 64 * 1024
+
+	// Documents one connection may be subscribed to at once
+	maxSubscriptions = 256
 )
 
 var (
@@ -31,6 +41,9 @@ var (
 	space   = []byte{' '}
 )
 
+// errConnectionClosed is returned by writeFrames once it wrote a closing frame
+var errConnectionClosed = errors.New("connection closed")
+
 // Client represents a connected user/editor
 type Client struct {
 	// Unique identifier
@@ -42,24 +55,48 @@ type Client struct {
 	// The websocket connection
 	conn *websocket.Conn
 
-	// Buffered channel of outbound messages
-	send chan []byte
+	// Bounded queue of outbound messages, shed by policy when the client is slow
+	outbox *outbox
+
+	// Closed once when the client disconnects
+	done      chan struct{}
+	closeOnce sync.Once
 
-	// Document this client is editing
+	// Document the client connected with, for messages that name none; empty
+	// for a workspace connection that opens its files later
 	documentID string
 
+	// Sessions of the documents the client is subscribed to, by document ID;
+	// guarded by the hub's mutex
+	sessions map[string]*DocumentSession
+
+	// Workspace the client connected to, if any
+	workspace *Workspace
+
 	// Reference to the service
 	service *Service
 
-	// User information
-	username string
-	color    string // For cursor color
+	// Stable identity of the user across connections, from the user query parameter
+	userKey string
+
+	// User information, changed by the sessions under profileMu; read it through profile
+	profileMu sync.RWMutex
+	username  string
+	color     string // For cursor color
+
+	// Colors that replace color in documents where another user holds it,
+	// by document ID; guarded by profileMu
+	docColors map[string]string
+
+	// Protocol version and capabilities agreed during the hello handshake
+	protoMu    sync.RWMutex
+	negotiated protocol.Negotiated
 }
 
 // readPump pumps messages from the websocket connection to the hub
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		c.hub.Unregister(c)
 		c.conn.Close()
 	}()
 
@@ -71,7 +108,7 @@ func (c *Client) readPump() {
 	})
 
 	for {
-		_, message, err := c.conn.ReadMessage()
+		frameType, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("Websocket error: %v", err)
@@ -79,10 +116,16 @@ func (c *Client) readPump() {
 			break
 		}
 
-		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
+		// The frame type tells us the wire format, whatever was negotiated
+		codec := protocol.JSON
+		if frameType == websocket.BinaryMessage {
+			codec = protocol.MessagePack
+		} else {
+			message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
+		}
 
 		// Process the message
-		c.processMessage(message)
+		c.processMessage(codec, message)
 	}
 }
 
@@ -96,23 +139,19 @@ func (c *Client) writePump() {
 
 	for {
 		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
+		case <-c.outbox.ready:
+			for frame := c.outbox.pop(); frame != nil; frame = c.outbox.pop() {
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := c.writeFrames(frame); err != nil {
+					return
+				}
 			}
-			w.Write(message)
 
-			if err := w.Close(); err != nil {
-				return
-			}
+		case <-c.done:
+			// The client was closed by the hub or a session
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
 
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
@@ -123,18 +162,67 @@ func (c *Client) writePump() {
 	}
 }
 
-// processMessage processes incoming messages from the client
-func (c *Client) processMessage(message []byte) {
-	var msg Message
-	if err := json.Unmarshal(message, &msg); err != nil {
-		log.Printf("Error unmarshaling message: %v", err)
-		c.sendError("Invalid message format")
-		return
+// writeFrames writes a frame, batching whatever else is already queued into
+// the same websocket message when the client negotiated batching. A closing
+// frame ends the batch and is followed by its close message.
+func (c *Client) writeFrames(first *Frame) error {
+	negotiated := c.Negotiated()
+	codec := protocol.CodecFor(negotiated)
+	c.conn.EnableWriteCompression(negotiated.Has(protocol.CapCompression))
+
+	frameType := websocket.TextMessage
+	if codec.Binary() {
+		frameType = websocket.BinaryMessage
+	}
+
+	w, err := c.conn.NextWriter(frameType)
+	if err != nil {
+		return err
+	}
+
+	written, size := 0, 0
+	var closing []byte
+	frame := first
+	for frame != nil && closing == nil {
+		if message, err := frame.Encode(codec); err != nil {
+			log.Printf("Error encoding %s message for %s: %v", frame.Type, c.id, err)
+		} else {
+			// Newline-delimit JSON; MessagePack values are self-delimiting
+			if written > 0 && !codec.Binary() {
+				w.Write(newline)
+			}
+			w.Write(message)
+			written++
+			size += len(message)
+		}
+
+		closing = frame.closing
+		frame = nil
+		if negotiated.Has(protocol.CapBatch) && written < maxBatchMessages && size < maxBatchBytes {
+			frame = c.outbox.pop()
+		}
 	}
 
-	// Add metadata to message
-	msg.ClientID = c.id
-	msg.DocumentID = c.documentID
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if closing != nil {
+		if err := c.conn.WriteMessage(websocket.CloseMessage, closing); err != nil {
+			return err
+		}
+		return errConnectionClosed
+	}
+	return nil
+}
+
+// processMessage decodes, validates and dispatches incoming messages from the client
+func (c *Client) processMessage(codec protocol.Codec, message []byte) {
+	env, payload, err := protocol.DecodeEnvelope(codec, message)
+	if err != nil {
+		log.Printf("Error decoding %q message from %s: %v", env.Type, c.id, err)
+		c.sendDecodeError(env.DocumentID, err)
+		return
+	}
 
 	// Update metrics
 	if c.service != nil {
@@ -143,347 +231,361 @@ func (c *Client) processMessage(message []byte) {
 		c.service.metrics.mu.Unlock()
 	}
 
-	// Handle different message types
-	switch msg.Type {
-	case "text_update":
-		c.handleTextUpdate(msg)
+	// Connection and workspace level messages are handled here, everything
+	// else by the session of the document the message names
+	switch m := payload.(type) {
+	case *protocol.HelloMessage:
+		c.handleHello(m)
+
+	case *protocol.Ping:
+		// Just a keepalive, no action needed
+		return
 
-	case "request_document":
-		c.handleDocumentRequest(msg)
+	case *protocol.Subscribe:
+		c.handleSubscribe(m)
 
-	case "save_document":
-		c.handleSaveDocument(msg)
+	case *protocol.Unsubscribe:
+		c.handleUnsubscribe(m)
 
-	case "typing_start":
-		c.handleTypingStart(msg)
+	case *protocol.FileCreate, *protocol.FileRename, *protocol.FileMove, *protocol.FileDelete,
+		*protocol.FileOpen, *protocol.FileClose:
+		c.handleFileMessage(payload)
 
-	case "typing_stop":
-		c.handleTypingStop(msg)
+	case *protocol.TerminalStart, *protocol.TerminalSubscribe, *protocol.TerminalUnsubscribe,
+		*protocol.TerminalInput, *protocol.TerminalResize, *protocol.TerminalSetDriver, *protocol.TerminalStop:
+		c.handleTerminalMessage(payload)
 
-	case "cursor_position":
-		c.handleCursorPosition(msg)
+	case *protocol.GitConfigure, *protocol.GitMapFile, *protocol.GitCommit, *protocol.GitDiff,
+		*protocol.GitBranches, *protocol.GitCheckout:
+		c.handleGitMessage(payload)
 
-	case "selection_change":
-		c.handleSelectionChange(msg)
+	case *protocol.Search:
+		if m.Data.Scope == scopeWorkspace {
+			c.handleSearchMessage(env, payload)
+			return
+		}
+		c.deliver(env, payload)
 
-	case "ping":
-		// Just a keepalive, no action needed
-		return
+	case *protocol.ReplaceAll:
+		if m.Data.Scope == scopeWorkspace {
+			c.handleSearchMessage(env, payload)
+			return
+		}
+		c.deliver(env, payload)
+
+	case *protocol.Heartbeat:
+		// A heartbeat naming no document keeps the user present in all of them
+		if env.DocumentID == "" {
+			for _, session := range c.hub.clientSessions(c) {
+				session.Deliver(c, env.Type, payload)
+			}
+			return
+		}
+		c.deliver(env, payload)
 
 	default:
-		log.Printf("Unknown message type: %s", msg.Type)
-		c.sendError(fmt.Sprintf("Unknown message type: %s", msg.Type))
+		c.deliver(env, payload)
 	}
 }
 
-// Add new handler functions
-func (c *Client) handleTypingStart(msg Message) {
-	// Broadcast typing indicator to other users
-	msg.Data = map[string]interface{}{
-		"userId":   c.id,
-		"username": c.username,
-		"color":    c.color,
+// deliver hands a message to the session of the document it names. A
+// message naming none goes to the connection's only document.
+func (c *Client) deliver(env protocol.Envelope, payload interface{}) {
+	if env.DocumentID == "" {
+		sessions := c.hub.clientSessions(c)
+		switch len(sessions) {
+		case 1:
+			sessions[0].Deliver(c, env.Type, payload)
+		case 0:
+			c.sendErrorCode("Not subscribed to any document", "not_subscribed", "documentId")
+		default:
+			c.sendErrorCode("documentId is required when subscribed to several documents", "missing_document", "documentId")
+		}
+		return
 	}
 
-	data, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("Error marshaling typing start: %v", err)
+	session := c.hub.clientSession(c, env.DocumentID)
+	if session == nil {
+		c.queue(messageFrame(errorMessage(env.DocumentID,
+			fmt.Sprintf("Not subscribed to document %q", env.DocumentID), "not_subscribed", "documentId")))
 		return
 	}
-
-	c.hub.broadcast <- data
+	session.Deliver(c, env.Type, payload)
 }
 
-func (c *Client) handleTypingStop(msg Message) {
-	// Broadcast typing stop to other users
-	msg.Data = map[string]interface{}{
-		"userId": c.id,
+// handleSubscribe joins the client to another document
+func (c *Client) handleSubscribe(msg *protocol.Subscribe) {
+	docID := msg.Data.DocumentID
+	if c.hub.clientSession(c, docID) == nil && len(c.hub.Subscriptions(c)) >= maxSubscriptions {
+		c.sendErrorCode(fmt.Sprintf("At most %d documents per connection", maxSubscriptions),
+			"too_many_subscriptions", "data.documentId")
+		return
 	}
 
-	data, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("Error marshaling typing stop: %v", err)
+	if err := c.hub.Subscribe(c, docID); err != nil {
+		log.Printf("[CLIENT] Client %s could not subscribe to %s: %v", c.id, docID, err)
+		c.queue(messageFrame(errorMessage(docID, "Failed to open document", "", "")))
 		return
 	}
+	c.sendSubscriptions()
+}
 
-	c.hub.broadcast <- data
+// handleUnsubscribe removes the client from one of its documents
+func (c *Client) handleUnsubscribe(msg *protocol.Unsubscribe) {
+	c.hub.Unsubscribe(c, msg.Data.DocumentID)
+	c.sendSubscriptions()
 }
 
-// Update the initialization message to include color
-func (c *Client) sendInitMessage() {
-	initMsg := Message{
-		Type:     "init",
+// sendSubscriptions tells the client which documents it is subscribed to
+func (c *Client) sendSubscriptions() {
+	c.queue(messageFrame(Message{
+		Type:     "subscriptions",
 		ClientID: c.id,
 		Data: map[string]interface{}{
-			"username": c.username,
-			"color":    c.color,
+			"documents": c.hub.Subscriptions(c),
 		},
+	}))
+}
+
+// sendDecodeError reports a malformed, unknown or invalid message about a
+// document back to the client
+func (c *Client) sendDecodeError(docID string, decodeErr error) {
+	data := map[string]interface{}{
+		"message": decodeErr.Error(),
+		"code":    "invalid_message",
 	}
 
-	data, err := json.Marshal(initMsg)
-	if err != nil {
-		log.Printf("Error marshaling init message: %v", err)
-		return
+	var validationErr *protocol.ValidationError
+	if errors.As(decodeErr, &validationErr) {
+		data["field"] = validationErr.Field
+	} else if errors.Is(decodeErr, protocol.ErrUnknownType) {
+		data["code"] = "unknown_message_type"
 	}
 
-	select {
-	case c.send <- data:
-	default:
-		// Client not ready
+	if err := c.SendMessage(Message{Type: "error", DocumentID: docID, Data: data}); err != nil {
+		log.Printf("Error sending decode error: %v", err)
 	}
 }
 
-// handleTextUpdate handles text update messages
-func (c *Client) handleTextUpdate(msg Message) {
-	log.Printf("[CLIENT] handleTextUpdate from %s, version %d", c.id, msg.Version)
+// Update the initialization message to include color and the negotiated protocol
+func (c *Client) sendInitMessage() {
+	negotiated := c.Negotiated()
 
-	// Extract version from message (default to 0 for backward compatibility)
-	clientVersion := 0
-	if msg.Version > 0 {
-		clientVersion = msg.Version
-	}
+	username, color := c.profile()
 
-	// Update document using OT
-	if c.service != nil {
-		newContent, newVersion, err := c.service.UpdateDocument(
-			c.documentID,
-			msg.Content,
-			c.id,
-			clientVersion,
-		)
+	initMsg := Message{
+		Type:     "init",
+		ClientID: c.id,
+		Data: map[string]interface{}{
+			"username":        username,
+			"color":           color,
+			"protocolVersion": negotiated.ProtocolVersion,
+			"capabilities":    negotiated.Capabilities,
+			"authorKey":       authorKey(c.userKey),
+		},
+	}
 
-		if err != nil {
-			log.Printf("Error updating document: %v", err)
-			c.sendError("Failed to update document")
-			return
-		}
+	c.queue(messageFrame(initMsg))
+}
 
-		// Update message with transformed content and new version
-		msg.Content = newContent
-		msg.Version = newVersion
-	}
+// Negotiated returns the protocol state agreed with this client
+func (c *Client) Negotiated() protocol.Negotiated {
+	c.protoMu.RLock()
+	defer c.protoMu.RUnlock()
 
-	// Add metadata
-	msg.ClientID = c.id
-	msg.DocumentID = c.documentID
+	return c.negotiated
+}
 
-	// Broadcast the transformed update to other clients
-	data, err := json.Marshal(msg)
+// handleHello negotiates the protocol version and capabilities declared by the client.
+// Clients that never say hello keep speaking the legacy protocol.
+func (c *Client) handleHello(msg *protocol.HelloMessage) {
+	negotiated, err := protocol.Negotiate(msg.Data, protocol.ServerCapabilities)
 	if err != nil {
-		log.Printf("Error marshaling text update: %v", err)
+		log.Printf("[CLIENT] Rejecting client %s: %v", c.id, err)
+		c.rejectProtocol(err)
 		return
 	}
 
-	// Send through hub broadcast channel
-	c.hub.broadcast <- data
+	c.protoMu.Lock()
+	c.negotiated = negotiated
+	c.protoMu.Unlock()
 
-	log.Printf("Client %s sent text update for doc %s (version %d)", c.id, c.documentID, msg.Version)
-}
+	log.Printf("[CLIENT] Client %s negotiated protocol v%d with capabilities %v",
+		c.id, negotiated.ProtocolVersion, negotiated.Capabilities)
 
-// handleDocumentRequest handles requests for document state
-func (c *Client) handleDocumentRequest(msg Message) {
-	if c.service != nil {
-		c.service.sendDocumentState(c, c.documentID)
+	c.sendInitMessage()
+	for _, session := range c.hub.clientSessions(c) {
+		session.post(negotiatedEvent{client: c})
 	}
 }
 
-// handleSaveDocument handles document save requests
-func (c *Client) handleSaveDocument(msg Message) {
-	// TODO: Implement document persistence
-	log.Printf("Saving document %s", c.documentID)
-
-	response := Message{
-		Type: "save_confirmation",
+// rejectProtocol tells the client why its protocol is unsupported and closes the connection
+func (c *Client) rejectProtocol(reason error) {
+	msg := Message{
+		Type: "error",
 		Data: map[string]interface{}{
-			"documentId": c.documentID,
-			"saved":      true,
-			"timestamp":  time.Now().Unix(),
+			"message":    reason.Error(),
+			"code":       "unsupported_protocol_version",
+			"minVersion": protocol.MinSupportedVersion,
+			"maxVersion": protocol.VersionCurrent,
 		},
 	}
 
-	data, err := json.Marshal(response)
-	if err != nil {
-		log.Printf("Error marshaling save confirmation: %v", err)
-		return
-	}
+	// writePump closes the connection once the error is flushed, so the
+	// client learns which versions are supported
+	f := messageFrame(msg)
+	f.closing = websocket.FormatCloseMessage(websocket.CloseProtocolError, reason.Error())
+	c.queue(f)
+	c.conn.SetReadDeadline(time.Now().Add(writeWait))
+}
 
-	select {
-	case c.send <- data:
-	default:
-		// Client not ready to receive
-	}
+// sendErrorCode sends an error the client can act on, naming the offending field
+func (c *Client) sendErrorCode(errorMsg, code, field string) {
+	c.queue(messageFrame(errorMessage("", errorMsg, code, field)))
 }
 
-// sendError sends an error message to the client
-func (c *Client) sendError(errorMsg string) {
-	msg := Message{
-		Type: "error",
-		Data: map[string]interface{}{
-			"message": errorMsg,
-		},
-	}
+// sendError sends a client an error about the session's document
+func (s *DocumentSession) sendError(client *Client, errorMsg string) {
+	client.queue(messageFrame(errorMessage(s.id, errorMsg, "", "")))
+}
 
-	data, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("Error marshaling error message: %v", err)
-		return
-	}
+// sendErrorCode sends a client an error about the session's document that
+// it can act on, naming the offending field
+func (s *DocumentSession) sendErrorCode(client *Client, errorMsg, code, field string) {
+	client.queue(messageFrame(errorMessage(s.id, errorMsg, code, field)))
+}
 
-	select {
-	case c.send <- data:
-	default:
-		// Client not ready to receive
+// errorMessage builds an error message; code and field are left out when empty
+func errorMessage(docID, errorMsg, code, field string) Message {
+	data := map[string]interface{}{
+		"message": errorMsg,
+	}
+	if code != "" {
+		data["code"] = code
+		data["field"] = field
+	}
+	return Message{
+		Type:       "error",
+		DocumentID: docID,
+		Data:       data,
 	}
 }
 
 // SendMessage sends a message to the client
 func (c *Client) SendMessage(msg Message) error {
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return err
+	if !c.queue(messageFrame(msg)) {
+		return fmt.Errorf("client %s not ready to receive", c.id)
 	}
+	return nil
+}
+
+// queue hands a frame to the write pump without blocking.
+// It reports false if the client is closed.
+func (c *Client) queue(frame *Frame) bool {
+	return c.enqueue(frame) != queueClosed
+}
 
+// enqueue hands a frame to the write pump under the slow-consumer policy.
+// A client too far behind to recover is closed.
+func (c *Client) enqueue(frame *Frame) queueResult {
 	select {
-	case c.send <- data:
-		return nil
+	case <-c.done:
+		return queueClosed
 	default:
-		return fmt.Errorf("client %s not ready to receive", c.id)
 	}
-}
-
-// NewClient creates a new client
-func NewClient(hub *Hub, conn *websocket.Conn, service *Service, documentID string) *Client {
-	clientID := uuid.New().String()
 
-	// Generate a random color for cursor
-	colors := []string{"#FF6B6B", "#4ECDC4", "#45B7D1", "#96CEB4", "#FFEAA7", "#DDA0DD", "#98D8C8", "#FFA07A"}
-	color := colors[time.Now().UnixNano()%int64(len(colors))]
+	result := c.outbox.push(frame)
+	if result == queueClosed {
+		log.Printf("[CLIENT] Client %s is too far behind, closing", c.id)
+		c.close()
+	}
 
-	return &Client{
-		id:         clientID[:8], // Use first 8 chars for display
-		hub:        hub,
-		conn:       conn,
-		send:       make(chan []byte, 256),
-		documentID: documentID,
-		service:    service,
-		username:   fmt.Sprintf("User-%s", clientID[:4]),
-		color:      color,
+	if c.service != nil && result != queueAccepted {
+		c.service.metrics.recordQueueResult(result)
 	}
+	return result
 }
 
-func (c *Client) handleCursorPosition(msg Message) {
-	log.Printf("[CLIENT] Cursor position from %s: %v", c.id, msg.Position)
-
-	// Extract position from message
-	position := 0
-	if pos, ok := msg.Data.(float64); ok {
-		position = int(pos)
-	} else if msg.Position > 0 {
-		position = msg.Position
-	}
+// QueueStats returns the state of the client's outbound queue
+func (c *Client) QueueStats() QueueStats {
+	return c.outbox.Stats()
+}
 
-	// Update cursor position in document's cursor manager
-	if c.service != nil {
-		doc, err := c.service.GetDocument(c.documentID)
-		if err != nil {
-			log.Printf("Error getting document: %v", err)
-			return
-		}
+// close disconnects the client; safe to call more than once and from any goroutine
+func (c *Client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
 
-		// Initialize CursorManager if nil
-		if doc.CursorManager == nil {
-			doc.CursorManager = NewCursorManager()
-		}
+// profile returns the user's display name and color
+func (c *Client) profile() (username, color string) {
+	c.profileMu.RLock()
+	defer c.profileMu.RUnlock()
 
-		doc.CursorManager.UpdateCursorPosition(c.id, c.username, c.color, position)
-	}
+	return c.username, c.color
+}
 
-	// Broadcast cursor position to other clients
-	cursorMsg := Message{
-		Type:       "cursor_position",
-		ClientID:   c.id,
-		DocumentID: c.documentID,
-		Data: map[string]interface{}{
-			"clientId": c.id,
-			"username": c.username,
-			"color":    c.color,
-			"position": position,
-		},
-	}
+// profileIn returns the user's display name and their color in a document
+func (c *Client) profileIn(docID string) (username, color string) {
+	c.profileMu.RLock()
+	defer c.profileMu.RUnlock()
 
-	data, err := json.Marshal(cursorMsg)
-	if err != nil {
-		log.Printf("Error marshaling cursor position: %v", err)
-		return
+	if color, ok := c.docColors[docID]; ok {
+		return c.username, color
 	}
-
-	c.hub.broadcast <- data
+	return c.username, c.color
 }
 
-func (c *Client) handleSelectionChange(msg Message) {
-	log.Printf("[CLIENT] Selection change from %s", c.id)
+// setProfile changes the user's display name and color; called by the
+// sessions. A new color is used in every document.
+func (c *Client) setProfile(username, color string) {
+	c.profileMu.Lock()
+	defer c.profileMu.Unlock()
 
-	// Extract selection range
-	start, end := 0, 0
-	if selection, ok := msg.Data.(map[string]interface{}); ok {
-		if s, ok := selection["start"].(float64); ok {
-			start = int(s)
-		}
-		if e, ok := selection["end"].(float64); ok {
-			end = int(e)
-		}
-	}
-
-	// Update selection in document's cursor manager
-	if c.service != nil {
-		doc, _ := c.service.GetDocument(c.documentID)
-		if doc.CursorManager != nil {
-			doc.CursorManager.UpdateSelection(c.id, c.username, c.color, start, end)
-		}
+	if color != c.color {
+		c.docColors = nil
 	}
+	c.username = username
+	c.color = color
+}
 
-	// Broadcast selection to other clients
-	selectionMsg := Message{
-		Type:       "selection_change",
-		ClientID:   c.id,
-		DocumentID: c.documentID,
-		Data: map[string]interface{}{
-			"clientId": c.id,
-			"username": c.username,
-			"color":    c.color,
-			"start":    start,
-			"end":      end,
-		},
-	}
+// setDocColor gives the user another color in one document, or their own
+// again when color is empty
+func (c *Client) setDocColor(docID, color string) {
+	c.profileMu.Lock()
+	defer c.profileMu.Unlock()
 
-	data, err := json.Marshal(selectionMsg)
-	if err != nil {
-		log.Printf("Error marshaling selection: %v", err)
+	if color == "" || color == c.color {
+		delete(c.docColors, docID)
 		return
 	}
-
-	c.hub.broadcast <- data
+	if c.docColors == nil {
+		c.docColors = make(map[string]string)
+	}
+	c.docColors[docID] = color
 }
 
-// When client disconnects, remove their cursor
-func (c *Client) cleanup() {
-	if c.service != nil {
-		doc, _ := c.service.GetDocument(c.documentID)
-		if doc.CursorManager != nil {
-			doc.CursorManager.RemoveClient(c.id)
-
-			// Notify other clients to remove this cursor
-			removeMsg := Message{
-				Type:       "cursor_remove",
-				ClientID:   c.id,
-				DocumentID: c.documentID,
-				Data: map[string]interface{}{
-					"clientId": c.id,
-				},
-			}
+// NewClient creates a new client. userKey identifies the user across
+// connections; the client's own ID is used if it is empty. The color is
+// assigned from the palette of its workspace or document when it connects.
+func NewClient(hub *Hub, conn *websocket.Conn, service *Service, documentID, userKey string) *Client {
+	clientID := uuid.New().String()
+	if userKey == "" {
+		userKey = clientID
+	}
 
-			data, _ := json.Marshal(removeMsg)
-			c.hub.broadcast <- data
-		}
+	return &Client{
+		id:         clientID[:8], // Use first 8 chars for display
+		hub:        hub,
+		conn:       conn,
+		outbox:     newOutbox(service.config.Queue),
+		done:       make(chan struct{}),
+		documentID: documentID,
+		sessions:   make(map[string]*DocumentSession),
+		service:    service,
+		userKey:    userKey,
+		username:   fmt.Sprintf("User-%s", clientID[:4]),
+		negotiated: protocol.Legacy(),
 	}
 }
@@ -0,0 +1,118 @@
+package editor
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"collaborative-editor/pkg/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// startTestService runs a service behind a test server and returns the
+// websocket URL to dial, without a query
+func startTestService(t *testing.T, cfg *Config) (*Service, string) {
+	t.Helper()
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	svc := NewService(cfg)
+	if err := svc.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", svc.HandleWebSocket)
+	svc.RegisterRoutes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		srv.Close()
+		svc.Shutdown()
+	})
+	return svc, "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+// dialTest connects a legacy JSON client
+func dialTest(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// testMessage is a server message as a legacy client decodes it
+type testMessage struct {
+	Type       string      `json:"type"`
+	ClientID   string      `json:"clientId"`
+	DocumentID string      `json:"documentId"`
+	Content    string      `json:"content"`
+	Version    int         `json:"version"`
+	Data       interface{} `json:"data"`
+}
+
+// field returns a field of the message's data object
+func (m testMessage) field(name string) interface{} {
+	data, _ := m.Data.(map[string]interface{})
+	return data[name]
+}
+
+// readUntil reads messages until one of the given type arrives
+func readUntil(t *testing.T, conn *websocket.Conn, msgType string) testMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", msgType, err)
+		}
+		var msg testMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("decoding %q: %v", data, err)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func TestRejectedProtocolSendsErrorBeforeClose(t *testing.T) {
+	_, url := startTestService(t, nil)
+	conn := dialTest(t, url+"?doc=reject")
+
+	hello := map[string]interface{}{
+		"type": "hello",
+		"data": map[string]interface{}{"protocolVersion": protocol.VersionCurrent + 1},
+	}
+	if err := conn.WriteJSON(hello); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := readUntil(t, conn, "error")
+	if msg.field("code") != "unsupported_protocol_version" {
+		t.Fatalf("code = %v, want unsupported_protocol_version", msg.field("code"))
+	}
+	if msg.field("minVersion") != float64(protocol.MinSupportedVersion) || msg.field("maxVersion") != float64(protocol.VersionCurrent) {
+		t.Fatalf("versions = %v-%v", msg.field("minVersion"), msg.field("maxVersion"))
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseProtocolError {
+			t.Fatalf("read after rejection: %v, want a protocol error close", err)
+		}
+		return
+	}
+}
@@ -0,0 +1,364 @@
+// internal/editor/comments.go
+package editor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"collaborative-editor/pkg/protocol"
+
+	"github.com/google/uuid"
+)
+
+// Comment errors, reported to clients with a code
+var (
+	ErrUnknownThread  = errors.New("no such comment thread")
+	ErrUnknownComment = errors.New("no such comment")
+	ErrNotAuthor      = errors.New("only the author can change a comment")
+)
+
+// Actions reported in comment_update
+const (
+	commentCreated  = "created"
+	commentReplied  = "replied"
+	commentEdited   = "edited"
+	commentResolved = "resolved"
+	commentReopened = "reopened"
+	commentDeleted  = "deleted"
+)
+
+// Comment is one message in a thread
+type Comment struct {
+	ID       string `json:"id"`
+	AuthorID string `json:"authorId"`
+	Author   string `json:"author"`
+	Color    string `json:"color"`
+
+	// Hash of the author's user key; identifies them across connections
+	// without revealing the key itself
+	AuthorKey string `json:"authorKey"`
+
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// CommentThread is a discussion anchored to a range of the document.
+// The anchor moves with edits so it keeps covering the same text.
+type CommentThread struct {
+	ID         string    `json:"id"`
+	Start      int       `json:"start"`
+	End        int       `json:"end"`
+	Resolved   bool      `json:"resolved"`
+	ResolvedBy string    `json:"resolvedBy,omitempty"`
+	Comments   []Comment `json:"comments"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+func (t *CommentThread) anchor() Anchor          { return Anchor{ID: t.ID, Start: t.Start, End: t.End} }
+func (t *CommentThread) setRange(start, end int) { t.Start, t.End = start, end }
+func (t *CommentThread) created() time.Time      { return t.CreatedAt }
+
+// collapses is false: a thread stays when its text is deleted
+func (t *CommentThread) collapses() bool { return false }
+
+// clone returns a thread that does not share its comments
+func (t *CommentThread) clone() CommentThread {
+	c := *t
+	c.Comments = append([]Comment(nil), t.Comments...)
+	return c
+}
+
+// CommentStore holds a document's comment threads
+type CommentStore struct {
+	rangeStore[CommentThread, *CommentThread]
+}
+
+// NewCommentStore creates an empty comment store
+func NewCommentStore() *CommentStore {
+	return &CommentStore{newRangeStore[CommentThread, *CommentThread]()}
+}
+
+// authorKey hashes a user key for sharing with other users
+func authorKey(userKey string) string {
+	sum := sha256.Sum256([]byte(userKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Create opens a thread on a range with its first comment
+func (cs *CommentStore) Create(start, end int, first Comment) CommentThread {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := time.Now()
+	first.ID = uuid.New().String()[:8]
+	first.CreatedAt, first.UpdatedAt = now, now
+
+	thread := &CommentThread{
+		ID:        uuid.New().String()[:8],
+		Start:     start,
+		End:       end,
+		Comments:  []Comment{first},
+		CreatedAt: now,
+	}
+	cs.items[thread.ID] = thread
+	return thread.clone()
+}
+
+// Reply adds a comment to a thread
+func (cs *CommentStore) Reply(threadID string, reply Comment) (CommentThread, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	thread, ok := cs.items[threadID]
+	if !ok {
+		return CommentThread{}, ErrUnknownThread
+	}
+
+	now := time.Now()
+	reply.ID = uuid.New().String()[:8]
+	reply.CreatedAt, reply.UpdatedAt = now, now
+	thread.Comments = append(thread.Comments, reply)
+	return thread.clone(), nil
+}
+
+// Edit replaces the body of a comment written by the user with the given author key
+func (cs *CommentStore) Edit(threadID, commentID, author, body string) (CommentThread, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	thread, ok := cs.items[threadID]
+	if !ok {
+		return CommentThread{}, ErrUnknownThread
+	}
+	for i := range thread.Comments {
+		c := &thread.Comments[i]
+		if c.ID != commentID {
+			continue
+		}
+		if c.AuthorKey != author {
+			return CommentThread{}, ErrNotAuthor
+		}
+		c.Body = body
+		c.UpdatedAt = time.Now()
+		return thread.clone(), nil
+	}
+	return CommentThread{}, ErrUnknownComment
+}
+
+// Resolve marks a thread resolved by a user, or reopens it
+func (cs *CommentStore) Resolve(threadID string, resolved bool, by string) (CommentThread, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	thread, ok := cs.items[threadID]
+	if !ok {
+		return CommentThread{}, ErrUnknownThread
+	}
+	thread.Resolved = resolved
+	thread.ResolvedBy = ""
+	if resolved {
+		thread.ResolvedBy = by
+	}
+	return thread.clone(), nil
+}
+
+// Delete removes a comment written by the user with the given author key, or
+// the whole thread when commentID is empty. Deleting a thread takes being the
+// author of its first comment; a thread whose last comment is deleted goes too.
+// It reports whether the thread was removed.
+func (cs *CommentStore) Delete(threadID, commentID, author string) (CommentThread, bool, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	thread, ok := cs.items[threadID]
+	if !ok {
+		return CommentThread{}, false, ErrUnknownThread
+	}
+
+	if commentID == "" {
+		if thread.Comments[0].AuthorKey != author {
+			return CommentThread{}, false, ErrNotAuthor
+		}
+		delete(cs.items, threadID)
+		return thread.clone(), true, nil
+	}
+
+	for i, c := range thread.Comments {
+		if c.ID != commentID {
+			continue
+		}
+		if c.AuthorKey != author {
+			return CommentThread{}, false, ErrNotAuthor
+		}
+		thread.Comments = append(thread.Comments[:i], thread.Comments[i+1:]...)
+		if len(thread.Comments) == 0 {
+			delete(cs.items, threadID)
+			return thread.clone(), true, nil
+		}
+		return thread.clone(), false, nil
+	}
+	return CommentThread{}, false, ErrUnknownComment
+}
+
+// commentBy builds a comment written by a client in a document
+func commentBy(client *Client, docID, body string) Comment {
+	username, color := client.profileIn(docID)
+
+	return Comment{
+		AuthorID:  client.id,
+		Author:    username,
+		Color:     color,
+		AuthorKey: authorKey(client.userKey),
+		Body:      strings.TrimSpace(body),
+	}
+}
+
+// handleCommentCreate opens a thread on a range of the document
+func (s *DocumentSession) handleCommentCreate(client *Client, msg *protocol.CommentCreate) {
+	thread := s.doc.Comments.Create(msg.Data.Start, msg.Data.End, commentBy(client, s.id, msg.Data.Body))
+	log.Printf("[SESSION] Client %s opened comment thread %s on %s [%d, %d)",
+		client.id, thread.ID, s.id, thread.Start, thread.End)
+
+	s.commentChanged(client.id, commentCreated, thread)
+}
+
+// handleCommentReply adds a comment to a thread
+func (s *DocumentSession) handleCommentReply(client *Client, msg *protocol.CommentReply) {
+	thread, err := s.doc.Comments.Reply(msg.Data.ThreadID, commentBy(client, s.id, msg.Data.Body))
+	if err != nil {
+		s.sendCommentError(client, err)
+		return
+	}
+	s.commentChanged(client.id, commentReplied, thread)
+}
+
+// handleCommentEdit changes one of the user's comments
+func (s *DocumentSession) handleCommentEdit(client *Client, msg *protocol.CommentEdit) {
+	thread, err := s.doc.Comments.Edit(msg.Data.ThreadID, msg.Data.CommentID,
+		authorKey(client.userKey), strings.TrimSpace(msg.Data.Body))
+	if err != nil {
+		s.sendCommentError(client, err)
+		return
+	}
+	s.commentChanged(client.id, commentEdited, thread)
+}
+
+// handleCommentResolve resolves or reopens a thread; anyone may do either
+func (s *DocumentSession) handleCommentResolve(client *Client, msg *protocol.CommentResolve) {
+	client.profileMu.RLock()
+	username := client.username
+	client.profileMu.RUnlock()
+
+	thread, err := s.doc.Comments.Resolve(msg.Data.ThreadID, msg.Data.Resolved, username)
+	if err != nil {
+		s.sendCommentError(client, err)
+		return
+	}
+
+	action := commentReopened
+	if thread.Resolved {
+		action = commentResolved
+	}
+	s.commentChanged(client.id, action, thread)
+}
+
+// handleCommentDelete removes a thread or one of the user's comments
+func (s *DocumentSession) handleCommentDelete(client *Client, msg *protocol.CommentDelete) {
+	thread, removed, err := s.doc.Comments.Delete(msg.Data.ThreadID, msg.Data.CommentID, authorKey(client.userKey))
+	if err != nil {
+		s.sendCommentError(client, err)
+		return
+	}
+
+	if removed {
+		log.Printf("[SESSION] Client %s deleted comment thread %s on %s", client.id, thread.ID, s.id)
+		thread.Comments = nil
+		s.commentChanged(client.id, commentDeleted, thread)
+		return
+	}
+	s.commentChanged(client.id, commentEdited, thread)
+}
+
+// sendCommentError tells a client why their comment change was refused
+func (s *DocumentSession) sendCommentError(client *Client, err error) {
+	switch err {
+	case ErrUnknownThread:
+		s.sendErrorCode(client, err.Error(), "unknown_thread", "data.threadId")
+	case ErrUnknownComment:
+		s.sendErrorCode(client, err.Error(), "unknown_comment", "data.commentId")
+	case ErrNotAuthor:
+		s.sendErrorCode(client, err.Error(), "not_author", "data.commentId")
+	default:
+		s.sendError(client, err.Error())
+	}
+}
+
+// commentChanged sends a thread's new state to every client, including the
+// one that changed it, and to the other nodes
+func (s *DocumentSession) commentChanged(clientID, action string, thread CommentThread) {
+	msg := Message{
+		Type:       "comment_update",
+		ClientID:   clientID,
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"action": action,
+			"thread": thread,
+		},
+	}
+	s.broadcast(messageFrame(msg), "")
+	s.relay(msg)
+}
+
+// applyRemoteComment mirrors a thread change made on another node
+func (s *DocumentSession) applyRemoteComment(msg *Message) {
+	var update struct {
+		Action string        `json:"action"`
+		Thread CommentThread `json:"thread"`
+	}
+	if err := decodeData(msg.Data, &update); err != nil {
+		log.Printf("[SESSION] Bad comment update for %s: %v", s.id, err)
+		return
+	}
+
+	if update.Action == commentDeleted {
+		s.doc.Comments.Remove(update.Thread.ID)
+	} else {
+		s.doc.Comments.Put(update.Thread)
+	}
+	s.broadcast(messageFrame(*msg), "")
+}
+
+// mergeComments adds the threads of a peer's snapshot this node did not know
+// and sends them to local clients
+func (s *DocumentSession) mergeComments(threads []CommentThread) {
+	for _, thread := range s.doc.Comments.Merge(threads, false) {
+		s.broadcast(messageFrame(Message{
+			Type:       "comment_update",
+			DocumentID: s.id,
+			Data: map[string]interface{}{
+				"action": commentCreated,
+				"thread": thread,
+			},
+		}), "")
+	}
+}
+
+// sendCommentAnchors tells clients where edits moved the comment threads
+func (s *DocumentSession) sendCommentAnchors() {
+	if moved, _ := s.doc.Comments.TakeMoved(); !moved {
+		return
+	}
+
+	s.broadcast(messageFrame(Message{
+		Type:       "comment_anchors",
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"anchors": s.doc.Comments.Anchors(),
+		},
+	}), "")
+}
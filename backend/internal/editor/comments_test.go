@@ -0,0 +1,51 @@
+package editor
+
+import (
+	"testing"
+
+	"collaborative-editor/pkg/ot"
+)
+
+func TestCommentAnchorsFollowEdits(t *testing.T) {
+	insert := func(pos int, content string) ot.Operation {
+		return ot.Operation{Type: ot.OpInsert, Position: pos, Content: content}
+	}
+	remove := func(pos, length int) ot.Operation {
+		return ot.Operation{Type: ot.OpDelete, Position: pos, Length: length}
+	}
+
+	tests := []struct {
+		name       string
+		op         ot.Operation
+		start, end int
+		moved      bool
+	}{
+		{"insert before", insert(0, "ab"), 6, 10, true},
+		{"insert inside", insert(6, "ab"), 4, 10, true},
+		{"insert at end", insert(8, "ab"), 4, 8, false},
+		{"insert after", insert(9, "ab"), 4, 8, false},
+		{"delete before", remove(0, 2), 2, 6, true},
+		{"delete inside", remove(5, 2), 4, 6, true},
+		{"delete overlapping start", remove(2, 4), 2, 4, true},
+		{"delete whole range", remove(2, 8), 2, 2, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := NewCommentStore()
+			thread := cs.Create(4, 8, Comment{Body: "check this"})
+
+			cs.Transform(tt.op)
+			got, ok := cs.Get(thread.ID)
+			if !ok {
+				t.Fatal("thread dropped, want it kept")
+			}
+			if got.Start != tt.start || got.End != tt.end {
+				t.Errorf("anchor is [%d, %d), want [%d, %d)", got.Start, got.End, tt.start, tt.end)
+			}
+			if moved, dropped := cs.TakeMoved(); moved != tt.moved || len(dropped) != 0 {
+				t.Errorf("TakeMoved = %v with %d dropped, want %v with none", moved, len(dropped), tt.moved)
+			}
+		})
+	}
+}
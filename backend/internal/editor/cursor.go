@@ -24,11 +24,23 @@ type SelectionRange struct {
 	Color    string `json:"color"`
 }
 
+// TypingState represents a user who is currently typing
+type TypingState struct {
+	ClientID  string    `json:"clientId"`
+	Username  string    `json:"username"`
+	Color     string    `json:"color"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// Typing indicators older than this are assumed to have missed their typing_stop
+const typingTimeout = 10 * time.Second
+
 // CursorManager manages cursor positions for a document
 type CursorManager struct {
 	mu         sync.RWMutex
 	cursors    map[string]*CursorPosition
 	selections map[string]*SelectionRange
+	typing     map[string]*TypingState
 }
 
 // NewCursorManager creates a new cursor manager
@@ -36,6 +48,7 @@ func NewCursorManager() *CursorManager {
 	return &CursorManager{
 		cursors:    make(map[string]*CursorPosition),
 		selections: make(map[string]*SelectionRange),
+		typing:     make(map[string]*TypingState),
 	}
 }
 
@@ -72,13 +85,48 @@ func (cm *CursorManager) UpdateSelection(clientID, username, color string, start
 	}
 }
 
-// RemoveClient removes a client's cursor and selection
+// SetTyping records whether a client is typing
+func (cm *CursorManager) SetTyping(clientID, username, color string, typing bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if !typing {
+		delete(cm.typing, clientID)
+		return
+	}
+
+	cm.typing[clientID] = &TypingState{
+		ClientID:  clientID,
+		Username:  username,
+		Color:     color,
+		StartedAt: time.Now(),
+	}
+}
+
+// SetProfile updates the name and color shown with a client's cursor state
+func (cm *CursorManager) SetProfile(clientID, username, color string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if c, ok := cm.cursors[clientID]; ok {
+		c.Username, c.Color = username, color
+	}
+	if sel, ok := cm.selections[clientID]; ok {
+		sel.Username, sel.Color = username, color
+	}
+	if t, ok := cm.typing[clientID]; ok {
+		t.Username, t.Color = username, color
+	}
+}
+
+// RemoveClient removes a client's cursor, selection and typing state
 func (cm *CursorManager) RemoveClient(clientID string) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
 	delete(cm.cursors, clientID)
 	delete(cm.selections, clientID)
+	delete(cm.typing, clientID)
 }
 
 // GetAllCursors returns all cursor positions except for the requesting client
@@ -109,16 +157,35 @@ func (cm *CursorManager) GetAllSelections(excludeClientID string) []SelectionRan
 	return selections
 }
 
+// GetAllTyping returns everyone currently typing except for the requesting client
+func (cm *CursorManager) GetAllTyping(excludeClientID string) []TypingState {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	var typing []TypingState
+	now := time.Now()
+	for id, t := range cm.typing {
+		if id != excludeClientID && now.Sub(t.StartedAt) <= typingTimeout {
+			typing = append(typing, *t)
+		}
+	}
+	return typing
+}
+
 // CleanupStale removes cursor positions that haven't been updated recently
-func (cm *CursorManager) CleanupStale(timeout time.Duration) {
+// and returns the IDs of their clients
+func (cm *CursorManager) CleanupStale(timeout time.Duration) []string {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
+	var removed []string
 	now := time.Now()
 	for id, cursor := range cm.cursors {
 		if now.Sub(cursor.UpdatedAt) > timeout {
 			delete(cm.cursors, id)
 			delete(cm.selections, id)
+			removed = append(removed, id)
 		}
 	}
+	return removed
 }
@@ -0,0 +1,327 @@
+// internal/editor/execution.go
+package editor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"collaborative-editor/internal/execution"
+	"collaborative-editor/pkg/protocol"
+	"github.com/google/uuid"
+)
+
+// How long past the sandbox timeout a run announced by another node is
+// considered running, in case that node died before it finished
+const remoteRunGrace = 30 * time.Second
+
+var (
+	// ErrExecutionRunning is returned when the document's code is already running
+	ErrExecutionRunning = errors.New("the document is already running")
+
+	// ErrUnknownExecution is returned for a run that is not in progress
+	ErrUnknownExecution = errors.New("no such run in progress")
+)
+
+// codeRun is the run of a document's code in progress on some node. A
+// document runs one program at a time, which every collaborator watches.
+type codeRun struct {
+	ID        string
+	Language  string
+	Node      string
+	StartedAt time.Time
+
+	// Stops the program; nil when it runs on another node
+	cancel context.CancelFunc
+
+	// Told the result when the run was started through the REST API
+	reply chan runReply
+}
+
+// Session events of code runs
+type (
+	// Output or the end of a run on this node
+	executionEvent struct {
+		runID    string
+		msg      Message
+		finished bool
+		result   execution.Result
+		err      error
+	}
+
+	// A run started through the REST API
+	runEvent struct {
+		clientID string
+		request  protocol.CodeRun
+		reply    chan runReply
+	}
+
+	// A run cancelled through the REST API
+	cancelRunEvent struct {
+		clientID    string
+		executionID string
+		reply       chan error
+	}
+)
+
+// runReply reports a run started through the REST API once it ends
+type runReply struct {
+	executionID string
+	result      execution.Result
+	err         error
+}
+
+// running returns the document's run in progress, forgetting one another
+// node never reported finished
+func (s *DocumentSession) running() *codeRun {
+	run := s.execution
+	if run != nil && run.cancel == nil &&
+		time.Since(run.StartedAt) > s.service.runner.Limits().Timeout+remoteRunGrace {
+		log.Printf("[SESSION] Forgetting run %s of %s on %s, it never finished", run.ID, s.id, run.Node)
+		s.execution = nil
+		return nil
+	}
+	return run
+}
+
+// handleRunCode runs the document for a client
+func (s *DocumentSession) handleRunCode(client *Client, msg *protocol.RunCode) {
+	if _, err := s.startRun(client.id, msg.Data, nil); err != nil {
+		s.sendErrorCode(client, err.Error(), runErrorCode(err), "data.language")
+	}
+}
+
+// startRun runs the document's current content in the sandbox. Its output
+// reaches every client of the document, on every node, as it is written.
+func (s *DocumentSession) startRun(clientID string, req protocol.CodeRun, reply chan runReply) (string, error) {
+	if !s.service.runner.Supports(req.Language) {
+		return "", fmt.Errorf("%w: %s", execution.ErrUnknownLanguage, req.Language)
+	}
+	if run := s.running(); run != nil {
+		return "", ErrExecutionRunning
+	}
+
+	content, version := s.doc.OTManager.GetDocument()
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &codeRun{
+		ID:        uuid.New().String()[:8],
+		Language:  req.Language,
+		Node:      s.service.nodeID,
+		StartedAt: time.Now(),
+		cancel:    cancel,
+		reply:     reply,
+	}
+	s.execution = run
+
+	log.Printf("[SESSION] Client %s runs %s as %s (run %s, version %d)", clientID, s.id, req.Language, run.ID, version)
+
+	started := Message{
+		Type:       "execution_started",
+		ClientID:   clientID,
+		DocumentID: s.id,
+		Version:    version,
+		Data: map[string]interface{}{
+			"executionId": run.ID,
+			"language":    run.Language,
+			"userId":      clientID,
+		},
+	}
+	s.broadcast(messageFrame(started), "")
+	s.relay(started)
+
+	go s.execute(ctx, run, clientID, execution.Request{Language: req.Language, Source: content, Stdin: req.Stdin})
+	return run.ID, nil
+}
+
+// execute runs a program off the session's goroutine and posts its output
+// and result back to it
+func (s *DocumentSession) execute(ctx context.Context, run *codeRun, clientID string, req execution.Request) {
+	seq := 0
+	result, err := s.service.runner.Run(ctx, req, func(out execution.Output) {
+		seq++
+		s.post(executionEvent{runID: run.ID, msg: Message{
+			Type:       "execution_output",
+			ClientID:   clientID,
+			DocumentID: s.id,
+			Data: map[string]interface{}{
+				"executionId": run.ID,
+				"stream":      out.Stream,
+				"data":        out.Data,
+				"seq":         seq,
+			},
+		}})
+	})
+
+	data := map[string]interface{}{
+		"executionId": run.ID,
+		"exitCode":    result.ExitCode,
+		"durationMs":  result.Duration.Milliseconds(),
+		"timedOut":    result.TimedOut,
+		"canceled":    result.Canceled,
+		"truncated":   result.Truncated,
+	}
+	if err != nil {
+		log.Printf("[SESSION] Run %s of %s failed: %v", run.ID, s.id, err)
+		data["error"] = err.Error()
+	}
+	s.post(executionEvent{
+		runID:    run.ID,
+		finished: true,
+		result:   result,
+		err:      err,
+		msg: Message{
+			Type:       "execution_finished",
+			ClientID:   clientID,
+			DocumentID: s.id,
+			Data:       data,
+		},
+	})
+}
+
+// handleExecutionEvent passes a local run's output on and ends the run
+func (s *DocumentSession) handleExecutionEvent(e executionEvent) {
+	s.broadcast(messageFrame(e.msg), "")
+	s.relay(e.msg)
+
+	if !e.finished {
+		return
+	}
+	if run := s.execution; run != nil && run.ID == e.runID {
+		run.cancel()
+		s.execution = nil
+		if run.reply != nil {
+			run.reply <- runReply{executionID: run.ID, result: e.result, err: e.err}
+		}
+	}
+}
+
+// handleCancelExecution stops the document's run for a client
+func (s *DocumentSession) handleCancelExecution(client *Client, msg *protocol.CancelExecution) {
+	if err := s.cancelRun(client.id, msg.Data.ExecutionID); err != nil {
+		s.sendErrorCode(client, err.Error(), runErrorCode(err), "data.executionId")
+	}
+}
+
+// cancelRun stops a run here, or asks the node running it to
+func (s *DocumentSession) cancelRun(clientID, executionID string) error {
+	run := s.running()
+	if run == nil || run.ID != executionID {
+		return ErrUnknownExecution
+	}
+
+	log.Printf("[SESSION] Client %s cancels run %s of %s", clientID, run.ID, s.id)
+	if run.cancel != nil {
+		run.cancel()
+		return nil
+	}
+
+	s.relay(Message{
+		Type:       "execution_cancel",
+		ClientID:   clientID,
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"executionId": run.ID,
+		},
+	})
+	return nil
+}
+
+// stopRun kills a local run when the session stops; its result is lost
+func (s *DocumentSession) stopRun() {
+	if run := s.execution; run != nil && run.cancel != nil {
+		run.cancel()
+		if run.reply != nil {
+			run.reply <- runReply{executionID: run.ID, err: errors.New("document session stopped")}
+		}
+	}
+}
+
+// applyRemoteRun tracks runs on other nodes, so the document runs one
+// program at a time across the cluster, and passes on cancellations
+func (s *DocumentSession) applyRemoteRun(origin string, msg *Message) {
+	data, _ := msg.Data.(map[string]interface{})
+	id := stringField(data, "executionId")
+
+	switch msg.Type {
+	case "execution_started":
+		if s.running() == nil {
+			s.execution = &codeRun{
+				ID:        id,
+				Language:  stringField(data, "language"),
+				Node:      origin,
+				StartedAt: time.Now(),
+			}
+		}
+
+	case "execution_finished":
+		if run := s.execution; run != nil && run.ID == id && run.cancel == nil {
+			s.execution = nil
+		}
+
+	case "execution_cancel":
+		if run := s.execution; run != nil && run.ID == id && run.cancel != nil {
+			log.Printf("[SESSION] Client %s on %s cancels run %s of %s", msg.ClientID, origin, run.ID, s.id)
+			run.cancel()
+		}
+	}
+}
+
+// runErrorCode maps a run error to the code clients see
+func runErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrExecutionRunning):
+		return "execution_running"
+	case errors.Is(err, ErrUnknownExecution):
+		return "unknown_execution"
+	case errors.Is(err, execution.ErrUnknownLanguage):
+		return "unsupported_language"
+	case errors.Is(err, execution.ErrBusy):
+		return "execution_busy"
+	default:
+		return "execution_failed"
+	}
+}
+
+// runInDocument runs a document's code for the REST API and waits for the result
+func (s *Service) runInDocument(ctx context.Context, docID string, req protocol.CodeRun) (runReply, error) {
+	session, err := s.hub.ensureSession(docID)
+	if err != nil {
+		return runReply{}, err
+	}
+
+	reply := make(chan runReply, 1)
+	if !session.post(runEvent{clientID: apiClientID, request: req, reply: reply}) {
+		return runReply{}, errors.New("document session stopped")
+	}
+
+	select {
+	case r := <-reply:
+		return r, r.err
+	case <-session.done:
+		return runReply{}, errors.New("document session stopped")
+	case <-ctx.Done():
+		// The caller went away; its run goes on for the collaborators
+		return runReply{}, ctx.Err()
+	}
+}
+
+// cancelInDocument cancels a document's run for the REST API
+func (s *Service) cancelInDocument(docID, executionID string) error {
+	session := s.hub.session(docID)
+	if session == nil {
+		return ErrUnknownExecution
+	}
+
+	reply := make(chan error, 1)
+	if !session.post(cancelRunEvent{clientID: apiClientID, executionID: executionID, reply: reply}) {
+		return ErrUnknownExecution
+	}
+	select {
+	case err := <-reply:
+		return err
+	case <-session.done:
+		return ErrUnknownExecution
+	}
+}
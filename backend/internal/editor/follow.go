@@ -0,0 +1,220 @@
+// internal/editor/follow.go
+package editor
+
+import (
+	"log"
+
+	"collaborative-editor/pkg/protocol"
+)
+
+// Reasons a follow ended, sent in follow_state
+const (
+	followReasonUnfollowed = "unfollowed"
+	followReasonEdited     = "edited"
+	followReasonLeft       = "left"
+)
+
+// handleFollow starts following another user and catches the follower up on
+// where that user currently is
+func (s *DocumentSession) handleFollow(client *Client, msg *protocol.Follow) {
+	leader := msg.Data.UserID
+	if leader == client.id {
+		s.sendError(client, "Cannot follow yourself")
+		return
+	}
+	if _, ok := s.doc.Presence.Get(leader); !ok {
+		s.sendErrorCode(client, "No such user in this document: "+leader, "unknown_user", "data.userId")
+		return
+	}
+
+	s.setFollow(client.id, leader, "")
+	s.relay(followChange(s.id, client.id, leader, ""))
+
+	if viewport, ok := s.viewports[leader]; ok {
+		client.enqueue(urgentFrame(viewport))
+	}
+	for _, c := range s.doc.CursorManager.GetAllCursors(client.id) {
+		if c.ClientID == leader {
+			client.enqueue(urgentFrame(cursorMessage(s.id, c)))
+		}
+	}
+}
+
+// handleUnfollow stops following
+func (s *DocumentSession) handleUnfollow(client *Client) {
+	s.stopFollowing(client.id, followReasonUnfollowed)
+}
+
+// stopFollowing ends a local user's follow, e.g. because they started editing
+func (s *DocumentSession) stopFollowing(follower, reason string) {
+	if s.follows[follower] == "" {
+		return
+	}
+
+	s.setFollow(follower, "", reason)
+	s.relay(followChange(s.id, follower, "", reason))
+}
+
+// handleViewport records a user's viewport and forwards it to their followers
+func (s *DocumentSession) handleViewport(client *Client, msg *protocol.Viewport) {
+	viewport := Message{
+		Type:       "viewport",
+		ClientID:   client.id,
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"userId":    client.id,
+			"startLine": msg.Data.StartLine,
+			"endLine":   msg.Data.EndLine,
+			"file":      msg.Data.File,
+		},
+	}
+
+	s.viewports[client.id] = viewport
+	s.sendToFollowers(viewport)
+	s.relay(viewport)
+}
+
+// setFollow records that follower now follows leader, or nobody if leader is
+// empty, and tells the local users involved
+func (s *DocumentSession) setFollow(follower, leader, reason string) {
+	previous := s.follows[follower]
+	if previous == leader {
+		return
+	}
+
+	if leader == "" {
+		delete(s.follows, follower)
+	} else {
+		s.follows[follower] = leader
+	}
+	log.Printf("[SESSION] %s follows %q in %s (was %q)", follower, leader, s.id, previous)
+
+	if c := s.localClient(follower); c != nil {
+		c.queue(messageFrame(Message{
+			Type:       "follow_state",
+			ClientID:   follower,
+			DocumentID: s.id,
+			Data: map[string]interface{}{
+				"following": leader,
+				"reason":    reason,
+			},
+		}))
+	}
+	if previous != "" {
+		s.sendFollowers(previous)
+	}
+	if leader != "" {
+		s.sendFollowers(leader)
+	}
+}
+
+// sendFollowers tells a local user who is following them
+func (s *DocumentSession) sendFollowers(leader string) {
+	c := s.localClient(leader)
+	if c == nil {
+		return
+	}
+
+	followers := []map[string]interface{}{}
+	for follower, l := range s.follows {
+		if l != leader {
+			continue
+		}
+		entry, _ := s.doc.Presence.Get(follower)
+		followers = append(followers, map[string]interface{}{
+			"userId":   follower,
+			"username": entry.Username,
+			"color":    entry.Color,
+		})
+	}
+
+	c.queue(messageFrame(Message{
+		Type:       "followers",
+		ClientID:   leader,
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"followers": followers,
+		},
+	}))
+}
+
+// sendToFollowers sends a message about a user ahead of everything else
+// queued for the local clients following them
+func (s *DocumentSession) sendToFollowers(msg Message) {
+	var frame *Frame
+	for c := range s.clients {
+		if s.follows[c.id] != msg.ClientID {
+			continue
+		}
+		if frame == nil {
+			frame = urgentFrame(msg)
+		}
+		c.enqueue(frame)
+	}
+}
+
+// broadcastFollowed broadcasts a message about a user, prioritised for their followers
+func (s *DocumentSession) broadcastFollowed(msg Message, excludeClientID string) {
+	s.broadcastWhere(messageFrame(msg), func(c *Client) bool {
+		return c.id != excludeClientID && s.follows[c.id] != msg.ClientID
+	})
+	s.sendToFollowers(msg)
+}
+
+// forgetFollows drops the follow relationships of a user who left
+func (s *DocumentSession) forgetFollows(userID string) {
+	delete(s.viewports, userID)
+
+	if s.follows[userID] != "" {
+		s.setFollow(userID, "", followReasonLeft)
+	}
+	for follower, leader := range s.follows {
+		if leader == userID {
+			s.setFollow(follower, "", followReasonLeft)
+		}
+	}
+}
+
+// applyFollowChange mirrors a follow started or stopped on another node
+func (s *DocumentSession) applyFollowChange(msg *Message) {
+	data, _ := msg.Data.(map[string]interface{})
+	s.setFollow(msg.ClientID, stringField(data, "leaderId"), stringField(data, "reason"))
+}
+
+// followChange builds the relay message for a follow started or stopped
+func followChange(docID, follower, leader, reason string) Message {
+	return Message{
+		Type:       "follow_change",
+		ClientID:   follower,
+		DocumentID: docID,
+		Data: map[string]interface{}{
+			"leaderId": leader,
+			"reason":   reason,
+		},
+	}
+}
+
+// cursorMessage builds the cursor_position message for a recorded cursor
+func cursorMessage(docID string, c CursorPosition) Message {
+	return Message{
+		Type:       "cursor_position",
+		ClientID:   c.ClientID,
+		DocumentID: docID,
+		Data: map[string]interface{}{
+			"clientId": c.ClientID,
+			"username": c.Username,
+			"color":    c.Color,
+			"position": c.Position,
+		},
+	}
+}
+
+// localClient finds a client of this node by ID
+func (s *DocumentSession) localClient(id string) *Client {
+	for c := range s.clients {
+		if c.id == id {
+			return c
+		}
+	}
+	return nil
+}
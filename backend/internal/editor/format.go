@@ -0,0 +1,293 @@
+// internal/editor/format.go
+package editor
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"collaborative-editor/internal/format"
+	"collaborative-editor/pkg/ot"
+	"collaborative-editor/pkg/protocol"
+)
+
+// FormatResult describes a format of a document. Changes are the edits
+// applied; Skipped are those dropped because they touched text edited while
+// the formatter ran, or a region locked by someone else.
+type FormatResult struct {
+	DocumentID string `json:"documentId"`
+	Language   string `json:"language"`
+	Changes    int    `json:"changes"`
+	Skipped    int    `json:"skipped"`
+	Version    int    `json:"version"`
+}
+
+// Session events of formatting
+type (
+	// A formatter finished with the content it was given, base
+	formattedEvent struct {
+		clientID  string
+		language  string
+		base      string
+		formatted string
+		err       error
+		done      func(FormatResult, error)
+	}
+
+	// A format requested through the REST API
+	formatEvent struct {
+		clientID string
+		language string
+		reply    chan formatReply
+	}
+)
+
+// formatReply reports a format requested through the REST API
+type formatReply struct {
+	result FormatResult
+	err    error
+}
+
+// formatChange is a format applied to the document: the edits it made to
+// base, producing version
+type formatChange struct {
+	base    string
+	edits   []ot.Edit
+	version int
+}
+
+// formatPatch is a formatter's output along with the content it formatted,
+// forwarded to the document's owner
+type formatPatch struct {
+	Base      string `json:"base"`
+	Formatted string `json:"formatted"`
+}
+
+// handleFormatDocument formats the document for a client
+func (s *DocumentSession) handleFormatDocument(client *Client, msg *protocol.FormatDocument) {
+	if s.suggesting[client.id] {
+		s.sendErrorCode(client, "Edits are suggestions while suggesting", "suggesting_mode", "type")
+		return
+	}
+
+	s.format(client.id, msg.Data.Language, func(result FormatResult, err error) {
+		if !s.clients[client] {
+			return
+		}
+		if errors.Is(err, ErrRegionLocked) {
+			s.rejectLockedEdit(client, err)
+			return
+		}
+		if err != nil {
+			s.sendErrorCode(client, err.Error(), formatErrorCode(err), "data.language")
+			return
+		}
+		client.queue(messageFrame(Message{
+			Type:       "format_result",
+			DocumentID: s.id,
+			Version:    result.Version,
+			Data:       result,
+		}))
+	})
+}
+
+// format runs the document's formatter on its current content off the
+// session's goroutine; without a language it is the one of the document's
+// metadata. done is called on the session's goroutine once the result is
+// applied, unless the session stops first.
+func (s *DocumentSession) format(clientID, language string, done func(FormatResult, error)) {
+	name := ""
+	if language == "" {
+		language, name = s.doc.Metadata.Language(), s.service.documentName(s.id)
+	}
+	fmtr, err := s.service.formatters.Find(language, name)
+	if err != nil {
+		done(FormatResult{DocumentID: s.id, Language: language}, err)
+		return
+	}
+
+	base, version := s.doc.OTManager.GetDocument()
+	log.Printf("[SESSION] Client %s formats %s as %s (version %d)", clientID, s.id, fmtr.Language, version)
+
+	go func() {
+		formatted, err := s.service.formatters.Format(context.Background(), fmtr, base)
+		s.post(formattedEvent{
+			clientID:  clientID,
+			language:  fmtr.Language,
+			base:      base,
+			formatted: formatted,
+			err:       err,
+			done:      done,
+		})
+	}()
+}
+
+// handleFormatted applies a formatter's output, or reports its failure
+func (s *DocumentSession) handleFormatted(e formattedEvent) {
+	if e.err != nil {
+		log.Printf("[SESSION] Formatting %s failed: %v", s.id, e.err)
+		e.done(FormatResult{DocumentID: s.id, Language: e.language}, e.err)
+		return
+	}
+
+	result, err := s.formatted(e.clientID, e.base, e.formatted)
+	result.Language = e.language
+	e.done(result, err)
+}
+
+// handleFormatEvent formats the document for the REST API
+func (s *DocumentSession) handleFormatEvent(e formatEvent) {
+	if s.suggesting[e.clientID] {
+		e.reply <- formatReply{err: errors.New("edits are suggestions while suggesting")}
+		return
+	}
+	s.format(e.clientID, e.language, func(result FormatResult, err error) {
+		e.reply <- formatReply{result: result, err: err}
+	})
+}
+
+// formatted applies a formatter's output. A node that does not own the
+// document forwards it to the owner, which fits it to its own copy; the
+// counts returned are then this node's estimate.
+func (s *DocumentSession) formatted(clientID, base, formatted string) (FormatResult, error) {
+	if owner := s.service.owner(s.id); owner != s.service.nodeID {
+		content, version := s.doc.OTManager.GetDocument()
+		edits, skipped := formatEdits(base, formatted, content)
+		result := FormatResult{DocumentID: s.id, Changes: len(edits), Skipped: skipped, Version: version}
+		if len(edits) == 0 {
+			return result, nil
+		}
+		return result, s.forward(owner, &forwardedEdit{
+			ClientID: clientID,
+			Format:   &formatPatch{Base: base, Formatted: formatted},
+		})
+	}
+
+	return s.applyFormat(clientID, base, formatted)
+}
+
+// applyFormat edits the owner's copy of the document with the changes the
+// formatter made to base, as one edit, and sends every client the edits
+// along with the result, so clients fit their unsent typing around them
+func (s *DocumentSession) applyFormat(clientID, base, formatted string) (FormatResult, error) {
+	result := FormatResult{DocumentID: s.id}
+	change := &formatChange{}
+	content, version, err := s.service.EditDocument(s.id, clientID, func(content string) ([]ot.Operation, error) {
+		edits, skipped := formatEdits(base, formatted, content)
+		edits, locked := s.unlockedEdits(clientID, edits)
+		result.Changes, result.Skipped = len(edits), skipped+locked
+		change.base, change.edits = content, edits
+		return ot.Ops(edits), nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	result.Version = version
+	if result.Changes == 0 {
+		return result, nil
+	}
+
+	log.Printf("[SESSION] Client %s formatted %s with %d changes, %d skipped (version %d)",
+		clientID, s.id, result.Changes, result.Skipped, version)
+
+	change.version = version
+	s.lastFormat = change
+
+	// The requester has not made the edit locally, so it must apply it too.
+	// The edits are against the previous version; content is for clients
+	// that replace their copy.
+	msg := Message{
+		Type:       "text_update",
+		Content:    content,
+		ClientID:   "format:" + clientID,
+		DocumentID: s.id,
+		Version:    version,
+		Data: map[string]interface{}{
+			"edits": change.edits,
+		},
+	}
+	s.broadcast(messageFrame(msg), "")
+	s.relay(msg)
+	s.afterEdit()
+	return result, nil
+}
+
+// updateText applies a client's text update. An update made before the client
+// had the last format would undo it, so the format's edits are first moved
+// onto the client's content, leaving out those touching what the client
+// changed, and the document is edited into the result.
+func (s *DocumentSession) updateText(clientID, content string, clientVersion int) (string, int, error) {
+	f := s.lastFormat
+	if _, version := s.doc.OTManager.GetDocument(); f == nil || clientVersion >= f.version || version != f.version {
+		return s.service.UpdateDocument(s.id, content, clientID, clientVersion)
+	}
+
+	edits, skipped := ot.Rebase(f.edits, ot.Diff(f.base, content))
+	merged := ot.Apply(content, edits)
+	log.Printf("[SESSION] Fitting the format of %s to an update from %s made before it, %d changes left out",
+		s.id, clientID, skipped)
+	return s.service.EditDocument(s.id, clientID, func(current string) ([]ot.Operation, error) {
+		return ot.Ops(ot.Diff(current, merged)), nil
+	})
+}
+
+// formatEdits returns the changes a formatter made to base, moved onto the
+// document's current content. Changes touching text edited since are left
+// out, so formatting never overwrites what someone typed meanwhile.
+func formatEdits(base, formatted, content string) ([]ot.Edit, int) {
+	edits := ot.Diff(base, formatted)
+	if content == base {
+		return edits, 0
+	}
+	return ot.Rebase(edits, ot.Diff(base, content))
+}
+
+// unlockedEdits leaves out the edits that touch a region another client locked
+func (s *DocumentSession) unlockedEdits(clientID string, edits []ot.Edit) ([]ot.Edit, int) {
+	kept := edits[:0]
+	for _, e := range edits {
+		allowed := true
+		for _, op := range ot.Ops([]ot.Edit{e}) {
+			op.ClientID = clientID
+			if s.doc.Locks.Check(op) != nil {
+				allowed = false
+				break
+			}
+		}
+		if allowed {
+			kept = append(kept, e)
+		}
+	}
+	return kept, len(edits) - len(kept)
+}
+
+// formatErrorCode maps a formatting error to the code clients see
+func formatErrorCode(err error) string {
+	if errors.Is(err, format.ErrNoFormatter) {
+		return "no_formatter"
+	}
+	return "format_failed"
+}
+
+// formatInDocument formats a document for the REST API and waits for the result
+func (s *Service) formatInDocument(ctx context.Context, docID, language string) (FormatResult, error) {
+	session, err := s.hub.ensureSession(docID)
+	if err != nil {
+		return FormatResult{}, err
+	}
+
+	reply := make(chan formatReply, 1)
+	if !session.post(formatEvent{clientID: apiClientID, language: language, reply: reply}) {
+		return FormatResult{}, errors.New("document session stopped")
+	}
+
+	select {
+	case r := <-reply:
+		return r.result, r.err
+	case <-session.done:
+		return FormatResult{}, errors.New("document session stopped")
+	case <-ctx.Done():
+		return FormatResult{}, ctx.Err()
+	}
+}
@@ -0,0 +1,63 @@
+package editor
+
+import (
+	"encoding/json"
+	"testing"
+
+	"collaborative-editor/pkg/ot"
+	"collaborative-editor/pkg/protocol"
+)
+
+func TestFormatIsSentAsEditsAndFittedToEarlierUpdates(t *testing.T) {
+	s := NewService(&Config{})
+	base := "a=1\nb=2\n"
+	if _, _, err := s.UpdateDocument("doc", base, "c0", 0); err != nil {
+		t.Fatal(err)
+	}
+	alice := NewClient(s.hub, nil, s, "doc", "alice")
+	s.hub.Register(alice)
+	defer s.hub.Unregister(alice)
+	session := s.hub.session("doc")
+
+	formatted := make(chan error, 1)
+	session.post(formattedEvent{
+		clientID:  apiClientID,
+		base:      base,
+		formatted: "a = 1\nb = 2\n",
+		done:      func(_ FormatResult, err error) { formatted <- err },
+	})
+	if err := <-formatted; err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients get the format's edits against the version they had
+	var update struct {
+		Content string `json:"content"`
+		Data    struct {
+			Edits []ot.Edit `json:"edits"`
+		} `json:"data"`
+	}
+	for f := alice.outbox.pop(); f != nil; f = alice.outbox.pop() {
+		if f.Type != "text_update" {
+			continue
+		}
+		payload, err := f.Encode(protocol.JSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.Unmarshal(payload, &update)
+	}
+	if got := ot.Apply(base, update.Data.Edits); len(update.Data.Edits) == 0 || got != update.Content {
+		t.Fatalf("edits %+v turn the document into %q, want %q", update.Data.Edits, got, update.Content)
+	}
+
+	// An update Alice sent before she had the format keeps it, except where
+	// she changed the text it formatted
+	session.Deliver(alice, "text_update", &protocol.TextUpdate{Content: "a=1\nb:2\nc=3\n", Version: 1})
+	reply := make(chan DocumentMetadata)
+	session.post(metadataEvent{reply: reply})
+	<-reply
+	if content, _ := session.doc.OTManager.GetDocument(); content != "a = 1\nb:2\nc=3\n" {
+		t.Fatalf("document is %q", content)
+	}
+}
@@ -0,0 +1,76 @@
+// internal/editor/frame.go
+package editor
+
+import (
+	"sync"
+
+	"collaborative-editor/pkg/protocol"
+)
+
+// Frame is an outbound message queued for one or more clients.
+// It is encoded lazily, at most once per codec, however many clients receive it.
+type Frame struct {
+	Type    string
+	payload interface{}
+
+	// Client the message is about, used to coalesce per-user updates
+	clientID string
+
+	// Document the message is about; frames only supersede frames of the
+	// same document
+	documentID string
+
+	// Sent ahead of everything else queued, such as a followed user's viewport
+	urgent bool
+
+	// Close message written once the frame is flushed, ending the connection
+	closing []byte
+
+	mu      sync.Mutex
+	encoded map[string][]byte
+}
+
+// NewFrame wraps a payload for sending
+func NewFrame(msgType string, payload interface{}) *Frame {
+	return &Frame{
+		Type:    msgType,
+		payload: payload,
+	}
+}
+
+// messageFrame wraps a Message for sending
+func messageFrame(msg Message) *Frame {
+	f := NewFrame(msg.Type, &msg)
+	f.clientID = msg.ClientID
+	f.documentID = msg.DocumentID
+	return f
+}
+
+// urgentFrame wraps a Message that jumps the queue.
+// Only the latest urgent frame of a type per user is kept.
+func urgentFrame(msg Message) *Frame {
+	f := messageFrame(msg)
+	f.urgent = true
+	return f
+}
+
+// Encode returns the frame encoded with the given codec
+func (f *Frame) Encode(codec protocol.Codec) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if data, ok := f.encoded[codec.Name()]; ok {
+		return data, nil
+	}
+
+	data, err := codec.Marshal(f.payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.encoded == nil {
+		f.encoded = make(map[string][]byte, 2)
+	}
+	f.encoded[codec.Name()] = data
+	return data, nil
+}
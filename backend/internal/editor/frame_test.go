@@ -0,0 +1,95 @@
+package editor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"collaborative-editor/pkg/protocol"
+)
+
+// Users in the document the benchmarked frames describe
+const broadcastUsers = 20
+
+// broadcastFrames builds the frames a busy document's session fans out:
+// the state a joining client gets, with everyone's cursors and presence,
+// and the updates every edit, cursor move and status change broadcasts
+func broadcastFrames(tb testing.TB) map[string]*Frame {
+	tb.Helper()
+	s := NewService(&Config{})
+	content := strings.Repeat("func main() {\n\tfmt.Println(\"héllo, wörld\")\n}\n", 100)
+	if _, _, err := s.UpdateDocument("bench", content, "c0", 1); err != nil {
+		tb.Fatal(err)
+	}
+	doc, _ := s.loadedDocument("bench")
+	session := newDocumentSession(doc, s)
+
+	var last PresenceEntry
+	for i := 0; i < broadcastUsers; i++ {
+		id, name, color := fmt.Sprintf("user%04d", i), fmt.Sprintf("User %d", i), "#3b82f6"
+		last = doc.Presence.Join(id, name, color, s.nodeID)
+		doc.CursorManager.UpdateCursorPosition(id, name, color, i*97)
+		doc.CursorManager.UpdateSelection(id, name, color, i*97, i*97+40)
+	}
+
+	joining := NewClient(s.hub, nil, s, doc.ID, "")
+	session.sendDocumentState(joining)
+	state := joining.outbox.pop()
+	if state == nil || state.Type != "document_state" {
+		tb.Fatal("no document_state queued")
+	}
+
+	return map[string]*Frame{
+		"document_state": state,
+		"text_update": messageFrame(Message{
+			Type: "text_update", Content: content + "// edited\n", ClientID: "user0001", DocumentID: doc.ID, Version: 2,
+		}),
+		"cursor_position": messageFrame(Message{
+			Type: "cursor_position", ClientID: "user0001", DocumentID: doc.ID, Position: 1234,
+			Data: map[string]interface{}{"username": "User 1", "color": "#3b82f6"},
+		}),
+		"presence_update": messageFrame(presenceUpdate(doc.ID, last, presenceStatus)),
+		"presence_state":  session.presenceListFrame(true),
+		"active_users":    session.presenceListFrame(false),
+	}
+}
+
+func TestBroadcastFramesEncode(t *testing.T) {
+	for name, frame := range broadcastFrames(t) {
+		for _, codec := range []protocol.Codec{protocol.JSON, protocol.MessagePack} {
+			data, err := frame.Encode(codec)
+			if err != nil || len(data) == 0 {
+				t.Errorf("%s/%s: %d bytes, %v", name, codec.Name(), len(data), err)
+			}
+		}
+	}
+}
+
+// BenchmarkBroadcastEncode measures encoding an outbound frame, which a
+// broadcast does once per codec in use however many clients receive it
+func BenchmarkBroadcastEncode(b *testing.B) {
+	frames := broadcastFrames(b)
+	names := make([]string, 0, len(frames))
+	for name := range frames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		frame := frames[name]
+		for _, codec := range []protocol.Codec{protocol.JSON, protocol.MessagePack} {
+			encoded, err := frame.Encode(codec)
+			if err != nil {
+				b.Fatalf("%s/%s: %v", name, codec.Name(), err)
+			}
+			b.Run(name+"/"+codec.Name(), func(b *testing.B) {
+				b.SetBytes(int64(len(encoded)))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					NewFrame(frame.Type, frame.payload).Encode(codec)
+				}
+			})
+		}
+	}
+}
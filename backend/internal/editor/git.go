@@ -0,0 +1,708 @@
+// internal/editor/git.go
+package editor
+
+import (
+	"errors"
+	"log"
+	"maps"
+	"path"
+	"sort"
+	"strings"
+
+	"collaborative-editor/internal/git"
+	"collaborative-editor/pkg/ot"
+	"collaborative-editor/pkg/protocol"
+)
+
+// Git errors
+var (
+	ErrGitDisabled     = errors.New("git is not enabled on this server")
+	ErrNoRepository    = errors.New("the workspace has no repository configured")
+	ErrInvalidRepoPath = errors.New("paths in the repository must stay inside it and out of .git")
+	ErrUncommitted     = errors.New("the workspace has changes that are not committed; commit them or force the checkout")
+)
+
+// Actions a checkout reports for each file it changed
+const (
+	gitReloaded = "reloaded"
+	gitCreated  = "created"
+	gitDeleted  = "deleted"
+)
+
+// gitState is a workspace's repository as its members see it. Git runs on
+// the node a request arrives at, in the repository at Path under that
+// node's git root; every node shares the configuration.
+type gitState struct {
+	WorkspaceID string `json:"workspaceId"`
+	Path        string `json:"path"`
+
+	// Folder of the repository the workspace's tree maps to; its root if empty
+	Dir string `json:"dir"`
+
+	// Repository paths of the files placed elsewhere than the tree says, by file ID
+	Mappings map[string]string `json:"mappings"`
+
+	// Branch HEAD is on and the commit it points to, as of the latest
+	// commit or checkout; the commit is empty on a branch without one
+	Branch string `json:"branch"`
+	Head   string `json:"head"`
+}
+
+// snapshot copies the state for sending
+func (g *gitState) snapshot() gitState {
+	state := *g
+	state.Mappings = maps.Clone(g.Mappings)
+	if state.Mappings == nil {
+		state.Mappings = map[string]string{}
+	}
+	return state
+}
+
+// repoPath returns where a workspace file goes in the repository
+func (g *gitState) repoPath(f searchFile) string {
+	if p, ok := g.Mappings[f.ID]; ok {
+		return p
+	}
+	return path.Join(g.Dir, f.path)
+}
+
+// gitReload is what a checkout did to one workspace file
+type gitReload struct {
+	FileID  string `json:"fileId"`
+	Path    string `json:"path"`
+	Action  string `json:"action"`
+	Version int    `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// reloadEvent asks a session to turn the document into a file checked out
+// from git, and to report the result on reply
+type reloadEvent struct {
+	clientID string
+	content  string
+	reply    chan reloadReply
+}
+
+type reloadReply struct {
+	version int
+	err     error
+}
+
+// cleanRepoPath cleans a slash separated path in a repository; empty is
+// its root
+func cleanRepoPath(p string) (string, error) {
+	p = path.Clean("/" + strings.TrimSpace(p))[1:]
+	if strings.Contains("/"+p+"/", "/../") {
+		return "", ErrInvalidRepoPath
+	}
+	for _, part := range strings.Split(p, "/") {
+		if strings.EqualFold(part, ".git") {
+			return "", ErrInvalidRepoPath
+		}
+	}
+	return p, nil
+}
+
+// handleGitMessage applies a git message from a client. Git commands take a
+// while, so they run off the read loop.
+func (c *Client) handleGitMessage(payload interface{}) {
+	w := c.workspace
+	if w == nil {
+		c.sendErrorCode("Connection is not in a workspace", "no_workspace", "type")
+		return
+	}
+
+	go func() {
+		var err error
+		switch m := payload.(type) {
+		case *protocol.GitConfigure:
+			err = w.ConfigureGit(c.id, m.Data.Path, m.Data.Dir, m.Data.Create)
+
+		case *protocol.GitMapFile:
+			err = w.MapGitFile(c.id, m.Data.FileID, m.Data.Path)
+
+		case *protocol.GitCommit:
+			author, coAuthors := w.gitAuthors(c)
+			_, err = w.Commit(c.id, m.Data.Message, author, coAuthors)
+
+		case *protocol.GitDiff:
+			var diff git.Diff
+			var state gitState
+			if state, diff, err = w.Diff(); err == nil {
+				c.queue(messageFrame(Message{
+					Type: "git_diff",
+					Data: map[string]interface{}{
+						"workspaceId": w.ID,
+						"branch":      state.Branch,
+						"head":        state.Head,
+						"diff":        diff,
+					},
+				}))
+			}
+
+		case *protocol.GitBranches:
+			var branches []git.Branch
+			if branches, err = w.Branches(); err == nil {
+				c.queue(messageFrame(Message{
+					Type: "git_branches",
+					Data: map[string]interface{}{
+						"workspaceId": w.ID,
+						"branches":    branches,
+					},
+				}))
+			}
+
+		case *protocol.GitCheckout:
+			_, err = w.Checkout(c.id, m.Data.Branch, m.Data.Create, m.Data.Force)
+		}
+
+		if err != nil {
+			c.sendErrorCode(err.Error(), gitErrorCode(err), "data")
+		}
+	}()
+}
+
+// ConfigureGit sets the repository the workspace's files are committed to,
+// by its path under the git root, and the folder of it the tree maps to.
+// Files mapped elsewhere keep their place.
+func (w *Workspace) ConfigureGit(clientID, repoPath, dir string, create bool) error {
+	repos := w.service.repos
+	if repos == nil {
+		return ErrGitDisabled
+	}
+	if strings.TrimSpace(repoPath) == "" {
+		repoPath = w.ID
+	}
+	dir, err := cleanRepoPath(dir)
+	if err != nil {
+		return err
+	}
+
+	w.gitMu.Lock()
+	defer w.gitMu.Unlock()
+
+	repo, err := repos.Open(repoPath, create)
+	if err != nil {
+		return err
+	}
+	branch, head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.unlock()
+
+	state := &gitState{WorkspaceID: w.ID, Path: repoPath, Dir: dir, Branch: branch, Head: head}
+	if w.git != nil {
+		state.Mappings = w.git.Mappings
+	}
+	w.git = state
+
+	log.Printf("[WORKSPACE] Client %s set the repository of %s to %s (folder %q, on %s)", clientID, w.ID, repoPath, dir, branch)
+	w.gitChanged(clientID)
+	return nil
+}
+
+// MapGitFile places a file at a path in the repository other than its place
+// in the tree, or back there if the path is empty
+func (w *Workspace) MapGitFile(clientID, fileID, repoPath string) error {
+	repoPath, err := cleanRepoPath(repoPath)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.unlock()
+
+	if w.git == nil {
+		return ErrNoRepository
+	}
+	if f, ok := w.files[fileID]; !ok || f.Kind != kindFile {
+		return ErrUnknownFile
+	}
+
+	mappings := maps.Clone(w.git.Mappings)
+	if mappings == nil {
+		mappings = make(map[string]string)
+	}
+	delete(mappings, fileID)
+	if repoPath != "" {
+		mapped := &gitState{Dir: w.git.Dir, Mappings: mappings}
+		for _, f := range w.files {
+			if f.Kind == kindFile && f.ID != fileID && mapped.repoPath(searchFile{*f, w.path(f.ID)}) == repoPath {
+				return ErrNameTaken
+			}
+		}
+		mappings[fileID] = repoPath
+	}
+	w.git.Mappings = mappings
+
+	w.gitChanged(clientID)
+	return nil
+}
+
+// Commit commits the workspace files this node has loaded on the repository's
+// current branch
+func (w *Workspace) Commit(clientID, message string, author git.Author, coAuthors []git.Author) (git.Commit, error) {
+	w.gitMu.Lock()
+	defer w.gitMu.Unlock()
+
+	state, repo, err := w.gitRepo()
+	if err != nil {
+		return git.Commit{}, err
+	}
+
+	message = strings.TrimSpace(message)
+	if len(coAuthors) > 0 {
+		message += "\n"
+		for _, a := range coAuthors {
+			message += "\nCo-authored-by: " + a.String()
+		}
+	}
+
+	snap, _ := w.gitSnapshot(state)
+	commit, err := repo.Commit(snap, message+"\n", author)
+	if err != nil {
+		return git.Commit{}, err
+	}
+
+	w.mu.Lock()
+	defer w.unlock()
+
+	msg := Message{
+		Type:     "git_committed",
+		ClientID: clientID,
+		Data: map[string]interface{}{
+			"workspaceId": w.ID,
+			"commit":      commit,
+		},
+	}
+	w.broadcast(msg)
+	w.publish(workspaceEnvelope{Kind: relayMessage, Message: &msg})
+	w.gitMoved(clientID, commit.Branch, commit.ID)
+	return commit, nil
+}
+
+// Diff returns how the workspace's files differ from HEAD
+func (w *Workspace) Diff() (gitState, git.Diff, error) {
+	w.gitMu.Lock()
+	defer w.gitMu.Unlock()
+
+	state, repo, err := w.gitRepo()
+	if err != nil {
+		return gitState{}, git.Diff{}, err
+	}
+	snap, _ := w.gitSnapshot(state)
+	diff, err := repo.Diff(snap)
+	return state, diff, err
+}
+
+// Branches lists the repository's branches
+func (w *Workspace) Branches() ([]git.Branch, error) {
+	_, repo, err := w.gitRepo()
+	if err != nil {
+		return nil, err
+	}
+	return repo.Branches()
+}
+
+// Checkout checks out a branch, or creates one at HEAD and moves to it.
+// Moving to another commit changes the workspace to match it: files the
+// branch holds are reloaded or created, and those the previous commit held
+// but the branch does not are deleted; other files stay. A workspace with
+// changes not committed is refused unless force is set, which loses them;
+// creating a branch keeps them.
+func (w *Workspace) Checkout(clientID, branch string, create, force bool) ([]gitReload, error) {
+	w.gitMu.Lock()
+	defer w.gitMu.Unlock()
+
+	state, repo, err := w.gitRepo()
+	if err != nil {
+		return nil, err
+	}
+	_, before, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	if !create && !force {
+		snap, _ := w.gitSnapshot(state)
+		diff, err := repo.Diff(snap)
+		if err != nil {
+			return nil, err
+		}
+		if len(diff.Changes) > 0 {
+			return nil, ErrUncommitted
+		}
+	}
+
+	if err := repo.Checkout(branch, create); err != nil {
+		return nil, err
+	}
+	branch, head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	reloads := []gitReload{}
+	if head != before || force {
+		scope := []string{state.Dir}
+		for _, p := range state.Mappings {
+			scope = append(scope, p)
+		}
+		previous, err := repo.Files(before, scope...)
+		if err != nil {
+			return nil, err
+		}
+		target, err := repo.Files(head, scope...)
+		if err != nil {
+			return nil, err
+		}
+		reloads = w.checkoutFiles(clientID, state, previous, target)
+	}
+
+	w.mu.Lock()
+	defer w.unlock()
+
+	msg := Message{
+		Type:     "git_checked_out",
+		ClientID: clientID,
+		Data: map[string]interface{}{
+			"workspaceId": w.ID,
+			"branch":      branch,
+			"head":        head,
+			"files":       reloads,
+		},
+	}
+	w.broadcast(msg)
+	w.publish(workspaceEnvelope{Kind: relayMessage, Message: &msg})
+	w.gitMoved(clientID, branch, head)
+
+	log.Printf("[WORKSPACE] Client %s checked out %s in %s, changing %d files", clientID, branch, w.ID, len(reloads))
+	return reloads, nil
+}
+
+// checkoutFiles changes the workspace's files from one commit's to another's
+func (w *Workspace) checkoutFiles(clientID string, state gitState, previous, target map[string]string) []gitReload {
+	_, files := w.gitSnapshot(state)
+
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	reloads := []gitReload{}
+	for _, p := range paths {
+		f := files[p]
+		content, inTarget := target[p]
+		if _, tracked := previous[p]; !inTarget && tracked {
+			reload := gitReload{FileID: f.ID, Path: f.path, Action: gitDeleted}
+			if _, err := w.Delete(clientID, f.ID); err != nil {
+				reload.Error = err.Error()
+			}
+			reloads = append(reloads, reload)
+		} else if inTarget {
+			if reload, changed := w.reloadFile(clientID, f, content); changed {
+				reloads = append(reloads, reload)
+			}
+		}
+	}
+
+	paths = paths[:0]
+	for p := range target {
+		if _, ok := files[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		rel, ok := p, state.Dir == ""
+		if !ok {
+			rel, ok = strings.CutPrefix(p, state.Dir+"/")
+		}
+		if !ok {
+			// A mapped file deleted from the workspace
+			continue
+		}
+		file, err := w.createPath(clientID, rel)
+		if err != nil {
+			reloads = append(reloads, gitReload{Path: rel, Action: gitCreated, Error: err.Error()})
+			continue
+		}
+		reload, _ := w.reloadFile(clientID, searchFile{file, rel}, target[p])
+		reload.Action = gitCreated
+		reloads = append(reloads, reload)
+	}
+	return reloads
+}
+
+// reloadFile turns a file's document into content checked out, and reports
+// whether that changed it
+func (w *Workspace) reloadFile(clientID string, f searchFile, content string) (gitReload, bool) {
+	reload := gitReload{FileID: f.ID, Path: f.path, Action: gitReloaded}
+	if doc, ok := w.service.loadedDocument(f.DocumentID); ok {
+		if current, version := doc.OTManager.GetDocument(); current == content {
+			reload.Version = version
+			return reload, false
+		}
+	}
+
+	version, err := w.service.reloadDocument(f.DocumentID, clientID, content)
+	reload.Version = version
+	if err != nil {
+		log.Printf("[WORKSPACE] Reloading %s of %s failed: %v", f.path, w.ID, err)
+		reload.Error = err.Error()
+	}
+	return reload, true
+}
+
+// createPath creates a file at a slash separated path of the tree, and the
+// folders leading to it
+func (w *Workspace) createPath(clientID, p string) (WorkspaceFile, error) {
+	parts := strings.Split(p, "/")
+	parentID := ""
+	for _, name := range parts[:len(parts)-1] {
+		folder, ok := w.child(parentID, name)
+		if !ok {
+			var err error
+			if folder, err = w.Create(clientID, kindFolder, name, parentID); err != nil {
+				return WorkspaceFile{}, err
+			}
+		}
+		if folder.Kind != kindFolder {
+			return WorkspaceFile{}, ErrNotFolder
+		}
+		parentID = folder.ID
+	}
+	return w.Create(clientID, kindFile, parts[len(parts)-1], parentID)
+}
+
+// child returns the file or folder of a name in a folder
+func (w *Workspace) child(parentID, name string) (WorkspaceFile, bool) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	for _, f := range w.files {
+		if f.ParentID == parentID && strings.EqualFold(f.Name, name) {
+			return *f, true
+		}
+	}
+	return WorkspaceFile{}, false
+}
+
+// gitRepo returns the workspace's repository and its configuration
+func (w *Workspace) gitRepo() (gitState, *git.Repo, error) {
+	if w.service.repos == nil {
+		return gitState{}, nil, ErrGitDisabled
+	}
+
+	w.mu.Lock()
+	if w.git == nil {
+		w.unlock()
+		return gitState{}, nil, ErrNoRepository
+	}
+	state := w.git.snapshot()
+	w.unlock()
+
+	repo, err := w.service.repos.Open(state.Path, false)
+	return state, repo, err
+}
+
+// gitSnapshot returns the workspace's files by repository path, and their
+// content as this node has it. Files whose document this node never loaded
+// are kept as the repository has them, rather than committed empty.
+func (w *Workspace) gitSnapshot(state gitState) (git.Snapshot, map[string]searchFile) {
+	snap := git.Snapshot{Dir: state.Dir, Files: make(map[string]string), Keep: make(map[string]bool)}
+	files := make(map[string]searchFile)
+	for _, f := range w.searchFiles() {
+		p := state.repoPath(f)
+		files[p] = f
+		doc, ok := w.service.loadedDocument(f.DocumentID)
+		if !ok {
+			snap.Keep[p] = true
+			continue
+		}
+		snap.Files[p], _ = doc.OTManager.GetDocument()
+	}
+	return snap, files
+}
+
+// gitAuthors returns the author of a client's commit, and the other users
+// connected to the workspace on this node as its co-authors. Their emails
+// are made from the hashed user keys, as comment authors are, so commits
+// do not give the keys away.
+func (w *Workspace) gitAuthors(c *Client) (git.Author, []git.Author) {
+	repos := w.service.repos
+	if repos == nil {
+		return git.Author{}, nil
+	}
+	name, _ := c.profile()
+	author := repos.UserAuthor(name, authorKey(c.userKey))
+
+	w.mu.Lock()
+	defer w.unlock()
+
+	seen := map[string]bool{c.userKey: true}
+	var coAuthors []git.Author
+	for member := range w.members {
+		if seen[member.userKey] {
+			continue
+		}
+		seen[member.userKey] = true
+		name, _ := member.profile()
+		coAuthors = append(coAuthors, repos.UserAuthor(name, authorKey(member.userKey)))
+	}
+	sort.Slice(coAuthors, func(i, j int) bool { return coAuthors[i].Name < coAuthors[j].Name })
+	return author, coAuthors
+}
+
+// gitMoved records where HEAD is after a commit or checkout. Callers hold w.mu.
+func (w *Workspace) gitMoved(clientID, branch, head string) {
+	if w.git == nil {
+		return
+	}
+	w.git.Branch, w.git.Head = branch, head
+	w.gitChanged(clientID)
+}
+
+// gitChanged sends the repository's state to every local connection and to
+// the other nodes. Callers hold w.mu.
+func (w *Workspace) gitChanged(clientID string) {
+	msg := Message{Type: "git_state", ClientID: clientID, Data: w.git.snapshot()}
+	w.broadcast(msg)
+	w.publish(workspaceEnvelope{Kind: relayMessage, Message: &msg})
+}
+
+// adoptGitState takes the repository state another node sent. Callers hold w.mu.
+func (w *Workspace) adoptGitState(state gitState) {
+	w.git = &state
+	w.broadcast(Message{Type: "git_state", Data: state.snapshot()})
+}
+
+// handleRemoteGit applies a git message published by another node
+func (w *Workspace) handleRemoteGit(msg *Message) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	if msg.Type != "git_state" {
+		w.broadcast(*msg)
+		return
+	}
+	var state gitState
+	if err := decodeData(msg.Data, &state); err != nil {
+		log.Printf("[WORKSPACE] Bad git state for %s: %v", w.ID, err)
+		return
+	}
+	w.adoptGitState(state)
+}
+
+// handleReloadEvent reloads the document for a checkout
+func (s *DocumentSession) handleReloadEvent(e reloadEvent) {
+	version, err := s.reload(e.clientID, e.content)
+	e.reply <- reloadReply{version: version, err: err}
+}
+
+// reload turns the document into content checked out from git. A node that
+// does not own the document forwards it to the owner, which changes its
+// own copy; the version returned is then this node's.
+func (s *DocumentSession) reload(clientID, content string) (int, error) {
+	if owner := s.service.owner(s.id); owner != s.service.nodeID {
+		_, version := s.doc.OTManager.GetDocument()
+		return version, s.forward(owner, &forwardedEdit{ClientID: clientID, Reload: &content})
+	}
+	return s.applyReload(clientID, content)
+}
+
+// applyReload edits the owner's copy of the document into content as one
+// edit, made of the operations that differ, so comments, suggestions and
+// locks follow the change, and sends the result to every client as a single
+// text update
+func (s *DocumentSession) applyReload(clientID, content string) (int, error) {
+	changes := 0
+	newContent, version, err := s.service.EditDocument(s.id, clientID, func(current string) ([]ot.Operation, error) {
+		edits := ot.Diff(current, content)
+		changes = len(edits)
+		return ot.Ops(edits), nil
+	})
+	if err != nil || changes == 0 {
+		return version, err
+	}
+
+	log.Printf("[SESSION] Client %s checked out %s with %d changes (version %d)", clientID, s.id, changes, version)
+
+	msg := Message{
+		Type:       "text_update",
+		Content:    newContent,
+		ClientID:   "git:" + clientID,
+		DocumentID: s.id,
+		Version:    version,
+	}
+	s.broadcast(messageFrame(msg), "")
+	s.relay(msg)
+	s.afterEdit()
+	return version, nil
+}
+
+// reloadDocument reloads a document in its session and waits for it
+func (s *Service) reloadDocument(docID, clientID, content string) (int, error) {
+	session, err := s.hub.ensureSession(docID)
+	if err != nil {
+		return 0, err
+	}
+
+	reply := make(chan reloadReply, 1)
+	if !session.post(reloadEvent{clientID: clientID, content: content, reply: reply}) {
+		return 0, errors.New("document session stopped")
+	}
+
+	select {
+	case r := <-reply:
+		return r.version, r.err
+	case <-session.done:
+		return 0, errors.New("document session stopped")
+	}
+}
+
+// gitInfo returns the workspace's repository state for the REST API
+func (w *Workspace) gitInfo() (gitState, bool) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	if w.git == nil {
+		return gitState{}, false
+	}
+	return w.git.snapshot(), true
+}
+
+// gitErrorCode maps a git error to the code clients see
+func gitErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrGitDisabled):
+		return "git_disabled"
+	case errors.Is(err, ErrNoRepository), errors.Is(err, git.ErrNotRepository):
+		return "no_repository"
+	case errors.Is(err, ErrInvalidRepoPath), errors.Is(err, git.ErrInvalidPath):
+		return "invalid_path"
+	case errors.Is(err, git.ErrUnknownBranch):
+		return "unknown_branch"
+	case errors.Is(err, git.ErrBranchExists):
+		return "branch_exists"
+	case errors.Is(err, git.ErrInvalidBranch):
+		return "invalid_branch"
+	case errors.Is(err, git.ErrNothingToCommit):
+		return "nothing_to_commit"
+	case errors.Is(err, git.ErrDetached):
+		return "detached_head"
+	case errors.Is(err, ErrUncommitted):
+		return "uncommitted_changes"
+	case errors.Is(err, ErrUnknownFile):
+		return "unknown_file"
+	case errors.Is(err, ErrNameTaken):
+		return "name_taken"
+	default:
+		return "git_failed"
+	}
+}
@@ -0,0 +1,32 @@
+package editor
+
+import (
+	"strings"
+	"testing"
+
+	"collaborative-editor/internal/git"
+)
+
+func TestGitAuthorsHideUserKeys(t *testing.T) {
+	s := NewService(&Config{Git: &git.Config{Root: t.TempDir(), EmailDomain: "users.example"}})
+	w := s.GetWorkspace("ws")
+
+	alice := &Client{id: "c1", userKey: "alice-secret-key", username: "Alice\n<root@host>"}
+	bob := &Client{id: "c2", userKey: "bob-secret-key", username: "Bob"}
+	w.mu.Lock()
+	w.members = map[*Client]bool{alice: true, bob: true}
+	w.mu.Unlock()
+
+	author, coAuthors := w.gitAuthors(alice)
+	if author.Email != authorKey("alice-secret-key")+"@users.example" || author.Name != "Aliceroot@host" {
+		t.Fatalf("author = %+v", author)
+	}
+	if len(coAuthors) != 1 || coAuthors[0].Email != authorKey("bob-secret-key")+"@users.example" {
+		t.Fatalf("co-authors = %+v", coAuthors)
+	}
+	for _, a := range append(coAuthors, author) {
+		if strings.Contains(a.String(), "secret") {
+			t.Fatalf("%s gives a user key away", a)
+		}
+	}
+}
@@ -2,26 +2,38 @@
 package editor
 
 import (
-	"encoding/json"
 	"log"
+	"sort"
+	"sync"
+	"time"
 )
 
-// Hub maintains active client connections and broadcasts messages
+// Sessions without local clients, started for edits forwarded by other nodes,
+// stop after being idle this long
+const headlessSessionIdle = 5 * time.Minute
+
+// Hub tracks connected clients and routes them to per-document sessions.
+// Document state and broadcasting live in each DocumentSession, so the hub
+// itself never sits on the hot path of a busy document.
 type Hub struct {
+	mu sync.RWMutex
+
 	// Registered clients
 	clients map[*Client]bool
 
-	// Inbound messages from clients
-	broadcast chan []byte
+	// Running document sessions keyed by document ID
+	sessions map[string]*DocumentSession
 
-	// Register requests from clients
-	register chan *Client
+	// Clients subscribed to each document. A session is stopped once its
+	// document has no members, unless it runs headless for other nodes.
+	members map[string]map[*Client]bool
 
-	// Unregister requests from clients
-	unregister chan *Client
+	// Reference to the service, used to load documents
+	service *Service
 
-	// Document-specific client tracking
-	documentClients map[string]map[*Client]bool
+	// Closed on shutdown to stop run
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 // Message represents different types of messages
@@ -36,331 +48,393 @@ type Message struct {
 }
 
 // NewHub creates a new Hub
-func NewHub() *Hub {
+func NewHub(service *Service) *Hub {
 	return &Hub{
-		broadcast:       make(chan []byte),
-		register:        make(chan *Client),
-		unregister:      make(chan *Client),
-		clients:         make(map[*Client]bool),
-		documentClients: make(map[string]map[*Client]bool),
+		clients:  make(map[*Client]bool),
+		sessions: make(map[string]*DocumentSession),
+		members:  make(map[string]map[*Client]bool),
+		service:  service,
+		stop:     make(chan struct{}),
 	}
 }
 
-// run starts the hub's main loop
+// run periodically stops idle headless sessions
 func (h *Hub) run() {
+	ticker := time.NewTicker(headlessSessionIdle / 5)
+	defer ticker.Stop()
+
 	for {
 		select {
-		case client := <-h.register:
-			h.handleRegister(client)
-
-		case client := <-h.unregister:
-			h.handleUnregister(client)
-
-		case message := <-h.broadcast:
-			h.handleBroadcast(message)
+		case <-ticker.C:
+			h.reapHeadlessSessions()
+		case <-h.stop:
+			return
 		}
 	}
 }
 
-// handleRegister handles client registration
-func (h *Hub) handleRegister(client *Client) {
+// Register adds a client, puts it in its workspace and joins it to the
+// document it connected with, if any
+func (h *Hub) Register(client *Client) {
 	log.Printf("[HUB] Registering client %s for document %s", client.id, client.documentID)
 
+	h.mu.Lock()
 	h.clients[client] = true
+	total := len(h.clients)
+	h.mu.Unlock()
 
+	if client.workspace != nil {
+		client.workspace.join(client)
+	}
 	if client.documentID != "" {
-		if h.documentClients[client.documentID] == nil {
-			h.documentClients[client.documentID] = make(map[*Client]bool)
-		}
-		h.documentClients[client.documentID][client] = true
-		log.Printf("[HUB] Document %s now has %d clients", client.documentID, len(h.documentClients[client.documentID]))
-
-		// List all clients in document
-		for c := range h.documentClients[client.documentID] {
-			log.Printf("[HUB]   - Client %s in document", c.id)
+		// A workspace client's color comes from the workspace's palette
+		if err := h.subscribe(client, client.documentID, client.workspace != nil); err != nil {
+			log.Printf("[HUB] Error loading document %s: %v", client.documentID, err)
+			h.Unregister(client)
+			return
 		}
 	}
 
-	log.Printf("Client %s connected. Total clients: %d", client.id, len(h.clients))
-
-	// THIS IS THE KEY PART - notify others
-	if client.documentID != "" {
-		h.notifyUserJoined(client)
-	}
+	log.Printf("Client %s connected. Total clients: %d", client.id, total)
 }
 
-// handleUnregister handles client disconnection
-func (h *Hub) handleUnregister(client *Client) {
-	if _, ok := h.clients[client]; ok {
-		delete(h.clients, client)
-		close(client.send)
-
-		// Remove from document-specific tracking
-		if client.documentID != "" && h.documentClients[client.documentID] != nil {
-			delete(h.documentClients[client.documentID], client)
-
-			// Clean up empty document entries
-			if len(h.documentClients[client.documentID]) == 0 {
-				delete(h.documentClients, client.documentID)
-			} else {
-				// IMPORTANT: Notify remaining users
-				h.notifyUserLeft(client)
-			}
-		}
+// Subscribe joins a registered client to another document's session,
+// starting the session if it is the document's first client
+func (h *Hub) Subscribe(client *Client, docID string) error {
+	return h.subscribe(client, docID, true)
+}
 
-		if client.service != nil {
-			doc, _ := client.service.GetDocument(client.documentID)
-			if doc != nil && doc.CursorManager != nil {
-				doc.CursorManager.RemoveClient(client.id)
-			}
-
-			// Send cursor_remove message to other clients
-			removeMsg := Message{
-				Type:       "cursor_remove",
-				ClientID:   client.id,
-				DocumentID: client.documentID,
-				Data: map[string]interface{}{
-					"clientId": client.id,
-				},
-			}
-
-			if data, err := json.Marshal(removeMsg); err == nil {
-				h.broadcastToDocument(client.documentID, data, client.id)
-			}
-		}
+// subscribe joins a client to a document's session. holdColor records the
+// client's color, assigned elsewhere, in the document's palette, giving the
+// client another color in the document if someone there already has it.
+func (h *Hub) subscribe(client *Client, docID string, holdColor bool) error {
+	doc, err := h.service.GetDocument(docID)
+	if err != nil {
+		return err
+	}
 
-		// Remove from service's document tracking
-		if client.service != nil {
-			client.service.RemoveClientFromDocument(client)
-		}
+	h.mu.Lock()
+	if !h.clients[client] || client.sessions[docID] != nil {
+		h.mu.Unlock()
+		return nil
+	}
+	session := h.startSession(doc)
+	if h.members[docID] == nil {
+		h.members[docID] = make(map[*Client]bool)
+	}
+	h.members[docID][client] = true
+	client.sessions[docID] = session
+	h.mu.Unlock()
 
-		log.Printf("Client %s disconnected. Total clients: %d", client.id, len(h.clients))
+	if holdColor {
+		_, color := client.profile()
+		client.setDocColor(docID, doc.Palette.Hold(client.userKey, color, doc.remoteColors(h.service.nodeID)))
 	}
+
+	// Queued outside the lock so a backed up session cannot stall other documents
+	session.post(joinEvent{client: client})
+	return nil
 }
 
-// handleBroadcast handles message broadcasting
-func (h *Hub) handleBroadcast(message []byte) {
-	var msg Message
-	if err := json.Unmarshal(message, &msg); err != nil {
-		log.Printf("Error unmarshaling message: %v", err)
+// Unsubscribe removes a client from one document's session, stopping the
+// session once empty
+func (h *Hub) Unsubscribe(client *Client, docID string) {
+	h.mu.Lock()
+	session := client.sessions[docID]
+	if session == nil {
+		h.mu.Unlock()
 		return
 	}
+	empty := h.leave(client, session)
+	h.mu.Unlock()
 
-	log.Printf("[HUB] Broadcasting message type: %s from client: %s", msg.Type, msg.ClientID)
-
-	// Route message based on type
-	switch msg.Type {
-	case "text_update":
-		// For text updates, broadcast to all others in the document
-		h.broadcastToDocument(msg.DocumentID, message, msg.ClientID)
-
-	case "cursor_position", "selection":
-		h.broadcastToDocument(msg.DocumentID, message, msg.ClientID)
-
-	case "typing_start", "typing_stop":
-		h.broadcastToDocument(msg.DocumentID, message, msg.ClientID)
-
-	default:
-		// Default: broadcast to document
-		if msg.DocumentID != "" {
-			h.broadcastToDocument(msg.DocumentID, message, msg.ClientID)
-		}
+	client.setDocColor(docID, "")
+	session.post(leaveEvent{client: client})
+	if empty {
+		session.post(stopEvent{})
 	}
 }
 
-// broadcastToDocument sends a message to all clients in a specific document
-func (h *Hub) broadcastToDocument(docID string, message []byte, excludeClientID string) {
-	clients := h.documentClients[docID]
-	if clients == nil {
-		log.Printf("[HUB] No clients for document %s", docID)
+// Unregister removes a client from all its sessions and its workspace,
+// stopping sessions once empty
+func (h *Hub) Unregister(client *Client) {
+	h.mu.Lock()
+	if !h.clients[client] {
+		h.mu.Unlock()
 		return
 	}
+	delete(h.clients, client)
 
-	sentCount := 0
-	for client := range clients {
-		if client.id != excludeClientID {
-			select {
-			case client.send <- message:
-				sentCount++
-				log.Printf("[HUB] Sent message to client %s", client.id)
-			default:
-				log.Printf("[HUB] Client %s buffer full, closing", client.id)
-				close(client.send)
-				delete(h.clients, client)
-				delete(clients, client)
-			}
+	sessions := make(map[*DocumentSession]bool, len(client.sessions))
+	for _, session := range client.sessions {
+		sessions[session] = h.leave(client, session)
+	}
+	total := len(h.clients)
+	h.mu.Unlock()
+
+	for session, empty := range sessions {
+		session.post(leaveEvent{client: client})
+		if empty {
+			session.post(stopEvent{})
 		}
 	}
+	if ws := client.workspace; ws != nil {
+		ws.leave(client)
+		ws.Palette.Release(client.userKey)
+	}
+	client.close()
+
+	h.service.metrics.mu.Lock()
+	h.service.metrics.ActiveConnections--
+	h.service.metrics.mu.Unlock()
 
-	log.Printf("[HUB] Broadcast complete: sent to %d clients", sentCount)
+	log.Printf("Client %s disconnected. Total clients: %d", client.id, total)
 }
 
-// broadcastToAll sends a message to all connected clients
-func (h *Hub) broadcastToAll(message []byte, excludeClientID string) {
-	for client := range h.clients {
-		if client.id != excludeClientID {
-			select {
-			case client.send <- message:
-			default:
-				close(client.send)
-				delete(h.clients, client)
-			}
-		}
+// leave drops a client's membership of a session and reports whether the
+// session is left without members, in which case it is forgotten.
+// Callers hold h.mu and stop an empty session.
+func (h *Hub) leave(client *Client, session *DocumentSession) bool {
+	delete(client.sessions, session.id)
+
+	members := h.members[session.id]
+	delete(members, client)
+	empty := len(members) == 0
+	if empty {
+		delete(h.members, session.id)
 	}
+	if empty && h.sessions[session.id] == session {
+		delete(h.sessions, session.id)
+
+		h.service.metrics.mu.Lock()
+		h.service.metrics.DocumentsActive--
+		h.service.metrics.mu.Unlock()
+	}
+	return empty
 }
 
-// notifyUserJoined notifies other users in a document that a new user joined
-func (h *Hub) notifyUserJoined(newClient *Client) {
-	log.Printf("[HUB] notifyUserJoined called for client %s", newClient.id)
+// closeDocument unsubscribes every local client from a document and stops
+// its session, for documents that no longer exist
+func (h *Hub) closeDocument(docID string) {
+	for _, client := range h.Members(docID) {
+		h.Unsubscribe(client, docID)
+	}
 
-	// Send join notification
-	notification := Message{
-		Type:       "user_joined",
-		ClientID:   newClient.id,
-		DocumentID: newClient.documentID,
-		Data: map[string]interface{}{
-			"userId":   newClient.id,
-			"username": newClient.username,
-			"color":    newClient.color,
-		},
+	// A headless session started for forwarded edits has no clients to leave
+	h.mu.Lock()
+	session := h.sessions[docID]
+	headless := session != nil && len(h.members[docID]) == 0
+	if headless {
+		delete(h.sessions, docID)
+
+		h.service.metrics.mu.Lock()
+		h.service.metrics.DocumentsActive--
+		h.service.metrics.mu.Unlock()
 	}
+	h.mu.Unlock()
 
-	data, err := json.Marshal(notification)
-	if err != nil {
-		log.Printf("Error marshaling join notification: %v", err)
-		return
+	if headless {
+		session.post(stopEvent{})
 	}
+}
 
-	// Broadcast to other users
-	h.broadcastToDocument(newClient.documentID, data, newClient.id)
+// Members returns the local clients subscribed to a document
+func (h *Hub) Members(docID string) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 
-	// CRITICAL: Send active users list to ALL users
-	h.sendActiveUsersToAll(newClient.documentID)
+	clients := make([]*Client, 0, len(h.members[docID]))
+	for client := range h.members[docID] {
+		clients = append(clients, client)
+	}
+	return clients
 }
 
-func (h *Hub) sendActiveUsersToAll(documentID string) {
-	log.Printf("[HUB] sendActiveUsersToAll called for document %s", documentID)
+// Subscriptions returns the IDs of the documents a client is subscribed to, sorted
+func (h *Hub) Subscriptions(client *Client) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 
-	users := []map[string]interface{}{}
-
-	if clients := h.documentClients[documentID]; clients != nil {
-		log.Printf("[HUB] Found %d clients in document", len(clients))
-		for c := range clients {
-			users = append(users, map[string]interface{}{
-				"userId":   c.id,
-				"username": c.username,
-				"color":    c.color,
-			})
-			log.Printf("[HUB]   Adding user %s to list", c.id)
-		}
+	docIDs := make([]string, 0, len(client.sessions))
+	for docID := range client.sessions {
+		docIDs = append(docIDs, docID)
 	}
+	sort.Strings(docIDs)
+	return docIDs
+}
 
-	message := Message{
-		Type:       "active_users",
-		DocumentID: documentID,
-		Data:       users,
-	}
+// clientSession returns the session of a document the client is subscribed to
+func (h *Hub) clientSession(client *Client, docID string) *DocumentSession {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 
-	data, err := json.Marshal(message)
-	if err != nil {
-		log.Printf("Error marshaling active users: %v", err)
-		return
+	return client.sessions[docID]
+}
+
+// clientSessions returns the sessions of every document the client is subscribed to
+func (h *Hub) clientSessions(client *Client) []*DocumentSession {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	sessions := make([]*DocumentSession, 0, len(client.sessions))
+	for _, session := range client.sessions {
+		sessions = append(sessions, session)
 	}
+	return sessions
+}
 
-	// Send to ALL clients
-	if clients := h.documentClients[documentID]; clients != nil {
-		for client := range clients {
-			select {
-			case client.send <- data:
-				log.Printf("[HUB] Sent active users list to client %s", client.id)
-			default:
-				log.Printf("[HUB] Failed to send to client %s (channel full)", client.id)
-			}
+// announceProfile tells the client's documents other than from about a
+// profile change made in from
+func (h *Hub) announceProfile(client *Client, from *DocumentSession) {
+	for _, session := range h.clientSessions(client) {
+		if session != from {
+			session.post(profileEvent{client: client})
 		}
 	}
 }
 
-// notifyUserLeft notifies other users in a document that a user left
-func (h *Hub) notifyUserLeft(leftClient *Client) {
-	notification := Message{
-		Type:       "user_left",
-		ClientID:   leftClient.id,
-		DocumentID: leftClient.documentID,
-		Data: map[string]interface{}{
-			"userId": leftClient.id,
-		},
+// startSession returns the document's running session, starting it if needed.
+// Callers hold h.mu.
+func (h *Hub) startSession(doc *Document) *DocumentSession {
+	session := h.sessions[doc.ID]
+	if session == nil {
+		session = newDocumentSession(doc, h.service)
+		h.sessions[doc.ID] = session
+		go session.run()
+
+		h.service.metrics.mu.Lock()
+		h.service.metrics.DocumentsActive++
+		h.service.metrics.mu.Unlock()
 	}
+	return session
+}
 
-	data, err := json.Marshal(notification)
+// ensureSession returns a document's session, starting one without local
+// clients if none runs, so this node can act as the document's owner
+func (h *Hub) ensureSession(docID string) (*DocumentSession, error) {
+	doc, err := h.service.GetDocument(docID)
 	if err != nil {
-		log.Printf("Error marshaling leave notification: %v", err)
-		return
+		return nil, err
 	}
 
-	// Broadcast to remaining users
-	h.broadcastToDocument(leftClient.documentID, data, leftClient.id)
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-	// Update active users list for remaining users
-	h.sendActiveUsersToAll(leftClient.documentID)
+	return h.startSession(doc), nil
 }
 
-// sendActiveUsers sends list of active users to a specific client (for initial connection)
-func (h *Hub) sendActiveUsers(client *Client) {
-	users := []map[string]interface{}{}
-
-	if clients := h.documentClients[client.documentID]; clients != nil {
-		for c := range clients {
-			// Include ALL users (the frontend will handle displaying "others")
-			users = append(users, map[string]interface{}{
-				"userId":   c.id,
-				"username": c.username,
-				"color":    c.color,
-			})
+// reapHeadlessSessions stops sessions that have no local clients and saw no events for a while
+func (h *Hub) reapHeadlessSessions() {
+	cutoff := time.Now().Add(-headlessSessionIdle).UnixNano()
+
+	h.mu.Lock()
+	var idle []*DocumentSession
+	for docID, session := range h.sessions {
+		if len(h.members[docID]) == 0 && session.lastEvent.Load() < cutoff {
+			delete(h.sessions, docID)
+			idle = append(idle, session)
 		}
 	}
+	h.mu.Unlock()
 
-	message := Message{
-		Type: "active_users",
-		Data: users,
+	for _, session := range idle {
+		session.post(stopEvent{})
+
+		h.service.metrics.mu.Lock()
+		h.service.metrics.DocumentsActive--
+		h.service.metrics.mu.Unlock()
 	}
+}
 
-	data, err := json.Marshal(message)
-	if err != nil {
-		log.Printf("Error marshaling active users: %v", err)
-		return
+// ownershipChanged tells every running session to re-check which node owns it
+func (h *Hub) ownershipChanged() {
+	h.mu.RLock()
+	sessions := make([]*DocumentSession, 0, len(h.sessions))
+	for _, session := range h.sessions {
+		sessions = append(sessions, session)
 	}
+	h.mu.RUnlock()
 
-	select {
-	case client.send <- data:
-		log.Printf("Sent initial active users list to client %s", client.id)
-	default:
-		// Client not ready to receive
+	for _, session := range sessions {
+		session.post(ownershipEvent{})
 	}
 }
 
+// session returns the running session for a document, if any
+func (h *Hub) session(docID string) *DocumentSession {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.sessions[docID]
+}
+
+// BroadcastToDocument routes a frame to every client in a document except one
+func (h *Hub) BroadcastToDocument(docID string, frame *Frame, excludeClientID string) {
+	session := h.session(docID)
+	if session == nil {
+		log.Printf("[HUB] No clients for document %s", docID)
+		return
+	}
+
+	session.Broadcast(frame, excludeClientID)
+}
+
+// ClientCount returns the number of registered clients
+func (h *Hub) ClientCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.clients)
+}
+
 // shutdown gracefully shuts down the hub
 func (h *Hub) shutdown() {
+	h.stopOnce.Do(func() { close(h.stop) })
+
+	h.mu.Lock()
+	clients := h.clients
+	sessions := h.sessions
+	h.clients = make(map[*Client]bool)
+	h.sessions = make(map[string]*DocumentSession)
+	h.members = make(map[string]map[*Client]bool)
+	h.mu.Unlock()
+
 	// Close all client connections
-	for client := range h.clients {
-		close(client.send)
-		client.conn.Close()
+	for client := range clients {
+		client.close()
+	}
+	for _, session := range sessions {
+		session.post(stopEvent{})
 	}
 
 	log.Println("Hub shutdown complete")
 }
 
+// QueueStats returns the outbound queue of every registered client
+func (h *Hub) QueueStats() map[string]QueueStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	stats := make(map[string]QueueStats, len(h.clients))
+	for client := range h.clients {
+		stats[client.id] = client.QueueStats()
+	}
+	return stats
+}
+
 // GetStats returns statistics about the hub
 func (h *Hub) GetStats() map[string]interface{} {
-	stats := map[string]interface{}{
-		"total_clients":    len(h.clients),
-		"total_documents":  len(h.documentClients),
-		"documents_detail": make(map[string]int),
-	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 
-	// Add per-document client counts
-	for docID, clients := range h.documentClients {
-		stats["documents_detail"].(map[string]int)[docID] = len(clients)
+	detail := make(map[string]int, len(h.sessions))
+	for docID := range h.sessions {
+		detail[docID] = len(h.members[docID])
 	}
 
-	return stats
+	return map[string]interface{}{
+		"total_clients":    len(h.clients),
+		"total_documents":  len(h.sessions),
+		"documents_detail": detail,
+	}
 }
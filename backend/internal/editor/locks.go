@@ -0,0 +1,265 @@
+// internal/editor/locks.go
+package editor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"collaborative-editor/pkg/ot"
+	"collaborative-editor/pkg/protocol"
+
+	"github.com/google/uuid"
+)
+
+// Lock errors
+var (
+	// ErrRegionLocked is returned for edits and locks overlapping another client's lock
+	ErrRegionLocked = errors.New("region is locked by another user")
+
+	ErrUnknownLock  = errors.New("no such region lock")
+	ErrNotLockOwner = errors.New("only the lock's owner can release it")
+)
+
+// Actions reported in lock_update
+const (
+	lockLocked   = "locked"
+	lockUnlocked = "unlocked"
+
+	// The owner disconnected, or the locked text was deleted
+	lockExpired = "expired"
+)
+
+// RegionLock reserves a range of the document for one client. Its bounds
+// move with edits; text typed right at either bound is outside the lock.
+type RegionLock struct {
+	ID        string    `json:"id"`
+	Start     int       `json:"start"`
+	End       int       `json:"end"`
+	OwnerID   string    `json:"ownerId"`
+	Owner     string    `json:"owner"`
+	Color     string    `json:"color"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// blocks reports whether an operation by another client touches the region
+func (l *RegionLock) blocks(op ot.Operation) bool {
+	if op.ClientID == l.OwnerID {
+		return false
+	}
+	switch op.Type {
+	case ot.OpInsert:
+		return op.Position > l.Start && op.Position < l.End
+	case ot.OpDelete:
+		return op.Position < l.End && op.Position+op.Length > l.Start
+	}
+	return false
+}
+
+func (l *RegionLock) anchor() Anchor          { return Anchor{ID: l.ID, Start: l.Start, End: l.End} }
+func (l *RegionLock) setRange(start, end int) { l.Start, l.End = start, end }
+func (l *RegionLock) created() time.Time      { return l.CreatedAt }
+func (l *RegionLock) clone() RegionLock       { return *l }
+
+// collapses is true: a lock whose text was deleted entirely expires
+func (l *RegionLock) collapses() bool { return true }
+
+// LockStore holds a document's region locks
+type LockStore struct {
+	rangeStore[RegionLock, *RegionLock]
+}
+
+// NewLockStore creates an empty lock store
+func NewLockStore() *LockStore {
+	return &LockStore{newRangeStore[RegionLock, *RegionLock]()}
+}
+
+// Lock reserves a range unless it overlaps another client's lock
+func (ls *LockStore) Lock(lock RegionLock) (RegionLock, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	for _, l := range ls.items {
+		if l.OwnerID != lock.OwnerID && lock.Start < l.End && lock.End > l.Start {
+			return RegionLock{}, fmt.Errorf("%w: %s holds [%d, %d)", ErrRegionLocked, l.Owner, l.Start, l.End)
+		}
+	}
+
+	lock.ID = uuid.New().String()[:8]
+	lock.CreatedAt = time.Now()
+	ls.items[lock.ID] = &lock
+	return lock, nil
+}
+
+// Unlock releases a lock held by ownerID
+func (ls *LockStore) Unlock(id, ownerID string) (RegionLock, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	l, ok := ls.items[id]
+	if !ok {
+		return RegionLock{}, ErrUnknownLock
+	}
+	if l.OwnerID != ownerID {
+		return RegionLock{}, ErrNotLockOwner
+	}
+	delete(ls.items, id)
+	return *l, nil
+}
+
+// ReleaseOwner releases every lock a client holds and returns them
+func (ls *LockStore) ReleaseOwner(ownerID string) []RegionLock {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	var released []RegionLock
+	for id, l := range ls.items {
+		if l.OwnerID == ownerID {
+			released = append(released, *l)
+			delete(ls.items, id)
+		}
+	}
+	return released
+}
+
+// Check refuses operations that touch a region locked by another client.
+// It is the document's OT guard.
+func (ls *LockStore) Check(op ot.Operation) error {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+
+	for _, l := range ls.items {
+		if l.blocks(op) {
+			return fmt.Errorf("%w: %s holds [%d, %d)", ErrRegionLocked, l.Owner, l.Start, l.End)
+		}
+	}
+	return nil
+}
+
+// handleLockRegion reserves a range for a client
+func (s *DocumentSession) handleLockRegion(client *Client, msg *protocol.LockRegion) {
+	owner, color := client.profileIn(s.id)
+
+	lock, err := s.doc.Locks.Lock(RegionLock{
+		Start:   msg.Data.Start,
+		End:     msg.Data.End,
+		OwnerID: client.id,
+		Owner:   owner,
+		Color:   color,
+	})
+	if err != nil {
+		s.sendErrorCode(client, err.Error(), "region_locked", "data.start")
+		return
+	}
+
+	log.Printf("[SESSION] Client %s locked [%d, %d) of %s", client.id, lock.Start, lock.End, s.id)
+	s.lockChanged(client.id, lockLocked, lock)
+}
+
+// handleUnlockRegion releases one of a client's locks
+func (s *DocumentSession) handleUnlockRegion(client *Client, msg *protocol.UnlockRegion) {
+	lock, err := s.doc.Locks.Unlock(msg.Data.LockID, client.id)
+	switch err {
+	case nil:
+	case ErrNotLockOwner:
+		s.sendErrorCode(client, err.Error(), "not_lock_owner", "data.lockId")
+		return
+	default:
+		s.sendErrorCode(client, err.Error(), "unknown_lock", "data.lockId")
+		return
+	}
+
+	log.Printf("[SESSION] Client %s unlocked [%d, %d) of %s", client.id, lock.Start, lock.End, s.id)
+	s.lockChanged(client.id, lockUnlocked, lock)
+}
+
+// releaseLocks expires the locks of a client that left this node
+func (s *DocumentSession) releaseLocks(clientID string) {
+	for _, lock := range s.doc.Locks.ReleaseOwner(clientID) {
+		log.Printf("[SESSION] Lock %s of %s on %s expired", lock.ID, clientID, s.id)
+		s.lockChanged(clientID, lockExpired, lock)
+	}
+}
+
+// rejectLockedEdit tells a client its edit touched a locked region and puts
+// its editor back to the document as it is
+func (s *DocumentSession) rejectLockedEdit(client *Client, err error) {
+	log.Printf("[SESSION] Refused edit from %s on %s: %v", client.id, s.id, err)
+	s.sendErrorCode(client, err.Error(), "region_locked", "content")
+	s.sendDocumentState(client)
+}
+
+// lockChanged sends a lock change to every client and to the other nodes
+func (s *DocumentSession) lockChanged(clientID, action string, lock RegionLock) {
+	msg := lockUpdate(s.id, clientID, action, lock)
+	s.broadcast(messageFrame(msg), "")
+	s.relay(msg)
+}
+
+// lockUpdate builds the message announcing a lock change
+func lockUpdate(docID, clientID, action string, lock RegionLock) Message {
+	return Message{
+		Type:       "lock_update",
+		ClientID:   clientID,
+		DocumentID: docID,
+		Data: map[string]interface{}{
+			"action": action,
+			"lock":   lock,
+		},
+	}
+}
+
+// applyRemoteLock mirrors a lock change made on another node
+func (s *DocumentSession) applyRemoteLock(msg *Message) {
+	var update struct {
+		Action string     `json:"action"`
+		Lock   RegionLock `json:"lock"`
+	}
+	if err := decodeData(msg.Data, &update); err != nil {
+		log.Printf("[SESSION] Bad lock update for %s: %v", s.id, err)
+		return
+	}
+
+	if update.Action == lockLocked {
+		s.doc.Locks.Put(update.Lock)
+	} else if !s.doc.Locks.Remove(update.Lock.ID) {
+		// Already expired here, e.g. through the same edit
+		return
+	}
+	s.broadcast(messageFrame(*msg), "")
+}
+
+// expireRemoteLocks drops the locks of a user that left another node
+func (s *DocumentSession) expireRemoteLocks(clientID string) {
+	for _, lock := range s.doc.Locks.ReleaseOwner(clientID) {
+		s.broadcast(messageFrame(lockUpdate(s.id, clientID, lockExpired, lock)), "")
+	}
+}
+
+// mergeLocks adds the locks of a peer's snapshot this node did not know
+func (s *DocumentSession) mergeLocks(locks []RegionLock) {
+	for _, lock := range s.doc.Locks.Merge(locks, false) {
+		s.broadcast(messageFrame(lockUpdate(s.id, lock.OwnerID, lockLocked, lock)), "")
+	}
+}
+
+// sendLockAnchors tells clients where edits moved the locks and which ones
+// expired because their text was deleted
+func (s *DocumentSession) sendLockAnchors() {
+	moved, expired := s.doc.Locks.TakeMoved()
+
+	for _, lock := range expired {
+		s.broadcast(messageFrame(lockUpdate(s.id, lock.OwnerID, lockExpired, lock)), "")
+	}
+
+	if moved {
+		s.broadcast(messageFrame(Message{
+			Type:       "lock_anchors",
+			DocumentID: s.id,
+			Data: map[string]interface{}{
+				"anchors": s.doc.Locks.Anchors(),
+			},
+		}), "")
+	}
+}
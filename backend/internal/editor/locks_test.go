@@ -0,0 +1,55 @@
+package editor
+
+import (
+	"testing"
+
+	"collaborative-editor/pkg/protocol"
+)
+
+func TestLockedRegionRefusesOtherUsersEdits(t *testing.T) {
+	s := NewService(&Config{})
+	if _, _, err := s.UpdateDocument("doc", "hello world", "c0", 0); err != nil {
+		t.Fatal(err)
+	}
+	alice := NewClient(s.hub, nil, s, "doc", "alice")
+	s.hub.Register(alice)
+	defer s.hub.Unregister(alice)
+	bob := NewClient(s.hub, nil, s, "doc", "bob")
+	s.hub.Register(bob)
+	defer s.hub.Unregister(bob)
+	session := s.hub.session("doc")
+	sync := func() {
+		reply := make(chan DocumentMetadata)
+		session.post(metadataEvent{reply: reply})
+		<-reply
+	}
+
+	if _, err := session.doc.Locks.Lock(RegionLock{Start: 0, End: 5, OwnerID: alice.id}); err != nil {
+		t.Fatal(err)
+	}
+	for bob.outbox.pop() != nil {
+	}
+
+	// Bob's edit inside Alice's lock is refused and he is told why
+	session.Deliver(bob, "text_update", &protocol.TextUpdate{Content: "heXllo world", Version: 1})
+	sync()
+	if content, _ := session.doc.OTManager.GetDocument(); content != "hello world" {
+		t.Fatalf("document is %q after bob's edit, want it unchanged", content)
+	}
+	refused := false
+	for f := bob.outbox.pop(); f != nil; f = bob.outbox.pop() {
+		refused = refused || f.Type == "error"
+	}
+	if !refused {
+		t.Error("bob got no error for his refused edit")
+	}
+
+	// Alice edits her own lock, Bob outside it
+	session.Deliver(alice, "text_update", &protocol.TextUpdate{Content: "helXlo world", Version: 1})
+	sync()
+	session.Deliver(bob, "text_update", &protocol.TextUpdate{Content: "helXlo world!", Version: 2})
+	sync()
+	if content, _ := session.doc.OTManager.GetDocument(); content != "helXlo world!" {
+		t.Fatalf("document is %q, want %q", content, "helXlo world!")
+	}
+}
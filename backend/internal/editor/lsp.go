@@ -0,0 +1,873 @@
+// internal/editor/lsp.go
+package editor
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"collaborative-editor/internal/lsp"
+	"collaborative-editor/pkg/ot"
+	"collaborative-editor/pkg/protocol"
+)
+
+const (
+	// How long a completion, hover or definition request may take
+	lspRequestTimeout = 10 * time.Second
+
+	// Wait before restarting a language server that exited
+	lspRestartDelay = 2 * time.Second
+
+	// Completions sent to a client at most
+	maxCompletionItems = 200
+)
+
+// ErrNoLanguageServer is returned for documents no language server handles
+var ErrNoLanguageServer = errors.New("no language server handles this document")
+
+// Severities as clients see them
+var diagnosticSeverities = map[int]string{
+	lsp.SeverityError:       "error",
+	lsp.SeverityWarning:     "warning",
+	lsp.SeverityInformation: "information",
+	lsp.SeverityHint:        "hint",
+}
+
+// languageServers bridges workspace files to the language servers
+// configured for them: one server per workspace and language, started when
+// the first of its files is opened and stopped when the last one closes.
+// Files are open in a server while their document's session runs here, so
+// each node runs servers for its own clients and publishes diagnostics to
+// them; the server sees the rest of the workspace on disk.
+type languageServers struct {
+	service *Service
+	configs []lsp.ServerConfig
+
+	mu sync.Mutex
+
+	// Running servers by workspace ID and language
+	servers map[string]*workspaceServer
+
+	// Documents open in a server, by ID
+	documents map[string]*lspDocument
+
+	// Documents whose edits are observed; observers are never removed
+	observed map[*Document]bool
+}
+
+// workspaceServer is a language server running for one workspace
+type workspaceServer struct {
+	key       string
+	workspace *Workspace
+	config    lsp.ServerConfig
+
+	// Temporary folder holding the workspace's files
+	root string
+
+	// Closed once the server started or failed to
+	ready  chan struct{}
+	server *lsp.Server
+	err    error
+
+	// Documents using the server, guarded by languageServers.mu
+	users int
+
+	// Set when the server is stopped on purpose rather than crashing
+	stopping atomic.Bool
+
+	// Serializes rewriting the files on disk
+	diskMu sync.Mutex
+}
+
+// lspDocument is a workspace document open in a language server
+type lspDocument struct {
+	id     string
+	fileID string
+	doc    *Document
+
+	// Session the document is open for; a session replacing a stopping one
+	// takes the document over, so the old one's close leaves it open.
+	// Guarded by languageServers.mu.
+	session *DocumentSession
+
+	// Operations applied to the document and not yet sent to the server
+	pendingMu sync.Mutex
+	pending   []ot.Operation
+
+	// Serializes what is sent to the server about the document
+	syncMu sync.Mutex
+
+	mu          sync.Mutex
+	server      *workspaceServer
+	uri         string
+	text        string
+	version     int
+	diagnostics []map[string]interface{}
+	closed      bool
+	err         error
+
+	// Signals the document's goroutine to send edits, reopen or close
+	wake chan struct{}
+}
+
+// newLanguageServers creates the bridge to the configured servers
+func newLanguageServers(service *Service, configs []lsp.ServerConfig) *languageServers {
+	return &languageServers{
+		service:   service,
+		configs:   configs,
+		servers:   make(map[string]*workspaceServer),
+		documents: make(map[string]*lspDocument),
+		observed:  make(map[*Document]bool),
+	}
+}
+
+// configFor returns the server configured for a file name
+func (b *languageServers) configFor(name string) (lsp.ServerConfig, bool) {
+	for _, cfg := range b.configs {
+		if cfg.Handles(name) {
+			return cfg, true
+		}
+	}
+	return lsp.ServerConfig{}, false
+}
+
+// open opens a session's workspace file in the server for its language,
+// if one is configured. It returns at once; the server starts in the background.
+func (b *languageServers) open(session *DocumentSession) {
+	doc := session.doc
+	if len(b.configs) == 0 {
+		return
+	}
+	wsID, fileID, ok := strings.Cut(doc.ID, ":")
+	if !ok {
+		return
+	}
+	ws := b.service.workspace(wsID)
+	if ws == nil {
+		return
+	}
+	file, ok := ws.File(fileID)
+	if !ok {
+		return
+	}
+	cfg, ok := b.configFor(file.Name)
+	if !ok {
+		return
+	}
+
+	b.mu.Lock()
+	if d := b.documents[doc.ID]; d != nil {
+		d.session = session
+		b.mu.Unlock()
+		return
+	}
+	d := &lspDocument{id: doc.ID, fileID: fileID, doc: doc, session: session, wake: make(chan struct{}, 1)}
+	b.documents[doc.ID] = d
+	observe := !b.observed[doc]
+	b.observed[doc] = true
+	b.mu.Unlock()
+
+	if observe {
+		id := doc.ID
+		doc.OTManager.Observe(func(op ot.Operation) { b.changed(id, op) })
+	}
+	go b.serve(d, ws, cfg)
+}
+
+// close closes a session's document in its server once the session stops,
+// unless a newer session of the document took it over
+func (b *languageServers) close(session *DocumentSession) {
+	b.mu.Lock()
+	d := b.documents[session.id]
+	if d == nil || d.session != session {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.documents, session.id)
+	b.mu.Unlock()
+
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+	d.signal()
+}
+
+// changed queues an edit of an open document for its server. It runs on
+// the editing goroutine, so it only queues.
+func (b *languageServers) changed(docID string, op ot.Operation) {
+	b.mu.Lock()
+	d := b.documents[docID]
+	b.mu.Unlock()
+
+	if d == nil {
+		return
+	}
+	d.pendingMu.Lock()
+	d.pending = append(d.pending, op)
+	d.pendingMu.Unlock()
+	d.signal()
+}
+
+// workspaceChanged rewrites a workspace's files on disk for its servers
+// and reopens documents whose path changed
+func (b *languageServers) workspaceChanged(ws *Workspace) {
+	b.mu.Lock()
+	var servers []*workspaceServer
+	for _, srv := range b.servers {
+		if srv.workspace == ws {
+			servers = append(servers, srv)
+		}
+	}
+	var documents []*lspDocument
+	for _, d := range b.documents {
+		if strings.HasPrefix(d.id, ws.ID+":") {
+			documents = append(documents, d)
+		}
+	}
+	b.mu.Unlock()
+
+	if len(servers) == 0 {
+		return
+	}
+	go func() {
+		for _, srv := range servers {
+			<-srv.ready
+			if srv.server != nil {
+				srv.writeFiles()
+			}
+		}
+		for _, d := range documents {
+			d.signal()
+		}
+	}()
+}
+
+// serve keeps a document open in its server until the document closes,
+// restarting the server if it exits
+func (b *languageServers) serve(d *lspDocument, ws *Workspace, cfg lsp.ServerConfig) {
+	for {
+		srv, err := b.acquire(ws, cfg)
+		if err != nil {
+			log.Printf("[LSP] No %s language server for %s: %v", cfg.Language, d.id, err)
+			d.mu.Lock()
+			d.err = err
+			d.mu.Unlock()
+			return
+		}
+
+		if err := d.attach(srv); err != nil {
+			log.Printf("[LSP] Error opening %s in the %s language server: %v", d.id, cfg.Language, err)
+		}
+		crashed := d.follow(srv)
+
+		if !crashed {
+			d.detach(srv, b.service)
+		}
+		b.release(srv)
+		if !crashed {
+			return
+		}
+
+		log.Printf("[LSP] The %s language server of %s exited, restarting", cfg.Language, ws.ID)
+		time.Sleep(lspRestartDelay)
+		if d.isClosed() {
+			return
+		}
+	}
+}
+
+// acquire returns the running server of a workspace and language, starting it if needed
+func (b *languageServers) acquire(ws *Workspace, cfg lsp.ServerConfig) (*workspaceServer, error) {
+	key := ws.ID + "/" + cfg.Language
+
+	b.mu.Lock()
+	srv := b.servers[key]
+	if srv == nil {
+		srv = &workspaceServer{key: key, workspace: ws, config: cfg, ready: make(chan struct{})}
+		b.servers[key] = srv
+		go b.launch(srv)
+	}
+	srv.users++
+	b.mu.Unlock()
+
+	<-srv.ready
+	if srv.server == nil {
+		b.release(srv)
+		return nil, srv.err
+	}
+	return srv, nil
+}
+
+// launch starts a server in a fresh folder holding the workspace's files
+func (b *languageServers) launch(srv *workspaceServer) {
+	defer close(srv.ready)
+
+	root, err := os.MkdirTemp("", "collab-lsp-*")
+	if err == nil {
+		srv.root = root
+		srv.writeFiles()
+		srv.server, err = lsp.Start(srv.config, root, func(p lsp.PublishDiagnosticsParams) {
+			b.publishDiagnostics(srv, p)
+		})
+	}
+	if err != nil {
+		srv.err = err
+		b.forget(srv)
+		if root != "" {
+			os.RemoveAll(root)
+		}
+		return
+	}
+
+	go func() {
+		<-srv.server.Done()
+		b.forget(srv)
+		if !srv.stopping.Load() {
+			log.Printf("[LSP] The %s language server of %s exited unexpectedly", srv.config.Language, srv.workspace.ID)
+		}
+	}()
+}
+
+// forget stops handing out a server that exited or failed to start
+func (b *languageServers) forget(srv *workspaceServer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.servers[srv.key] == srv {
+		delete(b.servers, srv.key)
+	}
+}
+
+// release drops a document's use of a server, stopping it after the last one
+func (b *languageServers) release(srv *workspaceServer) {
+	b.mu.Lock()
+	srv.users--
+	idle := srv.users == 0
+	if idle && b.servers[srv.key] == srv {
+		delete(b.servers, srv.key)
+	}
+	b.mu.Unlock()
+
+	if !idle || srv.server == nil {
+		return
+	}
+	srv.stopping.Store(true)
+	srv.server.Close()
+
+	srv.diskMu.Lock()
+	os.RemoveAll(srv.root)
+	srv.diskMu.Unlock()
+}
+
+// writeFiles replaces the server's folder with the workspace's files as
+// this node has them
+func (srv *workspaceServer) writeFiles() {
+	srv.diskMu.Lock()
+	defer srv.diskMu.Unlock()
+
+	if srv.stopping.Load() {
+		return
+	}
+	entries, _ := os.ReadDir(srv.root)
+	for _, e := range entries {
+		os.RemoveAll(filepath.Join(srv.root, e.Name()))
+	}
+
+	srv.workspace.writeFiles(srv.root)
+}
+
+// writeFile saves one document's content in the server's folder
+func (srv *workspaceServer) writeFile(uri, content string) {
+	path, ok := lsp.URIPath(uri)
+	if !ok {
+		return
+	}
+
+	srv.diskMu.Lock()
+	defer srv.diskMu.Unlock()
+
+	if srv.stopping.Load() {
+		return
+	}
+	os.MkdirAll(filepath.Dir(path), 0o755)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		log.Printf("[LSP] Error writing %s: %v", path, err)
+	}
+}
+
+// uri returns the URI of a workspace file in the server's folder
+func (srv *workspaceServer) uri(fileID string) (string, bool) {
+	path, ok := srv.workspace.Paths()[fileID]
+	if !ok {
+		return "", false
+	}
+	return lsp.FileURI(filepath.Join(srv.root, filepath.FromSlash(path))), true
+}
+
+// signal wakes the document's goroutine
+func (d *lspDocument) signal() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// isClosed reports whether the document's session stopped
+func (d *lspDocument) isClosed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.closed
+}
+
+// attach opens the document in a server with its current content
+func (d *lspDocument) attach(srv *workspaceServer) error {
+	d.syncMu.Lock()
+	defer d.syncMu.Unlock()
+
+	// Edits queued so far are part of the content sent
+	d.pendingMu.Lock()
+	d.pending = nil
+	d.pendingMu.Unlock()
+
+	uri, ok := srv.uri(d.fileID)
+	if !ok {
+		return ErrUnknownFile
+	}
+	content, _ := d.doc.OTManager.GetDocument()
+
+	d.mu.Lock()
+	d.server = srv
+	d.uri = uri
+	d.text = content
+	d.version = 1
+	d.err = nil
+	d.mu.Unlock()
+
+	log.Printf("[LSP] Opened %s in the %s language server as %s", d.id, srv.config.Language, uri)
+	return srv.server.DidOpen(uri, 1, content)
+}
+
+// detach closes the document in its server, leaving its content on disk
+// where the server can still see it
+func (d *lspDocument) detach(srv *workspaceServer, service *Service) {
+	d.syncMu.Lock()
+	defer d.syncMu.Unlock()
+
+	d.mu.Lock()
+	uri := d.uri
+	d.server = nil
+	d.mu.Unlock()
+
+	content, _ := d.doc.OTManager.GetDocument()
+	if _, ok := service.loadedDocument(d.id); ok {
+		srv.writeFile(uri, content)
+	}
+	srv.server.DidClose(uri)
+}
+
+// follow sends the document's edits to the server until the document
+// closes, reporting true if the server exited first
+func (d *lspDocument) follow(srv *workspaceServer) bool {
+	for {
+		select {
+		case <-d.wake:
+			if d.isClosed() {
+				return false
+			}
+			if err := d.sync(); err != nil {
+				log.Printf("[LSP] Error syncing %s: %v", d.id, err)
+			}
+		case <-srv.server.Done():
+			return true
+		}
+	}
+}
+
+// sync sends the server the edits made since the last sync, as ranges if it
+// takes them. If the text it has no longer matches the document, which can
+// happen when edits land while the document is being opened, it is sent
+// the whole text instead. A file moved in the workspace is reopened under
+// its new path.
+func (d *lspDocument) sync() error {
+	d.syncMu.Lock()
+	defer d.syncMu.Unlock()
+
+	d.pendingMu.Lock()
+	ops := d.pending
+	d.pending = nil
+	d.pendingMu.Unlock()
+
+	d.mu.Lock()
+	srv, uri := d.server, d.uri
+	d.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+
+	// Looked up without d.mu, which is taken under the workspace's lock
+	if moved, ok := srv.uri(d.fileID); ok && moved != uri {
+		d.mu.Lock()
+		d.uri = moved
+		text, version := d.text, d.version
+		d.mu.Unlock()
+
+		log.Printf("[LSP] %s moved to %s", d.id, moved)
+		srv.server.DidClose(uri)
+		if err := srv.server.DidOpen(moved, version, text); err != nil {
+			return err
+		}
+		uri = moved
+	}
+
+	current, _ := d.doc.OTManager.GetDocument()
+
+	d.mu.Lock()
+	text := d.text
+	changes := make([]lsp.ContentChange, 0, len(ops))
+	for _, op := range ops {
+		next, change, ok := applyChange(text, op)
+		if !ok {
+			break
+		}
+		text = next
+		changes = append(changes, change)
+	}
+	if text != current || (len(changes) > 0 && !srv.server.Incremental()) {
+		text = current
+		changes = []lsp.ContentChange{{Text: current}}
+	}
+	if len(changes) == 0 {
+		d.mu.Unlock()
+		return nil
+	}
+	d.text = text
+	d.version++
+	version := d.version
+	d.mu.Unlock()
+
+	return srv.server.DidChange(uri, version, changes)
+}
+
+// applyChange applies an operation to a server's copy of a document and
+// returns the change that makes the same edit. It reports false if the
+// operation does not fit the text.
+func applyChange(text string, op ot.Operation) (string, lsp.ContentChange, bool) {
+	switch op.Type {
+	case ot.OpInsert:
+		if op.Position < 0 || op.Position > len(text) {
+			return text, lsp.ContentChange{}, false
+		}
+		at := lsp.PositionAt(text, op.Position)
+		change := lsp.ContentChange{Range: &lsp.Range{Start: at, End: at}, Text: op.Content}
+		return text[:op.Position] + op.Content + text[op.Position:], change, true
+
+	case ot.OpDelete:
+		end := op.Position + op.Length
+		if op.Position < 0 || end > len(text) {
+			return text, lsp.ContentChange{}, false
+		}
+		r := lsp.Range{Start: lsp.PositionAt(text, op.Position), End: lsp.PositionAt(text, end)}
+		return text[:op.Position] + text[end:], lsp.ContentChange{Range: &r}, true
+	}
+	return text, lsp.ContentChange{}, false
+}
+
+// document returns an open document with its edits sent to the server, and
+// the server, URI and text they were sent as
+func (b *languageServers) document(docID string) (*lspDocument, *workspaceServer, string, string, error) {
+	b.mu.Lock()
+	d := b.documents[docID]
+	b.mu.Unlock()
+
+	if d == nil {
+		return nil, nil, "", "", ErrNoLanguageServer
+	}
+	if err := d.sync(); err != nil {
+		return nil, nil, "", "", err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.server == nil {
+		if d.err != nil {
+			return nil, nil, "", "", d.err
+		}
+		return nil, nil, "", "", errors.New("the language server is starting")
+	}
+	return d, d.server, d.uri, d.text, nil
+}
+
+// completion returns the suggestions at an offset of a document
+func (b *languageServers) completion(ctx context.Context, docID string, offset int) (map[string]interface{}, error) {
+	_, srv, uri, text, err := b.document(docID)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := srv.server.Completion(ctx, uri, lsp.PositionAt(text, offset))
+	if err != nil {
+		return nil, err
+	}
+
+	// The word being typed is replaced unless an item says otherwise
+	from := offset
+	for from > 0 && isWordByte(text[from-1]) {
+		from--
+	}
+
+	items := make([]map[string]interface{}, 0, len(list.Items))
+	for _, item := range list.Items {
+		if len(items) == maxCompletionItems {
+			list.IsIncomplete = true
+			break
+		}
+		insert, start, end := item.InsertText, from, offset
+		if insert == "" {
+			insert = item.Label
+		}
+		if item.TextEdit != nil {
+			insert = item.TextEdit.NewText
+			start = lsp.OffsetAt(text, item.TextEdit.Range.Start)
+			end = lsp.OffsetAt(text, item.TextEdit.Range.End)
+		}
+		entry := map[string]interface{}{
+			"label":      item.Label,
+			"insertText": insert,
+			"from":       start,
+			"to":         end,
+		}
+		if item.Kind > 0 {
+			entry["kind"] = item.Kind
+		}
+		if item.Detail != "" {
+			entry["detail"] = item.Detail
+		}
+		if doc := lsp.MarkupText(item.Documentation); doc != "" {
+			entry["documentation"] = doc
+		}
+		items = append(items, entry)
+	}
+
+	return map[string]interface{}{
+		"items":        items,
+		"isIncomplete": list.IsIncomplete,
+	}, nil
+}
+
+// hover returns what the server knows about the symbol at an offset
+func (b *languageServers) hover(ctx context.Context, docID string, offset int) (map[string]interface{}, error) {
+	_, srv, uri, text, err := b.document(docID)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := srv.server.Hover(ctx, uri, lsp.PositionAt(text, offset))
+	if err != nil || h == nil {
+		return map[string]interface{}{"contents": ""}, err
+	}
+
+	data := map[string]interface{}{"contents": h.Contents}
+	if h.Range != nil {
+		data["from"] = lsp.OffsetAt(text, h.Range.Start)
+		data["to"] = lsp.OffsetAt(text, h.Range.End)
+	}
+	return data, nil
+}
+
+// definition returns where the symbol at an offset is defined. Locations in
+// the workspace name their file; others, such as a standard library, only
+// their URI.
+func (b *languageServers) definition(ctx context.Context, docID string, offset int) (map[string]interface{}, error) {
+	_, srv, uri, text, err := b.document(docID)
+	if err != nil {
+		return nil, err
+	}
+
+	locations, err := srv.server.Definition(ctx, uri, lsp.PositionAt(text, offset))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]string)
+	for id, path := range srv.workspace.Paths() {
+		files[path] = id
+	}
+
+	results := make([]map[string]interface{}, 0, len(locations))
+	for _, loc := range locations {
+		entry := map[string]interface{}{
+			"uri":       loc.URI,
+			"line":      loc.Range.Start.Line,
+			"character": loc.Range.Start.Character,
+		}
+		path, ok := lsp.URIPath(loc.URI)
+		rel, err := filepath.Rel(srv.root, path)
+		if ok && err == nil && !strings.HasPrefix(rel, "..") {
+			rel = filepath.ToSlash(rel)
+			entry["path"] = rel
+			if fileID, ok := files[rel]; ok {
+				target := fileDocumentID(srv.workspace.ID, fileID)
+				entry["fileId"] = fileID
+				entry["documentId"] = target
+				if content, ok := b.text(target); ok {
+					entry["from"] = lsp.OffsetAt(content, loc.Range.Start)
+					entry["to"] = lsp.OffsetAt(content, loc.Range.End)
+				}
+			}
+		}
+		results = append(results, entry)
+	}
+
+	return map[string]interface{}{"locations": results}, nil
+}
+
+// text returns a document's text as its server has it, or its content
+// if it is not open
+func (b *languageServers) text(docID string) (string, bool) {
+	b.mu.Lock()
+	d := b.documents[docID]
+	b.mu.Unlock()
+
+	if d != nil {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.text, true
+	}
+	if doc, ok := b.service.loadedDocument(docID); ok {
+		content, _ := doc.OTManager.GetDocument()
+		return content, true
+	}
+	return "", false
+}
+
+// publishDiagnostics sends a file's diagnostics to the document's clients
+// on this node and keeps them for clients joining later
+func (b *languageServers) publishDiagnostics(srv *workspaceServer, p lsp.PublishDiagnosticsParams) {
+	b.mu.Lock()
+	var d *lspDocument
+	for _, candidate := range b.documents {
+		candidate.mu.Lock()
+		match := candidate.server == srv && candidate.uri == p.URI
+		candidate.mu.Unlock()
+		if match {
+			d = candidate
+			break
+		}
+	}
+	b.mu.Unlock()
+
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	diagnostics := make([]map[string]interface{}, 0, len(p.Diagnostics))
+	for _, diag := range p.Diagnostics {
+		entry := map[string]interface{}{
+			"from":      lsp.OffsetAt(d.text, diag.Range.Start),
+			"to":        lsp.OffsetAt(d.text, diag.Range.End),
+			"line":      diag.Range.Start.Line,
+			"character": diag.Range.Start.Character,
+			"severity":  diagnosticSeverities[diag.Severity],
+			"message":   diag.Message,
+		}
+		if entry["severity"] == "" {
+			entry["severity"] = "error"
+		}
+		if diag.Source != "" {
+			entry["source"] = diag.Source
+		}
+		if code := strings.Trim(string(diag.Code), `"`); code != "" {
+			entry["code"] = code
+		}
+		diagnostics = append(diagnostics, entry)
+	}
+	d.diagnostics = diagnostics
+	d.mu.Unlock()
+
+	if session := b.service.hub.session(d.id); session != nil {
+		session.Broadcast(messageFrame(diagnosticsMessage(d.id, diagnostics)), "")
+	}
+}
+
+// diagnosticsMessage reports a document's current diagnostics
+func diagnosticsMessage(docID string, diagnostics []map[string]interface{}) Message {
+	return Message{
+		Type:       "diagnostics",
+		DocumentID: docID,
+		Data: map[string]interface{}{
+			"documentId":  docID,
+			"diagnostics": diagnostics,
+		},
+	}
+}
+
+// diagnostics returns the last diagnostics of an open document
+func (b *languageServers) diagnostics(docID string) ([]map[string]interface{}, bool) {
+	b.mu.Lock()
+	d := b.documents[docID]
+	b.mu.Unlock()
+
+	if d == nil {
+		return nil, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.diagnostics, d.diagnostics != nil
+}
+
+// isWordByte reports whether a byte can be part of an identifier
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// handleCodeIntelligence answers a completion, hover or definition request
+// off the session's goroutine, since the language server may take a while
+func (s *DocumentSession) handleCodeIntelligence(client *Client, msgType string, pos protocol.CodePosition) {
+	query := s.service.lsp.completion
+	switch msgType {
+	case "hover":
+		query = s.service.lsp.hover
+	case "definition":
+		query = s.service.lsp.definition
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), lspRequestTimeout)
+		defer cancel()
+
+		data, err := query(ctx, s.id, pos.Offset)
+		if err != nil {
+			code := "language_server_error"
+			if errors.Is(err, ErrNoLanguageServer) {
+				code = "no_language_server"
+			}
+			client.queue(messageFrame(errorMessage(s.id, err.Error(), code, "type")))
+			return
+		}
+
+		data["requestId"] = pos.RequestID
+		data["offset"] = pos.Offset
+		client.queue(messageFrame(Message{
+			Type:       msgType + "_result",
+			DocumentID: s.id,
+			Data:       data,
+		}))
+	}()
+}
+
+// sendDiagnostics sends a joining client the document's diagnostics
+func (s *DocumentSession) sendDiagnostics(client *Client) {
+	if diagnostics, ok := s.service.lsp.diagnostics(s.id); ok {
+		client.queue(messageFrame(diagnosticsMessage(s.id, diagnostics)))
+	}
+}
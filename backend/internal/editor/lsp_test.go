@@ -0,0 +1,81 @@
+package editor
+
+import (
+	"testing"
+	"time"
+
+	"collaborative-editor/internal/lsp"
+)
+
+// lspSession returns the session a document is open in its language server for
+func lspSession(s *Service, docID string) (*lspDocument, *DocumentSession) {
+	s.lsp.mu.Lock()
+	defer s.lsp.mu.Unlock()
+
+	d := s.lsp.documents[docID]
+	if d == nil {
+		return nil, nil
+	}
+	return d, d.session
+}
+
+// waitStopped waits for a session's event loop to end
+func waitStopped(t *testing.T, session *DocumentSession) {
+	t.Helper()
+	select {
+	case <-session.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session %s never stopped", session.id)
+	}
+}
+
+func TestStoppingSessionLeavesNewerSessionsDocumentOpen(t *testing.T) {
+	// The server cannot start; the document is still tracked as open
+	svc, url := startTestService(t, &Config{LanguageServers: []lsp.ServerConfig{
+		{Language: "plaintext", Extensions: []string{".txt"}, Command: []string{"/nonexistent/language-server"}},
+	}})
+	file, err := svc.GetWorkspace("w1").Create("test", kindFile, "notes.txt", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	docID := file.DocumentID
+
+	alice := dialTest(t, url+"?doc="+docID)
+	readUntil(t, alice, "document_state")
+	old := svc.hub.session(docID)
+	if d, session := lspSession(svc, docID); d == nil || session != old {
+		t.Fatal("the first join did not open the document")
+	}
+
+	// Hold the old session up so that it stops only after the next one started
+	held := make(chan DocumentMetadata)
+	old.post(metadataEvent{reply: held})
+	alice.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for svc.hub.session(docID) == old {
+		if time.Now().After(deadline) {
+			t.Fatal("the hub never forgot the old session")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	bob := dialTest(t, url+"?doc="+docID)
+	readUntil(t, bob, "document_state")
+	rejoined := svc.hub.session(docID)
+	if rejoined == nil || rejoined == old {
+		t.Fatal("bob did not get a new session")
+	}
+
+	<-held
+	waitStopped(t, old)
+	d, session := lspSession(svc, docID)
+	if d == nil || session != rejoined || d.isClosed() {
+		t.Fatal("the stopping session closed its successor's document")
+	}
+
+	bob.Close()
+	waitStopped(t, rejoined)
+	if d, _ := lspSession(svc, docID); d != nil {
+		t.Fatal("the document stayed open after its session stopped")
+	}
+}
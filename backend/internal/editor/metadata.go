@@ -0,0 +1,310 @@
+// internal/editor/metadata.go
+package editor
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"collaborative-editor/internal/language"
+	"collaborative-editor/pkg/protocol"
+)
+
+// Metadata a document has until someone sets it
+const (
+	defaultTabWidth = 4
+	defaultEncoding = "utf-8"
+)
+
+// Line ending styles
+const (
+	lineEndingsLF   = "lf"
+	lineEndingsCRLF = "crlf"
+)
+
+// DocumentMetadata describes a document for editors and tools. Language and
+// LineEndings are detected from the document unless someone set them.
+type DocumentMetadata struct {
+	Language    string   `json:"language"`
+	TabWidth    int      `json:"tabWidth"`
+	LineEndings string   `json:"lineEndings"`
+	Encoding    string   `json:"encoding"`
+	Owner       string   `json:"owner"`
+	Tags        []string `json:"tags"`
+	Description string   `json:"description"`
+
+	// The fields that were detected rather than set
+	Detected []string `json:"detected,omitempty"`
+
+	UpdatedAt time.Time `json:"updatedAt,omitzero"`
+	UpdatedBy string    `json:"updatedBy,omitempty"`
+}
+
+// MetadataStore holds the metadata set on a document, where empty fields
+// mean the default or detected value, along with what was detected
+type MetadataStore struct {
+	mu  sync.RWMutex
+	set DocumentMetadata
+
+	language    string
+	lineEndings string
+}
+
+// NewMetadataStore creates a store with nothing set or detected yet
+func NewMetadataStore() *MetadataStore {
+	return &MetadataStore{language: language.Plaintext, lineEndings: lineEndingsLF}
+}
+
+// Get returns the document's metadata, with defaults and detected values
+// filling what was not set
+func (ms *MetadataStore) Get() DocumentMetadata {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	m := ms.set
+	m.Tags = append([]string{}, m.Tags...)
+	m.Detected = nil
+	if m.Language == "" {
+		m.Language = ms.language
+		m.Detected = append(m.Detected, "language")
+	}
+	if m.LineEndings == "" {
+		m.LineEndings = ms.lineEndings
+		m.Detected = append(m.Detected, "lineEndings")
+	}
+	if m.TabWidth == 0 {
+		m.TabWidth = defaultTabWidth
+	}
+	if m.Encoding == "" {
+		m.Encoding = defaultEncoding
+	}
+	return m
+}
+
+// Settings returns only what was set, as it is persisted and relayed
+func (ms *MetadataStore) Settings() DocumentMetadata {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	m := ms.set
+	m.Tags = append([]string(nil), m.Tags...)
+	return m
+}
+
+// Language returns the document's language, set or detected
+func (ms *MetadataStore) Language() string {
+	return ms.Get().Language
+}
+
+// Set applies a change made by a user
+func (ms *MetadataStore) Set(change protocol.MetadataChange, by string) DocumentMetadata {
+	ms.mu.Lock()
+	m := &ms.set
+	if change.Language != nil {
+		m.Language = *change.Language
+	}
+	if change.TabWidth != nil {
+		m.TabWidth = *change.TabWidth
+	}
+	if change.LineEndings != nil {
+		m.LineEndings = *change.LineEndings
+	}
+	if change.Encoding != nil {
+		m.Encoding = *change.Encoding
+	}
+	if change.Owner != nil {
+		m.Owner = strings.TrimSpace(*change.Owner)
+	}
+	if change.Tags != nil {
+		m.Tags = normalizeTags(change.Tags)
+	}
+	if change.Description != nil {
+		m.Description = strings.TrimSpace(*change.Description)
+	}
+	m.UpdatedAt = time.Now()
+	m.UpdatedBy = by
+	ms.mu.Unlock()
+
+	return ms.Get()
+}
+
+// Merge adopts metadata set on another node if it is newer, and reports
+// whether it was
+func (ms *MetadataStore) Merge(settings DocumentMetadata) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if !settings.UpdatedAt.After(ms.set.UpdatedAt) {
+		return false
+	}
+	settings.Detected = nil
+	ms.set = settings
+	return true
+}
+
+// Detect recognizes the language and line endings of the document's current
+// name and content, and reports whether that changed its metadata
+func (ms *MetadataStore) Detect(name, content string) bool {
+	lang := language.Detect(name, content)
+	endings := lineEndingsLF
+	if strings.Contains(content, "\r\n") {
+		endings = lineEndingsCRLF
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	changed := (ms.set.Language == "" && lang != ms.language) ||
+		(ms.set.LineEndings == "" && endings != ms.lineEndings)
+	ms.language, ms.lineEndings = lang, endings
+	return changed
+}
+
+// MarshalJSON persists what was set; the rest is detected again on load
+func (ms *MetadataStore) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ms.Settings())
+}
+
+// UnmarshalJSON restores persisted metadata
+func (ms *MetadataStore) UnmarshalJSON(data []byte) error {
+	var settings DocumentMetadata
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	settings.Detected = nil
+	ms.set = settings
+	if ms.language == "" {
+		ms.language, ms.lineEndings = language.Plaintext, lineEndingsLF
+	}
+	return nil
+}
+
+// normalizeTags trims tags and drops empty and repeated ones
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool, len(tags))
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		seen[strings.ToLower(tag)] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// metadataEvent is a metadata change made through the REST API
+type metadataEvent struct {
+	change protocol.MetadataChange
+	reply  chan DocumentMetadata
+}
+
+// handleSetMetadata changes the document's metadata for a client
+func (s *DocumentSession) handleSetMetadata(client *Client, msg *protocol.SetMetadata) {
+	username, _ := client.profile()
+	s.setMetadata(client.id, username, msg.Data)
+}
+
+// setMetadata applies a metadata change and sends it to everyone in the
+// document, on every node
+func (s *DocumentSession) setMetadata(clientID, by string, change protocol.MetadataChange) DocumentMetadata {
+	metadata := s.doc.Metadata.Set(change, by)
+	log.Printf("[SESSION] Client %s changed the metadata of %s (language %s)", clientID, s.id, metadata.Language)
+
+	s.sendMetadata(clientID)
+	s.relay(Message{
+		Type:       "metadata_update",
+		ClientID:   clientID,
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"settings": s.doc.Metadata.Settings(),
+		},
+	})
+	return metadata
+}
+
+// sendMetadata sends every local client the document's metadata
+func (s *DocumentSession) sendMetadata(clientID string) {
+	s.broadcast(messageFrame(Message{
+		Type:       "metadata_update",
+		ClientID:   clientID,
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"metadata": s.doc.Metadata.Get(),
+		},
+	}), "")
+}
+
+// detectMetadata detects the document's language and line endings again,
+// telling local clients if they changed. Every node detects them the same
+// way, so the result is not relayed.
+func (s *DocumentSession) detectMetadata() {
+	content, _ := s.doc.OTManager.GetDocument()
+	if s.doc.Metadata.Detect(s.service.documentName(s.id), content) {
+		s.sendMetadata("")
+	}
+}
+
+// applyRemoteMetadata adopts metadata set on another node
+func (s *DocumentSession) applyRemoteMetadata(msg *Message) {
+	var update struct {
+		Settings DocumentMetadata `json:"settings"`
+	}
+	if err := decodeData(msg.Data, &update); err != nil {
+		log.Printf("[SESSION] Bad metadata update for %s: %v", s.id, err)
+		return
+	}
+	if s.doc.Metadata.Merge(update.Settings) {
+		s.sendMetadata(msg.ClientID)
+	}
+}
+
+// mergeMetadata adopts the metadata of a peer's snapshot if it is newer
+func (s *DocumentSession) mergeMetadata(settings *DocumentMetadata) {
+	if settings != nil && s.doc.Metadata.Merge(*settings) {
+		s.sendMetadata("")
+	}
+}
+
+// metadataOf returns a document's metadata for the REST API
+func (s *Service) metadataOf(docID string) (DocumentMetadata, error) {
+	doc, err := s.GetDocument(docID)
+	if err != nil {
+		return DocumentMetadata{}, err
+	}
+
+	// A running session keeps what it detected current and tells its
+	// clients when it changes
+	if s.hub.session(docID) == nil {
+		content, _ := doc.OTManager.GetDocument()
+		doc.Metadata.Detect(s.documentName(docID), content)
+	}
+	return doc.Metadata.Get(), nil
+}
+
+// setMetadataOf changes a document's metadata for the REST API
+func (s *Service) setMetadataOf(docID string, change protocol.MetadataChange) (DocumentMetadata, error) {
+	session, err := s.hub.ensureSession(docID)
+	if err != nil {
+		return DocumentMetadata{}, err
+	}
+
+	reply := make(chan DocumentMetadata, 1)
+	if !session.post(metadataEvent{change: change, reply: reply}) {
+		return DocumentMetadata{}, errors.New("document session stopped")
+	}
+	select {
+	case metadata := <-reply:
+		return metadata, nil
+	case <-session.done:
+		return DocumentMetadata{}, errors.New("document session stopped")
+	}
+}
@@ -14,6 +14,13 @@ type OTManager struct {
 	pendingOps  []ot.Operation
 	lastContent string
 	documentID  string
+
+	// Called with every applied operation, after the lock is released
+	observers []func(ot.Operation)
+
+	// Vetoes client operations before they are applied, e.g. edits inside
+	// another client's locked region
+	guard func(ot.Operation) error
 }
 
 // NewOTManager creates a new OT manager
@@ -27,6 +34,15 @@ func NewOTManager(documentID string) *OTManager {
 
 // ProcessTextUpdate processes a text update using OT
 func (m *OTManager) ProcessTextUpdate(clientID string, newContent string, clientVersion int) (string, int, error) {
+	content, version, op, err := m.processTextUpdate(clientID, newContent, clientVersion)
+	if err == nil {
+		m.notify(op)
+	}
+	return content, version, err
+}
+
+// processTextUpdate applies a text update under the lock and returns the applied operation
+func (m *OTManager) processTextUpdate(clientID string, newContent string, clientVersion int) (string, int, ot.Operation, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -43,17 +59,106 @@ func (m *OTManager) ProcessTextUpdate(clientID string, newContent string, client
 		op = m.document.TransformAgainstHistory(op)
 	}
 
+	if m.guard != nil && op.Type != ot.OpRetain {
+		if err := m.guard(op); err != nil {
+			log.Printf("[OT Manager] Rejected operation from %s: %v", clientID, err)
+			return m.document.Content, m.document.Version, op, err
+		}
+	}
+
 	// Apply the operation
 	if err := m.document.Apply(op); err != nil {
 		log.Printf("[OT Manager] Error applying operation: %v", err)
-		return m.document.Content, m.document.Version, err
+		return m.document.Content, m.document.Version, op, err
 	}
 
 	m.lastContent = m.document.Content
 	log.Printf("[OT Manager] Document updated to version %d, content length: %d",
 		m.document.Version, len(m.document.Content))
 
-	return m.document.Content, m.document.Version, nil
+	return m.document.Content, m.document.Version, op, nil
+}
+
+// Edit applies the operations build derives from the current content as one
+// atomic change: nothing lands between reading the content and applying
+// them, every operation must pass the guard, and the version goes up once.
+// build returns the operations in the order they apply, each on the content
+// left by the previous ones; returning none leaves the document unchanged.
+func (m *OTManager) Edit(clientID string, build func(content string) ([]ot.Operation, error)) (string, int, error) {
+	content, version, ops, err := m.edit(clientID, build)
+	if err == nil {
+		for _, op := range ops {
+			m.notify(op)
+		}
+	}
+	return content, version, err
+}
+
+// edit builds and applies an atomic change under the lock and returns its operations
+func (m *OTManager) edit(clientID string, build func(content string) ([]ot.Operation, error)) (string, int, []ot.Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ops, err := build(m.document.Content)
+	if err != nil || len(ops) == 0 {
+		return m.document.Content, m.document.Version, nil, err
+	}
+
+	for i := range ops {
+		ops[i].ClientID = clientID
+		ops[i].Version = m.document.Version
+		if m.guard != nil {
+			if err := m.guard(ops[i]); err != nil {
+				log.Printf("[OT Manager] Rejected edit from %s: %v", clientID, err)
+				return m.document.Content, m.document.Version, nil, err
+			}
+		}
+	}
+
+	if err := m.document.ApplyAll(ops); err != nil {
+		log.Printf("[OT Manager] Error applying edit: %v", err)
+		return m.document.Content, m.document.Version, nil, err
+	}
+
+	m.lastContent = m.document.Content
+	log.Printf("[OT Manager] Edit of %d operations from %s, document updated to version %d",
+		len(ops), clientID, m.document.Version)
+
+	return m.document.Content, m.document.Version, ops, nil
+}
+
+// Observe registers a function called with every operation applied to the
+// document, including the changes of content adopted through Reset. It runs
+// on the goroutine that changed the document, outside the manager's lock.
+func (m *OTManager) Observe(fn func(ot.Operation)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.observers = append(m.observers, fn)
+}
+
+// SetGuard installs a check every client operation must pass before it is
+// applied. It runs under the manager's lock, so it must not call back into it.
+func (m *OTManager) SetGuard(fn func(ot.Operation) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.guard = fn
+}
+
+// notify passes an applied operation to the observers; callers must not hold m.mu
+func (m *OTManager) notify(op ot.Operation) {
+	if op.Type == ot.OpRetain {
+		return
+	}
+
+	m.mu.RLock()
+	observers := m.observers
+	m.mu.RUnlock()
+
+	for _, fn := range observers {
+		fn(op)
+	}
 }
 
 // GetDocument returns the current document state
@@ -63,3 +168,18 @@ func (m *OTManager) GetDocument() (string, int) {
 
 	return m.document.Content, m.document.Version
 }
+
+// Reset replaces the document state with an authoritative copy, such as one
+// received from another editor-service instance
+func (m *OTManager) Reset(content string, version int) {
+	m.mu.Lock()
+	// Observers see the change as the operation it amounts to
+	op := ot.GenerateOperation(m.lastContent, content, 0, "")
+	m.document.Content = content
+	m.document.Version = version
+	m.lastContent = content
+	m.mu.Unlock()
+
+	log.Printf("[OT Manager] Document reset to version %d, content length: %d", version, len(content))
+	m.notify(op)
+}
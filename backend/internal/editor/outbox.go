@@ -0,0 +1,287 @@
+// internal/editor/outbox.go
+package editor
+
+import (
+	"sync"
+)
+
+// QueuePolicy bounds what a slow client may accumulate before the server
+// starts shedding its messages
+type QueuePolicy struct {
+	// Frames queued before cursor, typing and presence updates are dropped
+	// and, as a last resort, the client is disconnected
+	MaxQueue int
+
+	// Edits of one document queued before they are discarded in favour of a
+	// single document_state resync of that document
+	MaxPendingEdits int
+}
+
+// DefaultQueuePolicy is used for zero fields of Config.Queue
+var DefaultQueuePolicy = QueuePolicy{
+	MaxQueue:        256,
+	MaxPendingEdits: 64,
+}
+
+// withDefaults fills unset limits from DefaultQueuePolicy
+func (p QueuePolicy) withDefaults() QueuePolicy {
+	if p.MaxQueue <= 0 {
+		p.MaxQueue = DefaultQueuePolicy.MaxQueue
+	}
+	if p.MaxPendingEdits <= 0 {
+		p.MaxPendingEdits = DefaultQueuePolicy.MaxPendingEdits
+	}
+	return p
+}
+
+// frameClass decides what may happen to a queued frame under backpressure
+type frameClass int
+
+const (
+	// Delivered in order; the client is disconnected if it cannot keep up
+	classReliable frameClass = iota
+
+	// Text updates, replaced by a document_state resync when too far behind
+	classEdit
+
+	// document_state, which supersedes queued edits and older states
+	classState
+
+	// Cursor, selection and typing updates; only the latest per user matters
+	classEphemeral
+
+	// Presence lists and the anchors of comments, suggestions and locks;
+	// only the latest matters
+	classPresence
+)
+
+// classify returns a frame's class and, for coalescable frames, the key of
+// the frames it supersedes. Keys are scoped to the frame's document.
+func classify(f *Frame) (frameClass, string) {
+	doc := f.documentID + "/"
+	switch f.Type {
+	case "text_update":
+		return classEdit, ""
+	case "document_state":
+		return classState, ""
+	case "cursor_position":
+		return classEphemeral, doc + "cursor:" + f.clientID
+	case "selection_change":
+		return classEphemeral, doc + "selection:" + f.clientID
+	case "typing_start", "typing_stop":
+		return classEphemeral, doc + "typing:" + f.clientID
+	case "active_users", "presence_state", "comment_anchors", "suggestion_anchors", "lock_anchors":
+		return classPresence, doc + f.Type
+	case "presence_update":
+		return classPresence, doc + "presence:" + f.clientID
+	default:
+		return classReliable, ""
+	}
+}
+
+// queueResult reports what happened to a pushed frame
+type queueResult int
+
+const (
+	queueAccepted  queueResult = iota // Appended to the queue
+	queueCoalesced                    // Replaced a superseded frame
+	queueDropped                      // Discarded, a newer one will follow
+	queueResync                       // Edits discarded, the client needs a document_state
+	queueClosed                       // The client is closed or hopelessly behind
+)
+
+// outbox is a client's bounded outbound queue.
+// Pushes never block; the write pump is woken through ready.
+type outbox struct {
+	policy QueuePolicy
+
+	mu     sync.Mutex
+	frames []*Frame
+	urgent []*Frame
+	edits  map[string]int // Queued text updates per document
+	stats  QueueStats
+
+	// Signalled when frames become available
+	ready chan struct{}
+}
+
+// QueueStats describes a client's outbound queue
+type QueueStats struct {
+	Depth     int   `json:"depth"`
+	Coalesced int64 `json:"coalesced"`
+	Dropped   int64 `json:"dropped"`
+	Resyncs   int64 `json:"resyncs"`
+}
+
+func newOutbox(policy QueuePolicy) *outbox {
+	return &outbox{
+		policy: policy.withDefaults(),
+		edits:  make(map[string]int),
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// push queues a frame according to the policy
+func (o *outbox) push(f *Frame) queueResult {
+	class, key := classify(f)
+
+	o.mu.Lock()
+	var result queueResult
+	if f.urgent {
+		result = o.pushUrgent(f)
+	} else {
+		result = o.pushLocked(f, class, key)
+	}
+	o.mu.Unlock()
+
+	if result == queueAccepted || result == queueCoalesced {
+		select {
+		case o.ready <- struct{}{}:
+		default:
+		}
+	}
+	return result
+}
+
+func (o *outbox) pushLocked(f *Frame, class frameClass, key string) queueResult {
+	switch class {
+	case classEphemeral, classPresence:
+		superseded := func(q *Frame) bool {
+			_, k := classify(q)
+			return k == key
+		}
+		if o.remove(superseded) > 0 {
+			o.stats.Coalesced++
+			o.frames = append(o.frames, f)
+			return queueCoalesced
+		}
+		if len(o.frames) >= o.policy.MaxQueue {
+			o.stats.Dropped++
+			return queueDropped
+		}
+
+	case classEdit:
+		if o.edits[f.documentID] >= o.policy.MaxPendingEdits || len(o.frames) >= o.policy.MaxQueue {
+			o.stats.Dropped += int64(o.removeEdits(f.documentID))
+			o.stats.Resyncs++
+			return queueResync
+		}
+		o.edits[f.documentID]++
+
+	case classState:
+		o.removeEdits(f.documentID)
+		o.remove(func(q *Frame) bool { return q.Type == "document_state" && q.documentID == f.documentID })
+		if len(o.frames) >= o.policy.MaxQueue && !o.shed() {
+			return queueClosed
+		}
+
+	default:
+		if len(o.frames) >= o.policy.MaxQueue && !o.shed() {
+			return queueClosed
+		}
+	}
+
+	o.frames = append(o.frames, f)
+	return queueAccepted
+}
+
+// pushUrgent queues a frame ahead of the normal queue, replacing an older
+// urgent frame of the same type about the same user in the same document
+func (o *outbox) pushUrgent(f *Frame) queueResult {
+	for i, q := range o.urgent {
+		if q.Type == f.Type && q.clientID == f.clientID && q.documentID == f.documentID {
+			copy(o.urgent[i:], o.urgent[i+1:])
+			o.urgent[len(o.urgent)-1] = f
+			o.stats.Coalesced++
+			return queueCoalesced
+		}
+	}
+
+	if len(o.urgent) >= o.policy.MaxQueue {
+		o.stats.Dropped++
+		return queueDropped
+	}
+	o.urgent = append(o.urgent, f)
+	return queueAccepted
+}
+
+// pop takes the oldest urgent frame, else the oldest queued frame, or nil if
+// the queue is empty
+func (o *outbox) pop() *Frame {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.urgent) > 0 {
+		f := o.urgent[0]
+		o.urgent[0] = nil
+		o.urgent = o.urgent[1:]
+		return f
+	}
+
+	if len(o.frames) == 0 {
+		return nil
+	}
+
+	f := o.frames[0]
+	o.frames[0] = nil
+	o.frames = o.frames[1:]
+	if f.Type == "text_update" {
+		o.countEdits(f.documentID, -1)
+	}
+	return f
+}
+
+// Stats returns the queue's current depth and counters
+func (o *outbox) Stats() QueueStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	stats := o.stats
+	stats.Depth = len(o.frames) + len(o.urgent)
+	return stats
+}
+
+// shed drops queued ephemeral and presence frames to make room, reporting
+// whether the queue is below its limit afterwards
+func (o *outbox) shed() bool {
+	dropped := o.remove(func(q *Frame) bool {
+		class, _ := classify(q)
+		return class == classEphemeral || class == classPresence
+	})
+	o.stats.Dropped += int64(dropped)
+
+	return len(o.frames) < o.policy.MaxQueue
+}
+
+// removeEdits drops the queued text updates of a document
+func (o *outbox) removeEdits(docID string) int {
+	n := o.remove(func(q *Frame) bool { return q.Type == "text_update" && q.documentID == docID })
+	o.countEdits(docID, -n)
+	return n
+}
+
+// countEdits changes a document's count of queued text updates
+func (o *outbox) countEdits(docID string, delta int) {
+	if n := o.edits[docID] + delta; n > 0 {
+		o.edits[docID] = n
+	} else {
+		delete(o.edits, docID)
+	}
+}
+
+// remove drops queued frames matching fn, keeping the order of the rest
+func (o *outbox) remove(fn func(*Frame) bool) int {
+	kept := o.frames[:0]
+	for _, q := range o.frames {
+		if !fn(q) {
+			kept = append(kept, q)
+		}
+	}
+
+	removed := len(o.frames) - len(kept)
+	for i := len(kept); i < len(o.frames); i++ {
+		o.frames[i] = nil
+	}
+	o.frames = kept
+	return removed
+}
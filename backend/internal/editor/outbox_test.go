@@ -0,0 +1,108 @@
+package editor
+
+import "testing"
+
+func editFrame(docID string, version int) *Frame {
+	return messageFrame(Message{Type: "text_update", DocumentID: docID, Version: version})
+}
+
+// popAll empties an outbox, returning the frames in order
+func popAll(o *outbox) []*Frame {
+	var frames []*Frame
+	for f := o.pop(); f != nil; f = o.pop() {
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+func TestOutboxResyncsOnlyTheDocumentTooFarBehind(t *testing.T) {
+	o := newOutbox(QueuePolicy{MaxQueue: 100, MaxPendingEdits: 3})
+
+	for v := 1; v <= 3; v++ {
+		if result := o.push(editFrame("busy", v)); result != queueAccepted {
+			t.Fatalf("edit %d of busy: %v", v, result)
+		}
+	}
+	if result := o.push(editFrame("quiet", 1)); result != queueAccepted {
+		t.Fatalf("an edit of another document was refused: %v", result)
+	}
+
+	// The busy document's fourth edit exceeds its own limit
+	if result := o.push(editFrame("busy", 4)); result != queueResync {
+		t.Fatalf("busy's edit over the limit: %v, want a resync", result)
+	}
+
+	frames := popAll(o)
+	if len(frames) != 1 || frames[0].documentID != "quiet" {
+		t.Fatalf("queue kept %d frames, want only quiet's edit", len(frames))
+	}
+	if stats := o.Stats(); stats.Resyncs != 1 || stats.Dropped != 3 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	// Both documents start from an empty count again
+	for v := 1; v <= 3; v++ {
+		if result := o.push(editFrame("busy", v)); result != queueAccepted {
+			t.Fatalf("edit %d of busy after the resync: %v", v, result)
+		}
+	}
+}
+
+func TestOutboxCountsEditsAsTheyAreSent(t *testing.T) {
+	o := newOutbox(QueuePolicy{MaxQueue: 100, MaxPendingEdits: 2})
+
+	o.push(editFrame("doc", 1))
+	o.push(editFrame("doc", 2))
+	if f := o.pop(); f == nil || f.Type != "text_update" {
+		t.Fatal("nothing to pop")
+	}
+	if result := o.push(editFrame("doc", 3)); result != queueAccepted {
+		t.Fatalf("edit after one was sent: %v", result)
+	}
+	if len(o.edits) != 1 || o.edits["doc"] != 2 {
+		t.Fatalf("edits = %v", o.edits)
+	}
+
+	popAll(o)
+	if len(o.edits) != 0 {
+		t.Fatalf("edits = %v after emptying the queue", o.edits)
+	}
+}
+
+func TestOutboxDocumentStateSupersedesEdits(t *testing.T) {
+	o := newOutbox(QueuePolicy{MaxQueue: 100, MaxPendingEdits: 10})
+
+	o.push(editFrame("a", 1))
+	o.push(editFrame("b", 1))
+	o.push(editFrame("a", 2))
+	o.push(messageFrame(Message{Type: "document_state", DocumentID: "a"}))
+
+	frames := popAll(o)
+	if len(frames) != 2 || frames[0].documentID != "b" || frames[1].Type != "document_state" {
+		t.Fatalf("queue held %d frames, want b's edit then a's state", len(frames))
+	}
+	if len(o.edits) != 0 {
+		t.Fatalf("edits = %v", o.edits)
+	}
+}
+
+func TestOutboxCoalescesEphemeralFramesPerDocument(t *testing.T) {
+	o := newOutbox(QueuePolicy{MaxQueue: 100, MaxPendingEdits: 10})
+	cursor := func(docID string, position int) *Frame {
+		return messageFrame(Message{Type: "cursor_position", ClientID: "c1", DocumentID: docID, Data: position})
+	}
+
+	o.push(cursor("a", 1))
+	o.push(cursor("b", 1))
+	if result := o.push(cursor("a", 2)); result != queueCoalesced {
+		t.Fatalf("second cursor in a: %v, want coalesced", result)
+	}
+
+	frames := popAll(o)
+	if len(frames) != 2 || frames[0].documentID != "b" || frames[1].documentID != "a" {
+		t.Fatalf("queue held %d frames", len(frames))
+	}
+	if msg := frames[1].payload.(*Message); msg.Data != 2 {
+		t.Fatalf("kept cursor %v, want the latest", msg.Data)
+	}
+}
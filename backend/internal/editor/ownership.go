@@ -0,0 +1,231 @@
+// internal/editor/ownership.go
+package editor
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	"collaborative-editor/pkg/protocol"
+)
+
+// Envelope kind sent to the node owning a document
+const relayForward = "forward"
+
+// forwardedEdit is a text update from a client on a non-owner node. It carries
+// the forwarding node's last known state so an owner that has no session for
+// the document yet, or just took it over, starts from the same base.
+type forwardedEdit struct {
+	ClientID    string `json:"clientId"`
+	Content     string `json:"content"`
+	Version     int    `json:"version"`
+	BaseContent string `json:"baseContent"`
+	BaseVersion int    `json:"baseVersion"`
+
+	// A replace_all the owner runs on its own copy, instead of Content
+	Replace *protocol.ReplaceQuery `json:"replace,omitempty"`
+
+	// A formatter's output the owner fits to its own copy, instead of Content
+	Format *formatPatch `json:"format,omitempty"`
+
+	// Content checked out from git the owner's copy turns into, instead of Content
+	Reload *string `json:"reload,omitempty"`
+}
+
+// ownershipEvent tells a session that the cluster's ownership changed
+type ownershipEvent struct{}
+
+// nodeTopic is the backplane topic a node receives forwarded edits on
+func nodeTopic(node string) string {
+	return "node:" + node
+}
+
+// owner returns the node owning a document; every document is local without a cluster
+func (s *Service) owner(docID string) string {
+	if s.membership == nil {
+		return s.nodeID
+	}
+	return s.membership.Owner(docID)
+}
+
+// isOwner reports whether this node is the OT authority for a document
+func (s *Service) isOwner(docID string) bool {
+	return s.owner(docID) == s.nodeID
+}
+
+// subscribeNode starts receiving edits forwarded to this node
+func (s *Service) subscribeNode() error {
+	sub, err := s.backplane.Subscribe(nodeTopic(s.nodeID), func(payload []byte) {
+		if payload == nil {
+			// The forwarding nodes catch up with the edits that were applied
+			log.Printf("[CLUSTER] Forwarded edits were dropped")
+			return
+		}
+
+		var env relayEnvelope
+		if err := json.Unmarshal(payload, &env); err != nil {
+			log.Printf("[CLUSTER] Bad forwarded message: %v", err)
+			return
+		}
+		if env.Kind != relayForward || env.Forward == nil {
+			return
+		}
+
+		session, err := s.hub.ensureSession(env.DocumentID)
+		if err != nil {
+			log.Printf("[CLUSTER] Error loading document %s: %v", env.DocumentID, err)
+			return
+		}
+		session.post(remoteEvent{envelope: env})
+	})
+	if err != nil {
+		return err
+	}
+
+	s.nodeSubscription = sub
+	return nil
+}
+
+// forwardTextUpdate sends an edit made on this node to the document's owner
+func (s *DocumentSession) forwardTextUpdate(clientID, owner string, content string, version int) error {
+	return s.forward(owner, &forwardedEdit{
+		ClientID: clientID,
+		Content:  content,
+		Version:  version,
+	})
+}
+
+// forwardReplace sends a replace_all made on this node to the document's owner
+func (s *DocumentSession) forwardReplace(clientID, owner string, q protocol.ReplaceQuery) error {
+	return s.forward(owner, &forwardedEdit{
+		ClientID: clientID,
+		Replace:  &q,
+	})
+}
+
+// forward sends an edit to the document's owner along with this node's state
+func (s *DocumentSession) forward(owner string, edit *forwardedEdit) error {
+	edit.BaseContent, edit.BaseVersion = s.doc.OTManager.GetDocument()
+
+	env := relayEnvelope{
+		Kind:       relayForward,
+		Origin:     s.service.nodeID,
+		DocumentID: s.id,
+		Forward:    edit,
+	}
+
+	payload, err := json.Marshal(env)
+	if err != nil {
+		log.Printf("[SESSION] Error marshaling forwarded edit: %v", err)
+		return err
+	}
+
+	if err := s.service.backplane.Publish(nodeTopic(owner), payload); err != nil {
+		log.Printf("[SESSION] Error forwarding edit to %s: %v", owner, err)
+		return err
+	}
+
+	log.Printf("[SESSION] Forwarded edit from %s for doc %s to owner %s", edit.ClientID, s.id, owner)
+	return nil
+}
+
+// applyForwarded applies an edit forwarded by another node. The result reaches
+// the forwarding node's clients through the document relay like any local edit.
+func (s *DocumentSession) applyForwarded(origin string, edit *forwardedEdit) {
+	if !s.service.isOwner(s.id) {
+		// Nodes briefly disagree while membership changes; the sender picked us, so apply
+		log.Printf("[SESSION] Applying edit for %s forwarded by %s although owner is %s",
+			s.id, origin, s.service.owner(s.id))
+	}
+
+	if _, localVersion := s.doc.OTManager.GetDocument(); edit.BaseVersion > localVersion {
+		s.adoptContent(edit.BaseContent, edit.BaseVersion)
+		for c := range s.clients {
+			s.sendDocumentState(c)
+		}
+	}
+
+	if edit.Replace != nil {
+		re, err := compileSearch(edit.Replace.Search())
+		if err == nil {
+			_, err = s.applyReplace(edit.ClientID, re, *edit.Replace)
+		}
+		if errors.Is(err, ErrRegionLocked) {
+			s.rejectForwarded(edit.ClientID, err)
+		} else if err != nil {
+			log.Printf("[SESSION] Error applying replace forwarded by %s: %v", origin, err)
+		}
+		return
+	}
+
+	if edit.Format != nil {
+		_, err := s.applyFormat(edit.ClientID, edit.Format.Base, edit.Format.Formatted)
+		if errors.Is(err, ErrRegionLocked) {
+			s.rejectForwarded(edit.ClientID, err)
+		} else if err != nil {
+			log.Printf("[SESSION] Error applying format forwarded by %s: %v", origin, err)
+		}
+		return
+	}
+
+	if edit.Reload != nil {
+		_, err := s.applyReload(edit.ClientID, *edit.Reload)
+		if errors.Is(err, ErrRegionLocked) {
+			s.rejectForwarded(edit.ClientID, err)
+		} else if err != nil {
+			log.Printf("[SESSION] Error applying checkout forwarded by %s: %v", origin, err)
+		}
+		return
+	}
+
+	newContent, newVersion, err := s.updateText(edit.ClientID, edit.Content, edit.Version)
+	if errors.Is(err, ErrRegionLocked) {
+		s.rejectForwarded(edit.ClientID, err)
+		return
+	}
+	if err != nil {
+		log.Printf("[SESSION] Error applying edit forwarded by %s: %v", origin, err)
+		return
+	}
+
+	msg := Message{
+		Type:       "text_update",
+		Content:    newContent,
+		ClientID:   edit.ClientID,
+		DocumentID: s.id,
+		Version:    newVersion,
+	}
+	s.broadcast(messageFrame(msg), "")
+	s.relay(msg)
+	s.afterEdit()
+}
+
+// rejectForwarded tells a client on the forwarding node its edit was
+// refused; that node passes it on
+func (s *DocumentSession) rejectForwarded(clientID string, err error) {
+	s.relay(Message{
+		Type:       "edit_rejected",
+		ClientID:   clientID,
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"message": err.Error(),
+		},
+	})
+}
+
+// handleOwnershipChange publishes this node's state when it takes over a
+// document, so every node continues from the new owner's version
+func (s *DocumentSession) handleOwnershipChange() {
+	owner := s.service.isOwner(s.id)
+	if owner == s.owner {
+		return
+	}
+	s.owner = owner
+
+	if owner {
+		log.Printf("[SESSION] Node %s took over document %s", s.service.nodeID, s.id)
+		s.publish(relayEnvelope{Kind: relaySnapshot, Snapshot: s.snapshot()})
+	} else {
+		log.Printf("[SESSION] Document %s handed over to %s", s.id, s.service.owner(s.id))
+	}
+}
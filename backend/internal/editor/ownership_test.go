@@ -0,0 +1,212 @@
+package editor
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"collaborative-editor/internal/backplane"
+	"collaborative-editor/internal/cluster"
+	"collaborative-editor/pkg/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// startTestCluster runs one service per node on a shared memory backplane
+func startTestCluster(t *testing.T, nodes ...string) ([]*Service, []string) {
+	t.Helper()
+	bp := backplane.NewMemory()
+	t.Cleanup(func() { bp.Close() })
+
+	services := make([]*Service, len(nodes))
+	urls := make([]string, len(nodes))
+	for i, node := range nodes {
+		services[i], urls[i] = startTestService(t, &Config{NodeID: node, Backplane: bp, Cluster: nodes})
+	}
+	return services, urls
+}
+
+// docOwnedBy returns a document ID the ring places on a node
+func docOwnedBy(t *testing.T, node string, nodes ...string) string {
+	t.Helper()
+	ring := cluster.NewRing(0, nodes...)
+	for i := 0; i < 1000; i++ {
+		if id := fmt.Sprintf("doc-%d", i); ring.Owner(id) == node {
+			return id
+		}
+	}
+	t.Fatalf("%s owns no test document", node)
+	return ""
+}
+
+// sendEdit sends a legacy full-content text update
+func sendEdit(t *testing.T, conn *websocket.Conn, content string, version int) {
+	t.Helper()
+	if err := conn.WriteJSON(map[string]interface{}{"type": "text_update", "content": content, "version": version}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitContent waits until a node has a document with the given content
+func waitContent(t *testing.T, s *Service, docID, want string) int {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if doc, ok := s.loadedDocument(docID); ok {
+			if content, version := doc.OTManager.GetDocument(); content == want {
+				return version
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never had %q in %s", s.nodeID, want, docID)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestForwardedEditAppliedByOwner(t *testing.T) {
+	nodes := []string{"n1", "n2"}
+	services, urls := startTestCluster(t, nodes...)
+	docID := docOwnedBy(t, "n1", nodes...)
+	if !services[0].isOwner(docID) || services[1].isOwner(docID) {
+		t.Fatalf("n1 should own %s", docID)
+	}
+
+	bob := dialTest(t, urls[1]+"?doc="+docID)
+	readUntil(t, bob, "document_state")
+
+	// The owner has no client for the document; the forwarded edit starts a
+	// session there, which applies it and relays the result back
+	sendEdit(t, bob, "hello", 1)
+	if msg := readUntil(t, bob, "text_update"); msg.Content != "hello" || msg.Version != 1 {
+		t.Fatalf("bob got %q at version %d", msg.Content, msg.Version)
+	}
+	waitContent(t, services[0], docID, "hello")
+	waitContent(t, services[1], docID, "hello")
+
+	// A client on the owner sees the next forwarded edit as a normal update
+	alice := dialTest(t, urls[0]+"?doc="+docID)
+	if state := readUntil(t, alice, "document_state"); state.Content != "hello" {
+		t.Fatalf("alice joined at %q", state.Content)
+	}
+	sendEdit(t, bob, "hello world", 2)
+	msg := readUntil(t, alice, "text_update")
+	if msg.Content != "hello world" || msg.Version != 2 {
+		t.Fatalf("alice got %q at version %d", msg.Content, msg.Version)
+	}
+	if version := waitContent(t, services[1], docID, "hello world"); version != 2 {
+		t.Fatalf("n2 has version %d, want the owner's 2", version)
+	}
+}
+
+func TestForwardedEditCarriesBaseToNewOwner(t *testing.T) {
+	nodes := []string{"n1", "n2"}
+	services, _ := startTestCluster(t, nodes...)
+	docID := docOwnedBy(t, "n1", nodes...)
+
+	// The forwarding node is ahead of an owner that has not seen the
+	// document yet, as after a handoff
+	payload, err := json.Marshal(relayEnvelope{
+		Kind:       relayForward,
+		Origin:     "n2",
+		DocumentID: docID,
+		Forward: &forwardedEdit{
+			ClientID:    "c1",
+			Content:     "base text!",
+			Version:     4,
+			BaseContent: "base text",
+			BaseVersion: 3,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := services[1].backplane.Publish(nodeTopic("n1"), payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if version := waitContent(t, services[0], docID, "base text!"); version != 4 {
+		t.Fatalf("owner applied the edit at version %d, want 4", version)
+	}
+}
+
+func TestOwnershipHandoffWhenOwnerLeaves(t *testing.T) {
+	nodes := []string{"n1", "n2"}
+	services, urls := startTestCluster(t, nodes...)
+	docID := docOwnedBy(t, "n1", nodes...)
+
+	bob := dialTest(t, urls[1]+"?doc="+docID)
+	readUntil(t, bob, "document_state")
+	sendEdit(t, bob, "one", 1)
+	readUntil(t, bob, "text_update")
+	waitContent(t, services[0], docID, "one")
+
+	// The owner announces that it leaves; n2 takes the document over at once
+	services[0].Shutdown()
+	deadline := time.Now().Add(time.Second)
+	for !services[1].isOwner(docID) {
+		if time.Now().After(deadline) {
+			t.Fatalf("n2 never took %s over", docID)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Edits now apply on n2 itself, continuing from the same version
+	carol := dialTest(t, urls[1]+"?doc="+docID)
+	readUntil(t, carol, "document_state")
+	sendEdit(t, bob, "one two", 2)
+	if msg := readUntil(t, carol, "text_update"); msg.Content != "one two" || msg.Version != 2 {
+		t.Fatalf("carol got %q at version %d", msg.Content, msg.Version)
+	}
+	if version := waitContent(t, services[1], docID, "one two"); version != 2 {
+		t.Fatalf("n2 has version %d", version)
+	}
+}
+
+func TestConcurrentEditsWithoutClusterConverge(t *testing.T) {
+	bp := backplane.NewMemory()
+	defer bp.Close()
+	var services []*Service
+	var clients []*Client
+	var sessions []*DocumentSession
+	for _, node := range []string{"n1", "n2"} {
+		s, _ := startTestService(t, &Config{NodeID: node, Backplane: bp})
+		client := NewClient(s.hub, nil, s, "doc", "user-"+node)
+		s.hub.Register(client)
+		services = append(services, s)
+		clients = append(clients, client)
+		sessions = append(sessions, s.hub.session("doc"))
+	}
+
+	// Without ownership both nodes apply an edit to version 0, each
+	// before hearing of the other's
+	var held []chan DocumentMetadata
+	for _, session := range sessions {
+		reply := make(chan DocumentMetadata)
+		session.post(metadataEvent{reply: reply})
+		held = append(held, reply)
+	}
+	for i, session := range sessions {
+		session.Deliver(clients[i], "text_update", &protocol.TextUpdate{Content: "from " + services[i].nodeID})
+	}
+	for _, reply := range held {
+		<-reply
+	}
+
+	// The nodes settle on the content of the one with the lowest ID
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		first, _ := sessions[0].doc.OTManager.GetDocument()
+		second, _ := sessions[1].doc.OTManager.GetDocument()
+		if first == second {
+			if first != "from n1" {
+				t.Fatalf("the nodes settled on %q, want the content of n1", first)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("n1 has %q and n2 %q", first, second)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
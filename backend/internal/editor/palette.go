@@ -0,0 +1,228 @@
+// internal/editor/palette.go
+package editor
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+
+	"collaborative-editor/pkg/protocol"
+)
+
+// paletteColors are distinct hues that all keep at least 4.5:1 contrast
+// with the white text of avatars and cursor labels
+var paletteColors = []string{
+	"#1565C0", // blue
+	"#C62828", // red
+	"#2E7D32", // green
+	"#6A1B9A", // purple
+	"#BF360C", // deep orange
+	"#00838F", // cyan
+	"#AD1457", // pink
+	"#283593", // indigo
+	"#00695C", // teal
+	"#4E342E", // brown
+	"#0277BD", // light blue
+	"#37474F", // blue grey
+}
+
+// ErrColorTaken is returned when a user picks a color another user holds
+var ErrColorTaken = errors.New("color is used by another user")
+
+// Palette hands out distinct colors to the users of a document and
+// remembers them, so a returning user gets their color back
+type Palette struct {
+	mu sync.Mutex
+
+	// Color of every user seen, keyed by user key
+	colors map[string]string
+
+	// Open connections per user key
+	active map[string]int
+}
+
+// NewPalette creates an empty palette
+func NewPalette() *Palette {
+	return &Palette{
+		colors: make(map[string]string),
+		active: make(map[string]int),
+	}
+}
+
+// Assign returns the color of a joining user. A returning user keeps their
+// color unless someone else took it meanwhile. taken holds colors in use
+// that the palette does not track, such as those of users on other nodes.
+func (p *Palette) Assign(userKey string, taken map[string]bool) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	inUse := p.inUse(userKey, taken)
+	color, known := p.colors[userKey]
+	if !known || inUse[color] {
+		color = p.pick(userKey, inUse)
+	}
+
+	p.colors[userKey] = color
+	p.active[userKey]++
+	return color
+}
+
+// Choose gives a user the color they picked, unless another user holds it
+func (p *Palette) Choose(userKey, color string, taken map[string]bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	color = strings.ToUpper(color)
+	if p.inUse(userKey, taken)[color] {
+		return ErrColorTaken
+	}
+
+	p.colors[userKey] = color
+	return nil
+}
+
+// Hold records that a user joined with a color assigned elsewhere, such as
+// by their workspace, and returns the color they have in this document: the
+// held one, or a free one when another user of the document holds it
+func (p *Palette) Hold(userKey, color string, taken map[string]bool) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if inUse := p.inUse(userKey, taken); inUse[color] {
+		color = p.pick(userKey, inUse)
+	}
+
+	p.colors[userKey] = color
+	p.active[userKey]++
+	return color
+}
+
+// Release records that one of a user's connections left
+func (p *Palette) Release(userKey string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.active[userKey]--; p.active[userKey] <= 0 {
+		delete(p.active, userKey)
+	}
+}
+
+// inUse returns the colors held by connected users other than userKey
+func (p *Palette) inUse(userKey string, taken map[string]bool) map[string]bool {
+	inUse := make(map[string]bool, len(p.active)+len(taken))
+	for color := range taken {
+		inUse[strings.ToUpper(color)] = true
+	}
+	for key := range p.active {
+		if key != userKey {
+			inUse[p.colors[key]] = true
+		}
+	}
+	return inUse
+}
+
+// pick chooses a free color, preferring ones no absent user will come back to.
+// With more users than colors, colors are shared round robin.
+func (p *Palette) pick(userKey string, inUse map[string]bool) string {
+	remembered := make(map[string]bool, len(p.colors))
+	for key, color := range p.colors {
+		if key != userKey {
+			remembered[color] = true
+		}
+	}
+
+	for _, color := range paletteColors {
+		if !inUse[color] && !remembered[color] {
+			return color
+		}
+	}
+	for _, color := range paletteColors {
+		if !inUse[color] {
+			return color
+		}
+	}
+	return paletteColors[len(p.active)%len(paletteColors)]
+}
+
+// remoteColors returns the colors of the document's users on other nodes
+func (d *Document) remoteColors(node string) map[string]bool {
+	colors := make(map[string]bool)
+	for _, entry := range d.Presence.List() {
+		if entry.Node != node {
+			colors[entry.Color] = true
+		}
+	}
+	return colors
+}
+
+// handleSetProfile changes a user's display name and color and tells everyone
+func (s *DocumentSession) handleSetProfile(client *Client, msg *protocol.SetProfile) {
+	username, color := client.profile()
+
+	if name := strings.TrimSpace(msg.Data.DisplayName); name != "" {
+		username = name
+	}
+	if msg.Data.Color != "" {
+		if err := s.doc.Palette.Choose(client.userKey, msg.Data.Color, s.doc.remoteColors(s.service.nodeID)); err != nil {
+			s.sendErrorCode(client, err.Error(), "color_taken", "data.color")
+			return
+		}
+		color = strings.ToUpper(msg.Data.Color)
+	}
+
+	client.setProfile(username, color)
+	username, color = client.profileIn(s.id)
+	log.Printf("[SESSION] Client %s is now %q with color %s", client.id, username, color)
+
+	update := profileUpdate(s.id, client.id, username, color)
+	s.applyProfile(update)
+	s.relay(update)
+
+	// The user looks the same in every document of the connection. The other
+	// sessions are told from another goroutine, as two sessions waiting on
+	// each other's full queues would deadlock.
+	go s.service.hub.announceProfile(client, s)
+}
+
+// announceProfile tells a document's users about a profile change the
+// client made in another document
+func (s *DocumentSession) announceProfile(client *Client) {
+	username, color := client.profileIn(s.id)
+
+	// A clash was already refused by the document the user changed it in
+	s.doc.Palette.Choose(client.userKey, color, nil)
+
+	update := profileUpdate(s.id, client.id, username, color)
+	s.applyProfile(update)
+	s.relay(update)
+}
+
+// profileUpdate builds the message announcing a user's new profile
+func profileUpdate(docID, userID, username, color string) Message {
+	return Message{
+		Type:       "profile_update",
+		ClientID:   userID,
+		DocumentID: docID,
+		Data: map[string]interface{}{
+			"userId":   userID,
+			"username": username,
+			"color":    color,
+		},
+	}
+}
+
+// applyProfile updates a user's profile in the document's state and sends the
+// change to every local client, including the user's own for confirmation
+func (s *DocumentSession) applyProfile(update Message) {
+	data, _ := update.Data.(map[string]interface{})
+	username, color := stringField(data, "username"), stringField(data, "color")
+
+	s.doc.CursorManager.SetProfile(update.ClientID, username, color)
+	entry, ok := s.doc.Presence.SetProfile(update.ClientID, username, color)
+
+	s.broadcast(messageFrame(update), "")
+	if ok {
+		s.sendPresence(entry, presenceProfile, "")
+	}
+}
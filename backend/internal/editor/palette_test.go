@@ -0,0 +1,113 @@
+package editor
+
+import (
+	"testing"
+	"time"
+
+	"collaborative-editor/pkg/protocol"
+)
+
+func TestHeldColorIsNotSharedWithinDocument(t *testing.T) {
+	s := NewService(&Config{})
+	ws := s.GetWorkspace("w1")
+	file, err := ws.Create("test", kindFile, "notes.txt", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := s.GetDocument(file.DocumentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice opens the document alone, Bob its workspace; both palettes
+	// hand out their first color
+	alice := NewClient(s.hub, nil, s, doc.ID, "alice")
+	alice.color = doc.Palette.Assign(alice.userKey, nil)
+	s.hub.Register(alice)
+	defer s.hub.Unregister(alice)
+
+	bob := NewClient(s.hub, nil, s, "", "bob")
+	bob.workspace = ws
+	bob.color = ws.Palette.Assign(bob.userKey, nil)
+	s.hub.Register(bob)
+	defer s.hub.Unregister(bob)
+	if alice.color != bob.color {
+		t.Fatalf("alice has %s and bob %s, want the same color", alice.color, bob.color)
+	}
+
+	if err := s.hub.Subscribe(bob, doc.ID); err != nil {
+		t.Fatal(err)
+	}
+	reply := make(chan DocumentMetadata)
+	s.hub.session(doc.ID).post(metadataEvent{reply: reply})
+	<-reply
+
+	colors := make(map[string]string)
+	for _, entry := range doc.Presence.List() {
+		colors[entry.UserID] = entry.Color
+	}
+	if colors[alice.id] == "" || colors[alice.id] == colors[bob.id] {
+		t.Fatalf("presence colors %v, want distinct colors for both users", colors)
+	}
+	if _, color := bob.profileIn(doc.ID); color != colors[bob.id] {
+		t.Fatalf("bob's color in the document is %s, presence shows %s", color, colors[bob.id])
+	}
+	if _, color := bob.profile(); color != alice.color {
+		t.Fatalf("bob's workspace color changed to %s", color)
+	}
+}
+
+func TestProfileChangeDoesNotWaitOnOtherSessions(t *testing.T) {
+	s := NewService(&Config{})
+	ws := s.GetWorkspace("w1")
+	var docs []string
+	for _, name := range []string{"a.txt", "b.txt"} {
+		file, err := ws.Create("test", kindFile, name, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, file.DocumentID)
+	}
+
+	bob := NewClient(s.hub, nil, s, "", "bob")
+	bob.workspace = ws
+	bob.color = ws.Palette.Assign(bob.userKey, nil)
+	s.hub.Register(bob)
+	defer s.hub.Unregister(bob)
+	for _, docID := range docs {
+		if err := s.hub.Subscribe(bob, docID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := s.hub.session(docs[0]), s.hub.session(docs[1])
+
+	// The second session is held up with its queue full
+	held := make(chan DocumentMetadata)
+	b.post(metadataEvent{reply: held})
+	for i := 0; i < sessionQueueSize; i++ {
+		b.Broadcast(messageFrame(Message{Type: "noop"}), bob.id)
+	}
+
+	a.Deliver(bob, "set_profile", &protocol.SetProfile{Data: protocol.Profile{DisplayName: "Bob"}})
+	reply := make(chan DocumentMetadata)
+	a.post(metadataEvent{reply: reply})
+	select {
+	case <-reply:
+	case <-time.After(time.Second):
+		t.Fatal("the profile change waited for the other document's session")
+	}
+
+	// The other document hears of the change once it catches up
+	<-held
+	deadline := time.Now().Add(time.Second)
+	for {
+		entries := s.hub.session(docs[1]).doc.Presence.List()
+		if len(entries) == 1 && entries[0].Username == "Bob" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the other document shows %v, want Bob", entries)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
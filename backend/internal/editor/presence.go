@@ -0,0 +1,316 @@
+// internal/editor/presence.go
+package editor
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"collaborative-editor/pkg/protocol"
+)
+
+// PresenceStatus is how engaged a user currently is with a document
+type PresenceStatus string
+
+const (
+	StatusActive PresenceStatus = "active"
+	StatusIdle   PresenceStatus = "idle"
+	StatusAway   PresenceStatus = "away"
+)
+
+const (
+	// Without edits, cursor moves or active heartbeats a user turns idle, then away
+	presenceIdleAfter = 1 * time.Minute
+	presenceAwayAfter = 5 * time.Minute
+
+	// A user whose client stopped heartbeating is away regardless of activity
+	presenceHeartbeatTimeout = 90 * time.Second
+
+	// How often sessions re-evaluate statuses and clean up stale cursors
+	presenceSweepInterval = 15 * time.Second
+)
+
+// PresenceEntry is one user's presence in a document
+type PresenceEntry struct {
+	UserID     string         `json:"userId"`
+	Username   string         `json:"username"`
+	Color      string         `json:"color"`
+	Status     PresenceStatus `json:"status"`
+	LastActive time.Time      `json:"lastActive"`
+	LastSeen   time.Time      `json:"lastSeen"`
+
+	// Node the user is connected to
+	Node string `json:"node,omitempty"`
+}
+
+// Presence tracks the users of a document and their status.
+// Statuses of local users are derived here; remote users' statuses are
+// whatever their node last reported.
+type Presence struct {
+	mu      sync.RWMutex
+	entries map[string]*PresenceEntry
+}
+
+// NewPresence creates an empty presence list
+func NewPresence() *Presence {
+	return &Presence{
+		entries: make(map[string]*PresenceEntry),
+	}
+}
+
+// Join adds a local user as active
+func (p *Presence) Join(userID, username, color, node string) PresenceEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	entry := &PresenceEntry{
+		UserID:     userID,
+		Username:   username,
+		Color:      color,
+		Status:     StatusActive,
+		LastActive: now,
+		LastSeen:   now,
+		Node:       node,
+	}
+	p.entries[userID] = entry
+	return *entry
+}
+
+// Put records an entry reported by another node
+func (p *Presence) Put(entry PresenceEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.entries[entry.UserID] = &entry
+}
+
+// Leave removes a user, reporting whether it was present
+func (p *Presence) Leave(userID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.entries[userID]; !ok {
+		return false
+	}
+	delete(p.entries, userID)
+	return true
+}
+
+// Touch records a sign of life from a user. active marks real activity
+// rather than a bare heartbeat. It returns the entry and whether its status changed.
+func (p *Presence) Touch(userID string, active bool) (PresenceEntry, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.entries[userID]
+	if !ok {
+		return PresenceEntry{}, false
+	}
+
+	now := time.Now()
+	entry.LastSeen = now
+	if active {
+		entry.LastActive = now
+	}
+	return *entry, p.update(entry, now)
+}
+
+// Sweep re-evaluates the status of the users connected to node, returning
+// those whose status changed
+func (p *Presence) Sweep(node string) []PresenceEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var changed []PresenceEntry
+	for _, entry := range p.entries {
+		if entry.Node == node && p.update(entry, now) {
+			changed = append(changed, *entry)
+		}
+	}
+	return changed
+}
+
+// SetProfile changes a user's display name and color
+func (p *Presence) SetProfile(userID, username, color string) (PresenceEntry, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.entries[userID]
+	if !ok {
+		return PresenceEntry{}, false
+	}
+	entry.Username = username
+	entry.Color = color
+	return *entry, true
+}
+
+// Get returns a user's entry
+func (p *Presence) Get(userID string) (PresenceEntry, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	entry, ok := p.entries[userID]
+	if !ok {
+		return PresenceEntry{}, false
+	}
+	return *entry, true
+}
+
+// List returns all entries ordered by user ID
+func (p *Presence) List() []PresenceEntry {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	list := make([]PresenceEntry, 0, len(p.entries))
+	for _, entry := range p.entries {
+		list = append(list, *entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UserID < list[j].UserID })
+	return list
+}
+
+// ListNode returns the entries of users connected to node
+func (p *Presence) ListNode(node string) []PresenceEntry {
+	var list []PresenceEntry
+	for _, entry := range p.List() {
+		if entry.Node == node {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// update derives an entry's status, reporting whether it changed
+func (p *Presence) update(entry *PresenceEntry, now time.Time) bool {
+	status := StatusActive
+	switch {
+	case now.Sub(entry.LastSeen) > presenceHeartbeatTimeout,
+		now.Sub(entry.LastActive) > presenceAwayAfter:
+		status = StatusAway
+	case now.Sub(entry.LastActive) > presenceIdleAfter:
+		status = StatusIdle
+	}
+
+	if status == entry.Status {
+		return false
+	}
+	entry.Status = status
+	return true
+}
+
+// Presence change events sent in presence_update
+const (
+	presenceJoined  = "joined"
+	presenceLeft    = "left"
+	presenceStatus  = "status"
+	presenceProfile = "profile"
+)
+
+// wantsPresenceDiffs reports whether a client negotiated presence diffs
+func wantsPresenceDiffs(c *Client) bool {
+	return c.Negotiated().Has(protocol.CapPresenceV2)
+}
+
+// sendPresenceState sends a client the document's whole presence list, as
+// presence_state if it negotiated diffs and as active_users otherwise
+func (s *DocumentSession) sendPresenceState(client *Client) {
+	client.queue(s.presenceListFrame(wantsPresenceDiffs(client)))
+}
+
+// presenceListFrame builds the full presence list message
+func (s *DocumentSession) presenceListFrame(diffs bool) *Frame {
+	entries := s.doc.Presence.List()
+
+	if diffs {
+		return messageFrame(Message{
+			Type:       "presence_state",
+			DocumentID: s.id,
+			Data:       entries,
+		})
+	}
+
+	users := make([]map[string]interface{}, 0, len(entries))
+	for _, e := range entries {
+		users = append(users, map[string]interface{}{
+			"userId":   e.UserID,
+			"username": e.Username,
+			"color":    e.Color,
+			"status":   e.Status,
+		})
+	}
+	return messageFrame(Message{
+		Type:       "active_users",
+		DocumentID: s.id,
+		Data:       users,
+	})
+}
+
+// sendPresence tells local clients about one user's presence change: a
+// presence_update diff for clients that negotiated it, the whole
+// active_users list for the rest
+func (s *DocumentSession) sendPresence(entry PresenceEntry, event string, excludeClientID string) {
+	diff := presenceUpdate(s.id, entry, event)
+	s.broadcastWhere(messageFrame(diff), func(c *Client) bool {
+		return c.id != excludeClientID && wantsPresenceDiffs(c)
+	})
+
+	// Legacy clients are told about joins and leaves through user_joined/user_left
+	// and only ever see the list, which status changes also alter
+	s.broadcastWhere(s.presenceListFrame(false), func(c *Client) bool {
+		return c.id != excludeClientID && !wantsPresenceDiffs(c)
+	})
+}
+
+// presenceUpdate builds the diff message for one user's presence change
+func presenceUpdate(docID string, entry PresenceEntry, event string) Message {
+	var user interface{} = entry
+	if event == presenceLeft {
+		user = map[string]interface{}{"userId": entry.UserID}
+	}
+
+	return Message{
+		Type:       "presence_update",
+		ClientID:   entry.UserID,
+		DocumentID: docID,
+		Data: map[string]interface{}{
+			"event": event,
+			"user":  user,
+		},
+	}
+}
+
+// touchPresence records activity or a heartbeat from a local client and
+// announces a resulting status change
+func (s *DocumentSession) touchPresence(client *Client, active bool) {
+	entry, changed := s.doc.Presence.Touch(client.id, active)
+	if !changed {
+		return
+	}
+
+	s.sendPresence(entry, presenceStatus, "")
+	s.relay(presenceUpdate(s.id, entry, presenceStatus))
+}
+
+// sweepPresence moves quiet local users to idle or away and removes cursors
+// that have not moved for as long as it takes to become away
+func (s *DocumentSession) sweepPresence() {
+	for _, entry := range s.doc.Presence.Sweep(s.service.nodeID) {
+		log.Printf("[SESSION] User %s is now %s in %s", entry.UserID, entry.Status, s.id)
+		s.sendPresence(entry, presenceStatus, "")
+		s.relay(presenceUpdate(s.id, entry, presenceStatus))
+	}
+
+	for _, clientID := range s.doc.CursorManager.CleanupStale(presenceAwayAfter) {
+		s.broadcast(messageFrame(Message{
+			Type:       "cursor_remove",
+			ClientID:   clientID,
+			DocumentID: s.id,
+			Data: map[string]interface{}{
+				"clientId": clientID,
+			},
+		}), "")
+	}
+}
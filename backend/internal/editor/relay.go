@@ -0,0 +1,483 @@
+// internal/editor/relay.go
+package editor
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+// Envelope kinds exchanged between sessions of the same document on different nodes
+const (
+	relayMessage     = "message"      // A message from a local client, to forward
+	relaySyncRequest = "sync_request" // A new session asking peers for their state
+	relaySnapshot    = "snapshot"     // Reply to sync_request
+)
+
+// relayEnvelope is what document sessions publish on the backplane
+type relayEnvelope struct {
+	Kind       string           `json:"kind"`
+	Origin     string           `json:"origin"`
+	DocumentID string           `json:"documentId"`
+	Message    *Message         `json:"message,omitempty"`
+	Snapshot   *sessionSnapshot `json:"snapshot,omitempty"`
+	Forward    *forwardedEdit   `json:"forward,omitempty"`
+}
+
+// sessionSnapshot is a node's view of a document, sent to peers that just started a session
+type sessionSnapshot struct {
+	Content string          `json:"content"`
+	Version int             `json:"version"`
+	Users   []PresenceEntry `json:"users"`
+
+	// Cursor state of the node's own users
+	Cursors    []CursorPosition `json:"cursors,omitempty"`
+	Selections []SelectionRange `json:"selections,omitempty"`
+	Typing     []TypingState    `json:"typing,omitempty"`
+
+	// Comment threads, anchored in Content
+	Comments    []CommentThread `json:"comments,omitempty"`
+	Suggestions []Suggestion    `json:"suggestions,omitempty"`
+
+	// Chat history
+	Chat []ChatEntry `json:"chat,omitempty"`
+
+	// Region locks of the node's own users
+	Locks []RegionLock `json:"locks,omitempty"`
+
+	// Metadata set on the document
+	Metadata *DocumentMetadata `json:"metadata,omitempty"`
+}
+
+// remoteEvent is a relay envelope received from another node
+type remoteEvent struct {
+	envelope relayEnvelope
+}
+
+// resyncEvent tells a session that relayed messages were lost, so it asks
+// its peers for their state again
+type resyncEvent struct{}
+
+// documentTopic is the backplane topic of a document
+func documentTopic(docID string) string {
+	return "doc:" + docID
+}
+
+// subscribe connects the session to its document's backplane topic and asks
+// peers on other nodes for their state
+func (s *DocumentSession) subscribe() {
+	bp := s.service.backplane
+	if bp == nil {
+		return
+	}
+
+	sub, err := bp.Subscribe(documentTopic(s.id), func(payload []byte) {
+		if payload == nil {
+			log.Printf("[SESSION] Relayed messages for %s were dropped, resynchronizing", s.id)
+			s.post(resyncEvent{})
+			return
+		}
+
+		var env relayEnvelope
+		if err := json.Unmarshal(payload, &env); err != nil {
+			log.Printf("[SESSION] Bad backplane message for %s: %v", s.id, err)
+			return
+		}
+		if env.Origin == s.service.nodeID {
+			return
+		}
+		s.post(remoteEvent{envelope: env})
+	})
+	if err != nil {
+		log.Printf("[SESSION] Error subscribing to document %s: %v", s.id, err)
+		return
+	}
+	s.subscription = sub
+
+	s.requestSync()
+}
+
+// unsubscribe disconnects the session from the backplane
+func (s *DocumentSession) unsubscribe() {
+	if s.subscription != nil {
+		s.subscription.Unsubscribe()
+		s.subscription = nil
+	}
+}
+
+// publish sends an envelope to the sessions of this document on other nodes
+func (s *DocumentSession) publish(env relayEnvelope) {
+	if s.subscription == nil {
+		return
+	}
+
+	env.Origin = s.service.nodeID
+	env.DocumentID = s.id
+
+	payload, err := json.Marshal(env)
+	if err != nil {
+		log.Printf("[SESSION] Error marshaling relay envelope: %v", err)
+		return
+	}
+
+	if err := s.service.backplane.Publish(documentTopic(s.id), payload); err != nil {
+		log.Printf("[SESSION] Error publishing to backplane: %v", err)
+	}
+}
+
+// relay forwards a message from a local client to the other nodes
+func (s *DocumentSession) relay(msg Message) {
+	s.publish(relayEnvelope{Kind: relayMessage, Message: &msg})
+}
+
+// handleRemote applies an envelope published by another node
+func (s *DocumentSession) handleRemote(env relayEnvelope) {
+	switch env.Kind {
+	case relayMessage:
+		if env.Message != nil {
+			s.handleRemoteMessage(env.Origin, env.Message)
+		}
+
+	case relaySyncRequest:
+		s.publish(relayEnvelope{Kind: relaySnapshot, Snapshot: s.snapshot()})
+
+	case relaySnapshot:
+		if env.Snapshot != nil {
+			s.applySnapshot(env.Origin, env.Snapshot)
+		}
+
+	case relayForward:
+		if env.Forward != nil {
+			s.applyForwarded(env.Origin, env.Forward)
+		}
+	}
+}
+
+// handleRemoteMessage mirrors a remote client's message into local state and
+// forwards it to local clients
+func (s *DocumentSession) handleRemoteMessage(origin string, msg *Message) {
+	data, _ := msg.Data.(map[string]interface{})
+
+	switch msg.Type {
+	case "text_update":
+		if !s.adoptRemote(origin, msg.Content, msg.Version) {
+			return
+		}
+
+	case "user_joined":
+		now := time.Now()
+		entry := PresenceEntry{
+			UserID:     msg.ClientID,
+			Username:   stringField(data, "username"),
+			Color:      stringField(data, "color"),
+			Status:     StatusActive,
+			LastActive: now,
+			LastSeen:   now,
+			Node:       origin,
+		}
+		s.doc.Presence.Put(entry)
+		defer s.sendPresence(entry, presenceJoined, "")
+
+	case "user_left":
+		s.doc.Presence.Leave(msg.ClientID)
+		s.doc.CursorManager.RemoveClient(msg.ClientID)
+		s.forgetFollows(msg.ClientID)
+		s.expireRemoteLocks(msg.ClientID)
+		defer s.sendPresence(PresenceEntry{UserID: msg.ClientID}, presenceLeft, "")
+
+	case "follow_change":
+		s.applyFollowChange(msg)
+		return
+
+	case "viewport":
+		s.viewports[msg.ClientID] = *msg
+		s.sendToFollowers(*msg)
+		return
+
+	case "profile_update":
+		s.applyProfile(*msg)
+		return
+
+	case "presence_update":
+		// Status changes are only meaningful to clients that negotiated diffs
+		var update struct {
+			User PresenceEntry `json:"user"`
+		}
+		if decodeData(msg.Data, &update) == nil {
+			update.User.Node = origin
+			s.doc.Presence.Put(update.User)
+			s.sendPresence(update.User, presenceStatus, "")
+		}
+		return
+
+	case "cursor_position":
+		s.doc.CursorManager.UpdateCursorPosition(msg.ClientID,
+			stringField(data, "username"), stringField(data, "color"), intField(data, "position"))
+
+	case "selection_change":
+		s.doc.CursorManager.UpdateSelection(msg.ClientID,
+			stringField(data, "username"), stringField(data, "color"),
+			intField(data, "start"), intField(data, "end"))
+
+	case "typing_start":
+		s.doc.CursorManager.SetTyping(msg.ClientID, stringField(data, "username"), stringField(data, "color"), true)
+
+	case "typing_stop":
+		s.doc.CursorManager.SetTyping(msg.ClientID, "", "", false)
+
+	case "cursor_remove":
+		s.doc.CursorManager.RemoveClient(msg.ClientID)
+
+	case "comment_update":
+		s.applyRemoteComment(msg)
+		return
+
+	case "suggestion_update":
+		s.applyRemoteSuggestion(msg)
+		return
+
+	case "chat_message":
+		s.applyRemoteChat(msg)
+		return
+
+	case "lock_update":
+		s.applyRemoteLock(msg)
+		return
+
+	case "metadata_update":
+		s.applyRemoteMetadata(msg)
+		return
+
+	case "execution_started", "execution_finished":
+		s.applyRemoteRun(origin, msg)
+
+	case "execution_cancel":
+		s.applyRemoteRun(origin, msg)
+		return
+
+	case "edit_rejected":
+		if client := s.localClient(msg.ClientID); client != nil {
+			s.rejectLockedEdit(client, errors.New(stringField(data, "message")))
+		}
+		return
+	}
+
+	switch msg.Type {
+	case "cursor_position", "selection_change":
+		s.broadcastFollowed(*msg, "")
+	default:
+		s.broadcast(messageFrame(*msg), "")
+	}
+
+	if msg.Type == "text_update" {
+		s.afterEdit()
+	}
+}
+
+// adoptRemote takes on a version relayed by another node and reports whether
+// it did. Only the owner produces versions, so each is the one after the
+// local version. A gap means relayed versions were lost, and differing
+// content at the local version means another node applied edits too; either
+// way the nodes exchange snapshots to agree again.
+func (s *DocumentSession) adoptRemote(origin, content string, version int) bool {
+	localContent, localVersion := s.doc.OTManager.GetDocument()
+	switch {
+	case version > localVersion+1:
+		log.Printf("[SESSION] Versions %d to %d of %s from %s were missed, resynchronizing",
+			localVersion+1, version-1, s.id, origin)
+		s.requestSync()
+
+	case version == localVersion && content != localContent:
+		log.Printf("[SESSION] Version %d of %s from %s conflicts with ours, resynchronizing",
+			version, s.id, origin)
+		s.requestSync()
+		return false
+
+	case version <= localVersion:
+		return false
+	}
+
+	s.adoptContent(content, version)
+	return true
+}
+
+// requestSync asks the document's sessions on other nodes for their state
+func (s *DocumentSession) requestSync() {
+	s.publish(relayEnvelope{Kind: relaySyncRequest})
+}
+
+// prevails reports whether a peer's content replaces this node's differing
+// content of the same version: the owner's does, and without a cluster the
+// lowest node ID's, so that all nodes settle on the same one
+func (s *DocumentSession) prevails(origin string) bool {
+	if s.service.membership != nil {
+		return origin == s.service.owner(s.id)
+	}
+	return origin < s.service.nodeID
+}
+
+// snapshot captures this node's view of the document for a peer
+func (s *DocumentSession) snapshot() *sessionSnapshot {
+	content, version := s.doc.OTManager.GetDocument()
+
+	users := s.doc.Presence.ListNode(s.service.nodeID)
+	snap := &sessionSnapshot{
+		Content:     content,
+		Version:     version,
+		Users:       users,
+		Comments:    s.doc.Comments.List(),
+		Suggestions: s.doc.Suggestions.List(),
+		Chat:        s.doc.Chat.Recent(0),
+	}
+	if settings := s.doc.Metadata.Settings(); !settings.UpdatedAt.IsZero() {
+		snap.Metadata = &settings
+	}
+
+	local := make(map[string]bool, len(users))
+	for _, u := range users {
+		local[u.UserID] = true
+	}
+	for _, c := range s.doc.CursorManager.GetAllCursors("") {
+		if local[c.ClientID] {
+			snap.Cursors = append(snap.Cursors, c)
+		}
+	}
+	for _, sel := range s.doc.CursorManager.GetAllSelections("") {
+		if local[sel.ClientID] {
+			snap.Selections = append(snap.Selections, sel)
+		}
+	}
+	for _, t := range s.doc.CursorManager.GetAllTyping("") {
+		if local[t.ClientID] {
+			snap.Typing = append(snap.Typing, t)
+		}
+	}
+	for _, l := range s.doc.Locks.List() {
+		if local[l.OwnerID] {
+			snap.Locks = append(snap.Locks, l)
+		}
+	}
+
+	return snap
+}
+
+// applySnapshot merges a peer's users and adopts its content if it is newer,
+// or prevails over this node's at the same version
+func (s *DocumentSession) applySnapshot(origin string, snap *sessionSnapshot) {
+	for _, user := range snap.Users {
+		user.Node = origin
+		s.doc.Presence.Put(user)
+	}
+
+	cursors := s.doc.CursorManager
+	for _, c := range snap.Cursors {
+		cursors.UpdateCursorPosition(c.ClientID, c.Username, c.Color, c.Position)
+	}
+	for _, sel := range snap.Selections {
+		cursors.UpdateSelection(sel.ClientID, sel.Username, sel.Color, sel.Start, sel.End)
+	}
+	for _, t := range snap.Typing {
+		cursors.SetTyping(t.ClientID, t.Username, t.Color, true)
+	}
+
+	localContent, localVersion := s.doc.OTManager.GetDocument()
+	conflict := snap.Version == localVersion && snap.Content != localContent
+	if snap.Version > localVersion || conflict && s.prevails(origin) {
+		// The new state carries the peer's cursors and comments along with its content
+		s.adoptContent(snap.Content, snap.Version)
+		s.doc.Comments.Merge(snap.Comments, true)
+		s.doc.Comments.TakeMoved()
+		s.doc.Suggestions.Merge(snap.Suggestions, true)
+		s.doc.Suggestions.TakeMoved()
+		for c := range s.clients {
+			s.sendDocumentState(c)
+		}
+	} else {
+		s.sendCursorSnapshot(snap)
+		s.mergeComments(snap.Comments)
+		s.mergeSuggestions(snap.Suggestions)
+	}
+
+	s.mergeChat(snap.Chat)
+	s.mergeLocks(snap.Locks)
+	s.mergeMetadata(snap.Metadata)
+	for c := range s.clients {
+		s.sendPresenceState(c)
+	}
+}
+
+// sendCursorSnapshot replays a peer's cursor state to local clients as
+// ordinary updates, leaving their document untouched
+func (s *DocumentSession) sendCursorSnapshot(snap *sessionSnapshot) {
+	for _, c := range snap.Cursors {
+		s.broadcast(messageFrame(Message{
+			Type:       "cursor_position",
+			ClientID:   c.ClientID,
+			DocumentID: s.id,
+			Data: map[string]interface{}{
+				"clientId": c.ClientID,
+				"username": c.Username,
+				"color":    c.Color,
+				"position": c.Position,
+			},
+		}), "")
+	}
+	for _, sel := range snap.Selections {
+		s.broadcast(messageFrame(Message{
+			Type:       "selection_change",
+			ClientID:   sel.ClientID,
+			DocumentID: s.id,
+			Data: map[string]interface{}{
+				"clientId": sel.ClientID,
+				"username": sel.Username,
+				"color":    sel.Color,
+				"start":    sel.Start,
+				"end":      sel.End,
+			},
+		}), "")
+	}
+	for _, t := range snap.Typing {
+		s.broadcast(messageFrame(Message{
+			Type:       "typing_start",
+			ClientID:   t.ClientID,
+			DocumentID: s.id,
+			Data: map[string]interface{}{
+				"userId":   t.ClientID,
+				"username": t.Username,
+				"color":    t.Color,
+			},
+		}), "")
+	}
+}
+
+// adoptContent replaces the local document with a version from another node
+func (s *DocumentSession) adoptContent(content string, version int) {
+	s.doc.OTManager.Reset(content, version)
+
+	s.doc.mu.Lock()
+	s.doc.Content = content
+	s.doc.Version = version
+	s.doc.mu.Unlock()
+}
+
+// decodeData converts relayed message data, decoded generically, into a struct
+func decodeData(data interface{}, v interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// stringField reads a string from relayed message data
+func stringField(data map[string]interface{}, key string) string {
+	v, _ := data[key].(string)
+	return v
+}
+
+// intField reads a number from relayed message data
+func intField(data map[string]interface{}, key string) int {
+	v, _ := data[key].(float64)
+	return int(v)
+}
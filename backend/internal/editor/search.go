@@ -0,0 +1,440 @@
+// internal/editor/search.go
+package editor
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"collaborative-editor/pkg/ot"
+	"collaborative-editor/pkg/protocol"
+)
+
+const (
+	// Search scope covering every file of the connection's workspace
+	scopeWorkspace = "workspace"
+
+	// Most matches one search returns; replace_all has no limit
+	maxSearchMatches = 1000
+
+	// Longest line excerpt returned with a match
+	maxPreviewLength = 200
+)
+
+// SearchMatch is one occurrence of a search. Start and End are offsets into
+// the document like every other range; Line and Column count from 1.
+type SearchMatch struct {
+	DocumentID string `json:"documentId"`
+	FileID     string `json:"fileId,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Start      int    `json:"start"`
+	End        int    `json:"end"`
+	Line       int    `json:"line"`
+	Column     int    `json:"column"`
+	Text       string `json:"text"`
+	Preview    string `json:"preview"`
+}
+
+// ReplaceResult reports what a replace_all did to one document
+type ReplaceResult struct {
+	DocumentID   string `json:"documentId"`
+	FileID       string `json:"fileId,omitempty"`
+	Path         string `json:"path,omitempty"`
+	Replacements int    `json:"replacements"`
+	Version      int    `json:"version"`
+	Error        string `json:"error,omitempty"`
+}
+
+// replaceEvent asks a session to run a replace_all on behalf of a workspace
+// search or the REST API, and to report the result on reply
+type replaceEvent struct {
+	clientID string
+	query    protocol.ReplaceQuery
+	reply    chan replaceReply
+}
+
+type replaceReply struct {
+	result ReplaceResult
+	err    error
+}
+
+// compileSearch turns a search into the regular expression that finds it
+func compileSearch(q protocol.SearchQuery) (*regexp.Regexp, error) {
+	pattern := q.Query
+	if !q.Regex {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if q.WholeWord {
+		pattern = `\b(?:` + pattern + `)\b`
+	}
+	if !q.CaseSensitive {
+		pattern = "(?i)" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+// findMatches returns the submatch indexes of every non-empty match in
+// content, and whether there were more than limit; limit < 0 means all
+func findMatches(re *regexp.Regexp, content string, limit int) ([][]int, bool) {
+	var matches [][]int
+	for _, m := range re.FindAllStringSubmatchIndex(content, -1) {
+		if m[0] == m[1] {
+			// Empty matches, like those of ^ or a*, have nothing to replace
+			continue
+		}
+		if limit >= 0 && len(matches) == limit {
+			return matches, true
+		}
+		matches = append(matches, m)
+	}
+	return matches, false
+}
+
+// searchDocument finds up to limit matches in a document's content
+func searchDocument(re *regexp.Regexp, docID, content string, limit int) ([]SearchMatch, bool) {
+	found, truncated := findMatches(re, content, limit)
+
+	matches := make([]SearchMatch, 0, len(found))
+	line, lineStart, scanned := 1, 0, 0
+	for _, m := range found {
+		// Matches come in order, so lines are counted in one pass
+		for ; scanned < m[0]; scanned++ {
+			if content[scanned] == '\n' {
+				line++
+				lineStart = scanned + 1
+			}
+		}
+
+		lineEnd := strings.IndexByte(content[m[0]:], '\n')
+		if lineEnd < 0 {
+			lineEnd = len(content)
+		} else {
+			lineEnd += m[0]
+		}
+		preview := content[lineStart:lineEnd]
+		if len(preview) > maxPreviewLength {
+			preview = preview[:maxPreviewLength]
+		}
+
+		matches = append(matches, SearchMatch{
+			DocumentID: docID,
+			Start:      m[0],
+			End:        m[1],
+			Line:       line,
+			Column:     m[0] - lineStart + 1,
+			Text:       content[m[0]:m[1]],
+			Preview:    preview,
+		})
+	}
+	return matches, truncated
+}
+
+// replacementOps turns every match in content into a deletion of the match
+// and an insertion of its replacement. They run from the end of the document
+// to the start, so each operation's position holds when it is applied.
+func replacementOps(re *regexp.Regexp, q protocol.ReplaceQuery, content string) []ot.Operation {
+	matches, _ := findMatches(re, content, -1)
+
+	var ops []ot.Operation
+	for i := len(matches) - 1; i >= 0; i-- {
+		m := matches[i]
+		replacement := q.Replacement
+		if q.Regex {
+			replacement = string(re.ExpandString(nil, q.Replacement, content, m))
+		}
+		if replacement == content[m[0]:m[1]] {
+			continue
+		}
+
+		ops = append(ops, ot.Operation{Type: ot.OpDelete, Position: m[0], Length: m[1] - m[0]})
+		if replacement != "" {
+			ops = append(ops, ot.Operation{Type: ot.OpInsert, Position: m[0], Content: replacement})
+		}
+	}
+	return ops
+}
+
+// countReplacements counts the matches a replace_all would change
+func countReplacements(ops []ot.Operation) int {
+	n := 0
+	for _, op := range ops {
+		if op.Type == ot.OpDelete {
+			n++
+		}
+	}
+	return n
+}
+
+// handleSearch answers a search of this document
+func (s *DocumentSession) handleSearch(client *Client, msg *protocol.Search) {
+	re, err := compileSearch(msg.Data)
+	if err != nil {
+		s.sendErrorCode(client, err.Error(), "invalid_message", "data.query")
+		return
+	}
+
+	content, version := s.doc.OTManager.GetDocument()
+	matches, truncated := searchDocument(re, s.id, content, maxSearchMatches)
+
+	client.queue(messageFrame(Message{
+		Type:       "search_results",
+		DocumentID: s.id,
+		Version:    version,
+		Data: map[string]interface{}{
+			"query":     msg.Data,
+			"matches":   matches,
+			"truncated": truncated,
+		},
+	}))
+}
+
+// handleReplaceAll replaces every match of a search in this document
+func (s *DocumentSession) handleReplaceAll(client *Client, msg *protocol.ReplaceAll) {
+	if s.suggesting[client.id] {
+		s.sendErrorCode(client, "Edits are suggestions while suggesting", "suggesting_mode", "type")
+		return
+	}
+
+	result, err := s.replaceAll(client.id, msg.Data)
+	if errors.Is(err, ErrRegionLocked) {
+		s.rejectLockedEdit(client, err)
+		return
+	}
+	if err != nil {
+		log.Printf("[SESSION] Error replacing in %s: %v", s.id, err)
+		s.sendError(client, "Failed to replace")
+		return
+	}
+
+	client.queue(messageFrame(Message{
+		Type:       "replace_result",
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"query":   msg.Data,
+			"results": []ReplaceResult{result},
+		},
+	}))
+}
+
+// handleReplaceEvent runs a replace_all requested from outside the session
+func (s *DocumentSession) handleReplaceEvent(e replaceEvent) {
+	if s.suggesting[e.clientID] {
+		e.reply <- replaceReply{err: errors.New("edits are suggestions while suggesting")}
+		return
+	}
+
+	result, err := s.replaceAll(e.clientID, e.query)
+	e.reply <- replaceReply{result: result, err: err}
+}
+
+// replaceAll replaces every match of a search as one edit. A node that does
+// not own the document forwards the search to the owner, which finds the
+// matches in its own, authoritative, copy; the count returned is then this
+// node's estimate.
+func (s *DocumentSession) replaceAll(clientID string, q protocol.ReplaceQuery) (ReplaceResult, error) {
+	re, err := compileSearch(q.Search())
+	if err != nil {
+		return ReplaceResult{}, err
+	}
+
+	if owner := s.service.owner(s.id); owner != s.service.nodeID {
+		content, version := s.doc.OTManager.GetDocument()
+		result := ReplaceResult{
+			DocumentID:   s.id,
+			Replacements: countReplacements(replacementOps(re, q, content)),
+			Version:      version,
+		}
+		if result.Replacements == 0 {
+			return result, nil
+		}
+		return result, s.forwardReplace(clientID, owner, q)
+	}
+
+	return s.applyReplace(clientID, re, q)
+}
+
+// applyReplace edits the owner's copy of the document and sends the result
+// to every client as a single text update
+func (s *DocumentSession) applyReplace(clientID string, re *regexp.Regexp, q protocol.ReplaceQuery) (ReplaceResult, error) {
+	replacements := 0
+	content, version, err := s.service.EditDocument(s.id, clientID, func(content string) ([]ot.Operation, error) {
+		ops := replacementOps(re, q, content)
+		replacements = countReplacements(ops)
+		return ops, nil
+	})
+	if err != nil {
+		return ReplaceResult{}, err
+	}
+
+	result := ReplaceResult{DocumentID: s.id, Replacements: replacements, Version: version}
+	if replacements == 0 {
+		return result, nil
+	}
+
+	log.Printf("[SESSION] Client %s replaced %d matches of %q in %s (version %d)",
+		clientID, replacements, q.Query, s.id, version)
+
+	// The requester has not made the edit locally, so it must apply it too
+	msg := Message{
+		Type:       "text_update",
+		Content:    content,
+		ClientID:   "replace:" + clientID,
+		DocumentID: s.id,
+		Version:    version,
+	}
+	s.broadcast(messageFrame(msg), "")
+	s.relay(msg)
+	s.afterEdit()
+	return result, nil
+}
+
+// Search searches every file of the workspace this node has loaded
+func (w *Workspace) Search(q protocol.SearchQuery) ([]SearchMatch, bool, error) {
+	re, err := compileSearch(q)
+	if err != nil {
+		return nil, false, err
+	}
+
+	matches := []SearchMatch{}
+	for _, file := range w.searchFiles() {
+		doc, ok := w.service.loadedDocument(file.DocumentID)
+		if !ok {
+			continue
+		}
+
+		content, _ := doc.OTManager.GetDocument()
+		found, truncated := searchDocument(re, file.DocumentID, content, maxSearchMatches-len(matches))
+		for i := range found {
+			found[i].FileID = file.ID
+			found[i].Path = file.path
+		}
+		matches = append(matches, found...)
+		if truncated {
+			return matches, true, nil
+		}
+	}
+	return matches, false, nil
+}
+
+// ReplaceAll replaces every match of a search in each file of the workspace.
+// Each document changes in one edit of its own.
+func (w *Workspace) ReplaceAll(clientID string, q protocol.ReplaceQuery) ([]ReplaceResult, error) {
+	re, err := compileSearch(q.Search())
+	if err != nil {
+		return nil, err
+	}
+
+	results := []ReplaceResult{}
+	for _, file := range w.searchFiles() {
+		doc, ok := w.service.loadedDocument(file.DocumentID)
+		if !ok {
+			continue
+		}
+		if content, _ := doc.OTManager.GetDocument(); !re.MatchString(content) {
+			continue
+		}
+
+		result, err := w.service.replaceInDocument(file.DocumentID, clientID, q)
+		result.DocumentID, result.FileID, result.Path = file.DocumentID, file.ID, file.path
+		if err != nil {
+			log.Printf("[WORKSPACE] Replace in %s of %s failed: %v", file.path, w.ID, err)
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// searchFile is a workspace file with its path
+type searchFile struct {
+	WorkspaceFile
+	path string
+}
+
+// searchFiles lists the workspace's files, not folders, ordered by path
+func (w *Workspace) searchFiles() []searchFile {
+	w.mu.Lock()
+	defer w.unlock()
+
+	var files []searchFile
+	for _, f := range w.files {
+		if f.Kind == kindFile {
+			files = append(files, searchFile{WorkspaceFile: *f, path: w.path(f.ID)})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	return files
+}
+
+// replaceInDocument runs a replace_all in a document's session and waits for it
+func (s *Service) replaceInDocument(docID, clientID string, q protocol.ReplaceQuery) (ReplaceResult, error) {
+	session, err := s.hub.ensureSession(docID)
+	if err != nil {
+		return ReplaceResult{}, err
+	}
+
+	reply := make(chan replaceReply, 1)
+	if !session.post(replaceEvent{clientID: clientID, query: q, reply: reply}) {
+		return ReplaceResult{}, errors.New("document session stopped")
+	}
+
+	select {
+	case r := <-reply:
+		return r.result, r.err
+	case <-session.done:
+		return ReplaceResult{}, errors.New("document session stopped")
+	}
+}
+
+// handleSearchMessage runs a search or replace_all over the client's whole
+// workspace; those about one document go to its session
+func (c *Client) handleSearchMessage(env protocol.Envelope, payload interface{}) {
+	if err := protocol.Validate(payload, protocol.ValidationContext{}); err != nil {
+		c.sendDecodeError(env.DocumentID, err)
+		return
+	}
+
+	w := c.workspace
+	if w == nil {
+		c.sendErrorCode("Connection is not in a workspace", "no_workspace", "data.scope")
+		return
+	}
+
+	switch m := payload.(type) {
+	case *protocol.Search:
+		matches, truncated, err := w.Search(m.Data)
+		if err != nil {
+			c.sendErrorCode(err.Error(), "invalid_message", "data.query")
+			return
+		}
+		c.queue(messageFrame(Message{
+			Type: "search_results",
+			Data: map[string]interface{}{
+				"workspaceId": w.ID,
+				"query":       m.Data,
+				"matches":     matches,
+				"truncated":   truncated,
+			},
+		}))
+
+	case *protocol.ReplaceAll:
+		// Waits on every document's session, so it runs off the read loop
+		go func() {
+			results, err := w.ReplaceAll(c.id, m.Data)
+			if err != nil {
+				c.sendErrorCode(err.Error(), "invalid_message", "data.query")
+				return
+			}
+			c.queue(messageFrame(Message{
+				Type: "replace_result",
+				Data: map[string]interface{}{
+					"workspaceId": w.ID,
+					"query":       m.Data,
+					"results":     results,
+				},
+			}))
+		}()
+	}
+}
@@ -2,12 +2,20 @@
 package editor
 
 import (
-	"encoding/json"
 	"log"
 	"net/http"
 	"sync"
 	"time"
 
+	"collaborative-editor/internal/backplane"
+	"collaborative-editor/internal/cluster"
+	"collaborative-editor/internal/execution"
+	"collaborative-editor/internal/format"
+	"collaborative-editor/internal/git"
+	"collaborative-editor/internal/lsp"
+	"collaborative-editor/internal/terminal"
+	"collaborative-editor/pkg/ot"
+
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
@@ -22,8 +30,35 @@ type Service struct {
 	// Document storage (in-memory for now, will be Redis later)
 	documents map[string]*Document
 
+	// File trees of multi-file workspaces, kept alongside the documents
+	workspaces map[string]*Workspace
+
 	// Metrics
 	metrics *Metrics
+
+	// Cross-node relay of document messages and this node's identity on it
+	backplane     backplane.Backplane
+	ownsBackplane bool
+	nodeID        string
+
+	// Document ownership across the cluster; nil when running alone
+	membership       *cluster.Membership
+	nodeSubscription backplane.Subscription
+
+	// Runs documents' code in a sandbox
+	runner *execution.Runner
+
+	// Language servers of workspace files open on this node
+	lsp *languageServers
+
+	// Formatters format_document and format on save run
+	formatters *format.Formatters
+
+	// Shells of workspaces' shared terminals; nil when they are disabled
+	shells *terminal.Shells
+
+	// Repositories workspaces commit to; nil when git is disabled
+	repos *git.Repositories
 }
 
 // Config holds service configuration
@@ -33,6 +68,44 @@ type Config struct {
 	ReadTimeout    time.Duration
 	PingInterval   time.Duration
 	MaxClients     int
+
+	// Queue bounds each client's outbound messages; zero fields use DefaultQueuePolicy
+	Queue QueuePolicy
+
+	// NodeID identifies this instance on the backplane; generated if empty
+	NodeID string
+
+	// Backplane relays document messages between instances; in-process if nil.
+	// The caller closes a backplane it passes in.
+	Backplane backplane.Backplane
+
+	// Cluster lists the node IDs sharing documents. Each document is owned by
+	// one of them, which applies all its edits; empty means this node owns all,
+	// and nodes sharing the backplane keep the lowest node ID's edits when
+	// theirs conflict.
+	Cluster []string
+
+	// Execution configures the sandbox run_code uses; default languages and
+	// limits if nil
+	Execution *execution.Config
+
+	// LanguageServers are started per workspace for the files they handle;
+	// none if empty
+	LanguageServers []lsp.ServerConfig
+
+	// Formatting configures the formatters; the default ones if nil
+	Formatting *format.Config
+
+	// FormatOnSave formats documents that have a formatter when they are saved
+	FormatOnSave bool
+
+	// Terminal enables workspaces' shared terminals, which run unsandboxed
+	// shells as the server's user; disabled if nil
+	Terminal *terminal.Config
+
+	// Git lets workspaces commit their files into local repositories kept
+	// under its root; disabled if nil
+	Git *git.Config
 }
 
 // Document represents a collaborative document
@@ -43,11 +116,28 @@ type Document struct {
 	UpdatedAt time.Time `json:"updated_at"`
 	CreatedAt time.Time `json:"created_at"`
 
-	// Track active editors
-	OTManager     *OTManager         `json:"-"`
-	CursorManager *CursorManager     `json:"-"`
-	ActiveClients map[string]*Client `json:"-"`
-	mu            sync.RWMutex       `json:"-"`
+	// OT and cursor state, owned by the document's session while it runs
+	OTManager     *OTManager     `json:"-"`
+	CursorManager *CursorManager `json:"-"`
+	Presence      *Presence      `json:"-"`
+	Palette       *Palette       `json:"-"`
+
+	// Comment threads, persisted with the content
+	Comments *CommentStore `json:"comments"`
+
+	// Changes proposed in suggesting mode, persisted with the content
+	Suggestions *SuggestionStore `json:"suggestions"`
+
+	// Chat between the document's collaborators
+	Chat *ChatLog `json:"chat"`
+
+	// Regions reserved by connected clients; they end with the connection
+	Locks *LockStore `json:"-"`
+
+	// Language, indentation, tags and the like, persisted with the content
+	Metadata *MetadataStore `json:"metadata"`
+
+	mu sync.RWMutex `json:"-"`
 }
 
 // Metrics tracks service performance
@@ -57,9 +147,32 @@ type Metrics struct {
 	MessagesReceived  int64
 	DocumentsActive   int64
 
+	// Slow-consumer handling
+	FramesCoalesced int64
+	FramesDropped   int64
+	Resyncs         int64
+	SlowClosed      int64
+
 	mu sync.RWMutex
 }
 
+// recordQueueResult counts frames the slow-consumer policy did not simply queue
+func (m *Metrics) recordQueueResult(result queueResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch result {
+	case queueCoalesced:
+		m.FramesCoalesced++
+	case queueDropped:
+		m.FramesDropped++
+	case queueResync:
+		m.Resyncs++
+	case queueClosed:
+		m.SlowClosed++
+	}
+}
+
 // NewService creates a new editor service
 func NewService(cfg *Config) *Service {
 	if cfg == nil {
@@ -72,37 +185,70 @@ func NewService(cfg *Config) *Service {
 		}
 	}
 
-	return &Service{
-		hub: &Hub{
-			clients:         make(map[*Client]bool),
-			broadcast:       make(chan []byte, 256),
-			register:        make(chan *Client),
-			unregister:      make(chan *Client),
-			documentClients: make(map[string]map[*Client]bool),
-		},
+	s := &Service{
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
+			// Offer permessage-deflate; writes are only compressed for clients
+			// that also negotiate the compression capability
+			EnableCompression: true,
 			CheckOrigin: func(r *http.Request) bool {
 				// TODO: Implement proper CORS check in production
 				return true
 			},
 		},
-		config:    cfg,
-		documents: make(map[string]*Document),
-		metrics:   &Metrics{},
+		config:     cfg,
+		documents:  make(map[string]*Document),
+		workspaces: make(map[string]*Workspace),
+		metrics:    &Metrics{},
+		runner:     execution.NewRunner(cfg.Execution),
+		formatters: format.New(cfg.Formatting),
 	}
+	if cfg.Terminal != nil {
+		s.shells = terminal.NewShells(cfg.Terminal)
+	}
+	if cfg.Git != nil {
+		s.repos = git.NewRepositories(cfg.Git)
+	}
+	s.hub = NewHub(s)
+	s.lsp = newLanguageServers(s, cfg.LanguageServers)
+
+	s.nodeID = cfg.NodeID
+	if s.nodeID == "" {
+		s.nodeID = uuid.New().String()[:8]
+	}
+	s.backplane = cfg.Backplane
+	if s.backplane == nil {
+		s.backplane = backplane.NewMemory()
+		s.ownsBackplane = true
+	}
+	if len(cfg.Cluster) > 0 {
+		s.membership = cluster.NewMembership(s.nodeID, cfg.Cluster, s.backplane)
+		s.membership.OnChange = func(nodes []string) {
+			s.hub.ownershipChanged()
+		}
+	}
+
+	return s
 }
 
 // Start initializes and starts the service
 func (s *Service) Start() error {
-	log.Println("Starting editor service...")
-
-	// Start the hub
-	go s.hub.run()
+	log.Printf("Starting editor service (node %s)...", s.nodeID)
 
 	// Start metrics collector
 	go s.collectMetrics()
+	go s.hub.run()
+
+	// Receive edits other nodes forward for documents this node owns
+	if err := s.subscribeNode(); err != nil {
+		return err
+	}
+	if s.membership != nil {
+		if err := s.membership.Start(); err != nil {
+			return err
+		}
+	}
 
 	// Initialize any required resources
 	if err := s.initialize(); err != nil {
@@ -117,20 +263,50 @@ func (s *Service) Start() error {
 func (s *Service) Shutdown() {
 	log.Println("Shutting down editor service...")
 
+	// Hand this node's documents to the rest of the cluster
+	if s.membership != nil {
+		s.membership.Stop()
+	}
+	if s.nodeSubscription != nil {
+		s.nodeSubscription.Unsubscribe()
+	}
+
 	// Close all client connections
 	s.hub.shutdown()
+	s.closeWorkspaces()
 
 	// Save any pending changes
 	s.savePendingDocuments()
 
+	if s.ownsBackplane {
+		if err := s.backplane.Close(); err != nil {
+			log.Printf("Error closing backplane: %v", err)
+		}
+	}
+
 	log.Println("Editor service shut down complete")
 }
 
-// HandleWebSocket handles WebSocket upgrade requests
+// HandleWebSocket handles WebSocket upgrade requests. A connection opens
+// one document with ?doc=, or joins a workspace with ?workspace= and
+// optionally opens one of its files with &file=.
 func (s *Service) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
 	// Extract document ID from query params
-	docID := r.URL.Query().Get("doc")
-	if docID == "" {
+	docID := query.Get("doc")
+	var ws *Workspace
+	if wsID := query.Get("workspace"); wsID != "" {
+		ws = s.GetWorkspace(wsID)
+		if fileID := query.Get("file"); fileID != "" {
+			file, ok := ws.File(fileID)
+			if !ok || file.Kind != kindFile {
+				http.Error(w, "Unknown file", http.StatusNotFound)
+				return
+			}
+			docID = file.DocumentID
+		}
+	} else if docID == "" {
 		http.Error(w, "Missing document ID", http.StatusBadRequest)
 		return
 	}
@@ -142,43 +318,29 @@ func (s *Service) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create new client with proper ID
-	clientID := uuid.New().String()
-	client := &Client{
-		id:         clientID[:8], // Use first 8 chars for display
-		hub:        s.hub,
-		conn:       conn,
-		send:       make(chan []byte, 256),
-		documentID: docID,
-		service:    s,
-		username:   "User-" + clientID[:4],
-		color:      "#4ECDC4",
+	// The user key lets a returning user keep their color
+	client := NewClient(s.hub, conn, s, docID, query.Get("user"))
+	if ws != nil {
+		client.workspace = ws
+		client.color = ws.Palette.Assign(client.userKey, nil)
+	} else if doc, err := s.GetDocument(docID); err == nil {
+		client.color = doc.Palette.Assign(client.userKey, doc.remoteColors(s.nodeID))
 	}
 
-	// Register client
-	s.hub.register <- client
-
 	// Update metrics
 	s.metrics.mu.Lock()
 	s.metrics.ActiveConnections++
 	s.metrics.mu.Unlock()
 
-	initMsg := Message{
-		Type:     "init",
-		ClientID: client.id,
-	}
-	initData, _ := json.Marshal(initMsg)
+	// Legacy init; clients that send hello get a second init with the negotiated protocol
+	client.sendInitMessage()
+
+	// Join the document's session, which sends the document state
+	s.hub.Register(client)
 
 	// Start client goroutines
 	go client.writePump()
 	go client.readPump()
-	client.send <- initData
-
-	// Then register with hub
-	s.hub.register <- client
-
-	// Then send document state
-	s.sendDocumentState(client, docID)
 
 	log.Printf("Client %s connected for document %s", client.id, docID)
 }
@@ -199,17 +361,28 @@ func (s *Service) GetDocument(id string) (*Document, error) {
 			UpdatedAt:     time.Now(),
 			OTManager:     NewOTManager(id), // Initialize OT manager
 			CursorManager: NewCursorManager(),
-			ActiveClients: make(map[string]*Client),
+			Presence:      NewPresence(),
+			Palette:       NewPalette(),
+			Comments:      NewCommentStore(),
+			Suggestions:   NewSuggestionStore(),
+			Chat:          NewChatLog(),
+			Locks:         NewLockStore(),
+			Metadata:      NewMetadataStore(),
 		}
+		// Comment anchors, suggestions and locks follow every edit, and
+		// locked regions are closed to everyone but their owner
+		doc.OTManager.Observe(doc.Comments.Transform)
+		doc.OTManager.Observe(doc.Suggestions.Transform)
+		doc.OTManager.Observe(doc.Locks.Transform)
+		doc.OTManager.SetGuard(doc.Locks.Check)
 
 		s.mu.Lock()
-		s.documents[id] = doc
+		if existing, ok := s.documents[id]; ok {
+			doc = existing
+		} else {
+			s.documents[id] = doc
+		}
 		s.mu.Unlock()
-
-		// Update metrics
-		s.metrics.mu.Lock()
-		s.metrics.DocumentsActive++
-		s.metrics.mu.Unlock()
 	}
 
 	return doc, nil
@@ -223,125 +396,88 @@ func (s *Service) UpdateDocument(id string, content string, clientID string, cli
 		return "", 0, err
 	}
 
-	// Use OT only for text updates
-	if doc.OTManager != nil {
-		newContent, newVersion, err := doc.OTManager.ProcessTextUpdate(clientID, content, clientVersion)
-		if err == nil {
-			doc.mu.Lock()
-			doc.Content = newContent
-			doc.Version = newVersion
-			doc.UpdatedAt = time.Now()
-			doc.mu.Unlock()
-			return newContent, newVersion, nil
-		}
+	// A refused edit is returned rather than written over the document, which
+	// would bypass region locks and leave anchors behind the content
+	newContent, newVersion, err := doc.OTManager.ProcessTextUpdate(clientID, content, clientVersion)
+	if err != nil {
+		return "", 0, err
 	}
 
-	// Fallback to simple versioning
 	doc.mu.Lock()
-	doc.Content = content
-	doc.Version++
+	doc.Content = newContent
+	doc.Version = newVersion
 	doc.UpdatedAt = time.Now()
-	newVersion := doc.Version
 	doc.mu.Unlock()
 
-	return content, newVersion, nil
+	return newContent, newVersion, nil
 }
 
-// BroadcastToDocument sends a message to all clients editing a document
-func (s *Service) BroadcastToDocument(docID string, message []byte, excludeClient *Client) {
-	doc, err := s.GetDocument(docID)
+// EditDocument applies an atomic multi-operation edit to a document through OT
+func (s *Service) EditDocument(id string, clientID string, build func(content string) ([]ot.Operation, error)) (string, int, error) {
+	doc, err := s.GetDocument(id)
 	if err != nil {
-		log.Printf("Error getting document %s: %v", docID, err)
-		return
-	}
-
-	doc.mu.RLock()
-	defer doc.mu.RUnlock()
-
-	for _, client := range doc.ActiveClients {
-		if client != excludeClient {
-			select {
-			case client.send <- message:
-			default:
-				// Client's send channel is full, close it
-				close(client.send)
-				delete(doc.ActiveClients, client.id)
-			}
-		}
+		return "", 0, err
 	}
 
-	// Update metrics
-	s.metrics.mu.Lock()
-	s.metrics.MessagesSent++
-	s.metrics.mu.Unlock()
-}
-
-// sendDocumentState sends the current document state to a client
-func (s *Service) sendDocumentState(client *Client, docID string) {
-	doc, err := s.GetDocument(docID)
+	newContent, newVersion, err := doc.OTManager.Edit(clientID, build)
 	if err != nil {
-		log.Printf("Error getting document: %v", err)
-		return
+		return "", 0, err
 	}
 
-	// Add client to document's active clients
 	doc.mu.Lock()
-	doc.ActiveClients[client.id] = client
+	doc.Content = newContent
+	doc.Version = newVersion
+	doc.UpdatedAt = time.Now()
 	doc.mu.Unlock()
 
-	// Send current document state
-	state := map[string]interface{}{
-		"type":    "document_state",
-		"content": doc.Content,
-		"version": doc.Version,
-		"docId":   doc.ID,
-	}
+	return newContent, newVersion, nil
+}
 
-	data, err := json.Marshal(state)
-	if err != nil {
-		log.Printf("Error marshaling document state: %v", err)
-		return
-	}
+// loadedDocument returns a document this node already has, without creating it
+func (s *Service) loadedDocument(id string) (*Document, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	client.send <- data
+	doc, ok := s.documents[id]
+	return doc, ok
 }
 
-// RemoveClientFromDocument removes a client from a document's active clients
-func (s *Service) RemoveClientFromDocument(client *Client) {
-	if client.documentID == "" {
-		return
-	}
-
-	doc, err := s.GetDocument(client.documentID)
-	if err != nil {
-		return
+// BroadcastToDocument sends a message to all clients editing a document
+func (s *Service) BroadcastToDocument(docID string, message *Frame, excludeClient *Client) {
+	excludeClientID := ""
+	if excludeClient != nil {
+		excludeClientID = excludeClient.id
 	}
 
-	doc.mu.Lock()
-	delete(doc.ActiveClients, client.id)
-	activeCount := len(doc.ActiveClients)
-	doc.mu.Unlock()
-
-	// If no clients are editing, mark document as inactive
-	if activeCount == 0 {
-		s.metrics.mu.Lock()
-		s.metrics.DocumentsActive--
-		s.metrics.mu.Unlock()
-	}
+	s.hub.BroadcastToDocument(docID, message, excludeClientID)
 }
 
 // GetMetrics returns current service metrics
 func (s *Service) GetMetrics() map[string]interface{} {
+	// Read the hub first; it takes the metrics lock while holding its own
+	hubClients := s.hub.ClientCount()
+	queues := s.hub.QueueStats()
+
 	s.metrics.mu.RLock()
 	defer s.metrics.mu.RUnlock()
 
-	return map[string]interface{}{
-		"active_connections": s.metrics.ActiveConnections,
-		"messages_sent":      s.metrics.MessagesSent,
-		"messages_received":  s.metrics.MessagesReceived,
-		"documents_active":   s.metrics.DocumentsActive,
-		"hub_clients":        len(s.hub.clients),
+	metrics := map[string]interface{}{
+		"active_connections":  s.metrics.ActiveConnections,
+		"messages_sent":       s.metrics.MessagesSent,
+		"messages_received":   s.metrics.MessagesReceived,
+		"documents_active":    s.metrics.DocumentsActive,
+		"frames_coalesced":    s.metrics.FramesCoalesced,
+		"frames_dropped":      s.metrics.FramesDropped,
+		"resyncs":             s.metrics.Resyncs,
+		"slow_clients_closed": s.metrics.SlowClosed,
+		"hub_clients":         hubClients,
+		"client_queues":       queues,
+		"node_id":             s.nodeID,
+	}
+	if s.membership != nil {
+		metrics["cluster_nodes"] = s.membership.Nodes()
 	}
+	return metrics
 }
 
 // initialize performs any required initialization
@@ -358,8 +494,13 @@ func (s *Service) savePendingDocuments() {
 	defer s.mu.RUnlock()
 
 	for id, doc := range s.documents {
+		doc.mu.RLock()
+		length := len(doc.Content)
+		doc.mu.RUnlock()
+
 		// TODO: Save to database
-		log.Printf("Saving document %s with content length %d", id, len(doc.Content))
+		log.Printf("Saving document %s with content length %d, %d comment threads and %d suggestions",
+			id, length, doc.Comments.Len(), doc.Suggestions.Len())
 	}
 }
 
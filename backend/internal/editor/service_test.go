@@ -0,0 +1,34 @@
+package editor
+
+import (
+	"errors"
+	"testing"
+
+	"collaborative-editor/pkg/ot"
+)
+
+func TestUpdateDocumentReturnsRefusedEdits(t *testing.T) {
+	s := NewService(&Config{})
+	if _, _, err := s.UpdateDocument("doc", "hello", "c1", 1); err != nil {
+		t.Fatalf("first edit: %v", err)
+	}
+	doc, _ := s.loadedDocument("doc")
+
+	observed := 0
+	doc.OTManager.Observe(func(ot.Operation) { observed++ })
+	refused := errors.New("refused")
+	doc.OTManager.guard = func(ot.Operation) error { return refused }
+
+	if _, _, err := s.UpdateDocument("doc", "goodbye", "c1", 2); !errors.Is(err, refused) {
+		t.Fatalf("UpdateDocument = %v, want the refusal", err)
+	}
+	if content, version := doc.OTManager.GetDocument(); content != "hello" || version != 1 {
+		t.Fatalf("document is %q at version %d after a refused edit", content, version)
+	}
+	if doc.Content != "hello" || doc.Version != 1 {
+		t.Fatalf("stored content %q at version %d after a refused edit", doc.Content, doc.Version)
+	}
+	if observed != 0 {
+		t.Fatalf("observers saw %d operations of a refused edit", observed)
+	}
+}
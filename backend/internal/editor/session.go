@@ -0,0 +1,704 @@
+// internal/editor/session.go
+package editor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"collaborative-editor/internal/backplane"
+	"collaborative-editor/internal/format"
+	"collaborative-editor/pkg/protocol"
+)
+
+// Size of a session's event queue before senders block
+const sessionQueueSize = 256
+
+// DocumentSession is the actor that owns one document's connected clients,
+// OT state and cursor state. Everything it owns is only touched from run,
+// so a busy document never adds latency to the others.
+type DocumentSession struct {
+	id      string
+	doc     *Document
+	service *Service
+
+	// Clients joined to this document, owned by run
+	clients map[*Client]bool
+
+	// Backplane subscription relaying this document between nodes
+	subscription backplane.Subscription
+
+	// Whether this node owns the document, owned by run
+	owner bool
+
+	// Follower to followed user, across all nodes, and the last viewport of
+	// each user; owned by run
+	follows   map[string]string
+	viewports map[string]Message
+
+	// Local clients in suggesting mode, owned by run
+	suggesting map[string]bool
+
+	// The document's program running on any node, owned by run
+	execution *codeRun
+
+	// The last format applied here, for updates sent before clients had it;
+	// owned by run
+	lastFormat *formatChange
+
+	// Unix nanoseconds of the last queued event, for reaping headless sessions
+	lastEvent atomic.Int64
+
+	// Ordered queue of joins, leaves, client messages and broadcasts
+	events chan interface{}
+
+	// Closed when run exits
+	done chan struct{}
+}
+
+// Session events
+type (
+	joinEvent struct {
+		client *Client
+	}
+
+	// A client finished the hello handshake
+	negotiatedEvent struct {
+		client *Client
+	}
+
+	leaveEvent struct {
+		client *Client
+	}
+
+	// A client changed its profile in another of its documents
+	profileEvent struct {
+		client *Client
+	}
+
+	messageEvent struct {
+		client  *Client
+		msgType string
+		payload interface{}
+	}
+
+	broadcastEvent struct {
+		frame           *Frame
+		excludeClientID string
+	}
+
+	stopEvent struct{}
+)
+
+// newDocumentSession creates a session for a document; the caller starts run
+func newDocumentSession(doc *Document, service *Service) *DocumentSession {
+	s := &DocumentSession{
+		id:         doc.ID,
+		doc:        doc,
+		service:    service,
+		clients:    make(map[*Client]bool),
+		owner:      service.isOwner(doc.ID),
+		follows:    make(map[string]string),
+		viewports:  make(map[string]Message),
+		suggesting: make(map[string]bool),
+		events:     make(chan interface{}, sessionQueueSize),
+		done:       make(chan struct{}),
+	}
+	s.lastEvent.Store(time.Now().UnixNano())
+	return s
+}
+
+// post queues an event for the session, reporting false if it already stopped
+func (s *DocumentSession) post(event interface{}) bool {
+	s.lastEvent.Store(time.Now().UnixNano())
+
+	select {
+	case s.events <- event:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// Deliver hands a decoded client message to the session
+func (s *DocumentSession) Deliver(client *Client, msgType string, payload interface{}) {
+	if !s.post(messageEvent{client: client, msgType: msgType, payload: payload}) {
+		log.Printf("[SESSION] Dropped %s from %s, session %s stopped", msgType, client.id, s.id)
+	}
+}
+
+// Broadcast sends a frame to every client in the document except one
+func (s *DocumentSession) Broadcast(frame *Frame, excludeClientID string) {
+	s.post(broadcastEvent{frame: frame, excludeClientID: excludeClientID})
+}
+
+// run is the session's event loop
+func (s *DocumentSession) run() {
+	defer close(s.done)
+
+	log.Printf("[SESSION] Started session for document %s", s.id)
+
+	// The cleanup only undoes what this session set up; a session started
+	// for the document while this one stops keeps its own
+	s.subscribe()
+	defer s.unsubscribe()
+	defer s.stopRun()
+	defer s.service.lsp.close(s)
+
+	sweep := time.NewTicker(presenceSweepInterval)
+	defer sweep.Stop()
+
+	for {
+		var event interface{}
+		select {
+		case event = <-s.events:
+		case <-sweep.C:
+			s.sweepPresence()
+			continue
+		}
+
+		switch e := event.(type) {
+		case joinEvent:
+			s.handleJoin(e.client)
+
+		case negotiatedEvent:
+			if s.clients[e.client] {
+				s.sendPresenceState(e.client)
+			}
+
+		case leaveEvent:
+			s.handleLeave(e.client)
+
+		case profileEvent:
+			if s.clients[e.client] {
+				s.announceProfile(e.client)
+			}
+
+		case messageEvent:
+			s.handleMessage(e.client, e.msgType, e.payload)
+
+		case broadcastEvent:
+			s.broadcast(e.frame, e.excludeClientID)
+
+		case remoteEvent:
+			s.handleRemote(e.envelope)
+
+		case resyncEvent:
+			s.requestSync()
+
+		case ownershipEvent:
+			s.handleOwnershipChange()
+
+		case replaceEvent:
+			s.handleReplaceEvent(e)
+
+		case reloadEvent:
+			s.handleReloadEvent(e)
+
+		case executionEvent:
+			s.handleExecutionEvent(e)
+
+		case runEvent:
+			if _, err := s.startRun(e.clientID, e.request, e.reply); err != nil {
+				e.reply <- runReply{err: err}
+			}
+
+		case cancelRunEvent:
+			e.reply <- s.cancelRun(e.clientID, e.executionID)
+
+		case formattedEvent:
+			s.handleFormatted(e)
+
+		case formatEvent:
+			s.handleFormatEvent(e)
+
+		case metadataEvent:
+			e.reply <- s.setMetadata(apiClientID, apiClientID, e.change)
+
+		case stopEvent:
+			log.Printf("[SESSION] Stopped session for document %s", s.id)
+			return
+		}
+	}
+}
+
+// handleJoin adds a client and brings it and its peers up to date
+func (s *DocumentSession) handleJoin(client *Client) {
+	username, color := client.profileIn(s.id)
+
+	s.clients[client] = true
+	log.Printf("[SESSION] Client %s joined document %s (%d clients)", client.id, s.id, len(s.clients))
+
+	entry := s.doc.Presence.Join(client.id, username, color, s.service.nodeID)
+
+	s.detectMetadata()
+	s.sendDocumentState(client)
+	s.sendChatHistory(client)
+	s.sendPresenceState(client)
+
+	// The document is opened in its language server with its first client
+	s.service.lsp.open(s)
+	s.sendDiagnostics(client)
+
+	notification := Message{
+		Type:       "user_joined",
+		ClientID:   client.id,
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"userId":   client.id,
+			"username": username,
+			"color":    color,
+		},
+	}
+	s.broadcast(messageFrame(notification), client.id)
+	s.relay(notification)
+	s.sendPresence(entry, presenceJoined, client.id)
+}
+
+// handleLeave removes a client and tells the remaining peers
+func (s *DocumentSession) handleLeave(client *Client) {
+	if !s.clients[client] {
+		return
+	}
+	delete(s.clients, client)
+
+	if s.doc.CursorManager != nil {
+		s.doc.CursorManager.RemoveClient(client.id)
+	}
+	s.doc.Presence.Leave(client.id)
+	s.doc.Palette.Release(client.userKey)
+	s.forgetFollows(client.id)
+	delete(s.suggesting, client.id)
+	s.releaseLocks(client.id)
+
+	log.Printf("[SESSION] Client %s left document %s (%d clients)", client.id, s.id, len(s.clients))
+
+	removeMsg := Message{
+		Type:       "cursor_remove",
+		ClientID:   client.id,
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"clientId": client.id,
+		},
+	}
+	s.broadcast(messageFrame(removeMsg), client.id)
+	s.relay(removeMsg)
+
+	notification := Message{
+		Type:       "user_left",
+		ClientID:   client.id,
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"userId": client.id,
+		},
+	}
+	s.broadcast(messageFrame(notification), client.id)
+	s.relay(notification)
+	s.sendPresence(PresenceEntry{UserID: client.id}, presenceLeft, client.id)
+}
+
+// handleMessage validates a client message against the document and dispatches it
+func (s *DocumentSession) handleMessage(client *Client, msgType string, payload interface{}) {
+	if !s.clients[client] {
+		return
+	}
+
+	if err := protocol.Validate(payload, s.validationContext()); err != nil {
+		log.Printf("[SESSION] Rejected %s message from %s: %v", msgType, client.id, err)
+		client.sendDecodeError(s.id, err)
+		return
+	}
+
+	switch payload.(type) {
+	case *protocol.TextUpdate, *protocol.CursorPosition, *protocol.SelectionChange, *protocol.TypingStart,
+		*protocol.ChatMessage, *protocol.ReplaceAll:
+		s.touchPresence(client, true)
+	}
+
+	switch m := payload.(type) {
+	case *protocol.TextUpdate:
+		s.handleTextUpdate(client, m)
+
+	case *protocol.RequestDocument:
+		s.sendDocumentState(client)
+
+	case *protocol.SaveDocument:
+		s.handleSaveDocument(client, m)
+
+	case *protocol.TypingStart:
+		s.handleTypingStart(client)
+
+	case *protocol.TypingStop:
+		s.handleTypingStop(client)
+
+	case *protocol.CursorPosition:
+		s.handleCursorPosition(client, m)
+
+	case *protocol.SelectionChange:
+		s.handleSelectionChange(client, m)
+
+	case *protocol.SetProfile:
+		s.handleSetProfile(client, m)
+
+	case *protocol.Follow:
+		s.handleFollow(client, m)
+
+	case *protocol.Unfollow:
+		s.handleUnfollow(client)
+
+	case *protocol.Viewport:
+		s.handleViewport(client, m)
+
+	case *protocol.Heartbeat:
+		s.touchPresence(client, m.Active)
+
+	case *protocol.CommentCreate:
+		s.handleCommentCreate(client, m)
+
+	case *protocol.CommentReply:
+		s.handleCommentReply(client, m)
+
+	case *protocol.CommentEdit:
+		s.handleCommentEdit(client, m)
+
+	case *protocol.CommentResolve:
+		s.handleCommentResolve(client, m)
+
+	case *protocol.CommentDelete:
+		s.handleCommentDelete(client, m)
+
+	case *protocol.SetMode:
+		s.handleSetMode(client, m)
+
+	case *protocol.Suggest:
+		s.handleSuggest(client, m)
+
+	case *protocol.SuggestionAccept:
+		s.handleSuggestionAccept(client, m)
+
+	case *protocol.SuggestionReject:
+		s.handleSuggestionReject(client, m)
+
+	case *protocol.ChatMessage:
+		s.handleChatMessage(client, m)
+
+	case *protocol.LockRegion:
+		s.handleLockRegion(client, m)
+
+	case *protocol.UnlockRegion:
+		s.handleUnlockRegion(client, m)
+
+	case *protocol.RunCode:
+		s.handleRunCode(client, m)
+
+	case *protocol.CancelExecution:
+		s.handleCancelExecution(client, m)
+
+	case *protocol.Completion:
+		s.handleCodeIntelligence(client, msgType, m.Data)
+
+	case *protocol.Hover:
+		s.handleCodeIntelligence(client, msgType, m.Data)
+
+	case *protocol.Definition:
+		s.handleCodeIntelligence(client, msgType, m.Data)
+
+	case *protocol.Search:
+		s.handleSearch(client, m)
+
+	case *protocol.SetMetadata:
+		s.handleSetMetadata(client, m)
+
+	case *protocol.FormatDocument:
+		s.handleFormatDocument(client, m)
+
+	case *protocol.ReplaceAll:
+		s.handleReplaceAll(client, m)
+
+	default:
+		log.Printf("[SESSION] No handler for message type: %s", msgType)
+		s.sendError(client, fmt.Sprintf("Unknown message type: %s", msgType))
+	}
+}
+
+// validationContext snapshots the document state messages are validated against
+func (s *DocumentSession) validationContext() protocol.ValidationContext {
+	content, _ := s.doc.OTManager.GetDocument()
+	return protocol.ValidationContext{DocumentLength: len(content)}
+}
+
+// broadcast sends a frame to all clients in the document except one
+func (s *DocumentSession) broadcast(frame *Frame, excludeClientID string) {
+	s.broadcastWhere(frame, func(c *Client) bool { return c.id != excludeClientID })
+}
+
+// broadcastWhere sends a frame to the clients matching fn.
+// Clients too far behind on edits get a fresh document_state instead.
+func (s *DocumentSession) broadcastWhere(frame *Frame, fn func(*Client) bool) {
+	sentCount := 0
+	for client := range s.clients {
+		if !fn(client) {
+			continue
+		}
+		switch client.enqueue(frame) {
+		case queueAccepted, queueCoalesced:
+			sentCount++
+		case queueResync:
+			log.Printf("[SESSION] Client %s fell behind on %s, resyncing", client.id, s.id)
+			s.sendDocumentState(client)
+			sentCount++
+		}
+	}
+
+	if s.service != nil {
+		s.service.metrics.mu.Lock()
+		s.service.metrics.MessagesSent += int64(sentCount)
+		s.service.metrics.mu.Unlock()
+	}
+}
+
+// sendDocumentState sends the current document state to a client, together
+// with everyone else's cursors, selections and typing state, and the comment
+// threads, suggestions and region locks at that revision
+func (s *DocumentSession) sendDocumentState(client *Client) {
+	s.doc.mu.RLock()
+	content, version := s.doc.Content, s.doc.Version
+	s.doc.mu.RUnlock()
+
+	// Cursor state only changes on this session's goroutine, so it matches
+	// the content; clamping guards against positions relayed from a node
+	// that is a revision ahead
+	length := len(content)
+	cursors := []CursorPosition{}
+	for _, c := range s.doc.CursorManager.GetAllCursors(client.id) {
+		c.Position = clamp(c.Position, length)
+		cursors = append(cursors, c)
+	}
+	selections := []SelectionRange{}
+	for _, sel := range s.doc.CursorManager.GetAllSelections(client.id) {
+		sel.Start, sel.End = clamp(sel.Start, length), clamp(sel.End, length)
+		if sel.Start < sel.End {
+			selections = append(selections, sel)
+		}
+	}
+	typing := s.doc.CursorManager.GetAllTyping(client.id)
+	if typing == nil {
+		typing = []TypingState{}
+	}
+
+	state := map[string]interface{}{
+		"type":        "document_state",
+		"content":     content,
+		"version":     version,
+		"docId":       s.doc.ID,
+		"documentId":  s.id,
+		"cursors":     cursors,
+		"selections":  selections,
+		"typing":      typing,
+		"comments":    s.doc.Comments.List(),
+		"suggestions": s.doc.Suggestions.List(),
+		"locks":       s.doc.Locks.List(),
+		"metadata":    s.doc.Metadata.Get(),
+	}
+
+	frame := NewFrame("document_state", state)
+	frame.documentID = s.id
+	client.queue(frame)
+}
+
+// handleTextUpdate applies a text update through OT and broadcasts the result.
+// Updates for documents owned by another node are forwarded to the owner.
+func (s *DocumentSession) handleTextUpdate(client *Client, update *protocol.TextUpdate) {
+	log.Printf("[SESSION] Text update from %s, version %d", client.id, update.Version)
+
+	if s.suggesting[client.id] {
+		s.sendErrorCode(client, "Edits are suggestions while suggesting", "suggesting_mode", "type")
+		s.sendDocumentState(client)
+		return
+	}
+
+	// Editing takes the follower back in control of their own view
+	s.stopFollowing(client.id, followReasonEdited)
+
+	if owner := s.service.owner(s.id); owner != s.service.nodeID {
+		if err := s.forwardTextUpdate(client.id, owner, update.Content, update.Version); err != nil {
+			s.sendError(client, "Failed to update document")
+		}
+		return
+	}
+
+	newContent, newVersion, err := s.updateText(client.id, update.Content, update.Version)
+	if errors.Is(err, ErrRegionLocked) {
+		s.rejectLockedEdit(client, err)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating document: %v", err)
+		s.sendError(client, "Failed to update document")
+		// The client's copy no longer matches the document
+		s.sendDocumentState(client)
+		return
+	}
+
+	msg := Message{
+		Type:       "text_update",
+		Content:    newContent,
+		ClientID:   client.id,
+		DocumentID: s.id,
+		Version:    newVersion,
+	}
+	s.broadcast(messageFrame(msg), client.id)
+	s.relay(msg)
+	s.afterEdit()
+
+	log.Printf("Client %s sent text update for doc %s (version %d)", client.id, s.id, newVersion)
+}
+
+// afterEdit brings clients up to date with state that follows the document's
+// content, once they have the edit itself
+func (s *DocumentSession) afterEdit() {
+	s.sendCommentAnchors()
+	s.sendSuggestionAnchors()
+	s.sendLockAnchors()
+	s.detectMetadata()
+}
+
+// handleSaveDocument handles document save requests. With format on save,
+// or when asked to, the document is formatted first; a file the formatter
+// refuses is saved as it is.
+func (s *DocumentSession) handleSaveDocument(client *Client, msg *protocol.SaveDocument) {
+	if (!msg.Format && !s.service.config.FormatOnSave) || s.suggesting[client.id] {
+		s.confirmSave(client, nil, nil)
+		return
+	}
+
+	s.format(client.id, "", func(result FormatResult, err error) {
+		if !s.clients[client] {
+			return
+		}
+		if errors.Is(err, format.ErrNoFormatter) && !msg.Format {
+			// Format on save leaves alone files nothing formats
+			s.confirmSave(client, nil, nil)
+			return
+		}
+		s.confirmSave(client, &result, err)
+	})
+}
+
+// confirmSave saves the document and tells the client, along with the
+// result of formatting it first, if it was
+func (s *DocumentSession) confirmSave(client *Client, formatted *FormatResult, formatErr error) {
+	// TODO: Implement document persistence
+	log.Printf("Saving document %s", s.id)
+
+	data := map[string]interface{}{
+		"documentId": s.id,
+		"saved":      true,
+		"timestamp":  time.Now().Unix(),
+	}
+	if formatErr != nil {
+		data["formatError"] = formatErr.Error()
+		data["formatCode"] = formatErrorCode(formatErr)
+	} else if formatted != nil {
+		data["formatted"] = formatted
+	}
+
+	response := Message{
+		Type:       "save_confirmation",
+		DocumentID: s.id,
+		Data:       data,
+	}
+	client.queue(messageFrame(response))
+}
+
+// handleTypingStart broadcasts a typing indicator to other users
+func (s *DocumentSession) handleTypingStart(client *Client) {
+	username, color := client.profileIn(s.id)
+
+	s.doc.CursorManager.SetTyping(client.id, username, color, true)
+
+	msg := Message{
+		Type:       "typing_start",
+		ClientID:   client.id,
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"userId":   client.id,
+			"username": username,
+			"color":    color,
+		},
+	}
+	s.broadcast(messageFrame(msg), client.id)
+	s.relay(msg)
+}
+
+// handleTypingStop broadcasts that a user stopped typing
+func (s *DocumentSession) handleTypingStop(client *Client) {
+	s.doc.CursorManager.SetTyping(client.id, "", "", false)
+
+	msg := Message{
+		Type:       "typing_stop",
+		ClientID:   client.id,
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"userId": client.id,
+		},
+	}
+	s.broadcast(messageFrame(msg), client.id)
+	s.relay(msg)
+}
+
+// handleCursorPosition records a client's cursor and broadcasts it
+func (s *DocumentSession) handleCursorPosition(client *Client, msg *protocol.CursorPosition) {
+	username, color := client.profileIn(s.id)
+
+	s.doc.CursorManager.UpdateCursorPosition(client.id, username, color, msg.Position)
+
+	cursorMsg := Message{
+		Type:       "cursor_position",
+		ClientID:   client.id,
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"clientId": client.id,
+			"username": username,
+			"color":    color,
+			"position": msg.Position,
+		},
+	}
+	s.broadcastFollowed(cursorMsg, client.id)
+	s.relay(cursorMsg)
+}
+
+// handleSelectionChange records a client's selection and broadcasts it
+func (s *DocumentSession) handleSelectionChange(client *Client, msg *protocol.SelectionChange) {
+	username, color := client.profileIn(s.id)
+	start, end := msg.Data.Start, msg.Data.End
+	s.doc.CursorManager.UpdateSelection(client.id, username, color, start, end)
+
+	selectionMsg := Message{
+		Type:       "selection_change",
+		ClientID:   client.id,
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"clientId": client.id,
+			"username": username,
+			"color":    color,
+			"start":    start,
+			"end":      end,
+		},
+	}
+	s.broadcastFollowed(selectionMsg, client.id)
+	s.relay(selectionMsg)
+}
+
+// clamp limits an offset to the document length
+func clamp(offset, length int) int {
+	if offset < 0 {
+		return 0
+	}
+	if offset > length {
+		return length
+	}
+	return offset
+}
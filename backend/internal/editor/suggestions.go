@@ -0,0 +1,346 @@
+// internal/editor/suggestions.go
+package editor
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"collaborative-editor/pkg/protocol"
+
+	"github.com/google/uuid"
+)
+
+// Edit modes a client can be in
+const (
+	modeEditing    = "editing"
+	modeSuggesting = "suggesting"
+)
+
+// Actions reported in suggestion_update
+const (
+	suggestionCreated  = "created"
+	suggestionUpdated  = "updated"
+	suggestionAccepted = "accepted"
+	suggestionRejected = "rejected"
+
+	// Concurrent edits removed the text a suggestion would delete
+	suggestionObsolete = "obsolete"
+)
+
+// ErrUnknownSuggestion is returned for a suggestion that was already accepted, rejected or dropped
+var ErrUnknownSuggestion = errors.New("no such suggestion")
+
+// Suggestion is a proposed change to the document: replacing the range
+// [Start, End) with Content. The range is rebased through every operation
+// applied to the document until the suggestion is accepted or rejected.
+type Suggestion struct {
+	ID        string    `json:"id"`
+	Start     int       `json:"start"`
+	End       int       `json:"end"`
+	Content   string    `json:"content,omitempty"`
+	AuthorID  string    `json:"authorId"`
+	Author    string    `json:"author"`
+	Color     string    `json:"color"`
+	AuthorKey string    `json:"authorKey"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Kind describes the suggestion as insert, delete or replace
+func (sg Suggestion) Kind() string {
+	switch {
+	case sg.Start == sg.End:
+		return "insert"
+	case sg.Content == "":
+		return "delete"
+	default:
+		return "replace"
+	}
+}
+
+// MarshalJSON includes the kind for clients
+func (sg Suggestion) MarshalJSON() ([]byte, error) {
+	type plain Suggestion
+	return json.Marshal(struct {
+		plain
+		Kind string `json:"kind"`
+	}{plain(sg), sg.Kind()})
+}
+
+func (sg *Suggestion) anchor() Anchor          { return Anchor{ID: sg.ID, Start: sg.Start, End: sg.End} }
+func (sg *Suggestion) setRange(start, end int) { sg.Start, sg.End = start, end }
+func (sg *Suggestion) created() time.Time      { return sg.CreatedAt }
+func (sg *Suggestion) clone() Suggestion       { return *sg }
+
+// collapses reports a deletion whose text is gone entirely, which became obsolete
+func (sg *Suggestion) collapses() bool { return sg.Content == "" }
+
+// SuggestionStore holds a document's pending suggestions
+type SuggestionStore struct {
+	rangeStore[Suggestion, *Suggestion]
+}
+
+// NewSuggestionStore creates an empty suggestion store
+func NewSuggestionStore() *SuggestionStore {
+	return &SuggestionStore{newRangeStore[Suggestion, *Suggestion]()}
+}
+
+// Add records a suggestion. Typing on at the end of the author's own
+// insertion, or deleting next to their own deletion, extends that suggestion
+// instead of creating another; it reports whether a new one was created.
+func (ss *SuggestionStore) Add(sg Suggestion) (Suggestion, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	for _, existing := range ss.items {
+		if existing.AuthorKey != sg.AuthorKey {
+			continue
+		}
+		switch {
+		case existing.Kind() == "insert" && sg.Start == sg.End && sg.Start == existing.Start:
+			existing.Content += sg.Content
+			return *existing, false
+		case existing.Kind() == "delete" && sg.Content == "" && sg.End == existing.Start:
+			existing.Start = sg.Start
+			return *existing, false
+		case existing.Kind() == "delete" && sg.Content == "" && sg.Start == existing.End:
+			existing.End = sg.End
+			return *existing, false
+		}
+	}
+
+	sg.ID = uuid.New().String()[:8]
+	sg.CreatedAt = time.Now()
+	ss.items[sg.ID] = &sg
+	return sg, true
+}
+
+// Take removes a suggestion for accepting or rejecting it
+func (ss *SuggestionStore) Take(id string) (Suggestion, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	sg, ok := ss.items[id]
+	if !ok {
+		return Suggestion{}, ErrUnknownSuggestion
+	}
+	delete(ss.items, id)
+	return *sg, nil
+}
+
+// handleSetMode switches a client between editing and suggesting
+func (s *DocumentSession) handleSetMode(client *Client, msg *protocol.SetMode) {
+	if msg.Data.Mode == modeSuggesting {
+		s.suggesting[client.id] = true
+	} else {
+		delete(s.suggesting, client.id)
+	}
+	log.Printf("[SESSION] Client %s is %s in %s", client.id, msg.Data.Mode, s.id)
+
+	client.queue(messageFrame(Message{
+		Type:       "mode_state",
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"mode": msg.Data.Mode,
+		},
+	}))
+}
+
+// handleSuggest records a proposed change
+func (s *DocumentSession) handleSuggest(client *Client, msg *protocol.Suggest) {
+	author := commentBy(client, s.id, "")
+	sg, created := s.doc.Suggestions.Add(Suggestion{
+		Start:     msg.Data.Start,
+		End:       msg.Data.End,
+		Content:   msg.Data.Content,
+		AuthorID:  author.AuthorID,
+		Author:    author.Author,
+		Color:     author.Color,
+		AuthorKey: author.AuthorKey,
+	})
+
+	action := suggestionUpdated
+	if created {
+		action = suggestionCreated
+		log.Printf("[SESSION] Client %s suggested %s %s on %s [%d, %d)",
+			client.id, sg.Kind(), sg.ID, s.id, sg.Start, sg.End)
+	}
+	s.suggestionChanged(client.id, action, sg)
+}
+
+// handleSuggestionAccept turns a suggestion into real edits. Only clients
+// editing, not suggesting, may accept.
+func (s *DocumentSession) handleSuggestionAccept(client *Client, msg *protocol.SuggestionAccept) {
+	if s.suggesting[client.id] {
+		s.sendErrorCode(client, "Switch to editing to accept suggestions", "suggesting_mode", "type")
+		return
+	}
+
+	sg, err := s.doc.Suggestions.Take(msg.Data.SuggestionID)
+	if err != nil {
+		s.sendErrorCode(client, err.Error(), "unknown_suggestion", "data.suggestionId")
+		return
+	}
+
+	// Announced first, so no node reports it obsolete once its deletion lands
+	log.Printf("[SESSION] Client %s accepted suggestion %s on %s", client.id, sg.ID, s.id)
+	s.suggestionChanged(client.id, suggestionAccepted, sg)
+
+	if err := s.applySuggestion(sg); err != nil {
+		log.Printf("[SESSION] Error accepting suggestion %s on %s: %v", sg.ID, s.id, err)
+		s.doc.Suggestions.Put(sg)
+		s.suggestionChanged(client.id, suggestionCreated, sg)
+		if errors.Is(err, ErrRegionLocked) {
+			s.sendErrorCode(client, err.Error(), "region_locked", "data.suggestionId")
+			return
+		}
+		s.sendError(client, "Failed to accept suggestion")
+	}
+}
+
+// handleSuggestionReject discards a suggestion. Editors may reject any
+// suggestion, authors may withdraw their own.
+func (s *DocumentSession) handleSuggestionReject(client *Client, msg *protocol.SuggestionReject) {
+	sg, ok := s.doc.Suggestions.Get(msg.Data.SuggestionID)
+	if !ok {
+		s.sendErrorCode(client, ErrUnknownSuggestion.Error(), "unknown_suggestion", "data.suggestionId")
+		return
+	}
+	if s.suggesting[client.id] && sg.AuthorKey != authorKey(client.userKey) {
+		s.sendErrorCode(client, "Switch to editing to reject suggestions", "suggesting_mode", "type")
+		return
+	}
+
+	s.doc.Suggestions.Remove(sg.ID)
+	log.Printf("[SESSION] Client %s rejected suggestion %s on %s", client.id, sg.ID, s.id)
+	s.suggestionChanged(client.id, suggestionRejected, sg)
+}
+
+// applySuggestion edits the document as the suggestion proposes, as a
+// deletion followed by an insertion, through the owner like any other edit
+func (s *DocumentSession) applySuggestion(sg Suggestion) error {
+	content, version := s.doc.OTManager.GetDocument()
+	if sg.End > len(content) {
+		return errors.New("suggestion lies outside the document")
+	}
+
+	var steps []string
+	deleted := content[:sg.Start] + content[sg.End:]
+	if sg.End > sg.Start {
+		steps = append(steps, deleted)
+	}
+	if sg.Content != "" {
+		steps = append(steps, deleted[:sg.Start]+sg.Content+deleted[sg.Start:])
+	}
+
+	// Edits carry the suggestion as their client, so every client applies
+	// them, the accepting one included
+	editor := "suggestion:" + sg.ID
+
+	if owner := s.service.owner(s.id); owner != s.service.nodeID {
+		for i, step := range steps {
+			if err := s.forwardTextUpdate(editor, owner, step, version+i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i, step := range steps {
+		newContent, newVersion, err := s.service.UpdateDocument(s.id, step, editor, version+i)
+		if err != nil {
+			return err
+		}
+
+		msg := Message{
+			Type:       "text_update",
+			Content:    newContent,
+			ClientID:   editor,
+			DocumentID: s.id,
+			Version:    newVersion,
+		}
+		s.broadcast(messageFrame(msg), "")
+		s.relay(msg)
+	}
+	s.afterEdit()
+	return nil
+}
+
+// suggestionChanged sends a suggestion's new state to every client and to the other nodes
+func (s *DocumentSession) suggestionChanged(clientID, action string, sg Suggestion) {
+	msg := Message{
+		Type:       "suggestion_update",
+		ClientID:   clientID,
+		DocumentID: s.id,
+		Data: map[string]interface{}{
+			"action":     action,
+			"suggestion": sg,
+		},
+	}
+	s.broadcast(messageFrame(msg), "")
+	s.relay(msg)
+}
+
+// applyRemoteSuggestion mirrors a suggestion change made on another node
+func (s *DocumentSession) applyRemoteSuggestion(msg *Message) {
+	var update struct {
+		Action     string     `json:"action"`
+		Suggestion Suggestion `json:"suggestion"`
+	}
+	if err := decodeData(msg.Data, &update); err != nil {
+		log.Printf("[SESSION] Bad suggestion update for %s: %v", s.id, err)
+		return
+	}
+
+	switch update.Action {
+	case suggestionCreated, suggestionUpdated:
+		s.doc.Suggestions.Put(update.Suggestion)
+	default:
+		s.doc.Suggestions.Remove(update.Suggestion.ID)
+	}
+	s.broadcast(messageFrame(*msg), "")
+}
+
+// mergeSuggestions adds the suggestions of a peer's snapshot this node did
+// not know and sends them to local clients
+func (s *DocumentSession) mergeSuggestions(suggestions []Suggestion) {
+	for _, sg := range s.doc.Suggestions.Merge(suggestions, false) {
+		s.broadcast(messageFrame(Message{
+			Type:       "suggestion_update",
+			DocumentID: s.id,
+			Data: map[string]interface{}{
+				"action":     suggestionCreated,
+				"suggestion": sg,
+			},
+		}), "")
+	}
+}
+
+// sendSuggestionAnchors tells clients where edits moved the suggestions and
+// which ones they made obsolete
+func (s *DocumentSession) sendSuggestionAnchors() {
+	moved, obsolete := s.doc.Suggestions.TakeMoved()
+
+	for _, sg := range obsolete {
+		log.Printf("[SESSION] Suggestion %s on %s is obsolete", sg.ID, s.id)
+		s.broadcast(messageFrame(Message{
+			Type:       "suggestion_update",
+			DocumentID: s.id,
+			Data: map[string]interface{}{
+				"action":     suggestionObsolete,
+				"suggestion": sg,
+			},
+		}), "")
+	}
+
+	if moved {
+		s.broadcast(messageFrame(Message{
+			Type:       "suggestion_anchors",
+			DocumentID: s.id,
+			Data: map[string]interface{}{
+				"anchors": s.doc.Suggestions.Anchors(),
+			},
+		}), "")
+	}
+}
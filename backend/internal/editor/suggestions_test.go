@@ -0,0 +1,51 @@
+package editor
+
+import (
+	"testing"
+
+	"collaborative-editor/pkg/protocol"
+)
+
+func TestSuggestionsRebaseOnAcceptAndReject(t *testing.T) {
+	s := NewService(&Config{})
+	if _, _, err := s.UpdateDocument("doc", "hello world", "c0", 0); err != nil {
+		t.Fatal(err)
+	}
+	alice := NewClient(s.hub, nil, s, "doc", "alice")
+	s.hub.Register(alice)
+	defer s.hub.Unregister(alice)
+	session := s.hub.session("doc")
+	sync := func() {
+		reply := make(chan DocumentMetadata)
+		session.post(metadataEvent{reply: reply})
+		<-reply
+	}
+
+	// Deleting "hello " makes the deletion of "hello" obsolete and moves
+	// the insertion after "world"
+	remove, _ := session.doc.Suggestions.Add(Suggestion{Start: 0, End: 6, AuthorKey: "bob"})
+	overlapped, _ := session.doc.Suggestions.Add(Suggestion{Start: 0, End: 5, AuthorKey: "carol"})
+	insert, _ := session.doc.Suggestions.Add(Suggestion{Start: 11, End: 11, Content: "!", AuthorKey: "bob"})
+
+	session.Deliver(alice, "suggestion_accept", &protocol.SuggestionAccept{Data: protocol.SuggestionRef{SuggestionID: remove.ID}})
+	sync()
+	if content, _ := session.doc.OTManager.GetDocument(); content != "world" {
+		t.Fatalf("document is %q after accepting, want %q", content, "world")
+	}
+	if _, ok := session.doc.Suggestions.Get(overlapped.ID); ok {
+		t.Error("deletion of accepted text kept, want it obsolete")
+	}
+	if got, ok := session.doc.Suggestions.Get(insert.ID); !ok || got.Start != 5 || got.End != 5 {
+		t.Fatalf("insertion is %+v (kept %v), want it at 5", got, ok)
+	}
+
+	// Rejecting leaves the document as it is
+	session.Deliver(alice, "suggestion_reject", &protocol.SuggestionReject{Data: protocol.SuggestionRef{SuggestionID: insert.ID}})
+	sync()
+	if content, _ := session.doc.OTManager.GetDocument(); content != "world" {
+		t.Fatalf("document is %q after rejecting, want %q", content, "world")
+	}
+	if n := session.doc.Suggestions.Len(); n != 0 {
+		t.Fatalf("%d suggestions left, want none", n)
+	}
+}
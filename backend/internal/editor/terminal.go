@@ -0,0 +1,631 @@
+// internal/editor/terminal.go
+package editor
+
+import (
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"time"
+	"unicode/utf8"
+
+	"collaborative-editor/internal/terminal"
+	"collaborative-editor/pkg/protocol"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Latest output kept for users who start watching a terminal late
+	maxScrollback = 64 << 10
+
+	// Keystrokes waiting for a slow shell before more are refused
+	maxPendingInput = 256
+
+	// Recordings a workspace keeps, oldest dropped first
+	maxRecordings = 10
+)
+
+// Terminal errors
+var (
+	ErrTerminalDisabled = errors.New("terminals are not enabled on this server")
+	ErrTerminalRunning  = errors.New("the workspace's terminal is already running")
+	ErrNoTerminal       = errors.New("the workspace has no terminal running")
+	ErrNotDriver        = errors.New("only the terminal's driver can do that")
+	ErrNotWatching      = errors.New("that user is not watching the terminal")
+	ErrTerminalBusy     = errors.New("the terminal is not keeping up with input")
+	ErrUnknownRecording = errors.New("no such recording")
+)
+
+// terminalState describes a workspace's shared terminal as its members see it
+type terminalState struct {
+	WorkspaceID string    `json:"workspaceId"`
+	TerminalID  string    `json:"terminalId"`
+	Node        string    `json:"node"`
+	StartedAt   time.Time `json:"startedAt"`
+	StartedBy   string    `json:"startedBy"`
+	Rows        int       `json:"rows"`
+	Cols        int       `json:"cols"`
+
+	// The only user whose input reaches the shell; empty when nobody drives
+	Driver string `json:"driver"`
+
+	// Users receiving the output, on every node, in the order they came
+	Watchers []terminalWatcher `json:"watchers"`
+}
+
+// terminalWatcher is a user receiving a terminal's output
+type terminalWatcher struct {
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
+}
+
+// terminalSnapshot is a terminal's state along with its latest output, for
+// a node joining the workspace late
+type terminalSnapshot struct {
+	terminalState
+	Seq        int    `json:"seq"`
+	Scrollback string `json:"scrollback"`
+}
+
+// sharedTerminal is the shell a workspace's members share. It runs on the
+// node it was started on, which decides who drives and watches it; the
+// other nodes mirror it from what that node publishes and pass their
+// users' requests to it. Fields are guarded by the workspace's mutex.
+type sharedTerminal struct {
+	terminalState
+
+	// Output chunks sent so far, and the latest output
+	seq        int
+	scrollback []byte
+
+	// The shell, its keystrokes waiting to be written and its working
+	// folder, on the node running it
+	term  *terminal.Terminal
+	input chan string
+	dir   string
+}
+
+// snapshot copies the terminal's state for sending
+func (t *sharedTerminal) snapshot() terminalState {
+	state := t.terminalState
+	state.Watchers = append([]terminalWatcher{}, t.Watchers...)
+	return state
+}
+
+// watching reports whether a user receives the terminal's output
+func (t *sharedTerminal) watching(userID string) bool {
+	return slices.ContainsFunc(t.Watchers, func(w terminalWatcher) bool { return w.UserID == userID })
+}
+
+// record appends output to the scrollback, dropping its oldest characters
+// beyond maxScrollback
+func (t *sharedTerminal) record(data string) {
+	t.scrollback = append(t.scrollback, data...)
+	if excess := len(t.scrollback) - maxScrollback; excess > 0 {
+		for excess < len(t.scrollback) && !utf8.RuneStart(t.scrollback[excess]) {
+			excess++
+		}
+		t.scrollback = append(t.scrollback[:0], t.scrollback[excess:]...)
+	}
+}
+
+// terminalRequest is what a user asks of a terminal, passed to the node
+// running it; each kind of request uses some of the fields
+type terminalRequest struct {
+	Input    string `json:"input,omitempty"`
+	Rows     int    `json:"rows,omitempty"`
+	Cols     int    `json:"cols,omitempty"`
+	UserID   string `json:"userId,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+// handleTerminalMessage applies a terminal message from a client
+func (c *Client) handleTerminalMessage(payload interface{}) {
+	w := c.workspace
+	if w == nil {
+		c.sendErrorCode("Connection is not in a workspace", "no_workspace", "type")
+		return
+	}
+
+	var err error
+	switch m := payload.(type) {
+	case *protocol.TerminalStart:
+		err = w.startTerminal(c, terminal.Size{Rows: m.Data.Rows, Cols: m.Data.Cols})
+
+	case *protocol.TerminalSubscribe:
+		err = w.watchTerminal(c)
+
+	case *protocol.TerminalUnsubscribe:
+		w.unwatchTerminal(c)
+
+	case *protocol.TerminalInput:
+		err = w.requestTerminal(c.id, "terminal_input", terminalRequest{Input: m.Data.Input})
+
+	case *protocol.TerminalResize:
+		err = w.requestTerminal(c.id, "terminal_resize", terminalRequest{Rows: m.Data.Rows, Cols: m.Data.Cols})
+
+	case *protocol.TerminalSetDriver:
+		err = w.requestTerminal(c.id, "terminal_set_driver", terminalRequest{UserID: m.Data.UserID})
+
+	case *protocol.TerminalStop:
+		err = w.requestTerminal(c.id, "terminal_stop", terminalRequest{})
+	}
+
+	if err != nil {
+		c.sendErrorCode(err.Error(), terminalErrorCode(err), "type")
+	}
+}
+
+// startTerminal starts the workspace's shell on this node in a fresh folder
+// holding the workspace's files. The client starting it drives and watches it.
+func (w *Workspace) startTerminal(c *Client, size terminal.Size) error {
+	shells := w.service.shells
+	if shells == nil {
+		return ErrTerminalDisabled
+	}
+
+	w.mu.Lock()
+	running := w.liveTerminal() != nil
+	w.unlock()
+	if running {
+		return ErrTerminalRunning
+	}
+
+	dir, err := os.MkdirTemp("", "collab-terminal-*")
+	if err != nil {
+		return err
+	}
+	w.writeFiles(dir)
+
+	w.mu.Lock()
+	defer w.unlock()
+
+	if w.liveTerminal() != nil {
+		os.RemoveAll(dir)
+		return ErrTerminalRunning
+	}
+
+	username, _ := c.profile()
+	t := &sharedTerminal{
+		terminalState: terminalState{
+			WorkspaceID: w.ID,
+			TerminalID:  uuid.New().String()[:8],
+			Node:        w.service.nodeID,
+			StartedAt:   time.Now(),
+			StartedBy:   c.id,
+			Rows:        size.Rows,
+			Cols:        size.Cols,
+			Driver:      c.id,
+			Watchers:    []terminalWatcher{{UserID: c.id, Username: username}},
+		},
+		input: make(chan string, maxPendingInput),
+		dir:   dir,
+	}
+	term, err := shells.Start(terminal.Request{ID: t.TerminalID, Dir: dir, Size: size}, func(data string) {
+		w.terminalOutput(t, data)
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	t.term = term
+
+	w.terminal = t
+	w.terminalClients = map[*Client]bool{c: true}
+	w.recordings = append(w.recordings, term.Recording())
+	if len(w.recordings) > maxRecordings {
+		w.recordings = slices.Delete(w.recordings, 0, len(w.recordings)-maxRecordings)
+	}
+
+	log.Printf("[WORKSPACE] Client %s started terminal %s of %s", c.id, t.TerminalID, w.ID)
+
+	go t.writeInput()
+	go w.awaitTerminalExit(t)
+	w.terminalChanged()
+	return nil
+}
+
+// writeInput types keystrokes into the shell in order, off the workspace's
+// lock, until it exits
+func (t *sharedTerminal) writeInput() {
+	for {
+		select {
+		case input := <-t.input:
+			t.term.Write(input)
+		case <-t.term.Done():
+			return
+		}
+	}
+}
+
+// terminalOutput sends the shell's output to the local watchers and the
+// other nodes
+func (w *Workspace) terminalOutput(t *sharedTerminal, data string) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	if w.terminal != t {
+		return
+	}
+	t.seq++
+	t.record(data)
+	msg := terminalOutputMessage(t, data, false)
+	w.sendToWatchers(msg)
+	w.publish(workspaceEnvelope{Kind: relayMessage, Message: &msg})
+}
+
+// terminalOutputMessage wraps a chunk of output, or the scrollback sent to
+// a user who started watching
+func terminalOutputMessage(t *sharedTerminal, data string, scrollback bool) Message {
+	return Message{
+		Type: "terminal_output",
+		Data: map[string]interface{}{
+			"workspaceId": t.WorkspaceID,
+			"terminalId":  t.TerminalID,
+			"data":        data,
+			"seq":         t.seq,
+			"scrollback":  scrollback,
+		},
+	}
+}
+
+// awaitTerminalExit ends the terminal once its shell exits, keeping its recording
+func (w *Workspace) awaitTerminalExit(t *sharedTerminal) {
+	<-t.term.Done()
+	result := t.term.Result()
+	os.RemoveAll(t.dir)
+
+	w.mu.Lock()
+	defer w.unlock()
+
+	log.Printf("[WORKSPACE] Terminal %s of %s exited with %d", t.TerminalID, w.ID, result.ExitCode)
+	w.terminalEnded(t, map[string]interface{}{
+		"exitCode":    result.ExitCode,
+		"durationMs":  result.Duration.Milliseconds(),
+		"idle":        result.Idle,
+		"closed":      result.Closed,
+		"recordingId": t.TerminalID,
+	}, true)
+}
+
+// terminalEnded forgets a terminal and tells every member, and with
+// publish the other nodes, why it ended. Callers hold w.mu.
+func (w *Workspace) terminalEnded(t *sharedTerminal, data map[string]interface{}, publish bool) {
+	if w.terminal != t {
+		return
+	}
+	w.terminal = nil
+	w.terminalClients = nil
+
+	data["workspaceId"] = w.ID
+	data["terminalId"] = t.TerminalID
+	msg := Message{Type: "terminal_exited", Data: data}
+	w.broadcast(msg)
+	if publish {
+		w.publish(workspaceEnvelope{Kind: relayMessage, Message: &msg})
+	}
+}
+
+// liveTerminal returns the workspace's terminal, forgetting one whose node
+// left the cluster without saying it ended. Callers hold w.mu.
+func (w *Workspace) liveTerminal() *sharedTerminal {
+	t := w.terminal
+	if t == nil || t.term != nil || w.service.membership == nil ||
+		slices.Contains(w.service.membership.Nodes(), t.Node) {
+		return t
+	}
+
+	log.Printf("[WORKSPACE] Forgetting terminal %s of %s, node %s left", t.TerminalID, w.ID, t.Node)
+	w.terminalEnded(t, map[string]interface{}{"lost": true}, false)
+	return nil
+}
+
+// watchTerminal streams the terminal's output to a client, starting with
+// the latest output so it sees the screen as the others do
+func (w *Workspace) watchTerminal(c *Client) error {
+	w.mu.Lock()
+	defer w.unlock()
+
+	t := w.liveTerminal()
+	if t == nil {
+		return ErrNoTerminal
+	}
+	if w.terminalClients[c] {
+		return nil
+	}
+
+	w.terminalClients[c] = true
+	if len(t.scrollback) > 0 {
+		c.queue(messageFrame(terminalOutputMessage(t, string(t.scrollback), true)))
+	}
+	username, _ := c.profile()
+	return w.passTerminalRequest(c.id, "terminal_watch", terminalRequest{Username: username})
+}
+
+// unwatchTerminal stops streaming the terminal's output to a client
+func (w *Workspace) unwatchTerminal(c *Client) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	w.leaveTerminal(c)
+}
+
+// leaveTerminal stops streaming the terminal's output to a client, which
+// gives up the driver role if it held it. Callers hold w.mu.
+func (w *Workspace) leaveTerminal(c *Client) {
+	if !w.terminalClients[c] {
+		return
+	}
+	delete(w.terminalClients, c)
+	w.passTerminalRequest(c.id, "terminal_unwatch", terminalRequest{})
+}
+
+// requestTerminal applies a client's request to the terminal
+func (w *Workspace) requestTerminal(clientID, kind string, req terminalRequest) error {
+	w.mu.Lock()
+	defer w.unlock()
+
+	return w.passTerminalRequest(clientID, kind, req)
+}
+
+// passTerminalRequest applies a user's request on the node running the
+// terminal, publishing it if that is another node. Requests only the driver
+// may make are refused here when this node knows another user drives; the
+// running node checks again. Callers hold w.mu.
+func (w *Workspace) passTerminalRequest(clientID, kind string, req terminalRequest) error {
+	t := w.liveTerminal()
+	if t == nil {
+		return ErrNoTerminal
+	}
+	msg := Message{Type: kind, ClientID: clientID, Data: req}
+	if t.term != nil {
+		return w.applyTerminalRequest(t, msg)
+	}
+
+	switch kind {
+	case "terminal_input", "terminal_resize", "terminal_stop":
+		if t.Driver != clientID {
+			return ErrNotDriver
+		}
+	}
+	w.publish(workspaceEnvelope{Kind: relayMessage, Message: &msg})
+	return nil
+}
+
+// applyTerminalRequest applies a user's request on the node running the
+// terminal. Callers hold w.mu.
+func (w *Workspace) applyTerminalRequest(t *sharedTerminal, msg Message) error {
+	var req terminalRequest
+	if err := decodeData(msg.Data, &req); err != nil {
+		return err
+	}
+	user := msg.ClientID
+
+	switch msg.Type {
+	case "terminal_watch":
+		if !t.watching(user) {
+			t.Watchers = append(t.Watchers, terminalWatcher{UserID: user, Username: req.Username})
+		}
+
+	case "terminal_unwatch":
+		t.Watchers = slices.DeleteFunc(t.Watchers, func(w terminalWatcher) bool { return w.UserID == user })
+		if t.Driver == user {
+			t.Driver = ""
+		}
+
+	case "terminal_set_driver":
+		target := req.UserID
+		switch {
+		case t.Driver != user && (t.Driver != "" || target != user):
+			return ErrNotDriver
+		case target != "" && !t.watching(target):
+			return ErrNotWatching
+		}
+		log.Printf("[WORKSPACE] Client %s made %q the driver of terminal %s of %s", user, target, t.TerminalID, w.ID)
+		t.Driver = target
+
+	case "terminal_input":
+		if t.Driver != user {
+			return ErrNotDriver
+		}
+		select {
+		case t.input <- req.Input:
+		default:
+			return ErrTerminalBusy
+		}
+		return nil
+
+	case "terminal_resize":
+		if t.Driver != user {
+			return ErrNotDriver
+		}
+		size := terminal.Size{Rows: req.Rows, Cols: req.Cols}
+		if size.Rows <= 0 || size.Cols <= 0 {
+			return nil
+		}
+		if err := t.term.Resize(size); err != nil {
+			return err
+		}
+		t.Rows, t.Cols = size.Rows, size.Cols
+
+	case "terminal_stop":
+		if t.Driver != user {
+			return ErrNotDriver
+		}
+		log.Printf("[WORKSPACE] Client %s stops terminal %s of %s", user, t.TerminalID, w.ID)
+		t.term.Close()
+		return nil
+
+	default:
+		return nil
+	}
+
+	w.terminalChanged()
+	return nil
+}
+
+// terminalChanged sends the terminal's state to every member and the other
+// nodes. Callers hold w.mu on the node running the terminal.
+func (w *Workspace) terminalChanged() {
+	msg := Message{Type: "terminal_state", Data: w.terminal.snapshot()}
+	w.broadcast(msg)
+	w.publish(workspaceEnvelope{Kind: relayMessage, Message: &msg})
+}
+
+// sendToWatchers sends a message to the local clients watching the
+// terminal. Callers hold w.mu.
+func (w *Workspace) sendToWatchers(msg Message) {
+	frame := messageFrame(msg)
+	for c := range w.terminalClients {
+		c.queue(frame)
+	}
+}
+
+// sendTerminalState tells a member joining the workspace about its terminal.
+// Callers hold w.mu.
+func (w *Workspace) sendTerminalState(c *Client) {
+	if t := w.liveTerminal(); t != nil {
+		c.queue(messageFrame(Message{Type: "terminal_state", Data: t.snapshot()}))
+	}
+}
+
+// terminalSnapshot returns the terminal running on this node for a node
+// joining the workspace. Callers hold w.mu.
+func (w *Workspace) terminalSnapshot() *terminalSnapshot {
+	t := w.terminal
+	if t == nil || t.term == nil {
+		return nil
+	}
+	return &terminalSnapshot{terminalState: t.snapshot(), Seq: t.seq, Scrollback: string(t.scrollback)}
+}
+
+// handleRemoteTerminal applies a terminal message published by another node:
+// the state, output or end of a terminal it runs, or a request for one
+// running here
+func (w *Workspace) handleRemoteTerminal(origin string, msg *Message) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	t := w.terminal
+	switch msg.Type {
+	case "terminal_state":
+		var state terminalState
+		if err := decodeData(msg.Data, &state); err != nil {
+			log.Printf("[WORKSPACE] Bad terminal state for %s: %v", w.ID, err)
+			return
+		}
+		w.mirrorTerminal(origin, terminalSnapshot{terminalState: state})
+
+	case "terminal_output":
+		data, _ := msg.Data.(map[string]interface{})
+		if t == nil || t.term != nil || t.TerminalID != stringField(data, "terminalId") {
+			return
+		}
+		t.seq = intField(data, "seq")
+		t.record(stringField(data, "data"))
+		w.sendToWatchers(*msg)
+
+	case "terminal_exited":
+		data, _ := msg.Data.(map[string]interface{})
+		if t != nil && t.term == nil && t.TerminalID == stringField(data, "terminalId") {
+			w.terminalEnded(t, data, false)
+		}
+
+	default:
+		if t == nil || t.term == nil {
+			return
+		}
+		if err := w.applyTerminalRequest(t, *msg); err != nil {
+			log.Printf("[WORKSPACE] Refused %s to terminal %s of %s from %s on %s: %v",
+				msg.Type, t.TerminalID, w.ID, msg.ClientID, origin, err)
+		}
+	}
+}
+
+// mirrorTerminal adopts the state of a terminal running on another node.
+// A terminal started here is kept over one started elsewhere at the same
+// time. Callers hold w.mu.
+func (w *Workspace) mirrorTerminal(origin string, snapshot terminalSnapshot) {
+	t := w.terminal
+	if snapshot.Node != origin || (t != nil && t.term != nil) {
+		return
+	}
+	if t == nil || t.TerminalID != snapshot.TerminalID {
+		t = &sharedTerminal{seq: snapshot.Seq}
+		t.record(snapshot.Scrollback)
+		w.terminal = t
+		w.terminalClients = make(map[*Client]bool)
+	}
+	t.terminalState = snapshot.terminalState
+
+	w.broadcast(Message{Type: "terminal_state", Data: t.snapshot()})
+}
+
+// closeTerminal kills the shell running on this node, when the service stops
+func (w *Workspace) closeTerminal() {
+	w.mu.Lock()
+	defer w.unlock()
+
+	if t := w.terminal; t != nil && t.term != nil {
+		t.term.Close()
+	}
+}
+
+// terminalInfo returns the workspace's terminal for the REST API
+func (w *Workspace) terminalInfo() (terminalState, bool) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	t := w.liveTerminal()
+	if t == nil {
+		return terminalState{}, false
+	}
+	return t.snapshot(), true
+}
+
+// recordingInfos describes the recordings of the terminals the workspace
+// ran on this node, oldest first
+func (w *Workspace) recordingInfos() []terminal.RecordingInfo {
+	w.mu.Lock()
+	defer w.unlock()
+
+	infos := make([]terminal.RecordingInfo, 0, len(w.recordings))
+	for _, r := range w.recordings {
+		infos = append(infos, r.Info())
+	}
+	return infos
+}
+
+// recording returns the recording of one of the workspace's terminals
+func (w *Workspace) recording(recordingID string) (*terminal.Recording, error) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	for _, r := range w.recordings {
+		if r.ID == recordingID {
+			return r, nil
+		}
+	}
+	return nil, ErrUnknownRecording
+}
+
+// terminalErrorCode maps a terminal error to the code clients see
+func terminalErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrTerminalDisabled), errors.Is(err, terminal.ErrUnsupported):
+		return "terminal_disabled"
+	case errors.Is(err, ErrTerminalRunning):
+		return "terminal_running"
+	case errors.Is(err, ErrNoTerminal):
+		return "no_terminal"
+	case errors.Is(err, ErrNotDriver):
+		return "not_driver"
+	case errors.Is(err, ErrNotWatching):
+		return "unknown_user"
+	case errors.Is(err, ErrTerminalBusy), errors.Is(err, terminal.ErrBusy):
+		return "terminal_busy"
+	default:
+		return "terminal_failed"
+	}
+}
@@ -0,0 +1,44 @@
+package editor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTerminalOutputPublishesWithoutWorkspaceLock(t *testing.T) {
+	bp := newStallingBackplane("terminal_output")
+	defer bp.Close()
+	s := NewService(&Config{Backplane: bp})
+	w := s.GetWorkspace("ws")
+
+	term := &sharedTerminal{terminalState: terminalState{WorkspaceID: "ws", TerminalID: "t1"}}
+	w.mu.Lock()
+	w.terminal = term
+	w.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		w.terminalOutput(term, "hello")
+		close(done)
+	}()
+	<-bp.stalled
+
+	// The workspace stays usable while the backplane is stuck
+	locked := make(chan struct{})
+	go func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if term.seq != 1 || string(term.scrollback) != "hello" {
+			t.Errorf("terminal at seq %d with %q", term.seq, term.scrollback)
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("w.mu held while publishing terminal output")
+	}
+
+	close(bp.release)
+	<-done
+}
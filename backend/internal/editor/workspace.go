@@ -0,0 +1,750 @@
+// internal/editor/workspace.go
+package editor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"collaborative-editor/internal/backplane"
+	"collaborative-editor/internal/terminal"
+	"collaborative-editor/pkg/protocol"
+
+	"github.com/google/uuid"
+)
+
+// Kinds of workspace entries
+const (
+	kindFile   = "file"
+	kindFolder = "folder"
+)
+
+// Actions reported in workspace_update
+const (
+	fileCreated = "created"
+	fileRenamed = "renamed"
+	fileMoved   = "moved"
+	fileDeleted = "deleted"
+)
+
+// Workspace errors
+var (
+	ErrUnknownFile      = errors.New("no such file or folder")
+	ErrUnknownWorkspace = errors.New("no such workspace")
+	ErrNameTaken        = errors.New("a file or folder of that name already exists there")
+	ErrNotFolder        = errors.New("parent is not a folder")
+	ErrMoveIntoSelf     = errors.New("cannot move a folder into itself")
+	ErrInvalidName      = errors.New("names cannot contain '/' or be '.' or '..'")
+)
+
+// WorkspaceFile is a file or folder in a workspace's tree. Each file is
+// backed by its own document.
+type WorkspaceFile struct {
+	ID         string    `json:"id"`
+	Kind       string    `json:"kind"`
+	Name       string    `json:"name"`
+	ParentID   string    `json:"parentId,omitempty"`
+	DocumentID string    `json:"documentId,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// fileDocumentID is the ID of the document backing a workspace file
+func fileDocumentID(workspaceID, fileID string) string {
+	return workspaceID + ":" + fileID
+}
+
+// Workspace is a tree of files and folders edited together. Tree changes
+// are sent to every connection in the workspace and relayed to other nodes.
+type Workspace struct {
+	ID string
+
+	// Users' colors, shared by all files so a user looks the same in each
+	Palette *Palette
+
+	service *Service
+
+	mu    sync.Mutex
+	files map[string]*WorkspaceFile
+
+	// Tree changes applied, so a node joining late adopts the most advanced tree
+	revision int
+
+	// Connections in the workspace on this node
+	members map[*Client]bool
+
+	// Backplane subscription relaying tree changes between nodes
+	subscription backplane.Subscription
+
+	// Envelopes queued under mu and published once it is released, and
+	// whether an unlock is publishing them
+	outgoing   []workspaceEnvelope
+	publishing bool
+
+	// Shared terminal, if one runs, and the connections on this node
+	// watching it
+	terminal        *sharedTerminal
+	terminalClients map[*Client]bool
+
+	// Recordings of the terminals run on this node, oldest first
+	recordings []*terminal.Recording
+
+	// Repository the files are committed to, if one is configured
+	git *gitState
+
+	// Runs the workspace's git operations on this node one at a time
+	gitMu sync.Mutex
+}
+
+// workspaceEnvelope is what workspaces publish on the backplane
+type workspaceEnvelope struct {
+	Kind        string          `json:"kind"`
+	Origin      string          `json:"origin"`
+	WorkspaceID string          `json:"workspaceId"`
+	Message     *Message        `json:"message,omitempty"`
+	Files       []WorkspaceFile `json:"files,omitempty"`
+	Revision    int             `json:"revision,omitempty"`
+
+	// The terminal the node replying to a sync request runs
+	Terminal *terminalSnapshot `json:"terminal,omitempty"`
+
+	// The repository of the node replying to a sync request
+	Git *gitState `json:"git,omitempty"`
+}
+
+// workspaceTopic is the backplane topic of a workspace
+func workspaceTopic(id string) string {
+	return "workspace:" + id
+}
+
+// newWorkspace creates an empty workspace; the caller subscribes it
+func newWorkspace(id string, service *Service) *Workspace {
+	return &Workspace{
+		ID:      id,
+		Palette: NewPalette(),
+		service: service,
+		files:   make(map[string]*WorkspaceFile),
+		members: make(map[*Client]bool),
+	}
+}
+
+// GetWorkspace returns a workspace, creating an empty one if it does not exist
+func (s *Service) GetWorkspace(id string) *Workspace {
+	s.mu.RLock()
+	ws, exists := s.workspaces[id]
+	s.mu.RUnlock()
+	if exists {
+		return ws
+	}
+
+	s.mu.Lock()
+	if ws, exists = s.workspaces[id]; exists {
+		s.mu.Unlock()
+		return ws
+	}
+	ws = newWorkspace(id, s)
+	s.workspaces[id] = ws
+	s.mu.Unlock()
+
+	ws.subscribe()
+	return ws
+}
+
+// workspace returns a workspace this node knows, without creating it
+func (s *Service) workspace(id string) *Workspace {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.workspaces[id]
+}
+
+// documentName is the file name of a workspace file's document, or the ID
+// of a document outside any workspace
+func (s *Service) documentName(docID string) string {
+	wsID, fileID, ok := strings.Cut(docID, ":")
+	if !ok {
+		return docID
+	}
+	if ws := s.workspace(wsID); ws != nil {
+		if file, ok := ws.File(fileID); ok {
+			return file.Name
+		}
+	}
+	return docID
+}
+
+// closeWorkspaces disconnects every workspace from the backplane
+func (s *Service) closeWorkspaces() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, ws := range s.workspaces {
+		ws.closeTerminal()
+		ws.unsubscribe()
+	}
+}
+
+// dropDocument stops a deleted file's session and forgets its document
+func (s *Service) dropDocument(docID string) {
+	s.hub.closeDocument(docID)
+
+	s.mu.Lock()
+	delete(s.documents, docID)
+	s.mu.Unlock()
+}
+
+// checkName rejects names that cannot be a path segment
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return ErrInvalidName
+	}
+	return nil
+}
+
+// checkPlace verifies a name is free in a folder. Callers hold w.mu.
+func (w *Workspace) checkPlace(parentID, name, except string) error {
+	if parentID != "" {
+		parent, ok := w.files[parentID]
+		if !ok {
+			return ErrUnknownFile
+		}
+		if parent.Kind != kindFolder {
+			return ErrNotFolder
+		}
+	}
+	for _, f := range w.files {
+		if f.ParentID == parentID && f.ID != except && strings.EqualFold(f.Name, name) {
+			return ErrNameTaken
+		}
+	}
+	return nil
+}
+
+// Create adds a file or folder and tells everyone in the workspace
+func (w *Workspace) Create(clientID, kind, name, parentID string) (WorkspaceFile, error) {
+	name = strings.TrimSpace(name)
+	if kind != kindFile && kind != kindFolder {
+		return WorkspaceFile{}, fmt.Errorf("unknown kind %q", kind)
+	}
+	if err := checkName(name); err != nil {
+		return WorkspaceFile{}, err
+	}
+
+	w.mu.Lock()
+	defer w.unlock()
+
+	if err := w.checkPlace(parentID, name, ""); err != nil {
+		return WorkspaceFile{}, err
+	}
+
+	now := time.Now()
+	file := &WorkspaceFile{
+		ID:        uuid.New().String()[:8],
+		Kind:      kind,
+		Name:      name,
+		ParentID:  parentID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if kind == kindFile {
+		file.DocumentID = fileDocumentID(w.ID, file.ID)
+	}
+	w.files[file.ID] = file
+	w.revision++
+
+	log.Printf("[WORKSPACE] Created %s %q in %s", kind, w.path(file.ID), w.ID)
+	w.changed(clientID, fileCreated, *file, nil)
+	return *file, nil
+}
+
+// Rename gives a file or folder a new name
+func (w *Workspace) Rename(clientID, id, name string) (WorkspaceFile, error) {
+	name = strings.TrimSpace(name)
+	if err := checkName(name); err != nil {
+		return WorkspaceFile{}, err
+	}
+
+	w.mu.Lock()
+	defer w.unlock()
+
+	file, ok := w.files[id]
+	if !ok {
+		return WorkspaceFile{}, ErrUnknownFile
+	}
+	if err := w.checkPlace(file.ParentID, name, id); err != nil {
+		return WorkspaceFile{}, err
+	}
+
+	file.Name = name
+	file.UpdatedAt = time.Now()
+	w.revision++
+
+	w.changed(clientID, fileRenamed, *file, nil)
+	return *file, nil
+}
+
+// Move puts a file or folder into another folder, or the root if parentID is empty
+func (w *Workspace) Move(clientID, id, parentID string) (WorkspaceFile, error) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	file, ok := w.files[id]
+	if !ok {
+		return WorkspaceFile{}, ErrUnknownFile
+	}
+	for p := parentID; p != ""; p = w.files[p].ParentID {
+		if p == id {
+			return WorkspaceFile{}, ErrMoveIntoSelf
+		}
+		if _, ok := w.files[p]; !ok {
+			return WorkspaceFile{}, ErrUnknownFile
+		}
+	}
+	if err := w.checkPlace(parentID, file.Name, id); err != nil {
+		return WorkspaceFile{}, err
+	}
+
+	file.ParentID = parentID
+	file.UpdatedAt = time.Now()
+	w.revision++
+
+	w.changed(clientID, fileMoved, *file, nil)
+	return *file, nil
+}
+
+// Delete removes a file, or a folder and everything in it. The documents of
+// removed files are closed and forgotten.
+func (w *Workspace) Delete(clientID, id string) ([]WorkspaceFile, error) {
+	w.mu.Lock()
+	file, ok := w.files[id]
+	if !ok {
+		w.unlock()
+		return nil, ErrUnknownFile
+	}
+
+	path := w.path(id)
+	removed := w.subtree(id)
+	for _, f := range removed {
+		delete(w.files, f.ID)
+	}
+	w.revision++
+
+	log.Printf("[WORKSPACE] Deleted %q and %d entries below it in %s", path, len(removed)-1, w.ID)
+	w.changed(clientID, fileDeleted, *file, removed)
+	w.unlock()
+
+	w.dropDocuments(removed)
+	return removed, nil
+}
+
+// subtree returns a file or folder and everything below it. Callers hold w.mu.
+func (w *Workspace) subtree(id string) []WorkspaceFile {
+	files := []WorkspaceFile{*w.files[id]}
+	for i := 0; i < len(files); i++ {
+		if files[i].Kind != kindFolder {
+			continue
+		}
+		for _, f := range w.files {
+			if f.ParentID == files[i].ID {
+				files = append(files, *f)
+			}
+		}
+	}
+	return files
+}
+
+// dropDocuments forgets the documents of deleted files
+func (w *Workspace) dropDocuments(files []WorkspaceFile) {
+	for _, f := range files {
+		if f.DocumentID != "" {
+			w.service.dropDocument(f.DocumentID)
+		}
+	}
+}
+
+// File returns a file or folder by ID
+func (w *Workspace) File(id string) (WorkspaceFile, bool) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	f, ok := w.files[id]
+	if !ok {
+		return WorkspaceFile{}, false
+	}
+	return *f, true
+}
+
+// Files returns the whole tree ordered by path
+func (w *Workspace) Files() []WorkspaceFile {
+	w.mu.Lock()
+	defer w.unlock()
+
+	return w.list()
+}
+
+// Paths returns the path of every file and folder, by ID
+func (w *Workspace) Paths() map[string]string {
+	w.mu.Lock()
+	defer w.unlock()
+
+	paths := make(map[string]string, len(w.files))
+	for id := range w.files {
+		paths[id] = w.path(id)
+	}
+	return paths
+}
+
+// writeFiles writes the workspace's files and folders under root as this
+// node has them; files whose document was never loaded are empty
+func (w *Workspace) writeFiles(root string) {
+	paths := w.Paths()
+	for _, f := range w.Files() {
+		path := filepath.Join(root, filepath.FromSlash(paths[f.ID]))
+		if f.Kind == kindFolder {
+			os.MkdirAll(path, 0o755)
+			continue
+		}
+		var content string
+		if doc, ok := w.service.loadedDocument(f.DocumentID); ok {
+			content, _ = doc.OTManager.GetDocument()
+		}
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			log.Printf("[WORKSPACE] Error writing %s: %v", path, err)
+		}
+	}
+}
+
+// list returns the tree ordered by path. Callers hold w.mu.
+func (w *Workspace) list() []WorkspaceFile {
+	paths := make(map[string]string, len(w.files))
+	files := make([]WorkspaceFile, 0, len(w.files))
+	for id, f := range w.files {
+		paths[id] = w.path(id)
+		files = append(files, *f)
+	}
+	sort.Slice(files, func(i, j int) bool { return paths[files[i].ID] < paths[files[j].ID] })
+	return files
+}
+
+// path returns a file's slash separated path from the root. Callers hold w.mu.
+func (w *Workspace) path(id string) string {
+	var parts []string
+	for f := w.files[id]; f != nil; f = w.files[f.ParentID] {
+		parts = append([]string{f.Name}, parts...)
+	}
+	return strings.Join(parts, "/")
+}
+
+// join adds a connection to the workspace and sends it the tree
+func (w *Workspace) join(client *Client) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	w.members[client] = true
+	client.queue(messageFrame(Message{
+		Type: "workspace_state",
+		Data: map[string]interface{}{
+			"workspaceId": w.ID,
+			"files":       w.list(),
+		},
+	}))
+	w.sendTerminalState(client)
+	if w.git != nil {
+		client.queue(messageFrame(Message{Type: "git_state", Data: w.git.snapshot()}))
+	}
+}
+
+// leave removes a connection from the workspace and its terminal
+func (w *Workspace) leave(client *Client) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	delete(w.members, client)
+	w.leaveTerminal(client)
+}
+
+// changed sends a tree change to every local connection and to the other
+// nodes. Callers hold w.mu, which keeps changes in order.
+func (w *Workspace) changed(clientID, action string, file WorkspaceFile, removed []WorkspaceFile) {
+	msg := Message{
+		Type:     "workspace_update",
+		ClientID: clientID,
+		Data: map[string]interface{}{
+			"workspaceId": w.ID,
+			"action":      action,
+			"file":        file,
+			"removed":     removed,
+		},
+	}
+	w.broadcast(msg)
+	w.publish(workspaceEnvelope{Kind: relayMessage, Message: &msg})
+	w.service.lsp.workspaceChanged(w)
+}
+
+// broadcast sends a message to every local connection. Callers hold w.mu.
+func (w *Workspace) broadcast(msg Message) {
+	frame := messageFrame(msg)
+	for c := range w.members {
+		c.queue(frame)
+	}
+}
+
+// subscribe connects the workspace to its backplane topic and asks peers
+// for their tree
+func (w *Workspace) subscribe() {
+	bp := w.service.backplane
+	if bp == nil {
+		return
+	}
+
+	sub, err := bp.Subscribe(workspaceTopic(w.ID), func(payload []byte) {
+		if payload == nil {
+			log.Printf("[WORKSPACE] Relayed changes for %s were dropped, resynchronizing", w.ID)
+			w.mu.Lock()
+			w.publish(workspaceEnvelope{Kind: relaySyncRequest})
+			w.unlock()
+			return
+		}
+
+		var env workspaceEnvelope
+		if err := json.Unmarshal(payload, &env); err != nil {
+			log.Printf("[WORKSPACE] Bad backplane message for %s: %v", w.ID, err)
+			return
+		}
+		if env.Origin != w.service.nodeID {
+			w.handleRemote(env)
+		}
+	})
+	if err != nil {
+		log.Printf("[WORKSPACE] Error subscribing to workspace %s: %v", w.ID, err)
+		return
+	}
+
+	w.mu.Lock()
+	w.subscription = sub
+	w.publish(workspaceEnvelope{Kind: relaySyncRequest})
+	w.unlock()
+}
+
+// unsubscribe disconnects the workspace from the backplane
+func (w *Workspace) unsubscribe() {
+	w.mu.Lock()
+	defer w.unlock()
+
+	if w.subscription != nil {
+		w.subscription.Unsubscribe()
+		w.subscription = nil
+	}
+}
+
+// publish queues an envelope for the workspace on other nodes; it is sent
+// once w.mu is released with unlock. Callers hold w.mu.
+func (w *Workspace) publish(env workspaceEnvelope) {
+	if w.subscription == nil {
+		return
+	}
+	w.outgoing = append(w.outgoing, env)
+}
+
+// unlock releases w.mu, then publishes the envelopes queued under it, so a
+// slow backplane never holds up the workspace. Only one caller publishes at
+// a time, taking over what others queue meanwhile, which keeps envelopes in
+// the order they were queued.
+func (w *Workspace) unlock() {
+	publish := len(w.outgoing) > 0 && !w.publishing
+	w.publishing = w.publishing || publish
+	w.mu.Unlock()
+
+	for publish {
+		w.mu.Lock()
+		outgoing := w.outgoing
+		w.outgoing = nil
+		w.publishing = len(outgoing) > 0
+		publish = w.publishing
+		w.mu.Unlock()
+
+		for _, env := range outgoing {
+			w.sendEnvelope(env)
+		}
+	}
+}
+
+// sendEnvelope publishes an envelope on the workspace's topic
+func (w *Workspace) sendEnvelope(env workspaceEnvelope) {
+	env.Origin = w.service.nodeID
+	env.WorkspaceID = w.ID
+
+	payload, err := json.Marshal(env)
+	if err != nil {
+		log.Printf("[WORKSPACE] Error marshaling relay envelope: %v", err)
+		return
+	}
+	if err := w.service.backplane.Publish(workspaceTopic(w.ID), payload); err != nil {
+		log.Printf("[WORKSPACE] Error publishing to backplane: %v", err)
+	}
+}
+
+// handleRemote applies an envelope published by another node
+func (w *Workspace) handleRemote(env workspaceEnvelope) {
+	switch env.Kind {
+	case relayMessage:
+		if env.Message == nil {
+			return
+		}
+		if env.Message.Type == "workspace_update" {
+			w.applyRemoteChange(env.Message)
+		} else if strings.HasPrefix(env.Message.Type, "terminal_") {
+			w.handleRemoteTerminal(env.Origin, env.Message)
+		} else if strings.HasPrefix(env.Message.Type, "git_") {
+			w.handleRemoteGit(env.Message)
+		}
+
+	case relaySyncRequest:
+		w.mu.Lock()
+		env := workspaceEnvelope{
+			Kind:     relaySnapshot,
+			Files:    w.list(),
+			Revision: w.revision,
+			Terminal: w.terminalSnapshot(),
+		}
+		if w.git != nil {
+			state := w.git.snapshot()
+			env.Git = &state
+		}
+		w.publish(env)
+		w.unlock()
+
+	case relaySnapshot:
+		w.applySnapshot(env.Files, env.Revision)
+		w.mu.Lock()
+		if env.Terminal != nil {
+			w.mirrorTerminal(env.Origin, *env.Terminal)
+		}
+		if env.Git != nil && w.git == nil {
+			w.adoptGitState(*env.Git)
+		}
+		w.unlock()
+	}
+}
+
+// applyRemoteChange mirrors a tree change made on another node
+func (w *Workspace) applyRemoteChange(msg *Message) {
+	var change struct {
+		Action  string          `json:"action"`
+		File    WorkspaceFile   `json:"file"`
+		Removed []WorkspaceFile `json:"removed"`
+	}
+	if err := decodeData(msg.Data, &change); err != nil {
+		log.Printf("[WORKSPACE] Bad workspace update for %s: %v", w.ID, err)
+		return
+	}
+
+	w.mu.Lock()
+	if change.Action == fileDeleted {
+		for _, f := range change.Removed {
+			delete(w.files, f.ID)
+		}
+	} else {
+		file := change.File
+		w.files[file.ID] = &file
+	}
+	w.revision++
+	w.broadcast(*msg)
+	w.service.lsp.workspaceChanged(w)
+	w.unlock()
+
+	if change.Action == fileDeleted {
+		w.dropDocuments(change.Removed)
+	}
+}
+
+// applySnapshot adopts a peer's tree if it saw more changes than this node
+func (w *Workspace) applySnapshot(files []WorkspaceFile, revision int) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	if revision <= w.revision {
+		return
+	}
+
+	w.files = make(map[string]*WorkspaceFile, len(files))
+	for _, f := range files {
+		file := f
+		w.files[f.ID] = &file
+	}
+	w.revision = revision
+	w.service.lsp.workspaceChanged(w)
+
+	w.broadcast(Message{
+		Type: "workspace_state",
+		Data: map[string]interface{}{
+			"workspaceId": w.ID,
+			"files":       w.list(),
+		},
+	})
+}
+
+// handleFileMessage applies a workspace message from a client
+func (c *Client) handleFileMessage(payload interface{}) {
+	w := c.workspace
+	if w == nil {
+		c.sendErrorCode("Connection is not in a workspace", "no_workspace", "type")
+		return
+	}
+
+	var err error
+	switch m := payload.(type) {
+	case *protocol.FileCreate:
+		_, err = w.Create(c.id, m.Data.Kind, m.Data.Name, m.Data.ParentID)
+
+	case *protocol.FileRename:
+		_, err = w.Rename(c.id, m.Data.FileID, m.Data.Name)
+
+	case *protocol.FileMove:
+		_, err = w.Move(c.id, m.Data.FileID, m.Data.ParentID)
+
+	case *protocol.FileDelete:
+		_, err = w.Delete(c.id, m.Data.FileID)
+
+	case *protocol.FileOpen:
+		file, ok := w.File(m.Data.FileID)
+		if !ok || file.Kind != kindFile {
+			err = ErrUnknownFile
+			break
+		}
+		err = c.hub.Subscribe(c, file.DocumentID)
+
+	case *protocol.FileClose:
+		c.hub.Unsubscribe(c, fileDocumentID(w.ID, m.Data.FileID))
+	}
+
+	if err != nil {
+		c.sendErrorCode(err.Error(), workspaceErrorCode(err), "data")
+	}
+}
+
+// workspaceErrorCode maps a workspace error to the code sent to clients
+func workspaceErrorCode(err error) string {
+	switch err {
+	case ErrUnknownFile:
+		return "unknown_file"
+	case ErrUnknownWorkspace:
+		return "unknown_workspace"
+	case ErrNameTaken:
+		return "name_taken"
+	case ErrNotFolder, ErrMoveIntoSelf:
+		return "invalid_move"
+	case ErrInvalidName:
+		return "invalid_name"
+	default:
+		return "invalid_message"
+	}
+}
@@ -0,0 +1,108 @@
+package editor
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"collaborative-editor/internal/backplane"
+)
+
+// stallingBackplane holds up publishes whose payload contains a string
+// until released, as a backplane whose network stalls would
+type stallingBackplane struct {
+	backplane.Backplane
+	match   string
+	stalled chan struct{}
+	release chan struct{}
+
+	mu        sync.Mutex
+	published []workspaceEnvelope
+}
+
+func newStallingBackplane(match string) *stallingBackplane {
+	return &stallingBackplane{
+		Backplane: backplane.NewMemory(),
+		match:     match,
+		stalled:   make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+}
+
+func (b *stallingBackplane) Publish(topic string, payload []byte) error {
+	if strings.Contains(string(payload), b.match) {
+		b.stalled <- struct{}{}
+		<-b.release
+	}
+	var env workspaceEnvelope
+	if json.Unmarshal(payload, &env) == nil {
+		b.mu.Lock()
+		b.published = append(b.published, env)
+		b.mu.Unlock()
+	}
+	return b.Backplane.Publish(topic, payload)
+}
+
+// updates returns the names of the files in the tree changes published
+func (b *stallingBackplane) updates() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var names []string
+	for _, env := range b.published {
+		if env.Message == nil || env.Message.Type != "workspace_update" {
+			continue
+		}
+		data, _ := json.Marshal(env.Message.Data)
+		var update struct {
+			File WorkspaceFile `json:"file"`
+		}
+		json.Unmarshal(data, &update)
+		names = append(names, update.File.Name)
+	}
+	return names
+}
+
+func TestStalledBackplaneDoesNotHoldUpJoin(t *testing.T) {
+	bp := newStallingBackplane("first.txt")
+	defer bp.Close()
+	s := NewService(&Config{Backplane: bp})
+	w := s.GetWorkspace("ws")
+
+	created := make(chan struct{})
+	go func() {
+		w.Create("c1", kindFile, "first.txt", "")
+		close(created)
+	}()
+	<-bp.stalled
+
+	// Joining, leaving and further changes go ahead while the publish hangs
+	joined := make(chan struct{})
+	go func() {
+		client := NewClient(s.hub, nil, s, "", "")
+		w.join(client)
+		if _, err := w.Create("c2", kindFile, "second.txt", ""); err != nil {
+			t.Error(err)
+		}
+		w.leave(client)
+		close(joined)
+	}()
+	select {
+	case <-joined:
+	case <-time.After(time.Second):
+		t.Fatal("join waited for the backplane")
+	}
+
+	// The changes still reach the other nodes in the order they were made
+	close(bp.release)
+	<-created
+	deadline := time.Now().Add(time.Second)
+	for len(bp.updates()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := bp.updates(); len(got) != 2 || got[0] != "first.txt" || got[1] != "second.txt" {
+		t.Fatalf("published %v, want first.txt then second.txt", got)
+	}
+}
@@ -0,0 +1,402 @@
+// Package execution runs untrusted code in a local sandbox: a separate
+// process with resource limits, a wall clock timeout, no network and a
+// temporary working directory, removed afterwards, as the only files it can
+// write; of the host it sees nothing else but read-only system paths.
+package execution
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Output streams
+const (
+	Stdout = "stdout"
+	Stderr = "stderr"
+)
+
+var (
+	// ErrUnknownLanguage is returned for a language no runner is configured for
+	ErrUnknownLanguage = errors.New("unsupported language")
+
+	// ErrUnsupported is returned where the platform cannot sandbox a process
+	ErrUnsupported = errors.New("sandboxed execution is not supported on this platform")
+
+	// ErrBusy is returned when as many programs as allowed are already running
+	ErrBusy = errors.New("too many programs running, try again later")
+)
+
+// Language describes how to run a program. The source is written to File in
+// the working directory and Command runs with the directory as its cwd.
+type Language struct {
+	Name    string   `json:"name"`
+	File    string   `json:"file"`
+	Command []string `json:"command"`
+}
+
+// DefaultLanguages are the languages a runner offers when configured with
+// none; those whose interpreter is not installed are left out
+var DefaultLanguages = []Language{
+	{Name: "python", File: "main.py", Command: []string{"python3", "main.py"}},
+	{Name: "javascript", File: "main.js", Command: []string{"node", "main.js"}},
+	{Name: "go", File: "main.go", Command: []string{"go", "run", "main.go"}},
+	{Name: "ruby", File: "main.rb", Command: []string{"ruby", "main.rb"}},
+	{Name: "bash", File: "main.sh", Command: []string{"bash", "main.sh"}},
+}
+
+// Limits bound what one run may use; zero fields take DefaultLimits
+type Limits struct {
+	// Wall clock time before the run is killed
+	Timeout time.Duration
+
+	// CPU time, across all of the run's threads
+	CPUTime time.Duration
+
+	// Address space of each process, in bytes
+	Memory int64
+
+	// Largest file a process may write, in bytes
+	FileSize int64
+
+	// Open file descriptors per process
+	OpenFiles int64
+
+	// Output kept and streamed, stdout and stderr together; the run is
+	// killed once it writes more
+	Output int
+}
+
+// DefaultLimits are generous enough to compile and run small programs
+var DefaultLimits = Limits{
+	Timeout:   15 * time.Second,
+	CPUTime:   10 * time.Second,
+	Memory:    4 << 30,
+	FileSize:  16 << 20,
+	OpenFiles: 256,
+	Output:    1 << 20,
+}
+
+// Config configures a Runner
+type Config struct {
+	// Languages offered; DefaultLanguages if empty
+	Languages []Language
+
+	// Limits of every run; zero fields use DefaultLimits
+	Limits Limits
+
+	// Extra environment variables of every run, as KEY=value
+	Env []string
+
+	// Programs running at once; DefaultMaxConcurrent if zero
+	MaxConcurrent int
+}
+
+// DefaultMaxConcurrent bounds the programs one runner runs at once
+const DefaultMaxConcurrent = 4
+
+// Request is a program to run
+type Request struct {
+	Language string
+	Source   string
+	Stdin    string
+}
+
+// Output is a chunk a program wrote. Data always holds whole UTF-8 characters.
+type Output struct {
+	Stream string
+	Data   string
+}
+
+// Result describes a finished run
+type Result struct {
+	ExitCode  int           `json:"exitCode"`
+	Duration  time.Duration `json:"-"`
+	TimedOut  bool          `json:"timedOut,omitempty"`
+	Canceled  bool          `json:"canceled,omitempty"`
+	Truncated bool          `json:"truncated,omitempty"`
+	Stdout    string        `json:"stdout"`
+	Stderr    string        `json:"stderr"`
+}
+
+// Runner runs programs in sandboxed processes
+type Runner struct {
+	languages map[string]Language
+	limits    Limits
+	env       []string
+
+	// Holds a token per running program
+	slots chan struct{}
+}
+
+// NewRunner creates a runner offering the configured languages that are installed
+func NewRunner(cfg *Config) *Runner {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	languages := cfg.Languages
+	if len(languages) == 0 {
+		languages = DefaultLanguages
+	}
+
+	maxConcurrent := cfg.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = DefaultMaxConcurrent
+	}
+
+	r := &Runner{
+		languages: make(map[string]Language),
+		limits:    cfg.Limits.withDefaults(),
+		env:       cfg.Env,
+		slots:     make(chan struct{}, maxConcurrent),
+	}
+	for _, lang := range languages {
+		path, err := exec.LookPath(lang.Command[0])
+		if err != nil {
+			continue
+		}
+		lang.Command = append([]string{path}, lang.Command[1:]...)
+		r.languages[lang.Name] = lang
+	}
+	return r
+}
+
+// withDefaults fills zero limits from DefaultLimits
+func (l Limits) withDefaults() Limits {
+	d := DefaultLimits
+	if l.Timeout > 0 {
+		d.Timeout = l.Timeout
+	}
+	if l.CPUTime > 0 {
+		d.CPUTime = l.CPUTime
+	}
+	if l.Memory > 0 {
+		d.Memory = l.Memory
+	}
+	if l.FileSize > 0 {
+		d.FileSize = l.FileSize
+	}
+	if l.OpenFiles > 0 {
+		d.OpenFiles = l.OpenFiles
+	}
+	if l.Output > 0 {
+		d.Output = l.Output
+	}
+	return d
+}
+
+// Limits returns the limits every run is held to
+func (r *Runner) Limits() Limits {
+	return r.limits
+}
+
+// Languages lists the languages the runner can run, by name
+func (r *Runner) Languages() []string {
+	names := make([]string, 0, len(r.languages))
+	for name := range r.languages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Supports reports whether the runner can run a language
+func (r *Runner) Supports(language string) bool {
+	_, ok := r.languages[language]
+	return ok
+}
+
+// Run runs a program and waits for it, passing its output to onOutput as it
+// is written; onOutput is never called concurrently. Cancelling ctx kills
+// the program. An error means the program could not be started.
+func (r *Runner) Run(ctx context.Context, req Request, onOutput func(Output)) (Result, error) {
+	lang, ok := r.languages[req.Language]
+	if !ok {
+		return Result{}, fmt.Errorf("%w: %s", ErrUnknownLanguage, req.Language)
+	}
+
+	select {
+	case r.slots <- struct{}{}:
+		defer func() { <-r.slots }()
+	default:
+		return Result{}, ErrBusy
+	}
+
+	dir, err := os.MkdirTemp("", "collab-run-*")
+	if err != nil {
+		return Result{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.WriteFile(filepath.Join(dir, lang.File), []byte(req.Source), 0o644); err != nil {
+		return Result{}, err
+	}
+
+	cmd, err := r.command(lang, dir)
+	if err != nil {
+		return Result{}, err
+	}
+	cmd.Stdin = bytes.NewReader([]byte(req.Stdin))
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return Result{}, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return Result{}, err
+	}
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return Result{}, fmt.Errorf("starting sandbox: %w", err)
+	}
+
+	out := &collector{limit: r.limits.Output, onOutput: onOutput, overflow: make(chan struct{})}
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go out.read(Stdout, stdout, &readers)
+	go out.read(Stderr, stderr, &readers)
+
+	// Kill the program on timeout, cancellation or too much output
+	timer := time.NewTimer(r.limits.Timeout)
+	defer timer.Stop()
+	exited := make(chan struct{})
+	watched := make(chan struct{})
+	var result Result
+	go func() {
+		defer close(watched)
+		select {
+		case <-timer.C:
+			result.TimedOut = true
+		case <-ctx.Done():
+			result.Canceled = true
+		case <-out.overflow:
+		case <-exited:
+			return
+		}
+		kill(cmd)
+	}()
+
+	readers.Wait()
+	err = cmd.Wait()
+	close(exited)
+	<-watched
+
+	result.Duration = time.Since(start)
+	result.Stdout, result.Stderr, result.Truncated = out.stdout.String(), out.stderr.String(), out.truncated
+	result.ExitCode = exitCode(cmd, err)
+
+	log.Printf("[EXECUTION] %s run exited with %d after %v (timed out: %v, canceled: %v, truncated: %v)",
+		req.Language, result.ExitCode, result.Duration.Round(time.Millisecond),
+		result.TimedOut, result.Canceled, result.Truncated)
+	return result, nil
+}
+
+// exitCode returns a finished process's exit status, or 128 plus the signal
+// that killed it as a shell would report it
+func exitCode(cmd *exec.Cmd, err error) int {
+	if cmd.ProcessState == nil {
+		return -1
+	}
+	if code := cmd.ProcessState.ExitCode(); code >= 0 {
+		return code
+	}
+	if sig, ok := signalOf(cmd.ProcessState); ok {
+		return 128 + sig
+	}
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
+// collector gathers a run's output up to a limit and passes it on in chunks
+type collector struct {
+	mu       sync.Mutex
+	limit    int
+	written  int
+	onOutput func(Output)
+
+	stdout, stderr bytes.Buffer
+	truncated      bool
+
+	// Closed once the limit is exceeded
+	overflow chan struct{}
+}
+
+// read copies one stream until it closes, holding back a partial UTF-8
+// character until the rest of it arrives
+func (c *collector) read(stream string, r io.Reader, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	buf := make([]byte, 4096)
+	var pending []byte
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			pending = append(pending, buf[:n]...)
+			cut := completeUTF8(pending)
+			c.write(stream, pending[:cut])
+			pending = append(pending[:0], pending[cut:]...)
+		}
+		if err != nil {
+			c.write(stream, pending)
+			return
+		}
+	}
+}
+
+// write records and forwards a chunk, cutting it at the output limit
+func (c *collector) write(stream string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.truncated {
+		return
+	}
+	if room := c.limit - c.written; len(data) > room {
+		data = data[:completeUTF8(data[:room])]
+		c.truncated = true
+		close(c.overflow)
+	}
+	c.written += len(data)
+
+	if stream == Stdout {
+		c.stdout.Write(data)
+	} else {
+		c.stderr.Write(data)
+	}
+	if c.onOutput != nil && len(data) > 0 {
+		c.onOutput(Output{Stream: stream, Data: string(data)})
+	}
+}
+
+// completeUTF8 returns the length of the longest prefix of b that does not
+// end in the middle of a UTF-8 character
+func completeUTF8(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return len(b)
+			}
+			return i
+		}
+	}
+	return len(b)
+}
@@ -0,0 +1,376 @@
+//go:build linux
+
+package execution
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Name the runner re-executes its own binary under to become the sandbox helper
+	sandboxArg0 = "collab-sandbox"
+
+	// Environment variable passing the limits to the helper
+	limitsEnv = "COLLAB_SANDBOX_LIMITS"
+
+	// User the program runs as inside its user namespace. Not being root
+	// there, it loses every capability when the helper execs it.
+	sandboxID = 65534
+
+	// RLIMIT_NPROC, which the syscall package does not define
+	rlimitNproc = 6
+
+	// Processes and threads the program may have at once
+	maxProcesses = 256
+
+	// Capability the helper keeps until it has built the program's root
+	capSysAdmin = 21
+
+	// prctl options the syscall package does not define
+	prSetNoNewPrivs = 38
+	prCapAmbient    = 47
+	prCapAmbientAll = 4
+
+	// statfs flag of a relatime mount; the others match their MS_ flags
+	stRelatime = 0x1000
+)
+
+// Host paths visible read-only in the sandbox, besides the directories of
+// PATH, where they exist
+var systemPaths = []string{
+	"/bin", "/sbin", "/lib", "/lib32", "/lib64", "/libx32", "/usr", "/opt",
+	"/etc/alternatives", "/etc/ld.so.cache", "/etc/ld.so.conf", "/etc/ld.so.conf.d",
+	"/etc/localtime", "/etc/ssl", "/etc/ca-certificates",
+}
+
+// Devices bound into the sandbox's /dev
+var devices = []string{"null", "zero", "full", "random", "urandom"}
+
+// A binary re-executed by the runner sets its limits and becomes the program
+func init() {
+	if len(os.Args) > 0 && os.Args[0] == sandboxArg0 {
+		os.Exit(sandboxMain(os.Args[1:]))
+	}
+}
+
+// command builds the process running a program: this binary as the sandbox
+// helper, in new user, mount, network, PID, IPC and UTS namespaces, so the
+// program sees no files but its directory and read-only system paths, has
+// no network but loopback, cannot see or signal other processes and dies
+// with everything it started.
+func (r *Runner) command(lang Language, dir string) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := &exec.Cmd{
+		Path: self,
+		Args: append([]string{sandboxArg0}, lang.Command...),
+		Dir:  dir,
+		Env:  r.environment(dir),
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET |
+				syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+			UidMappings: []syscall.SysProcIDMap{{ContainerID: sandboxID, HostID: os.Getuid(), Size: 1}},
+			GidMappings: []syscall.SysProcIDMap{{ContainerID: sandboxID, HostID: os.Getgid(), Size: 1}},
+			// Only for mounting the program's root; dropped before the exec
+			AmbientCaps: []uintptr{capSysAdmin},
+			Setpgid:     true,
+			Pdeathsig:   syscall.SIGKILL,
+		},
+		// Give up on output still held by stray processes once the program exits
+		WaitDelay: time.Second,
+	}
+	return cmd, nil
+}
+
+// environment is the program's whole environment; nothing of the
+// server's is passed on but PATH
+func (r *Runner) environment(dir string) []string {
+	l := r.limits
+	env := []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + dir,
+		"TMPDIR=" + dir,
+		"LANG=C.UTF-8",
+		"GOCACHE=" + dir + "/.cache/go-build",
+		"GOPATH=" + dir + "/go",
+		"GOTOOLCHAIN=local",
+		"GOPROXY=off",
+		fmt.Sprintf("%s=%d %d %d %d", limitsEnv,
+			int64(l.CPUTime/time.Second), l.Memory, l.FileSize, l.OpenFiles),
+	}
+	return append(env, r.env...)
+}
+
+// sandboxMain runs in the re-executed helper: it confines the program to
+// its directory, applies the limits and replaces itself with the program
+func sandboxMain(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "sandbox: no command")
+		return 127
+	}
+
+	if err := isolateFilesystem(); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		return 127
+	}
+
+	var cpu, memory, fileSize, openFiles uint64
+	if _, err := fmt.Sscan(os.Getenv(limitsEnv), &cpu, &memory, &fileSize, &openFiles); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: bad limits: %v\n", err)
+		return 127
+	}
+
+	limits := []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_CPU, cpu},
+		{syscall.RLIMIT_AS, memory},
+		{syscall.RLIMIT_FSIZE, fileSize},
+		{syscall.RLIMIT_NOFILE, openFiles},
+		{syscall.RLIMIT_CORE, 0},
+		{rlimitNproc, maxProcesses},
+	}
+	for _, l := range limits {
+		if err := syscall.Setrlimit(l.resource, &syscall.Rlimit{Cur: l.value, Max: l.value}); err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: setting limit %d: %v\n", l.resource, err)
+			return 127
+		}
+	}
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, limitsEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+
+	// Not being root in its namespace, the program starts with no
+	// capabilities once the ambient one is gone
+	if err := prctl(prCapAmbient, prCapAmbientAll); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: dropping capabilities: %v\n", err)
+		return 127
+	}
+	if err := prctl(prSetNoNewPrivs, 1); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		return 127
+	}
+
+	err := syscall.Exec(args[0], args, env)
+	fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+	return 127
+}
+
+// isolateFilesystem makes a fresh root the helper's, and so the program's,
+// whole filesystem: a tmpfs over the working directory, holding the
+// directory itself at its own path, the system paths and PATH read-only, a
+// few devices and the sandbox's own /proc. The helper runs in the
+// working directory.
+func isolateFilesystem() error {
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	// Nothing mounted from here on propagates to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+
+	// The working directory stays reachable as "." once covered by the root
+	root := dir
+	if err := syscall.Mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "size=1m,mode=0755"); err != nil {
+		return fmt.Errorf("mounting root: %w", err)
+	}
+	if err := bind(".", filepath.Join(root, dir), syscall.MS_NOSUID|syscall.MS_NODEV); err != nil {
+		return err
+	}
+
+	paths, links := visiblePaths()
+	for _, path := range paths {
+		if err := bind(path, filepath.Join(root, path), syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV); err != nil {
+			return err
+		}
+	}
+	for path, link := range links {
+		target := filepath.Join(root, path)
+		if _, err := os.Lstat(target); err == nil {
+			// Inside a directory already shown
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		if err := os.Symlink(link, target); err != nil {
+			return err
+		}
+	}
+
+	devDir := filepath.Join(root, "dev")
+	if err := os.MkdirAll(devDir, 0o755); err != nil {
+		return err
+	}
+	for _, name := range devices {
+		if err := bind(filepath.Join("/dev", name), filepath.Join(devDir, name), syscall.MS_NOSUID|syscall.MS_NOEXEC); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for name, target := range map[string]string{
+		"fd": "/proc/self/fd", "stdin": "/proc/self/fd/0", "stdout": "/proc/self/fd/1", "stderr": "/proc/self/fd/2",
+	} {
+		if err := os.Symlink(target, filepath.Join(devDir, name)); err != nil {
+			return err
+		}
+	}
+
+	// A proc of the sandbox's PID namespace; where the host masks parts of
+	// its own, the kernel refuses it and the program goes without
+	procDir := filepath.Join(root, "proc")
+	if err := os.Mkdir(procDir, 0o555); err != nil {
+		return err
+	}
+	syscall.Mount("proc", procDir, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+
+	if err := os.Chdir(root); err != nil {
+		return err
+	}
+	// With the new root over the old one, detaching "." leaves only the new
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("detaching the host filesystem: %w", err)
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("making root read-only: %w", err)
+	}
+	return os.Chdir(dir)
+}
+
+// visiblePaths returns the host directories and files shown read-only,
+// leaving out those inside another, and the symbolic links leading to
+// them. They are the system paths and the directories of PATH, with the
+// installation a bin or shims directory belongs to.
+func visiblePaths() ([]string, map[string]string) {
+	candidates := append([]string(nil), systemPaths...)
+	for _, entry := range filepath.SplitList(os.Getenv("PATH")) {
+		if !filepath.IsAbs(entry) {
+			continue
+		}
+		entry = filepath.Clean(entry)
+		if base := filepath.Base(entry); base == "bin" || base == "shims" {
+			entry = filepath.Dir(entry)
+		}
+		candidates = append(candidates, entry)
+	}
+
+	var paths []string
+	links := make(map[string]string)
+	for _, path := range candidates {
+		// A link is followed until what it leads to, which is shown instead
+		for i := 0; i < 40; i++ {
+			info, err := os.Lstat(path)
+			if err != nil {
+				path = ""
+				break
+			}
+			if info.Mode()&os.ModeSymlink == 0 {
+				break
+			}
+			link, err := os.Readlink(path)
+			if err != nil {
+				path = ""
+				break
+			}
+			links[path] = link
+			if !filepath.IsAbs(link) {
+				link = filepath.Join(filepath.Dir(path), link)
+			}
+			path = filepath.Clean(link)
+		}
+		if path != "" && path != "/" {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	var visible []string
+	for _, path := range paths {
+		if n := len(visible); n > 0 && (path == visible[n-1] || strings.HasPrefix(path, visible[n-1]+"/")) {
+			continue
+		}
+		visible = append(visible, path)
+	}
+	return visible, links
+}
+
+// bind mounts source at target, creating the target, and remounts it with
+// flags. The flags a namespace may not clear on a host mount are kept.
+func bind(source, target string, flags uintptr) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0o755)
+	} else if err = os.MkdirAll(filepath.Dir(target), 0o755); err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0o644); err == nil {
+			err = f.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("binding %s: %w", source, err)
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(target, &st); err != nil {
+		return err
+	}
+	flags |= syscall.MS_REMOUNT | syscall.MS_BIND |
+		uintptr(st.Flags)&(syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC|syscall.MS_NOATIME|syscall.MS_NODIRATIME)
+	if st.Flags&stRelatime != 0 {
+		flags |= syscall.MS_RELATIME
+	}
+	if err := syscall.Mount("", target, "", flags, ""); err != nil {
+		return fmt.Errorf("remounting %s: %w", source, err)
+	}
+	return nil
+}
+
+// prctl calls prctl(2) with one argument
+func prctl(option, arg uintptr) error {
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, option, arg, 0, 0, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// kill stops a program and everything it started
+func kill(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	cmd.Process.Kill()
+}
+
+// signalOf returns the signal that killed a process
+func signalOf(state *os.ProcessState) (int, bool) {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return 0, false
+	}
+	return int(status.Signal()), true
+}
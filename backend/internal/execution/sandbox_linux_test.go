@@ -0,0 +1,91 @@
+//go:build linux
+
+package execution
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runBash runs a bash script in the sandbox, skipping the test where the
+// sandbox cannot be set up
+func runBash(t *testing.T, script string) Result {
+	t.Helper()
+	r := NewRunner(nil)
+	if !r.Supports("bash") {
+		t.Skip("bash is not installed")
+	}
+	result, err := r.Run(context.Background(), Request{Language: "bash", Source: script}, nil)
+	if err != nil {
+		t.Skipf("sandbox unavailable: %v", err)
+	}
+	if result.ExitCode == 127 && strings.HasPrefix(result.Stderr, "sandbox: ") {
+		t.Skipf("sandbox unavailable: %s", result.Stderr)
+	}
+	return result
+}
+
+func TestSandboxCannotReadOutsideItsDirectory(t *testing.T) {
+	outside := t.TempDir()
+	secret := filepath.Join(outside, "secret")
+	if err := os.WriteFile(secret, []byte("hunter2"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	result := runBash(t, `cat `+secret+`; ls `+outside+`; ls /tmp /root /home; echo done`)
+	if strings.Contains(result.Stdout, "hunter2") || strings.Contains(result.Stdout, "secret") {
+		t.Fatalf("the sandbox read outside its directory:\n%s", result.Stdout)
+	}
+	if !strings.Contains(result.Stdout, "done") {
+		t.Fatalf("the script did not run: %+v", result)
+	}
+}
+
+func TestSandboxWritesOnlyItsDirectory(t *testing.T) {
+	result := runBash(t, `
+echo kept > note && cat note
+touch /usr/escaped 2>/dev/null && echo wrote /usr
+touch /escaped 2>/dev/null && echo wrote /
+pwd
+`)
+	if result.ExitCode != 0 || !strings.HasPrefix(result.Stdout, "kept\n") {
+		t.Fatalf("the program could not use its directory: %+v", result)
+	}
+	if strings.Contains(result.Stdout, "wrote") {
+		t.Fatalf("the program wrote outside its directory:\n%s", result.Stdout)
+	}
+	if _, err := os.Stat("/escaped"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("a file appeared on the host: %v", err)
+	}
+}
+
+func TestSandboxRunsInstalledLanguages(t *testing.T) {
+	// Go is left out: with an empty build cache it compiles the standard
+	// library, which takes longer than a run may
+	sources := map[string]string{
+		"python":     `print("hello")`,
+		"javascript": `console.log("hello")`,
+		"ruby":       `puts "hello"`,
+		"bash":       `echo hello`,
+	}
+	r := NewRunner(nil)
+	for _, lang := range r.Languages() {
+		source, ok := sources[lang]
+		if !ok {
+			continue
+		}
+		t.Run(lang, func(t *testing.T) {
+			result, err := r.Run(context.Background(), Request{Language: lang, Source: source}, nil)
+			if err != nil {
+				t.Skipf("sandbox unavailable: %v", err)
+			}
+			if result.ExitCode != 0 || result.Stdout != "hello\n" || result.Stderr != "" {
+				t.Fatalf("%s run: %+v", lang, result)
+			}
+		})
+	}
+}
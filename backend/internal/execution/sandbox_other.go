@@ -0,0 +1,23 @@
+//go:build !linux
+
+package execution
+
+import (
+	"os"
+	"os/exec"
+)
+
+// command refuses to run programs; only Linux has the namespaces the sandbox needs
+func (r *Runner) command(lang Language, dir string) (*exec.Cmd, error) {
+	return nil, ErrUnsupported
+}
+
+// kill stops a program
+func kill(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+// signalOf returns the signal that killed a process
+func signalOf(state *os.ProcessState) (int, bool) {
+	return 0, false
+}
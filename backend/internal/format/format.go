@@ -0,0 +1,207 @@
+// Package format runs source code formatters. A formatter reads a file on
+// its standard input and writes the formatted file to its standard output.
+package format
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Output read from a formatter, and its error output kept, at most
+const (
+	maxOutput = 16 << 20
+	maxErrors = 4 << 10
+)
+
+// ErrNoFormatter is returned for a file no formatter is configured for
+var ErrNoFormatter = errors.New("no formatter for this file")
+
+// Error is a formatter's refusal to format a file, usually because it does
+// not parse; Message is what the formatter wrote to its error output
+type Error struct {
+	Formatter string
+	Message   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Formatter, e.Message)
+}
+
+// Formatter describes a formatter and the files it formats
+type Formatter struct {
+	Language string `json:"language"`
+
+	// Extensions of the files it formats, with the dot; those of the
+	// language's default formatter if empty
+	Extensions []string `json:"extensions"`
+
+	Command []string `json:"command"`
+}
+
+// Handles reports whether the formatter formats a file name
+func (f Formatter) Handles(name string) bool {
+	extensions := f.Extensions
+	if len(extensions) == 0 {
+		for _, d := range DefaultFormatters {
+			if d.Language == f.Language {
+				extensions = d.Extensions
+			}
+		}
+	}
+
+	ext := strings.ToLower(path.Ext(name))
+	for _, e := range extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultFormatters are the formatters offered when configured with none;
+// those not installed are left out
+var DefaultFormatters = []Formatter{
+	{Language: "go", Extensions: []string{".go"}, Command: []string{"gofmt"}},
+	{Language: "python", Extensions: []string{".py"}, Command: []string{"black", "--quiet", "-"}},
+	{Language: "javascript", Extensions: []string{".js", ".mjs", ".cjs", ".jsx"}, Command: []string{"prettier", "--stdin-filepath", "file.js"}},
+	{Language: "typescript", Extensions: []string{".ts", ".tsx"}, Command: []string{"prettier", "--stdin-filepath", "file.ts"}},
+	{Language: "css", Extensions: []string{".css"}, Command: []string{"prettier", "--stdin-filepath", "file.css"}},
+	{Language: "html", Extensions: []string{".html", ".htm"}, Command: []string{"prettier", "--stdin-filepath", "file.html"}},
+	{Language: "json", Extensions: []string{".json"}, Command: []string{"prettier", "--stdin-filepath", "file.json"}},
+	{Language: "markdown", Extensions: []string{".md"}, Command: []string{"prettier", "--stdin-filepath", "file.md"}},
+	{Language: "rust", Extensions: []string{".rs"}, Command: []string{"rustfmt", "--edition", "2021", "--emit", "stdout"}},
+	{Language: "c", Extensions: []string{".c", ".h"}, Command: []string{"clang-format", "--assume-filename=file.c"}},
+	{Language: "cpp", Extensions: []string{".cc", ".cpp", ".hpp"}, Command: []string{"clang-format", "--assume-filename=file.cpp"}},
+}
+
+// DefaultTimeout bounds one run of a formatter
+const DefaultTimeout = 10 * time.Second
+
+// Config configures the formatters
+type Config struct {
+	// Formatters offered; DefaultFormatters if empty
+	Formatters []Formatter
+
+	// Time a formatter may take; DefaultTimeout if zero
+	Timeout time.Duration
+}
+
+// Formatters runs the configured formatters that are installed
+type Formatters struct {
+	formatters []Formatter
+	timeout    time.Duration
+}
+
+// New creates the formatters of a configuration, dropping those not installed
+func New(cfg *Config) *Formatters {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	formatters := cfg.Formatters
+	if len(formatters) == 0 {
+		formatters = DefaultFormatters
+	}
+
+	f := &Formatters{timeout: cfg.Timeout}
+	if f.timeout <= 0 {
+		f.timeout = DefaultTimeout
+	}
+	for _, fmtr := range formatters {
+		bin, err := exec.LookPath(fmtr.Command[0])
+		if err != nil {
+			continue
+		}
+		fmtr.Command = append([]string{bin}, fmtr.Command[1:]...)
+		f.formatters = append(f.formatters, fmtr)
+	}
+	return f
+}
+
+// Languages lists the languages there is a formatter for
+func (f *Formatters) Languages() []string {
+	var names []string
+	for _, fmtr := range f.formatters {
+		names = append(names, fmtr.Language)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Find returns the formatter of a language or, failing that, the first one
+// handling a file name; an empty name matches none
+func (f *Formatters) Find(language, name string) (Formatter, error) {
+	for _, fmtr := range f.formatters {
+		if fmtr.Language == language {
+			return fmtr, nil
+		}
+	}
+	if name != "" {
+		for _, fmtr := range f.formatters {
+			if fmtr.Handles(name) {
+				return fmtr, nil
+			}
+		}
+	}
+	return Formatter{}, fmt.Errorf("%w: %s", ErrNoFormatter, language)
+}
+
+// Format runs a formatter on source and returns the formatted source
+func (f *Formatters) Format(ctx context.Context, fmtr Formatter, source string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, fmtr.Command[0], fmtr.Command[1:]...)
+	cmd.Dir = os.TempDir()
+	cmd.Stdin = strings.NewReader(source)
+	stdout := &limitedBuffer{limit: maxOutput}
+	stderr := &limitedBuffer{limit: maxErrors}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", &Error{Formatter: fmtr.Language, Message: fmt.Sprintf("timed out after %s", f.timeout)}
+	}
+	if stdout.truncated {
+		return "", &Error{Formatter: fmtr.Language, Message: "output too large"}
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = exitErr.Error()
+		}
+		return "", &Error{Formatter: fmtr.Language, Message: msg}
+	}
+	if err != nil {
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,704 @@
+// Package git commits files into local git repositories and reads them back,
+// driving the git command line. Repositories need no remote. Commits are
+// built in a temporary index from the files given, so a working tree checked
+// out in the repository is only brought along afterwards, when it can be.
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	// ErrNotRepository is returned for a path holding no repository
+	ErrNotRepository = errors.New("not a git repository")
+
+	// ErrInvalidPath is returned for a repository path naming no folder
+	// under the root
+	ErrInvalidPath = errors.New("repository paths must name a folder inside the git root")
+
+	// ErrUnknownBranch is returned for a branch that does not exist
+	ErrUnknownBranch = errors.New("no such branch")
+
+	// ErrBranchExists is returned when creating a branch that exists
+	ErrBranchExists = errors.New("a branch of that name already exists")
+
+	// ErrInvalidBranch is returned for a name git does not allow for a branch
+	ErrInvalidBranch = errors.New("not a valid branch name")
+
+	// ErrNothingToCommit is returned for a commit that would change nothing
+	ErrNothingToCommit = errors.New("nothing to commit")
+
+	// ErrDetached is returned for a commit while HEAD names no branch
+	ErrDetached = errors.New("HEAD is not on a branch")
+)
+
+const (
+	// Time one git command may take
+	commandTimeout = 30 * time.Second
+
+	// Files larger than this are not read as text
+	maxFileSize = 4 << 20
+
+	// Patch text a diff returns, at most
+	maxPatch = 1 << 20
+
+	// Branch new repositories start on
+	defaultBranch = "main"
+)
+
+// Error is git's refusal to run a command; Message is its error output
+type Error struct {
+	Command string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("git %s: %s", e.Command, e.Message)
+}
+
+// Config configures the repositories
+type Config struct {
+	// Folder repositories are kept under; their paths are relative to it
+	Root string
+
+	// Committer of every commit; the authors are the users
+	Committer Author
+
+	// Domain of the email addresses users commit with
+	EmailDomain string
+}
+
+// Author is who made a commit
+type Author struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// String formats the author as git trailers write it
+func (a Author) String() string {
+	return fmt.Sprintf("%s <%s>", a.Name, a.Email)
+}
+
+// Change is a file a commit or diff changes; Status is git's A, M or D
+type Change struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+}
+
+// Commit describes a commit made
+type Commit struct {
+	ID      string    `json:"commit"`
+	Branch  string    `json:"branch"`
+	Message string    `json:"message"`
+	Author  Author    `json:"author"`
+	Time    time.Time `json:"time"`
+	Changes []Change  `json:"changes"`
+}
+
+// Diff is how files differ from HEAD
+type Diff struct {
+	Changes   []Change `json:"changes"`
+	Patch     string   `json:"patch"`
+	Truncated bool     `json:"truncated"`
+}
+
+// Branch is a branch of a repository
+type Branch struct {
+	Name    string    `json:"name"`
+	Commit  string    `json:"commit,omitempty"`
+	Subject string    `json:"subject,omitempty"`
+	Time    time.Time `json:"time"`
+	Current bool      `json:"current"`
+}
+
+// Snapshot is the content of files to commit or diff, by slash separated
+// path. Text files under Dir it does not list are removed, unless Keep
+// names them; files elsewhere, and those git holds as binary, stay as they are.
+type Snapshot struct {
+	Dir   string
+	Files map[string]string
+	Keep  map[string]bool
+}
+
+// Repositories opens the repositories under a root folder
+type Repositories struct {
+	root        string
+	committer   Author
+	emailDomain string
+
+	mu    sync.Mutex
+	repos map[string]*Repo
+}
+
+// NewRepositories creates the repositories of a configuration
+func NewRepositories(cfg *Config) *Repositories {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	r := &Repositories{
+		root:        cfg.Root,
+		committer:   cfg.Committer,
+		emailDomain: cfg.EmailDomain,
+		repos:       make(map[string]*Repo),
+	}
+	if r.root == "" {
+		r.root = filepath.Join(os.TempDir(), "collab-git")
+	}
+	if r.committer.Name == "" {
+		r.committer.Name = "Collaborative Editor"
+	}
+	if r.committer.Email == "" {
+		r.committer.Email = "editor@localhost"
+	}
+	if r.emailDomain == "" {
+		r.emailDomain = "users.noreply.localhost"
+	}
+	return r
+}
+
+// UserAuthor returns the author a user commits as, their email address
+// made from their stable ID, which must not be a secret. The name loses the
+// characters that would break an author line or trailer; one left empty
+// becomes the ID.
+func (r *Repositories) UserAuthor(name, userID string) Author {
+	name = strings.TrimSpace(strings.Map(func(c rune) rune {
+		if c == '<' || c == '>' || unicode.IsControl(c) {
+			return -1
+		}
+		return c
+	}, name))
+	if name == "" {
+		name = userID
+	}
+	return Author{Name: name, Email: userID + "@" + r.emailDomain}
+}
+
+// Open opens the repository at a path under the root, creating it first if
+// create is set and there is none. Paths cannot leave the root: ".." stops
+// at it, as it does at the top of a file system.
+func (r *Repositories) Open(repoPath string, create bool) (*Repo, error) {
+	clean := path.Clean("/" + filepath.ToSlash(repoPath))
+	if clean == "/" {
+		return nil, ErrInvalidPath
+	}
+	dir := filepath.Join(r.root, filepath.FromSlash(clean))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if repo, ok := r.repos[dir]; ok {
+		return repo, nil
+	}
+
+	repo := &Repo{dir: dir, committer: r.committer}
+	if _, err := repo.git(nil, nil, "rev-parse", "--git-dir"); err != nil {
+		if !create {
+			return nil, ErrNotRepository
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		if _, err := repo.git(nil, nil, "init", "--quiet", "--initial-branch="+defaultBranch); err != nil {
+			return nil, err
+		}
+		log.Printf("[GIT] Created repository %s", dir)
+	}
+
+	out, err := repo.git(nil, nil, "rev-parse", "--is-bare-repository")
+	if err != nil {
+		return nil, err
+	}
+	repo.bare = strings.TrimSpace(out) == "true"
+
+	r.repos[dir] = repo
+	return repo, nil
+}
+
+// Repo is a local git repository. Its methods run one at a time.
+type Repo struct {
+	dir       string
+	bare      bool
+	committer Author
+
+	mu sync.Mutex
+}
+
+// Head returns the branch HEAD is on and the commit it points to; the
+// commit is empty on a branch with no commits yet, and the branch empty
+// when HEAD is detached
+func (r *Repo) Head() (branch, commit string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.head()
+}
+
+func (r *Repo) head() (branch, commit string, err error) {
+	if out, err := r.git(nil, nil, "symbolic-ref", "--quiet", "--short", "HEAD"); err == nil {
+		branch = strings.TrimSpace(out)
+	}
+	commit, err = r.resolve("HEAD")
+	return branch, commit, err
+}
+
+// resolve returns the commit a revision names, empty if it names none
+func (r *Repo) resolve(rev string) (string, error) {
+	out, err := r.git(nil, nil, "rev-parse", "--quiet", "--verify", rev+"^{commit}")
+	var gitErr *Error
+	if errors.As(err, &gitErr) {
+		return "", nil
+	}
+	return strings.TrimSpace(out), err
+}
+
+// Files returns the text files of a commit under the given paths, all of
+// them if none are given; nothing if the commit is empty, as on a new branch
+func (r *Repo) Files(commit string, paths ...string) (map[string]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries, err := r.textFiles(commit, paths...)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string, len(entries))
+	for p, e := range entries {
+		files[p] = e.content
+	}
+	return files, nil
+}
+
+// treeEntry is a text file of a commit
+type treeEntry struct {
+	mode    string
+	content string
+}
+
+// textFiles reads the text files of a commit under the given paths
+func (r *Repo) textFiles(commit string, paths ...string) (map[string]treeEntry, error) {
+	entries := make(map[string]treeEntry)
+	if commit == "" {
+		return entries, nil
+	}
+
+	args := []string{"ls-tree", "-r", "-z", "--full-tree", "--long", commit}
+	for _, p := range paths {
+		if p != "" {
+			args = append(args, p)
+		}
+	}
+	out, err := r.git(nil, nil, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each record is "mode type object size\tpath"; symbolic links,
+	// submodules and large files are not text
+	var modes, names, objects []string
+	for _, record := range strings.Split(out, "\x00") {
+		info, name, ok := strings.Cut(record, "\t")
+		fields := strings.Fields(info)
+		if !ok || len(fields) != 4 || fields[1] != "blob" || fields[0] == "120000" {
+			continue
+		}
+		if size, err := strconv.Atoi(fields[3]); err != nil || size > maxFileSize {
+			continue
+		}
+		modes, names, objects = append(modes, fields[0]), append(names, name), append(objects, fields[2])
+	}
+	if len(objects) == 0 {
+		return entries, nil
+	}
+
+	contents, err := r.readBlobs(objects)
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		c := contents[i]
+		if utf8.ValidString(c) && !strings.ContainsRune(c, 0) {
+			entries[name] = treeEntry{mode: modes[i], content: c}
+		}
+	}
+	return entries, nil
+}
+
+// readBlobs reads the content of blobs in one git command
+func (r *Repo) readBlobs(objects []string) ([]string, error) {
+	out, err := r.git(strings.NewReader(strings.Join(objects, "\n")+"\n"), nil, "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+
+	// Each blob is "object blob size\n" followed by its content and a newline
+	contents := make([]string, 0, len(objects))
+	for range objects {
+		header, rest, ok := strings.Cut(out, "\n")
+		fields := strings.Fields(header)
+		if !ok || len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected cat-file output %q", header)
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil || size+1 > len(rest) {
+			return nil, fmt.Errorf("unexpected cat-file output %q", header)
+		}
+		contents = append(contents, rest[:size])
+		out = rest[size+1:]
+	}
+	return contents, nil
+}
+
+// Diff returns how a snapshot differs from HEAD
+func (r *Repo) Diff(snap Snapshot) (Diff, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, head, err := r.head()
+	if err != nil {
+		return Diff{}, err
+	}
+	tree, err := r.writeTree(head, snap)
+	if err != nil {
+		return Diff{}, err
+	}
+	base, err := r.treeOf(head)
+	if err != nil {
+		return Diff{}, err
+	}
+
+	changes, err := r.changes(base, tree)
+	if err != nil {
+		return Diff{}, err
+	}
+	patch, err := r.git(nil, nil, "diff-tree", "-p", "--no-color", "--no-ext-diff", "--no-textconv", base, tree)
+	if err != nil {
+		return Diff{}, err
+	}
+
+	diff := Diff{Changes: changes, Patch: patch}
+	if len(patch) > maxPatch {
+		cut := maxPatch
+		for cut > 0 && !utf8.RuneStart(patch[cut]) {
+			cut--
+		}
+		diff.Patch, diff.Truncated = patch[:cut], true
+	}
+	return diff, nil
+}
+
+// Commit commits a snapshot on the branch HEAD is on
+func (r *Repo) Commit(snap Snapshot, message string, author Author) (Commit, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	branch, head, err := r.head()
+	if err != nil {
+		return Commit{}, err
+	}
+	if branch == "" {
+		return Commit{}, ErrDetached
+	}
+	tree, err := r.writeTree(head, snap)
+	if err != nil {
+		return Commit{}, err
+	}
+	base, err := r.treeOf(head)
+	if err != nil {
+		return Commit{}, err
+	}
+	if tree == base {
+		return Commit{}, ErrNothingToCommit
+	}
+
+	now := time.Now()
+	date := fmt.Sprintf("%d %s", now.Unix(), now.Format("-0700"))
+	env := []string{
+		"GIT_AUTHOR_NAME=" + author.Name,
+		"GIT_AUTHOR_EMAIL=" + author.Email,
+		"GIT_AUTHOR_DATE=" + date,
+		"GIT_COMMITTER_NAME=" + r.committer.Name,
+		"GIT_COMMITTER_EMAIL=" + r.committer.Email,
+		"GIT_COMMITTER_DATE=" + date,
+	}
+	args := []string{"commit-tree", tree, "-F", "-"}
+	if head != "" {
+		args = append(args, "-p", head)
+	}
+	out, err := r.git(strings.NewReader(message), env, args...)
+	if err != nil {
+		return Commit{}, err
+	}
+	commit := strings.TrimSpace(out)
+
+	// Moves the branch only if nobody else moved it meanwhile
+	subject, _, _ := strings.Cut(message, "\n")
+	if _, err := r.git(nil, nil, "update-ref", "-m", "commit: "+subject, "HEAD", commit, head); err != nil {
+		return Commit{}, err
+	}
+
+	changes, err := r.changes(base, tree)
+	if err != nil {
+		return Commit{}, err
+	}
+	r.updateWorktree(base, tree)
+
+	log.Printf("[GIT] Committed %s on %s in %s by %s (%d files)", commit[:7], branch, r.dir, author, len(changes))
+	return Commit{
+		ID:      commit,
+		Branch:  branch,
+		Message: message,
+		Author:  author,
+		Time:    now,
+		Changes: changes,
+	}, nil
+}
+
+// Branches lists the repository's branches by name, including the one HEAD
+// is on while it has no commits
+func (r *Repo) Branches() ([]Branch, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, _, err := r.head()
+	if err != nil {
+		return nil, err
+	}
+	out, err := r.git(nil, nil, "for-each-ref", "--format=%(refname:short)%00%(objectname)%00%(committerdate:unix)%00%(subject)", "refs/heads")
+	if err != nil {
+		return nil, err
+	}
+
+	branches := []Branch{}
+	listed := false
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.SplitN(line, "\x00", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		b := Branch{Name: fields[0], Commit: fields[1], Subject: fields[3], Current: fields[0] == current}
+		if secs, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+			b.Time = time.Unix(secs, 0)
+		}
+		listed = listed || b.Current
+		branches = append(branches, b)
+	}
+	if current != "" && !listed {
+		branches = append(branches, Branch{Name: current, Current: true})
+	}
+	sort.Slice(branches, func(i, j int) bool { return branches[i].Name < branches[j].Name })
+	return branches, nil
+}
+
+// Checkout moves HEAD to a branch, first creating it at HEAD if create is set
+func (r *Repo) Checkout(branch string, create bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.git(nil, nil, "check-ref-format", "--branch", branch); err != nil || strings.HasPrefix(branch, "-") {
+		return ErrInvalidBranch
+	}
+	ref := "refs/heads/" + branch
+
+	_, head, err := r.head()
+	if err != nil {
+		return err
+	}
+	target, err := r.resolve(ref)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case create && target != "":
+		return ErrBranchExists
+	case create && head != "":
+		if _, err := r.git(nil, nil, "update-ref", "-m", "branch: Created from HEAD", ref, head, ""); err != nil {
+			return err
+		}
+		target = head
+	case !create && target == "":
+		return ErrUnknownBranch
+	}
+
+	from, err := r.treeOf(head)
+	if err != nil {
+		return err
+	}
+	to, err := r.treeOf(target)
+	if err != nil {
+		return err
+	}
+	if _, err := r.git(nil, nil, "symbolic-ref", "-m", "checkout: moving to "+branch, "HEAD", ref); err != nil {
+		return err
+	}
+	r.updateWorktree(from, to)
+
+	log.Printf("[GIT] Checked out %s in %s", branch, r.dir)
+	return nil
+}
+
+// writeTree writes the tree of HEAD changed by a snapshot into the
+// repository, through an index of its own, and returns it
+func (r *Repo) writeTree(head string, snap Snapshot) (string, error) {
+	tmp, err := os.MkdirTemp("", "collab-git-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	env := []string{"GIT_INDEX_FILE=" + filepath.Join(tmp, "index")}
+
+	if head != "" {
+		if _, err := r.git(nil, env, "read-tree", head); err != nil {
+			return "", err
+		}
+	}
+	existing, err := r.textFiles(head, snap.Dir)
+	if err != nil {
+		return "", err
+	}
+
+	// Removed files first, so a file may take a removed one's place
+	var removed []string
+	for p := range existing {
+		if _, ok := snap.Files[p]; !ok && !snap.Keep[p] {
+			removed = append(removed, p)
+		}
+	}
+	if len(removed) > 0 {
+		stdin := strings.Join(removed, "\x00") + "\x00"
+		if _, err := r.git(strings.NewReader(stdin), env, "update-index", "--force-remove", "-z", "--stdin"); err != nil {
+			return "", err
+		}
+	}
+
+	if len(snap.Files) > 0 {
+		paths := make([]string, 0, len(snap.Files))
+		for p := range snap.Files {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+
+		// Blobs are hashed from files, all in one command
+		var list bytes.Buffer
+		for i, p := range paths {
+			name := filepath.Join(tmp, strconv.Itoa(i))
+			if err := os.WriteFile(name, []byte(snap.Files[p]), 0o600); err != nil {
+				return "", err
+			}
+			list.WriteString(name + "\n")
+		}
+		out, err := r.git(&list, nil, "hash-object", "-w", "--no-filters", "--stdin-paths")
+		if err != nil {
+			return "", err
+		}
+		objects := strings.Fields(out)
+		if len(objects) != len(paths) {
+			return "", fmt.Errorf("hash-object returned %d objects for %d files", len(objects), len(paths))
+		}
+
+		// Files keep an executable bit they had
+		var info strings.Builder
+		for i, p := range paths {
+			mode := "100644"
+			if e, ok := existing[p]; ok {
+				mode = e.mode
+			}
+			fmt.Fprintf(&info, "%s %s\t%s\x00", mode, objects[i], p)
+		}
+		if _, err := r.git(strings.NewReader(info.String()), env, "update-index", "-z", "--index-info"); err != nil {
+			return "", err
+		}
+	}
+
+	out, err := r.git(nil, env, "write-tree")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// treeOf returns a commit's tree, or the empty tree for no commit
+func (r *Repo) treeOf(commit string) (string, error) {
+	if commit == "" {
+		out, err := r.git(strings.NewReader(""), nil, "hash-object", "-w", "-t", "tree", "--stdin")
+		return strings.TrimSpace(out), err
+	}
+	out, err := r.git(nil, nil, "rev-parse", commit+"^{tree}")
+	return strings.TrimSpace(out), err
+}
+
+// changes lists the files that differ between two trees
+func (r *Repo) changes(from, to string) ([]Change, error) {
+	out, err := r.git(nil, nil, "diff-tree", "-r", "-z", "--name-status", "--no-renames", from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []Change{}
+	fields := strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		changes = append(changes, Change{Status: fields[i], Path: fields[i+1]})
+	}
+	return changes, nil
+}
+
+// updateWorktree brings a working tree checked out in the repository from
+// one tree to another, as a checkout would. One with changes of its own in
+// the way is left as it is; its status then shows the difference.
+func (r *Repo) updateWorktree(from, to string) {
+	if r.bare || from == to {
+		return
+	}
+	if _, err := r.git(nil, nil, "read-tree", "-m", "-u", from, to); err != nil {
+		log.Printf("[GIT] Left the working tree of %s as it was: %v", r.dir, err)
+	}
+}
+
+// git runs a git command in the repository and returns its output
+func (r *Repo) git(stdin io.Reader, env []string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = r.dir
+	// Never the repository of a folder above, should this one be gone
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "LC_ALL=C", "GIT_CEILING_DIRECTORIES="+filepath.Dir(r.dir))
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdin = stdin
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", &Error{Command: args[0], Message: fmt.Sprintf("timed out after %s", commandTimeout)}
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = exitErr.Error()
+		}
+		return "", &Error{Command: args[0], Message: msg}
+	}
+	if err != nil {
+		return "", err
+	}
+	return stdout.String(), nil
+}
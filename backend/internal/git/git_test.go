@@ -0,0 +1,25 @@
+package git
+
+import "testing"
+
+func TestUserAuthor(t *testing.T) {
+	r := NewRepositories(&Config{EmailDomain: "users.example"})
+
+	cases := []struct {
+		name, want string
+	}{
+		{"Ada Lovelace", "Ada Lovelace"},
+		{"  Ada  ", "Ada"},
+		{"Ada <ada@evil.example>", "Ada ada@evil.example"},
+		{"Ada\nCo-authored-by: Eve <eve@example>", "AdaCo-authored-by: Eve eve@example"},
+		{"Ada\r\x00", "Ada"},
+		{"<>\n", "0123abcd"},
+		{"", "0123abcd"},
+	}
+	for _, c := range cases {
+		a := r.UserAuthor(c.name, "0123abcd")
+		if a.Name != c.want || a.Email != "0123abcd@users.example" {
+			t.Errorf("UserAuthor(%q) = %+v, want name %q", c.name, a, c.want)
+		}
+	}
+}
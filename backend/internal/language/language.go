@@ -0,0 +1,183 @@
+// Package language recognizes what a file is written in from its name, its
+// shebang line or, failing those, its first lines. Languages are named by
+// their Language Server Protocol identifiers, as formatters and language
+// servers are configured.
+package language
+
+import (
+	"encoding/json"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Plaintext is the language of a file nothing was recognized in
+const Plaintext = "plaintext"
+
+// Only this much of a file is looked at for its content, and only files this
+// small are checked for being JSON
+const (
+	sniffSize = 4096
+	jsonSize  = 64 << 10
+)
+
+// byExtension maps lowercase file extensions to languages
+var byExtension = map[string]string{
+	".go":    "go",
+	".py":    "python",
+	".pyw":   "python",
+	".js":    "javascript",
+	".mjs":   "javascript",
+	".cjs":   "javascript",
+	".jsx":   "javascript",
+	".ts":    "typescript",
+	".tsx":   "typescript",
+	".rs":    "rust",
+	".c":     "c",
+	".h":     "c",
+	".cc":    "cpp",
+	".cpp":   "cpp",
+	".cxx":   "cpp",
+	".hpp":   "cpp",
+	".java":  "java",
+	".kt":    "kotlin",
+	".cs":    "csharp",
+	".swift": "swift",
+	".rb":    "ruby",
+	".php":   "php",
+	".pl":    "perl",
+	".lua":   "lua",
+	".sh":    "shellscript",
+	".bash":  "shellscript",
+	".zsh":   "shellscript",
+	".sql":   "sql",
+	".html":  "html",
+	".htm":   "html",
+	".css":   "css",
+	".scss":  "scss",
+	".json":  "json",
+	".xml":   "xml",
+	".yaml":  "yaml",
+	".yml":   "yaml",
+	".toml":  "toml",
+	".md":    "markdown",
+	".txt":   Plaintext,
+}
+
+// byName maps lowercase file names without a telling extension to languages
+var byName = map[string]string{
+	"makefile":   "makefile",
+	"dockerfile": "dockerfile",
+	"gemfile":    "ruby",
+	"rakefile":   "ruby",
+	".bashrc":    "shellscript",
+	".profile":   "shellscript",
+	".zshrc":     "shellscript",
+}
+
+// byInterpreter maps the programs named by shebang lines to languages
+var byInterpreter = map[string]string{
+	"python": "python",
+	"node":   "javascript",
+	"deno":   "typescript",
+	"bash":   "shellscript",
+	"sh":     "shellscript",
+	"zsh":    "shellscript",
+	"ruby":   "ruby",
+	"php":    "php",
+	"perl":   "perl",
+	"lua":    "lua",
+}
+
+// Lines telling a language apart, tried in order on a file's first lines
+var byContent = []struct {
+	language string
+	pattern  *regexp.Regexp
+}{
+	{"go", regexp.MustCompile(`(?m)^package [a-z_][a-z0-9_]*\s*$`)},
+	{"rust", regexp.MustCompile(`(?m)^(fn main\(\)|use [a-z_]+::|pub fn |impl )`)},
+	{"python", regexp.MustCompile(`(?m)^(def \w+\(.*\)( -> .+)?:\s*$|from [\w.]+ import |import [\w.]+(, [\w.]+)*\s*$|if __name__ == )`)},
+	{"cpp", regexp.MustCompile(`(?m)^(#include <(iostream|string|vector|memory)>|using namespace |template ?<)`)},
+	{"c", regexp.MustCompile(`(?m)^#include [<"]`)},
+	{"java", regexp.MustCompile(`(?m)^(package [\w.]+;|public (final )?class )`)},
+	{"javascript", regexp.MustCompile(`(?m)^((const|let|var) \w+ = require\(|module\.exports|export (default )?(function|const|class) )`)},
+}
+
+// Detect returns the language of a file named name holding content
+func Detect(name, content string) string {
+	if lang := FromName(name); lang != "" {
+		return lang
+	}
+
+	head := content
+	if len(head) > sniffSize {
+		head = head[:sniffSize]
+	}
+	if lang := fromShebang(head); lang != "" {
+		return lang
+	}
+	if lang := fromContent(head, content); lang != "" {
+		return lang
+	}
+	return Plaintext
+}
+
+// FromName returns the language a file name tells, or "" if it tells none
+func FromName(name string) string {
+	base := strings.ToLower(path.Base(name))
+	if lang, ok := byName[base]; ok {
+		return lang
+	}
+	return byExtension[path.Ext(base)]
+}
+
+// fromShebang returns the language of the interpreter a #! line names
+func fromShebang(head string) string {
+	if !strings.HasPrefix(head, "#!") {
+		return ""
+	}
+	line, _, _ := strings.Cut(head[2:], "\n")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	program := path.Base(fields[0])
+	if program == "env" {
+		// #!/usr/bin/env [-S] python3 -u
+		program = ""
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") {
+				program = f
+				break
+			}
+		}
+	}
+	// python3.12 is python
+	return byInterpreter[strings.TrimRight(program, "0123456789.")]
+}
+
+// fromContent recognizes markup by how it starts and code by telling lines
+func fromContent(head, content string) string {
+	trimmed := strings.TrimSpace(head)
+	lower := strings.ToLower(trimmed)
+	switch {
+	case strings.HasPrefix(trimmed, "<?php"):
+		return "php"
+	case strings.HasPrefix(trimmed, "<?xml"):
+		return "xml"
+	case strings.HasPrefix(lower, "<!doctype html"), strings.HasPrefix(lower, "<html"):
+		return "html"
+	case strings.HasPrefix(trimmed, "{"), strings.HasPrefix(trimmed, "["):
+		if len(content) <= jsonSize && json.Valid([]byte(content)) {
+			return "json"
+		}
+	}
+
+	for _, c := range byContent {
+		if c.pattern.MatchString(head) {
+			return c.language
+		}
+	}
+	return ""
+}
@@ -0,0 +1,215 @@
+package lsp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"sync"
+)
+
+// ErrClosed is returned for calls on a server that exited or was closed
+var ErrClosed = errors.New("language server is not running")
+
+// ResponseError is an error a language server answered a request with
+type ResponseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("language server error %d: %s", e.Code, e.Message)
+}
+
+// Messages written to the server
+type (
+	outgoingCall struct {
+		JSONRPC string      `json:"jsonrpc"`
+		ID      *int64      `json:"id,omitempty"`
+		Method  string      `json:"method"`
+		Params  interface{} `json:"params,omitempty"`
+	}
+
+	outgoingReply struct {
+		JSONRPC string          `json:"jsonrpc"`
+		ID      json.RawMessage `json:"id"`
+		Result  interface{}     `json:"result"`
+	}
+)
+
+// incoming is any message read from the server: a response when it has an
+// ID and no method, a request when it has both, a notification otherwise
+type incoming struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *ResponseError  `json:"error,omitempty"`
+}
+
+// conn speaks JSON-RPC 2.0 with the Content-Length framing of the base
+// protocol over a server's standard input and output
+type conn struct {
+	w   io.Writer
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  int64
+	pending map[int64]chan incoming
+	closed  bool
+
+	// Passed the server's notifications, on the read goroutine
+	onNotify func(method string, params json.RawMessage)
+
+	// Closed when the read loop ends
+	done chan struct{}
+}
+
+// newConn starts reading messages from r
+func newConn(r io.Reader, w io.Writer, onNotify func(string, json.RawMessage)) *conn {
+	c := &conn{
+		w:        w,
+		pending:  make(map[int64]chan incoming),
+		onNotify: onNotify,
+		done:     make(chan struct{}),
+	}
+	go c.read(bufio.NewReader(r))
+	return c
+}
+
+// call sends a request and decodes its result into result, which may be nil.
+// Cancelling ctx tells the server to give up on the request.
+func (c *conn) call(ctx context.Context, method string, params, result interface{}) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.nextID++
+	id := c.nextID
+	reply := make(chan incoming, 1)
+	c.pending[id] = reply
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(outgoingCall{JSONRPC: "2.0", ID: &id, Method: method, Params: params}); err != nil {
+		return err
+	}
+
+	select {
+	case msg := <-reply:
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if result == nil || len(msg.Result) == 0 {
+			return nil
+		}
+		return json.Unmarshal(msg.Result, result)
+	case <-c.done:
+		return ErrClosed
+	case <-ctx.Done():
+		c.notify("$/cancelRequest", map[string]int64{"id": id})
+		return ctx.Err()
+	}
+}
+
+// notify sends a notification
+func (c *conn) notify(method string, params interface{}) error {
+	return c.write(outgoingCall{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// write frames and sends one message
+func (c *conn) write(msg interface{}) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if _, err := fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = c.w.Write(body)
+	return err
+}
+
+// read dispatches messages until the server's output closes
+func (c *conn) read(r *bufio.Reader) {
+	defer func() {
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+		close(c.done)
+	}()
+
+	headers := textproto.NewReader(r)
+	for {
+		header, err := headers.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		length, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil || length < 0 {
+			return
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+
+		var msg incoming
+		if err := json.Unmarshal(body, &msg); err != nil {
+			continue
+		}
+		c.dispatch(msg)
+	}
+}
+
+// dispatch routes a message read from the server
+func (c *conn) dispatch(msg incoming) {
+	switch {
+	case msg.Method == "":
+		id, err := strconv.ParseInt(string(msg.ID), 10, 64)
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		reply := c.pending[id]
+		c.mu.Unlock()
+		if reply != nil {
+			reply <- msg
+		}
+
+	case len(msg.ID) > 0:
+		// The editor offers no client features, so server requests such as
+		// workspace/configuration get empty answers
+		c.write(outgoingReply{JSONRPC: "2.0", ID: msg.ID, Result: emptyResult(msg)})
+
+	case c.onNotify != nil:
+		c.onNotify(msg.Method, msg.Params)
+	}
+}
+
+// emptyResult is the answer to a server request the editor does not serve
+func emptyResult(msg incoming) interface{} {
+	if msg.Method != "workspace/configuration" {
+		return nil
+	}
+	// One (empty) setting per item asked for
+	var params struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	json.Unmarshal(msg.Params, &params)
+	return make([]interface{}, len(params.Items))
+}
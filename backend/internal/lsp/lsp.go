@@ -0,0 +1,494 @@
+// Package lsp runs language servers over stdio and speaks the parts of the
+// Language Server Protocol the editor needs: keeping documents in sync,
+// completion, hover, go to definition and diagnostics.
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNotSupported is returned for a request the server does not offer
+var ErrNotSupported = errors.New("not supported by the language server")
+
+// How long a server may take to start and to shut down
+const (
+	initializeTimeout = 30 * time.Second
+	shutdownTimeout   = 2 * time.Second
+)
+
+// ServerConfig describes a language server and the files it handles
+type ServerConfig struct {
+	// Language is the LSP language identifier, e.g. "go"
+	Language string
+
+	// Extensions of the files the server handles, with the dot;
+	// DefaultExtensions of the language if empty
+	Extensions []string
+
+	// Command starts the server, which speaks over its stdin and stdout
+	Command []string
+}
+
+// DefaultExtensions are the file extensions of common languages
+var DefaultExtensions = map[string][]string{
+	"go":          {".go"},
+	"python":      {".py"},
+	"javascript":  {".js", ".mjs", ".cjs"},
+	"typescript":  {".ts", ".tsx"},
+	"rust":        {".rs"},
+	"c":           {".c", ".h"},
+	"cpp":         {".cc", ".cpp", ".hpp"},
+	"java":        {".java"},
+	"ruby":        {".rb"},
+	"shellscript": {".sh"},
+	"html":        {".html"},
+	"css":         {".css"},
+	"json":        {".json"},
+	"markdown":    {".md"},
+	"yaml":        {".yaml", ".yml"},
+}
+
+// Handles reports whether the server is configured for a file name
+func (c ServerConfig) Handles(name string) bool {
+	extensions := c.Extensions
+	if len(extensions) == 0 {
+		extensions = DefaultExtensions[c.Language]
+	}
+	for _, ext := range extensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Position is a zero based line and UTF-16 character offset
+type Position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+// Range is a half-open range of positions
+type Range struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+// Location is a range in a file
+type Location struct {
+	URI   string `json:"uri"`
+	Range Range  `json:"range"`
+}
+
+// Diagnostic severities
+const (
+	SeverityError       = 1
+	SeverityWarning     = 2
+	SeverityInformation = 3
+	SeverityHint        = 4
+)
+
+// Diagnostic is an error, warning or hint about a range of a file
+type Diagnostic struct {
+	Range    Range           `json:"range"`
+	Severity int             `json:"severity,omitempty"`
+	Code     json.RawMessage `json:"code,omitempty"`
+	Source   string          `json:"source,omitempty"`
+	Message  string          `json:"message"`
+}
+
+// PublishDiagnosticsParams are a file's current diagnostics
+type PublishDiagnosticsParams struct {
+	URI         string       `json:"uri"`
+	Diagnostics []Diagnostic `json:"diagnostics"`
+}
+
+// ContentChange is an edit of an open file: Text replaces Range, or the
+// whole file if Range is nil
+type ContentChange struct {
+	Range *Range `json:"range,omitempty"`
+	Text  string `json:"text"`
+}
+
+// TextEdit replaces a range with new text
+type TextEdit struct {
+	Range   Range  `json:"range"`
+	NewText string `json:"newText"`
+}
+
+// CompletionItem is one suggestion of a completion request
+type CompletionItem struct {
+	Label         string          `json:"label"`
+	Kind          int             `json:"kind,omitempty"`
+	Detail        string          `json:"detail,omitempty"`
+	Documentation json.RawMessage `json:"documentation,omitempty"`
+	InsertText    string          `json:"insertText,omitempty"`
+	SortText      string          `json:"sortText,omitempty"`
+
+	// Where the suggestion goes; nil means the word at the position
+	TextEdit *TextEdit `json:"-"`
+}
+
+// UnmarshalJSON reads the item's text edit, which newer servers send as an
+// insert/replace edit
+func (i *CompletionItem) UnmarshalJSON(data []byte) error {
+	type plain CompletionItem
+	var item struct {
+		plain
+		TextEdit *struct {
+			Range   *Range `json:"range"`
+			Insert  *Range `json:"insert"`
+			NewText string `json:"newText"`
+		} `json:"textEdit"`
+	}
+	if err := json.Unmarshal(data, &item); err != nil {
+		return err
+	}
+
+	*i = CompletionItem(item.plain)
+	if edit := item.TextEdit; edit != nil {
+		r := edit.Range
+		if r == nil {
+			r = edit.Insert
+		}
+		if r != nil {
+			i.TextEdit = &TextEdit{Range: *r, NewText: edit.NewText}
+		}
+	}
+	return nil
+}
+
+// CompletionList is the answer to a completion request
+type CompletionList struct {
+	IsIncomplete bool             `json:"isIncomplete"`
+	Items        []CompletionItem `json:"items"`
+}
+
+// Hover is the information shown for the symbol at a position
+type Hover struct {
+	// Markdown or plain text
+	Contents string
+	Range    *Range
+}
+
+// Server is a running language server with a workspace folder
+type Server struct {
+	config ServerConfig
+	root   string
+	cmd    *exec.Cmd
+	conn   *conn
+
+	// What the server announced it supports
+	incremental bool
+	completion  bool
+	hover       bool
+	definition  bool
+}
+
+// Start launches a language server for the workspace folder root and waits
+// until it is initialized. onDiagnostics is passed every file's diagnostics
+// as the server publishes them, on a goroutine of the server's.
+func Start(cfg ServerConfig, root string, onDiagnostics func(PublishDiagnosticsParams)) (*Server, error) {
+	if len(cfg.Command) == 0 {
+		return nil, fmt.Errorf("no command configured for %s", cfg.Language)
+	}
+
+	cmd := exec.Command(cfg.Command[0], cfg.Command[1:]...)
+	cmd.Dir = root
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting %s language server: %w", cfg.Language, err)
+	}
+
+	s := &Server{config: cfg, root: root, cmd: cmd}
+	s.conn = newConn(stdout, stdin, func(method string, params json.RawMessage) {
+		if method != "textDocument/publishDiagnostics" || onDiagnostics == nil {
+			return
+		}
+		var p PublishDiagnosticsParams
+		if err := json.Unmarshal(params, &p); err == nil {
+			onDiagnostics(p)
+		}
+	})
+	go func() {
+		<-s.conn.done
+		cmd.Wait()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), initializeTimeout)
+	defer cancel()
+	if err := s.initialize(ctx); err != nil {
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("initializing %s language server: %w", cfg.Language, err)
+	}
+
+	log.Printf("[LSP] Started %s language server (pid %d) in %s", cfg.Language, cmd.Process.Pid, root)
+	return s, nil
+}
+
+// initialize performs the protocol's handshake and records the server's capabilities
+func (s *Server) initialize(ctx context.Context) error {
+	name := filepath.Base(s.root)
+	params := map[string]interface{}{
+		"processId": os.Getpid(),
+		"clientInfo": map[string]string{
+			"name": "collaborative-editor",
+		},
+		"rootUri": FileURI(s.root),
+		"workspaceFolders": []map[string]string{
+			{"uri": FileURI(s.root), "name": name},
+		},
+		"capabilities": map[string]interface{}{
+			"textDocument": map[string]interface{}{
+				"synchronization": map[string]interface{}{"dynamicRegistration": false},
+				"completion": map[string]interface{}{
+					"completionItem": map[string]interface{}{"snippetSupport": false},
+				},
+				"hover": map[string]interface{}{
+					"contentFormat": []string{"markdown", "plaintext"},
+				},
+				"definition":         map[string]interface{}{"linkSupport": true},
+				"publishDiagnostics": map[string]interface{}{},
+			},
+		},
+	}
+
+	var result struct {
+		Capabilities struct {
+			TextDocumentSync   json.RawMessage `json:"textDocumentSync"`
+			CompletionProvider json.RawMessage `json:"completionProvider"`
+			HoverProvider      json.RawMessage `json:"hoverProvider"`
+			DefinitionProvider json.RawMessage `json:"definitionProvider"`
+		} `json:"capabilities"`
+	}
+	if err := s.conn.call(ctx, "initialize", params, &result); err != nil {
+		return err
+	}
+
+	caps := result.Capabilities
+	s.incremental = syncKind(caps.TextDocumentSync) == 2
+	s.completion = provides(caps.CompletionProvider)
+	s.hover = provides(caps.HoverProvider)
+	s.definition = provides(caps.DefinitionProvider)
+
+	return s.conn.notify("initialized", map[string]interface{}{})
+}
+
+// syncKind reads the textDocumentSync capability, a number or an object
+func syncKind(raw json.RawMessage) int {
+	var kind int
+	if json.Unmarshal(raw, &kind) == nil {
+		return kind
+	}
+	var options struct {
+		Change int `json:"change"`
+	}
+	json.Unmarshal(raw, &options)
+	return options.Change
+}
+
+// provides reads a capability that is true or an options object
+func provides(raw json.RawMessage) bool {
+	s := string(raw)
+	return s != "" && s != "null" && s != "false"
+}
+
+// Config returns the configuration the server was started with
+func (s *Server) Config() ServerConfig {
+	return s.config
+}
+
+// Incremental reports whether the server takes edits as ranges rather
+// than the whole text
+func (s *Server) Incremental() bool {
+	return s.incremental
+}
+
+// Done is closed when the server exits
+func (s *Server) Done() <-chan struct{} {
+	return s.conn.done
+}
+
+// DidOpen tells the server the editor now holds a file's content
+func (s *Server) DidOpen(uri string, version int, text string) error {
+	return s.conn.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{
+			"uri":        uri,
+			"languageId": s.config.Language,
+			"version":    version,
+			"text":       text,
+		},
+	})
+}
+
+// DidChange sends edits of an open file, applied in order
+func (s *Server) DidChange(uri string, version int, changes []ContentChange) error {
+	return s.conn.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": uri, "version": version},
+		"contentChanges": changes,
+	})
+}
+
+// DidClose tells the server a file's content is on disk again
+func (s *Server) DidClose(uri string) error {
+	return s.conn.notify("textDocument/didClose", map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+	})
+}
+
+// positionParams names a position in a file
+func positionParams(uri string, pos Position) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"position":     pos,
+	}
+}
+
+// Completion asks for suggestions at a position
+func (s *Server) Completion(ctx context.Context, uri string, pos Position) (CompletionList, error) {
+	if !s.completion {
+		return CompletionList{}, ErrNotSupported
+	}
+
+	var raw json.RawMessage
+	if err := s.conn.call(ctx, "textDocument/completion", positionParams(uri, pos), &raw); err != nil {
+		return CompletionList{}, err
+	}
+
+	// A list, a bare array of items or null
+	var list CompletionList
+	if err := json.Unmarshal(raw, &list.Items); err != nil {
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return CompletionList{}, err
+		}
+	}
+	return list, nil
+}
+
+// Hover asks for information on the symbol at a position; nil if there is none
+func (s *Server) Hover(ctx context.Context, uri string, pos Position) (*Hover, error) {
+	if !s.hover {
+		return nil, ErrNotSupported
+	}
+
+	var result *struct {
+		Contents json.RawMessage `json:"contents"`
+		Range    *Range          `json:"range"`
+	}
+	if err := s.conn.call(ctx, "textDocument/hover", positionParams(uri, pos), &result); err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+
+	contents := MarkupText(result.Contents)
+	if contents == "" {
+		return nil, nil
+	}
+	return &Hover{Contents: contents, Range: result.Range}, nil
+}
+
+// Definition asks where the symbol at a position is defined
+func (s *Server) Definition(ctx context.Context, uri string, pos Position) ([]Location, error) {
+	if !s.definition {
+		return nil, ErrNotSupported
+	}
+
+	var raw json.RawMessage
+	if err := s.conn.call(ctx, "textDocument/definition", positionParams(uri, pos), &raw); err != nil {
+		return nil, err
+	}
+
+	// A location, an array of locations, an array of links or null
+	var one Location
+	if json.Unmarshal(raw, &one) == nil && one.URI != "" {
+		return []Location{one}, nil
+	}
+	var entries []struct {
+		Location
+		TargetURI            string `json:"targetUri"`
+		TargetSelectionRange Range  `json:"targetSelectionRange"`
+	}
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, nil
+	}
+	locations := make([]Location, 0, len(entries))
+	for _, e := range entries {
+		if e.TargetURI != "" {
+			locations = append(locations, Location{URI: e.TargetURI, Range: e.TargetSelectionRange})
+		} else if e.URI != "" {
+			locations = append(locations, e.Location)
+		}
+	}
+	return locations, nil
+}
+
+// MarkupText flattens hover contents, which may be a string, markup content,
+// a marked string or an array of those, into markdown
+func MarkupText(raw json.RawMessage) string {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return text
+	}
+
+	var markup struct {
+		Kind     string `json:"kind"`
+		Language string `json:"language"`
+		Value    string `json:"value"`
+	}
+	if json.Unmarshal(raw, &markup) == nil && markup.Value != "" {
+		if markup.Language != "" {
+			return "```" + markup.Language + "\n" + markup.Value + "\n```"
+		}
+		return markup.Value
+	}
+
+	var parts []json.RawMessage
+	if json.Unmarshal(raw, &parts) != nil {
+		return ""
+	}
+	texts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if t := MarkupText(part); t != "" {
+			texts = append(texts, t)
+		}
+	}
+	return strings.Join(texts, "\n\n")
+}
+
+// Close shuts the server down, killing it if it does not exit in time
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := s.conn.call(ctx, "shutdown", nil, nil); err == nil {
+		s.conn.notify("exit", nil)
+	}
+
+	select {
+	case <-s.conn.done:
+	case <-ctx.Done():
+		s.cmd.Process.Kill()
+		<-s.conn.done
+	}
+
+	log.Printf("[LSP] Stopped %s language server in %s", s.config.Language, s.root)
+	return nil
+}
@@ -0,0 +1,74 @@
+package lsp
+
+import (
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// PositionAt converts a byte offset in text to a position, whose character
+// counts UTF-16 code units as the protocol requires
+func PositionAt(text string, offset int) Position {
+	if offset > len(text) {
+		offset = len(text)
+	}
+
+	line, start := 0, 0
+	for i := 0; i < offset; i++ {
+		if text[i] == '\n' {
+			line++
+			start = i + 1
+		}
+	}
+
+	character := 0
+	for _, r := range text[start:offset] {
+		character += utf16Len(r)
+	}
+	return Position{Line: line, Character: character}
+}
+
+// OffsetAt converts a position to a byte offset in text. Positions past the
+// end of their line or of the text are clamped to it.
+func OffsetAt(text string, pos Position) int {
+	offset := 0
+	for line := 0; line < pos.Line; line++ {
+		next := strings.IndexByte(text[offset:], '\n')
+		if next < 0 {
+			return len(text)
+		}
+		offset += next + 1
+	}
+
+	for character := 0; character < pos.Character && offset < len(text); {
+		r, size := utf8.DecodeRuneInString(text[offset:])
+		if r == '\n' {
+			break
+		}
+		character += utf16Len(r)
+		offset += size
+	}
+	return offset
+}
+
+// utf16Len is the number of UTF-16 code units encoding r
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// FileURI returns the file URI of an absolute path
+func FileURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+// URIPath returns the path of a file URI
+func URIPath(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	return u.Path, true
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+
+package terminal
+
+import (
+	"os"
+	"os/exec"
+)
+
+// openPTY refuses to open a pseudo-terminal; only Linux is supported
+func openPTY() (master, slave *os.File, err error) {
+	return nil, nil, ErrUnsupported
+}
+
+// setSize does nothing without a pseudo-terminal
+func setSize(master *os.File, size Size) error {
+	return ErrUnsupported
+}
+
+// attach leaves the shell as it is
+func attach(cmd *exec.Cmd) {}
+
+// kill stops a shell
+func kill(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+// signalOf returns the signal that killed a process
+func signalOf(state *os.ProcessState) (int, bool) {
+	return 0, false
+}
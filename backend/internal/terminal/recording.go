@@ -0,0 +1,145 @@
+package terminal
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Kinds of recorded events, as asciicast names them
+const (
+	Output  = "o"
+	Input   = "i"
+	Resized = "r"
+)
+
+// Event is something that happened in a terminal, at Time since it started.
+// Output and Input hold the text; Resized holds the new size as COLSxROWS.
+type Event struct {
+	Time time.Duration
+	Kind string
+	Data string
+}
+
+// Recording is everything that happened in a terminal, up to a size limit
+type Recording struct {
+	ID        string
+	StartedAt time.Time
+
+	// Size the terminal started with
+	Size Size
+
+	mu        sync.Mutex
+	events    []Event
+	bytes     int
+	limit     int
+	truncated bool
+	running   bool
+	endedAt   time.Time
+	exitCode  int
+}
+
+// RecordingInfo describes a recording
+type RecordingInfo struct {
+	ID         string    `json:"recordingId"`
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs int64     `json:"durationMs"`
+	Rows       int       `json:"rows"`
+	Cols       int       `json:"cols"`
+	Events     int       `json:"events"`
+	Bytes      int       `json:"bytes"`
+	Truncated  bool      `json:"truncated"`
+	Running    bool      `json:"running"`
+	ExitCode   *int      `json:"exitCode,omitempty"`
+}
+
+// newRecording starts recording a terminal
+func newRecording(id string, size Size, limit int) *Recording {
+	return &Recording{ID: id, StartedAt: time.Now(), Size: size, limit: limit, running: true}
+}
+
+// add records an event, unless the recording is full
+func (r *Recording) add(kind, data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.truncated {
+		return
+	}
+	if r.bytes+len(data) > r.limit {
+		r.truncated = true
+		return
+	}
+	r.bytes += len(data)
+	r.events = append(r.events, Event{Time: time.Since(r.StartedAt), Kind: kind, Data: data})
+}
+
+// finish ends the recording once the shell exited
+func (r *Recording) finish(exitCode int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.running = false
+	r.endedAt = time.Now()
+	r.exitCode = exitCode
+}
+
+// Info describes the recording
+func (r *Recording) Info() RecordingInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	info := RecordingInfo{
+		ID:        r.ID,
+		StartedAt: r.StartedAt,
+		Rows:      r.Size.Rows,
+		Cols:      r.Size.Cols,
+		Events:    len(r.events),
+		Bytes:     r.bytes,
+		Truncated: r.truncated,
+		Running:   r.running,
+	}
+	end := time.Now()
+	if !r.running {
+		end = r.endedAt
+		code := r.exitCode
+		info.ExitCode = &code
+	}
+	info.DurationMs = end.Sub(r.StartedAt).Milliseconds()
+	return info
+}
+
+// Events returns the events recorded so far
+func (r *Recording) Events() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Event(nil), r.events...)
+}
+
+// WriteCast writes the recording in the asciicast v2 format terminal
+// players replay: a header line, then one [seconds, kind, data] line per event
+func (r *Recording) WriteCast(w io.Writer) error {
+	header := map[string]interface{}{
+		"version":   2,
+		"width":     r.Size.Cols,
+		"height":    r.Size.Rows,
+		"timestamp": r.StartedAt.Unix(),
+		"title":     r.ID,
+		"env":       map[string]string{"TERM": "xterm-256color"},
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	for _, e := range r.Events() {
+		if err := enc.Encode([]interface{}{e.Time.Seconds(), e.Kind, e.Data}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
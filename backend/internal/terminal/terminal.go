@@ -0,0 +1,401 @@
+// Package terminal runs interactive shells on pseudo-terminals for several
+// users to share, and records what happens in each so it can be replayed.
+// Shells are not sandboxed: they run as the server's user, in a working
+// directory of the caller's choosing.
+package terminal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// ErrUnsupported is returned where the platform has no pseudo-terminals
+	ErrUnsupported = errors.New("terminals are not supported on this platform")
+
+	// ErrBusy is returned when as many shells as allowed are already running
+	ErrBusy = errors.New("too many terminals running, try again later")
+
+	// ErrClosed is returned for input to a shell that exited
+	ErrClosed = errors.New("the terminal has exited")
+)
+
+const (
+	// DefaultIdleTimeout closes shells nobody typed in for this long
+	DefaultIdleTimeout = 30 * time.Minute
+
+	// DefaultMaxRecording bounds the bytes of output and input one recording keeps
+	DefaultMaxRecording = 8 << 20
+
+	// DefaultMaxTerminals bounds the shells running at once
+	DefaultMaxTerminals = 8
+
+	// How long output still buffered in the terminal is read after the shell exits
+	drainTimeout = time.Second
+)
+
+// Config configures the shells
+type Config struct {
+	// Command run as the shell; bash, or sh without it, if empty
+	Shell []string
+
+	// Extra environment variables of every shell, as KEY=value
+	Env []string
+
+	// Time a shell may go without input before it is closed;
+	// DefaultIdleTimeout if zero
+	IdleTimeout time.Duration
+
+	// Bytes a recording keeps; DefaultMaxRecording if zero
+	MaxRecording int
+
+	// Shells running at once; DefaultMaxTerminals if zero
+	MaxTerminals int
+}
+
+// Size is the size of a terminal in characters
+type Size struct {
+	Rows int `json:"rows"`
+	Cols int `json:"cols"`
+}
+
+// Request is a shell to start
+type Request struct {
+	// Names the shell's recording
+	ID string
+
+	// Working directory of the shell, also its HOME
+	Dir string
+
+	Size Size
+}
+
+// Result describes how a shell ended
+type Result struct {
+	ExitCode int
+	Duration time.Duration
+
+	// Closed for going without input for too long
+	Idle bool
+
+	// Closed on purpose rather than exiting
+	Closed bool
+}
+
+// Shells starts shells on pseudo-terminals
+type Shells struct {
+	shell        []string
+	env          []string
+	idleTimeout  time.Duration
+	maxRecording int
+	slots        chan struct{}
+}
+
+// NewShells creates the shells of a configuration
+func NewShells(cfg *Config) *Shells {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	s := &Shells{
+		shell:        cfg.Shell,
+		env:          cfg.Env,
+		idleTimeout:  cfg.IdleTimeout,
+		maxRecording: cfg.MaxRecording,
+	}
+	if len(s.shell) == 0 {
+		s.shell = []string{"sh"}
+		if _, err := exec.LookPath("bash"); err == nil {
+			s.shell = []string{"bash"}
+		}
+	}
+	if s.idleTimeout <= 0 {
+		s.idleTimeout = DefaultIdleTimeout
+	}
+	if s.maxRecording <= 0 {
+		s.maxRecording = DefaultMaxRecording
+	}
+	maxTerminals := cfg.MaxTerminals
+	if maxTerminals <= 0 {
+		maxTerminals = DefaultMaxTerminals
+	}
+	s.slots = make(chan struct{}, maxTerminals)
+	return s
+}
+
+// Terminal is a shell running on a pseudo-terminal
+type Terminal struct {
+	cmd         *exec.Cmd
+	pty         *os.File
+	recording   *Recording
+	idleTimeout time.Duration
+	idle        *time.Timer
+	started     time.Time
+
+	mu     sync.Mutex
+	size   Size
+	reason string
+	result Result
+
+	// Closed once the shell exited and its output was read
+	done chan struct{}
+}
+
+// Reasons a shell is closed
+const (
+	closedIdle      = "idle"
+	closedOnPurpose = "closed"
+)
+
+// Start starts a shell and returns at once. Its output is passed to onOutput
+// as it is written, never concurrently and always in whole UTF-8 characters.
+func (s *Shells) Start(req Request, onOutput func(string)) (*Terminal, error) {
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		return nil, ErrBusy
+	}
+
+	t, err := s.start(req, onOutput)
+	if err != nil {
+		<-s.slots
+		return nil, err
+	}
+	go func() {
+		<-t.done
+		<-s.slots
+	}()
+	return t, nil
+}
+
+// start opens the pseudo-terminal and starts the shell on it
+func (s *Shells) start(req Request, onOutput func(string)) (*Terminal, error) {
+	bin, err := exec.LookPath(s.shell[0])
+	if err != nil {
+		return nil, fmt.Errorf("no shell: %w", err)
+	}
+
+	master, slave, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+	defer slave.Close()
+
+	if err := setSize(master, req.Size); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("sizing terminal: %w", err)
+	}
+
+	cmd := exec.Command(bin, s.shell[1:]...)
+	cmd.Dir = req.Dir
+	cmd.Env = append([]string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + req.Dir,
+		"SHELL=" + bin,
+		"TERM=xterm-256color",
+		"LANG=C.UTF-8",
+	}, s.env...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	attach(cmd)
+
+	if err := cmd.Start(); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("starting shell: %w", err)
+	}
+
+	t := &Terminal{
+		cmd:         cmd,
+		pty:         master,
+		recording:   newRecording(req.ID, req.Size, s.maxRecording),
+		idleTimeout: s.idleTimeout,
+		started:     time.Now(),
+		size:        req.Size,
+		done:        make(chan struct{}),
+	}
+	t.idle = time.AfterFunc(s.idleTimeout, func() { t.close(closedIdle) })
+
+	log.Printf("[TERMINAL] Started %s (pid %d) for %s in %s", bin, cmd.Process.Pid, req.ID, req.Dir)
+
+	read := make(chan struct{})
+	go t.read(onOutput, read)
+	go t.wait(read)
+	return t, nil
+}
+
+// read passes the shell's output on until the terminal closes, holding
+// back a partial UTF-8 character until the rest of it arrives
+func (t *Terminal) read(onOutput func(string), read chan struct{}) {
+	defer close(read)
+
+	buf := make([]byte, 32<<10)
+	var pending []byte
+	for {
+		n, err := t.pty.Read(buf)
+		if n > 0 {
+			pending = append(pending, buf[:n]...)
+			cut := completeUTF8(pending)
+			t.output(onOutput, pending[:cut])
+			pending = append(pending[:0], pending[cut:]...)
+		}
+		if err != nil {
+			t.output(onOutput, pending)
+			return
+		}
+	}
+}
+
+// output records a chunk of output and passes it on
+func (t *Terminal) output(onOutput func(string), data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	t.recording.add(Output, string(data))
+	onOutput(string(data))
+}
+
+// wait reaps the shell, reads what it left in the terminal and closes it.
+// Programs the shell left running lose their terminal.
+func (t *Terminal) wait(read chan struct{}) {
+	err := t.cmd.Wait()
+	t.idle.Stop()
+
+	select {
+	case <-read:
+	case <-time.After(drainTimeout):
+	}
+	t.pty.Close()
+	<-read
+
+	t.mu.Lock()
+	t.result = Result{
+		ExitCode: exitCode(t.cmd, err),
+		Duration: time.Since(t.started),
+		Idle:     t.reason == closedIdle,
+		Closed:   t.reason == closedOnPurpose,
+	}
+	result := t.result
+	t.mu.Unlock()
+
+	t.recording.finish(result.ExitCode)
+	log.Printf("[TERMINAL] Shell of %s exited with %d after %v (idle: %v, closed: %v)",
+		t.recording.ID, result.ExitCode, result.Duration.Round(time.Millisecond), result.Idle, result.Closed)
+	close(t.done)
+}
+
+// Write types input into the terminal
+func (t *Terminal) Write(input string) error {
+	select {
+	case <-t.done:
+		return ErrClosed
+	default:
+	}
+
+	t.idle.Reset(t.idleTimeout)
+	t.recording.add(Input, input)
+	if _, err := t.pty.Write([]byte(input)); err != nil {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Resize changes the terminal's size, which the programs in it are told of
+func (t *Terminal) Resize(size Size) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if size == t.size {
+		return nil
+	}
+	if err := setSize(t.pty, size); err != nil {
+		return err
+	}
+	t.size = size
+	t.recording.add(Resized, fmt.Sprintf("%dx%d", size.Cols, size.Rows))
+	return nil
+}
+
+// Size returns the terminal's size
+func (t *Terminal) Size() Size {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.size
+}
+
+// Close kills the shell and everything it started
+func (t *Terminal) Close() {
+	t.close(closedOnPurpose)
+}
+
+// close kills the shell for a reason, unless it already exited
+func (t *Terminal) close(reason string) {
+	select {
+	case <-t.done:
+		return
+	default:
+	}
+
+	t.mu.Lock()
+	if t.reason == "" {
+		t.reason = reason
+	}
+	t.mu.Unlock()
+	kill(t.cmd)
+}
+
+// Done is closed once the shell exited
+func (t *Terminal) Done() <-chan struct{} {
+	return t.done
+}
+
+// Result describes how the shell ended, once Done is closed
+func (t *Terminal) Result() Result {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.result
+}
+
+// Recording returns the recording of the terminal, which grows until the
+// shell exits
+func (t *Terminal) Recording() *Recording {
+	return t.recording
+}
+
+// exitCode returns a finished shell's exit status, or 128 plus the signal
+// that killed it as a shell would report it
+func exitCode(cmd *exec.Cmd, err error) int {
+	if cmd.ProcessState == nil {
+		return -1
+	}
+	if code := cmd.ProcessState.ExitCode(); code >= 0 {
+		return code
+	}
+	if sig, ok := signalOf(cmd.ProcessState); ok {
+		return 128 + sig
+	}
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
+// completeUTF8 returns the length of the longest prefix of b that does not
+// end in the middle of a UTF-8 character
+func completeUTF8(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return len(b)
+			}
+			return i
+		}
+	}
+	return len(b)
+}
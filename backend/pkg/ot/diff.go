@@ -0,0 +1,312 @@
+package ot
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Hunks longer than this many characters on either side are not refined
+	// below whole lines
+	maxRefine = 4096
+
+	// Sequences further apart than this many insertions and deletions are
+	// replaced as a whole, which bounds the search's time and memory
+	maxDistance = 1024
+)
+
+// Edit replaces the text between byte offsets Start and End of a document
+// with Text
+type Edit struct {
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	Text  string `json:"text"`
+}
+
+// Diff returns the edits that turn old into new, ordered by position and
+// not overlapping. Lines are matched first; each changed block of lines is
+// then narrowed to the characters that differ, so the edits leave alone as
+// much of the old text as they can.
+func Diff(old, new string) []Edit {
+	a, b := splitLines(old), splitLines(new)
+	starts := offsets(a)
+
+	var edits []Edit
+	for _, h := range diffSeq(a, b) {
+		start := starts[h.aStart]
+		for _, e := range refine(old[start:starts[h.aEnd]], strings.Join(b[h.bStart:h.bEnd], "")) {
+			e.Start += start
+			e.End += start
+			edits = append(edits, e)
+		}
+	}
+	return edits
+}
+
+// Apply returns text with edits made against it applied
+func Apply(text string, edits []Edit) string {
+	var b strings.Builder
+	last := 0
+	for _, e := range edits {
+		b.WriteString(text[last:e.Start])
+		b.WriteString(e.Text)
+		last = e.End
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// Ops returns the operations applying edits to the document they were made
+// against, from the end of the document to its start so each applies to the
+// content left by the previous ones
+func Ops(edits []Edit) []Operation {
+	var ops []Operation
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+		if e.End > e.Start {
+			ops = append(ops, Operation{Type: OpDelete, Position: e.Start, Length: e.End - e.Start})
+		}
+		if e.Text != "" {
+			ops = append(ops, Operation{Type: OpInsert, Position: e.Start, Content: e.Text})
+		}
+	}
+	return ops
+}
+
+// Rebase moves edits made against a base document onto a later version of
+// it, which changes, also made against the base, turned it into. Edits that
+// touch text the changes touched are dropped rather than guessed at, and
+// counted in skipped. Both lists must be ordered and not overlap.
+func Rebase(edits, changes []Edit) (rebased []Edit, skipped int) {
+	shift, next := 0, 0
+	for _, e := range edits {
+		for next < len(changes) && changes[next].End <= e.Start && !conflicts(e, changes[next]) {
+			c := changes[next]
+			shift += len(c.Text) - (c.End - c.Start)
+			next++
+		}
+
+		conflict := false
+		for _, c := range changes[next:] {
+			if c.Start > e.End {
+				break
+			}
+			if conflicts(e, c) {
+				conflict = true
+				break
+			}
+		}
+		if conflict {
+			skipped++
+			continue
+		}
+
+		e.Start += shift
+		e.End += shift
+		rebased = append(rebased, e)
+	}
+	return rebased, skipped
+}
+
+// conflicts reports whether two edits of the same text touch each other:
+// they overlap, or one inserts inside or at either end of the other
+func conflicts(a, b Edit) bool {
+	if a.Start == a.End || b.Start == b.End {
+		return a.Start <= b.End && b.Start <= a.End
+	}
+	return a.Start < b.End && b.Start < a.End
+}
+
+// refine narrows a changed block to the characters that differ. Small blocks
+// are diffed character by character; larger ones lose only their common
+// prefix and suffix.
+func refine(old, new string) []Edit {
+	prefix := commonPrefix(old, new)
+	suffix := commonSuffix(old[prefix:], new[prefix:])
+	old, new = old[prefix:len(old)-suffix], new[prefix:len(new)-suffix]
+	if old == "" && new == "" {
+		return nil
+	}
+	if len(old) > maxRefine || len(new) > maxRefine {
+		return []Edit{{Start: prefix, End: prefix + len(old), Text: new}}
+	}
+
+	a, b := splitRunes(old), splitRunes(new)
+	starts := offsets(a)
+
+	var edits []Edit
+	for _, h := range diffSeq(a, b) {
+		edits = append(edits, Edit{
+			Start: prefix + starts[h.aStart],
+			End:   prefix + starts[h.aEnd],
+			Text:  strings.Join(b[h.bStart:h.bEnd], ""),
+		})
+	}
+	return edits
+}
+
+// commonPrefix is the length in bytes of the longest common prefix of whole characters
+func commonPrefix(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	for n > 0 && n < len(a) && !utf8.RuneStart(a[n]) {
+		n--
+	}
+	return n
+}
+
+// commonSuffix is the length in bytes of the longest common suffix of whole characters
+func commonSuffix(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[len(a)-1-n] == b[len(b)-1-n] {
+		n++
+	}
+	for n > 0 && n < len(a) && !utf8.RuneStart(a[len(a)-n]) {
+		n--
+	}
+	return n
+}
+
+// splitLines splits text into lines that keep their line endings
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// splitRunes splits text into its characters
+func splitRunes(text string) []string {
+	chars := make([]string, 0, len(text))
+	for i, r := range text {
+		chars = append(chars, text[i:i+utf8.RuneLen(r)])
+	}
+	return chars
+}
+
+// offsets returns the byte offset at which each piece of text starts, and
+// the total length last
+func offsets(pieces []string) []int {
+	starts := make([]int, len(pieces)+1)
+	for i, p := range pieces {
+		starts[i+1] = starts[i] + len(p)
+	}
+	return starts
+}
+
+// hunk replaces a[aStart:aEnd] with b[bStart:bEnd]
+type hunk struct {
+	aStart, aEnd int
+	bStart, bEnd int
+}
+
+// diffSeq returns the hunks of a shortest edit script turning a into b,
+// found with Myers' algorithm after trimming their common ends
+func diffSeq(a, b []string) []hunk {
+	lo := 0
+	for lo < len(a) && lo < len(b) && a[lo] == b[lo] {
+		lo++
+	}
+	aHi, bHi := len(a), len(b)
+	for aHi > lo && bHi > lo && a[aHi-1] == b[bHi-1] {
+		aHi--
+		bHi--
+	}
+
+	hunks := myers(a[lo:aHi], b[lo:bHi])
+	for i := range hunks {
+		hunks[i].aStart += lo
+		hunks[i].aEnd += lo
+		hunks[i].bStart += lo
+		hunks[i].bEnd += lo
+	}
+	return hunks
+}
+
+// myers finds the hunks of a shortest edit script with Myers' O(ND) algorithm
+func myers(a, b []string) []hunk {
+	n, m := len(a), len(b)
+	if n == 0 && m == 0 {
+		return nil
+	}
+	if n == 0 || m == 0 {
+		return []hunk{{0, n, 0, m}}
+	}
+
+	// v[off+k] is the furthest x reached on diagonal k; trace keeps the
+	// diagonals round d can read, as they were before it, to walk the path back
+	off := n + m + 1
+	v := make([]int, 2*off+1)
+	var trace [][]int
+
+search:
+	for d := 0; ; d++ {
+		if d > maxDistance {
+			return []hunk{{0, n, 0, m}}
+		}
+		trace = append(trace, append([]int(nil), v[off-d:off+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			x := v[off+k-1] + 1
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Walk back from the end, marking each deleted line of a and inserted line of b
+	deleted, inserted := make([]bool, n), make([]bool, m)
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && v[d+k-1] < v[d+k+1]) {
+			prevK = k + 1
+		}
+		prevX := v[d+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+		}
+		if x == prevX {
+			inserted[prevY] = true
+		} else {
+			deleted[prevX] = true
+		}
+		x, y = prevX, prevY
+	}
+
+	// Group runs of changes between common elements into hunks
+	var hunks []hunk
+	i, j := 0, 0
+	for i < n || j < m {
+		if i < n && j < m && !deleted[i] && !inserted[j] {
+			i++
+			j++
+			continue
+		}
+		h := hunk{aStart: i, bStart: j}
+		for i < n && deleted[i] {
+			i++
+		}
+		for j < m && inserted[j] {
+			j++
+		}
+		h.aEnd, h.bEnd = i, j
+		hunks = append(hunks, h)
+	}
+	return hunks
+}
@@ -0,0 +1,131 @@
+package ot
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     []Edit
+	}{
+		{"both empty", "", "", nil},
+		{"unchanged", "a\nb\n", "a\nb\n", nil},
+		{"from empty", "", "abc", []Edit{{0, 0, "abc"}}},
+		{"to empty", "abc", "", []Edit{{0, 3, ""}}},
+		{"insert in line", "hello world", "hello, world", []Edit{{5, 5, ","}}},
+		{"insert line", "a\nc\n", "a\nb\nc\n", []Edit{{2, 2, "b\n"}}},
+		{"delete in line", "hello, world", "hello world", []Edit{{5, 6, ""}}},
+		{"delete line", "a\nb\nc\n", "a\nc\n", []Edit{{2, 4, ""}}},
+		{"replace word", "the cat sat", "the dog sat", []Edit{{4, 7, "dog"}}},
+		{"separate changes", "a=1\nb=2\n", "a = 1\nb = 2\n",
+			[]Edit{{1, 1, " "}, {2, 2, " "}, {5, 5, " "}, {6, 6, " "}}},
+		{"unicode", "héllo wörld", "hällo wörld!", []Edit{{1, 3, "ä"}, {13, 13, "!"}}},
+		{"unicode insert", "日本", "日x本", []Edit{{3, 3, "x"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Diff(tt.old, tt.new)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff(%q, %q) = %v, want %v", tt.old, tt.new, got, tt.want)
+			}
+			if applied := Apply(tt.old, got); applied != tt.new {
+				t.Errorf("applying the edits gives %q, want %q", applied, tt.new)
+			}
+		})
+	}
+}
+
+func TestRebase(t *testing.T) {
+	tests := []struct {
+		name        string
+		edits       []Edit
+		changes     []Edit
+		want        []Edit
+		wantSkipped int
+	}{
+		{"no changes", []Edit{{1, 2, "x"}}, nil, []Edit{{1, 2, "x"}}, 0},
+		{"change before", []Edit{{10, 10, "x"}}, []Edit{{0, 0, "ab"}}, []Edit{{12, 12, "x"}}, 0},
+		{"deletion before", []Edit{{10, 11, "x"}}, []Edit{{2, 5, ""}}, []Edit{{7, 8, "x"}}, 0},
+		{"change after", []Edit{{0, 1, "X"}}, []Edit{{5, 6, ""}}, []Edit{{0, 1, "X"}}, 0},
+		{"overlap", []Edit{{2, 5, "z"}}, []Edit{{4, 6, "q"}}, nil, 1},
+		{"insert at change start", []Edit{{3, 3, "x"}}, []Edit{{3, 5, ""}}, nil, 1},
+		{"insert at change end", []Edit{{5, 5, "x"}}, []Edit{{3, 5, ""}}, nil, 1},
+		{"adjacent replacements", []Edit{{0, 2, "x"}}, []Edit{{2, 4, "y"}}, []Edit{{0, 2, "x"}}, 0},
+		{"some kept", []Edit{{0, 1, "A"}, {4, 5, "E"}, {8, 9, "I"}}, []Edit{{4, 6, ""}},
+			[]Edit{{0, 1, "A"}, {6, 7, "I"}}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, skipped := Rebase(tt.edits, tt.changes)
+			if !reflect.DeepEqual(got, tt.want) || skipped != tt.wantSkipped {
+				t.Errorf("Rebase(%v, %v) = %v, %d skipped; want %v, %d skipped",
+					tt.edits, tt.changes, got, skipped, tt.want, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestRebaseOverConcurrentEdit(t *testing.T) {
+	tests := []struct {
+		name                   string
+		base, formatted, typed string
+		want                   string
+		wantSkipped            int
+	}{
+		{"apart", "a=1\nb=2\n", "a = 1\nb = 2\n", "a=1\nb=2\nc=3\n", "a = 1\nb = 2\nc=3\n", 0},
+		{"same line", "a=1\nb=2\n", "a = 1\nb = 2\n", "a=1\nb:2\n", "a = 1\nb:2\n", 2},
+		{"unicode", "ä=1\nö=2\n", "ä = 1\nö = 2\n", "ä=1\nö=2\nü=3\n", "ä = 1\nö = 2\nü=3\n", 0},
+		{"typed at start", "x\n", "x;\n", ">x\n", ">x;\n", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rebased, skipped := Rebase(Diff(tt.base, tt.formatted), Diff(tt.base, tt.typed))
+			if got := Apply(tt.typed, rebased); got != tt.want || skipped != tt.wantSkipped {
+				t.Errorf("got %q with %d skipped, want %q with %d skipped", got, skipped, tt.want, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestMyers(t *testing.T) {
+	distinct := func(prefix string, n int) []string {
+		s := make([]string, n)
+		for i := range s {
+			s[i] = fmt.Sprint(prefix, i)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name string
+		a, b []string
+		want []hunk
+	}{
+		{"both empty", nil, nil, nil},
+		{"insert only", nil, splitRunes("ab"), []hunk{{0, 0, 0, 2}}},
+		{"delete only", splitRunes("ab"), nil, []hunk{{0, 2, 0, 0}}},
+		{"equal", splitRunes("abc"), splitRunes("abc"), nil},
+		{"delete middle", splitRunes("abc"), splitRunes("ac"), []hunk{{1, 2, 1, 1}}},
+		{"insert middle", splitRunes("ac"), splitRunes("abc"), []hunk{{1, 1, 1, 2}}},
+		{"replace", splitRunes("abc"), splitRunes("axc"), []hunk{{1, 2, 1, 2}}},
+		{"two changes", splitRunes("abcd"), splitRunes("xbcy"), []hunk{{0, 1, 0, 1}, {3, 4, 3, 4}}},
+		{"unicode", splitRunes("héllo"), splitRunes("hällo"), []hunk{{1, 2, 1, 2}}},
+		{"too far apart", distinct("a", maxDistance), distinct("b", maxDistance),
+			[]hunk{{0, maxDistance, 0, maxDistance}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := myers(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("myers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
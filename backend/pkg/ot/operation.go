@@ -154,28 +154,59 @@ func (d *Document) Apply(op Operation) error {
 	log.Printf("[OT] Applying operation type:%d pos:%d to doc version:%d",
 		op.Type, op.Position, d.Version)
 
-	switch op.Type {
-	case OpInsert:
-		if op.Position < 0 || op.Position > len(d.Content) {
-			return fmt.Errorf("invalid insert position: %d (content length: %d)",
-				op.Position, len(d.Content))
-		}
-		d.Content = d.Content[:op.Position] + op.Content + d.Content[op.Position:]
+	content, err := applyTo(d.Content, op)
+	if err != nil {
+		return err
+	}
+	d.Content = content
 
-	case OpDelete:
-		if op.Position < 0 || op.Position+op.Length > len(d.Content) {
-			return fmt.Errorf("invalid delete range: %d-%d (content length: %d)",
-				op.Position, op.Position+op.Length, len(d.Content))
+	d.Version++
+	d.AcknowledgedOps = append(d.AcknowledgedOps, op)
+
+	return nil
+}
+
+// ApplyAll applies several operations as one change of the document. Each
+// operation sees the content left by the ones before it, the version goes up
+// once, and if any operation does not fit the document is left unchanged.
+func (d *Document) ApplyAll(ops []Operation) error {
+	log.Printf("[OT] Applying %d operations to doc version:%d", len(ops), d.Version)
+
+	content := d.Content
+	for _, op := range ops {
+		var err error
+		if content, err = applyTo(content, op); err != nil {
+			return err
 		}
-		d.Content = d.Content[:op.Position] + d.Content[op.Position+op.Length:]
 	}
+	d.Content = content
 
 	d.Version++
-	d.AcknowledgedOps = append(d.AcknowledgedOps, op)
+	d.AcknowledgedOps = append(d.AcknowledgedOps, ops...)
 
 	return nil
 }
 
+// applyTo returns content with an operation applied
+func applyTo(content string, op Operation) (string, error) {
+	switch op.Type {
+	case OpInsert:
+		if op.Position < 0 || op.Position > len(content) {
+			return content, fmt.Errorf("invalid insert position: %d (content length: %d)",
+				op.Position, len(content))
+		}
+		return content[:op.Position] + op.Content + content[op.Position:], nil
+
+	case OpDelete:
+		if op.Position < 0 || op.Position+op.Length > len(content) {
+			return content, fmt.Errorf("invalid delete range: %d-%d (content length: %d)",
+				op.Position, op.Position+op.Length, len(content))
+		}
+		return content[:op.Position] + content[op.Position+op.Length:], nil
+	}
+	return content, nil
+}
+
 // TransformAgainstHistory transforms an operation against all pending operations
 func (d *Document) TransformAgainstHistory(op Operation) Operation {
 	transformed := op
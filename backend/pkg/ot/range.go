@@ -0,0 +1,34 @@
+package ot
+
+// TransformPosition maps a document offset through an operation.
+// Text inserted at the offset itself goes before it.
+func TransformPosition(pos int, op Operation) int {
+	switch op.Type {
+	case OpInsert:
+		if op.Position <= pos {
+			return pos + len(op.Content)
+		}
+	case OpDelete:
+		if pos > op.Position+op.Length {
+			return pos - op.Length
+		}
+		if pos > op.Position {
+			return op.Position
+		}
+	}
+	return pos
+}
+
+// TransformRange maps a half-open range through an operation so it keeps
+// covering the same text. Insertions at its start go before it, insertions
+// inside it grow it, and deleting all of it collapses it to an empty range.
+func TransformRange(start, end int, op Operation) (int, int) {
+	if op.Type == OpInsert && op.Position > start && op.Position < end {
+		return start, end + len(op.Content)
+	}
+	if op.Type == OpInsert && op.Position == end && end > start {
+		// Text typed right after the range is not part of it
+		return start, end
+	}
+	return TransformPosition(start, op), TransformPosition(end, op)
+}
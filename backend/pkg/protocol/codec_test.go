@@ -0,0 +1,163 @@
+package protocol
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sampleSize bounds the strings of sample messages, so content-carrying
+// messages are benchmarked with a document of a realistic size
+const sampleSize = 4096
+
+const sampleLine = "func main() { fmt.Println(\"hello\") }\n"
+
+// sampleMessage returns a message of a registered type whose fields satisfy
+// their validation rules, as a client using the codec would send it
+func sampleMessage(t testing.TB, codec Codec, name string) map[string]interface{} {
+	t.Helper()
+	registryMu.RLock()
+	mt := registry[name]
+	registryMu.RUnlock()
+
+	payload := reflect.ValueOf(mt.factory()).Elem()
+	fillSample(payload, fieldRules{})
+
+	raw, err := codec.Marshal(payload.Interface())
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	var msg map[string]interface{}
+	if err := codec.Unmarshal(raw, &msg); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	msg["type"] = name
+	return msg
+}
+
+// fillSample sets every serialized field of v to a value its rules allow
+func fillSample(v reflect.Value, rules fieldRules) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		v.Set(reflect.New(v.Type().Elem()))
+		fillSample(v.Elem(), rules)
+
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if jsonName(field) == "" {
+				continue
+			}
+			fillSample(v.Field(i), parseRules(field.Tag.Get("validate")))
+		}
+
+	case reflect.String:
+		size := int64(sampleSize)
+		if rules.max != nil && *rules.max < size {
+			size = *rules.max
+		}
+		text := strings.Repeat(sampleLine, int(size)/len(sampleLine)+1)[:size]
+		v.SetString(text)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := int64(1)
+		if rules.min != nil && *rules.min > n {
+			n = *rules.min
+		}
+		if rules.max != nil && *rules.max < n {
+			n = *rules.max
+		}
+		v.SetInt(n)
+
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1)
+
+	case reflect.Bool:
+		v.SetBool(true)
+
+	case reflect.Slice:
+		n := int64(1)
+		if rules.min != nil && *rules.min > n {
+			n = *rules.min
+		}
+		slice := reflect.MakeSlice(v.Type(), int(n), int(n))
+		for i := 0; i < slice.Len(); i++ {
+			fillSample(slice.Index(i), fieldRules{})
+		}
+		v.Set(slice)
+
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		key := reflect.New(v.Type().Key()).Elem()
+		elem := reflect.New(v.Type().Elem()).Elem()
+		fillSample(key, fieldRules{max: new(int64)})
+		if key.Kind() == reflect.String {
+			key.SetString("key")
+		}
+		fillSample(elem, fieldRules{})
+		m.SetMapIndex(key, elem)
+		v.Set(m)
+	}
+}
+
+var codecs = []Codec{JSON, MessagePack}
+
+func TestSampleMessagesDecode(t *testing.T) {
+	for _, name := range Types() {
+		for _, codec := range codecs {
+			msg := sampleMessage(t, codec, name)
+			raw, err := codec.Marshal(msg)
+			if err != nil {
+				t.Fatalf("%s/%s: %v", name, codec.Name(), err)
+			}
+			decoded, payload, err := Decode(codec, raw)
+			if err != nil {
+				t.Errorf("%s/%s: %v", name, codec.Name(), err)
+				continue
+			}
+			if decoded != name || payload == nil {
+				t.Errorf("%s/%s decoded as %q", name, codec.Name(), decoded)
+			}
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, name := range Types() {
+		for _, codec := range codecs {
+			msg := sampleMessage(b, codec, name)
+			encoded, err := codec.Marshal(msg)
+			if err != nil {
+				b.Fatalf("%s/%s: %v", name, codec.Name(), err)
+			}
+			b.Run(name+"/"+codec.Name(), func(b *testing.B) {
+				b.SetBytes(int64(len(encoded)))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					codec.Marshal(msg)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for _, name := range Types() {
+		for _, codec := range codecs {
+			msg := sampleMessage(b, codec, name)
+			raw, err := codec.Marshal(msg)
+			if err != nil {
+				b.Fatalf("%s/%s: %v", name, codec.Name(), err)
+			}
+			b.Run(name+"/"+codec.Name(), func(b *testing.B) {
+				b.SetBytes(int64(len(raw)))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, _, err := Decode(codec, raw); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
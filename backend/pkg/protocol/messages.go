@@ -0,0 +1,777 @@
+package protocol
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Inbound messages sent by clients. Field tags drive both decoding
+// validation and the generated JSON Schema.
+
+// HelloMessage opens the protocol handshake
+type HelloMessage struct {
+	Data Hello `json:"data" validate:"required"`
+}
+
+// TextUpdate carries the client's full document content
+type TextUpdate struct {
+	Content string `json:"content" validate:"required"`
+	Version int    `json:"version" validate:"min=0"`
+}
+
+// RequestDocument asks for the current document state
+type RequestDocument struct{}
+
+// SaveDocument asks the server to persist the document
+type SaveDocument struct {
+	Content string `json:"content,omitempty"`
+
+	// Format the document before saving it, as format on save does
+	Format bool `json:"format,omitempty"`
+}
+
+// TypingStart signals that the client started typing
+type TypingStart struct{}
+
+// TypingStop signals that the client stopped typing
+type TypingStop struct{}
+
+// CursorPosition reports the client's caret offset
+type CursorPosition struct {
+	Position int `json:"position" validate:"required,min=0"`
+}
+
+// SelectionRange is a half-open character range
+type SelectionRange struct {
+	Start int `json:"start" validate:"required,min=0"`
+	End   int `json:"end" validate:"required,min=0"`
+}
+
+// SelectionChange reports the client's current selection
+type SelectionChange struct {
+	Data SelectionRange `json:"data" validate:"required"`
+}
+
+// Ping is an application level keepalive
+type Ping struct{}
+
+// Heartbeat keeps the user's presence alive while the editor is open
+type Heartbeat struct {
+	// The user interacted with the editor since the last heartbeat
+	Active bool `json:"active,omitempty"`
+}
+
+// Profile is the identity a user shows to collaborators
+type Profile struct {
+	DisplayName string `json:"displayName,omitempty" validate:"max=40"`
+	Color       string `json:"color,omitempty"`
+}
+
+// SetProfile changes the user's display name and/or color
+type SetProfile struct {
+	Data Profile `json:"data" validate:"required"`
+}
+
+// FollowTarget names the user to follow
+type FollowTarget struct {
+	UserID string `json:"userId" validate:"required,min=1"`
+}
+
+// Follow starts following another user's viewport and cursor
+type Follow struct {
+	Data FollowTarget `json:"data" validate:"required"`
+}
+
+// Unfollow stops following
+type Unfollow struct{}
+
+// ViewportRange is the part of a file visible in the client's editor
+type ViewportRange struct {
+	StartLine int    `json:"startLine" validate:"required,min=0"`
+	EndLine   int    `json:"endLine" validate:"required,min=0"`
+	File      string `json:"file,omitempty"`
+}
+
+// Viewport reports what the user is looking at, for their followers
+type Viewport struct {
+	Data ViewportRange `json:"data" validate:"required"`
+}
+
+// ValidateContext checks the line range is ordered
+func (m *Viewport) ValidateContext(ctx ValidationContext) error {
+	if m.Data.StartLine > m.Data.EndLine {
+		return &ValidationError{Field: "data.startLine", Reason: "must not be after data.endLine"}
+	}
+	return nil
+}
+
+// NewCommentThread anchors a new thread to a character range
+type NewCommentThread struct {
+	Start int    `json:"start" validate:"required,min=0"`
+	End   int    `json:"end" validate:"required,min=0"`
+	Body  string `json:"body" validate:"required,min=1,max=5000"`
+}
+
+// CommentCreate opens a comment thread on a range
+type CommentCreate struct {
+	Data NewCommentThread `json:"data" validate:"required"`
+}
+
+// ValidateContext checks the anchor is ordered and lies within the document
+func (m *CommentCreate) ValidateContext(ctx ValidationContext) error {
+	if m.Data.Start > m.Data.End {
+		return &ValidationError{Field: "data.start", Reason: "must not be after data.end"}
+	}
+	if m.Data.End > ctx.DocumentLength {
+		return &ValidationError{
+			Field:  "data.end",
+			Reason: fmt.Sprintf("must be at most document length %d", ctx.DocumentLength),
+		}
+	}
+	return nil
+}
+
+// CommentReplyData adds a comment to a thread
+type CommentReplyData struct {
+	ThreadID string `json:"threadId" validate:"required,min=1"`
+	Body     string `json:"body" validate:"required,min=1,max=5000"`
+}
+
+// CommentReply answers a comment thread
+type CommentReply struct {
+	Data CommentReplyData `json:"data" validate:"required"`
+}
+
+// CommentEditData replaces the body of one of the user's comments
+type CommentEditData struct {
+	ThreadID  string `json:"threadId" validate:"required,min=1"`
+	CommentID string `json:"commentId" validate:"required,min=1"`
+	Body      string `json:"body" validate:"required,min=1,max=5000"`
+}
+
+// CommentEdit changes a comment
+type CommentEdit struct {
+	Data CommentEditData `json:"data" validate:"required"`
+}
+
+// CommentResolveData resolves or reopens a thread
+type CommentResolveData struct {
+	ThreadID string `json:"threadId" validate:"required,min=1"`
+	Resolved bool   `json:"resolved"`
+}
+
+// CommentResolve marks a thread resolved or reopens it
+type CommentResolve struct {
+	Data CommentResolveData `json:"data" validate:"required"`
+}
+
+// CommentDeleteData names a whole thread, or one comment in it
+type CommentDeleteData struct {
+	ThreadID  string `json:"threadId" validate:"required,min=1"`
+	CommentID string `json:"commentId,omitempty"`
+}
+
+// CommentDelete removes a thread or one of the user's comments
+type CommentDelete struct {
+	Data CommentDeleteData `json:"data" validate:"required"`
+}
+
+// EditMode is how a client's edits reach the document
+type EditMode struct {
+	// "editing" applies edits, "suggesting" records them as suggestions
+	Mode string `json:"mode" validate:"required"`
+}
+
+// SetMode switches the client between editing and suggesting
+type SetMode struct {
+	Data EditMode `json:"data" validate:"required"`
+}
+
+// ValidateContext checks the mode is known
+func (m *SetMode) ValidateContext(ctx ValidationContext) error {
+	if m.Data.Mode != "editing" && m.Data.Mode != "suggesting" {
+		return &ValidationError{Field: "data.mode", Reason: "must be editing or suggesting"}
+	}
+	return nil
+}
+
+// SuggestedChange proposes replacing a range with new text. An empty range
+// proposes an insertion, empty content a deletion.
+type SuggestedChange struct {
+	Start   int    `json:"start" validate:"required,min=0"`
+	End     int    `json:"end" validate:"required,min=0"`
+	Content string `json:"content,omitempty" validate:"max=100000"`
+}
+
+// Suggest records a change for others to accept or reject
+type Suggest struct {
+	Data SuggestedChange `json:"data" validate:"required"`
+}
+
+// ValidateContext checks the range is ordered, within the document and that
+// the suggestion changes something
+func (m *Suggest) ValidateContext(ctx ValidationContext) error {
+	if m.Data.Start > m.Data.End {
+		return &ValidationError{Field: "data.start", Reason: "must not be after data.end"}
+	}
+	if m.Data.End > ctx.DocumentLength {
+		return &ValidationError{
+			Field:  "data.end",
+			Reason: fmt.Sprintf("must be at most document length %d", ctx.DocumentLength),
+		}
+	}
+	if m.Data.Start == m.Data.End && m.Data.Content == "" {
+		return &ValidationError{Field: "data", Reason: "must delete a range or insert content"}
+	}
+	return nil
+}
+
+// SuggestionRef names a suggestion
+type SuggestionRef struct {
+	SuggestionID string `json:"suggestionId" validate:"required,min=1"`
+}
+
+// SuggestionAccept applies a suggestion to the document
+type SuggestionAccept struct {
+	Data SuggestionRef `json:"data" validate:"required"`
+}
+
+// SuggestionReject discards a suggestion
+type SuggestionReject struct {
+	Data SuggestionRef `json:"data" validate:"required"`
+}
+
+// ChatText is a chat message body; @name mentions the user of that name
+type ChatText struct {
+	Body string `json:"body" validate:"required,min=1,max=4000"`
+}
+
+// ChatMessage posts to the document's chat
+type ChatMessage struct {
+	Data ChatText `json:"data" validate:"required"`
+}
+
+// LockRange is the range a client wants to reserve
+type LockRange struct {
+	Start int `json:"start" validate:"required,min=0"`
+	End   int `json:"end" validate:"required,min=0"`
+}
+
+// LockRegion reserves a range for the client; others cannot edit inside it
+type LockRegion struct {
+	Data LockRange `json:"data" validate:"required"`
+}
+
+// ValidateContext checks the range is non-empty and lies within the document
+func (m *LockRegion) ValidateContext(ctx ValidationContext) error {
+	if m.Data.Start >= m.Data.End {
+		return &ValidationError{Field: "data.start", Reason: "must be before data.end"}
+	}
+	if m.Data.End > ctx.DocumentLength {
+		return &ValidationError{
+			Field:  "data.end",
+			Reason: fmt.Sprintf("must be at most document length %d", ctx.DocumentLength),
+		}
+	}
+	return nil
+}
+
+// LockRef names a region lock
+type LockRef struct {
+	LockID string `json:"lockId" validate:"required,min=1"`
+}
+
+// UnlockRegion releases one of the client's locks
+type UnlockRegion struct {
+	Data LockRef `json:"data" validate:"required"`
+}
+
+// DocumentRef names a document
+type DocumentRef struct {
+	DocumentID string `json:"documentId" validate:"required,min=1,max=256"`
+}
+
+// Subscribe joins the connection to another document; later messages name
+// the document they are about with documentId
+type Subscribe struct {
+	Data DocumentRef `json:"data" validate:"required"`
+}
+
+// Unsubscribe leaves one of the connection's documents
+type Unsubscribe struct {
+	Data DocumentRef `json:"data" validate:"required"`
+}
+
+// NewFile names a file or folder to create in a workspace; an empty parent
+// is the workspace root
+type NewFile struct {
+	Kind     string `json:"kind" validate:"required,min=1"`
+	Name     string `json:"name" validate:"required,min=1,max=255"`
+	ParentID string `json:"parentId,omitempty"`
+}
+
+// FileCreate adds a file or folder to the workspace
+type FileCreate struct {
+	Data NewFile `json:"data" validate:"required"`
+}
+
+// ValidateContext checks the kind is known
+func (m *FileCreate) ValidateContext(ctx ValidationContext) error {
+	if m.Data.Kind != "file" && m.Data.Kind != "folder" {
+		return &ValidationError{Field: "data.kind", Reason: "must be file or folder"}
+	}
+	return nil
+}
+
+// FileName gives a workspace file or folder a new name
+type FileName struct {
+	FileID string `json:"fileId" validate:"required,min=1"`
+	Name   string `json:"name" validate:"required,min=1,max=255"`
+}
+
+// FileRename renames a file or folder
+type FileRename struct {
+	Data FileName `json:"data" validate:"required"`
+}
+
+// FileParent moves a workspace file or folder into another folder; an empty
+// parent is the workspace root
+type FileParent struct {
+	FileID   string `json:"fileId" validate:"required,min=1"`
+	ParentID string `json:"parentId,omitempty"`
+}
+
+// FileMove moves a file or folder
+type FileMove struct {
+	Data FileParent `json:"data" validate:"required"`
+}
+
+// FileRef names a workspace file or folder
+type FileRef struct {
+	FileID string `json:"fileId" validate:"required,min=1"`
+}
+
+// FileDelete deletes a file, or a folder with everything in it
+type FileDelete struct {
+	Data FileRef `json:"data" validate:"required"`
+}
+
+// FileOpen subscribes the connection to a workspace file's document
+type FileOpen struct {
+	Data FileRef `json:"data" validate:"required"`
+}
+
+// FileClose unsubscribes the connection from a workspace file's document
+type FileClose struct {
+	Data FileRef `json:"data" validate:"required"`
+}
+
+// SearchQuery describes a search. Scope "workspace" searches every file of
+// the connection's workspace instead of one document.
+type SearchQuery struct {
+	Query         string `json:"query" validate:"required,min=1,max=1000"`
+	Regex         bool   `json:"regex,omitempty"`
+	CaseSensitive bool   `json:"caseSensitive,omitempty"`
+	WholeWord     bool   `json:"wholeWord,omitempty"`
+	Scope         string `json:"scope,omitempty"`
+}
+
+// Search finds the occurrences of a literal string or regular expression
+type Search struct {
+	Data SearchQuery `json:"data" validate:"required"`
+}
+
+// ValidateContext checks the scope is known and a regular expression compiles
+func (m *Search) ValidateContext(ctx ValidationContext) error {
+	return m.Data.check()
+}
+
+// ReplaceQuery replaces every match of a search. In a regular expression
+// search the replacement may refer to groups as $1 or ${name}.
+type ReplaceQuery struct {
+	Query         string `json:"query" validate:"required,min=1,max=1000"`
+	Regex         bool   `json:"regex,omitempty"`
+	CaseSensitive bool   `json:"caseSensitive,omitempty"`
+	WholeWord     bool   `json:"wholeWord,omitempty"`
+	Scope         string `json:"scope,omitempty"`
+	Replacement   string `json:"replacement" validate:"max=100000"`
+}
+
+// Search returns the search whose matches are replaced
+func (q ReplaceQuery) Search() SearchQuery {
+	return SearchQuery{
+		Query:         q.Query,
+		Regex:         q.Regex,
+		CaseSensitive: q.CaseSensitive,
+		WholeWord:     q.WholeWord,
+		Scope:         q.Scope,
+	}
+}
+
+// ReplaceAll replaces every match of a search as one edit
+type ReplaceAll struct {
+	Data ReplaceQuery `json:"data" validate:"required"`
+}
+
+// ValidateContext checks the scope is known and a regular expression compiles
+func (m *ReplaceAll) ValidateContext(ctx ValidationContext) error {
+	return m.Data.Search().check()
+}
+
+// check validates the parts of a search the field tags cannot express
+func (q SearchQuery) check() error {
+	if q.Scope != "" && q.Scope != "document" && q.Scope != "workspace" {
+		return &ValidationError{Field: "data.scope", Reason: "must be document or workspace"}
+	}
+	if q.Regex {
+		if _, err := regexp.Compile(q.Query); err != nil {
+			return &ValidationError{Field: "data.query", Reason: err.Error()}
+		}
+	}
+	return nil
+}
+
+// CodeRun names the language the document is written in and the input
+// the program reads
+type CodeRun struct {
+	Language string `json:"language" validate:"required,min=1,max=32"`
+	Stdin    string `json:"stdin,omitempty" validate:"max=65536"`
+}
+
+// RunCode runs the document's content in a sandbox, streaming its output to
+// everyone in the document
+type RunCode struct {
+	Data CodeRun `json:"data" validate:"required"`
+}
+
+// ExecutionRef names a run of a document
+type ExecutionRef struct {
+	ExecutionID string `json:"executionId" validate:"required,min=1"`
+}
+
+// CancelExecution stops a running program
+type CancelExecution struct {
+	Data ExecutionRef `json:"data" validate:"required"`
+}
+
+// TerminalSize is the size of a client's terminal view in characters
+type TerminalSize struct {
+	Rows int `json:"rows" validate:"required,min=1,max=500"`
+	Cols int `json:"cols" validate:"required,min=1,max=1000"`
+}
+
+// TerminalStart starts the workspace's shared shell, making the client its
+// driver and streaming its output to the client
+type TerminalStart struct {
+	Data TerminalSize `json:"data" validate:"required"`
+}
+
+// TerminalSubscribe streams the workspace terminal's output to the connection
+type TerminalSubscribe struct{}
+
+// TerminalUnsubscribe stops streaming the terminal's output
+type TerminalUnsubscribe struct{}
+
+// TerminalKeys is what the driver typed into the terminal
+type TerminalKeys struct {
+	Input string `json:"input" validate:"required,min=1,max=4096"`
+}
+
+// TerminalInput types into the terminal; only its driver may
+type TerminalInput struct {
+	Data TerminalKeys `json:"data" validate:"required"`
+}
+
+// TerminalResize resizes the terminal to the driver's view
+type TerminalResize struct {
+	Data TerminalSize `json:"data" validate:"required"`
+}
+
+// TerminalDriver names the user to drive the terminal; empty gives the role up
+type TerminalDriver struct {
+	UserID string `json:"userId" validate:"max=64"`
+}
+
+// TerminalSetDriver hands the driver role to another subscriber, or takes
+// it when nobody holds it
+type TerminalSetDriver struct {
+	Data TerminalDriver `json:"data" validate:"required"`
+}
+
+// TerminalStop closes the terminal; only its driver may
+type TerminalStop struct{}
+
+// GitRepository names the workspace's repository, by its path under the
+// server's git root, and the folder of it the workspace's tree maps to
+type GitRepository struct {
+	Path string `json:"path,omitempty" validate:"max=256"`
+	Dir  string `json:"dir,omitempty" validate:"max=1024"`
+
+	// Create the repository if there is none at the path
+	Create bool `json:"create,omitempty"`
+}
+
+// GitConfigure sets the workspace's repository; an empty path is one named
+// after the workspace
+type GitConfigure struct {
+	Data GitRepository `json:"data" validate:"required"`
+}
+
+// GitFileMapping places a file elsewhere in the repository than its place
+// in the tree; an empty path puts it back
+type GitFileMapping struct {
+	FileID string `json:"fileId" validate:"required,min=1"`
+	Path   string `json:"path" validate:"max=1024"`
+}
+
+// GitMapFile maps a workspace file to a path in the repository
+type GitMapFile struct {
+	Data GitFileMapping `json:"data" validate:"required"`
+}
+
+// GitCommitMessage is the message of a commit
+type GitCommitMessage struct {
+	Message string `json:"message" validate:"required,min=1,max=10000"`
+}
+
+// GitCommit commits the workspace's files on the current branch, authored
+// by the sender with the other connected users as co-authors
+type GitCommit struct {
+	Data GitCommitMessage `json:"data" validate:"required"`
+}
+
+// GitDiff asks how the workspace's files differ from HEAD
+type GitDiff struct{}
+
+// GitBranches asks for the repository's branches
+type GitBranches struct{}
+
+// GitBranchRef names a branch to check out
+type GitBranchRef struct {
+	Branch string `json:"branch" validate:"required,min=1,max=255"`
+
+	// Create the branch at HEAD first
+	Create bool `json:"create,omitempty"`
+
+	// Check out even though the workspace has changes not committed, which
+	// are lost
+	Force bool `json:"force,omitempty"`
+}
+
+// GitCheckout checks out a branch, changing the workspace's files to its own
+type GitCheckout struct {
+	Data GitBranchRef `json:"data" validate:"required"`
+}
+
+// CodePosition names an offset in the document for a code intelligence
+// request; the result echoes the request ID
+type CodePosition struct {
+	Offset    int    `json:"offset"`
+	RequestID string `json:"requestId,omitempty" validate:"max=64"`
+}
+
+// check verifies the offset lies within the document
+func (p CodePosition) check(ctx ValidationContext) error {
+	if p.Offset < 0 || p.Offset > ctx.DocumentLength {
+		return &ValidationError{
+			Field:  "data.offset",
+			Reason: fmt.Sprintf("must be between 0 and document length %d", ctx.DocumentLength),
+		}
+	}
+	return nil
+}
+
+// Completion asks the language server for suggestions at an offset
+type Completion struct {
+	Data CodePosition `json:"data" validate:"required"`
+}
+
+// ValidateContext checks the offset lies within the document
+func (m *Completion) ValidateContext(ctx ValidationContext) error {
+	return m.Data.check(ctx)
+}
+
+// Hover asks the language server about the symbol at an offset
+type Hover struct {
+	Data CodePosition `json:"data" validate:"required"`
+}
+
+// ValidateContext checks the offset lies within the document
+func (m *Hover) ValidateContext(ctx ValidationContext) error {
+	return m.Data.check(ctx)
+}
+
+// Definition asks the language server where the symbol at an offset is defined
+type Definition struct {
+	Data CodePosition `json:"data" validate:"required"`
+}
+
+// ValidateContext checks the offset lies within the document
+func (m *Definition) ValidateContext(ctx ValidationContext) error {
+	return m.Data.check(ctx)
+}
+
+// FormatRequest picks the formatter of a format_document; by default it is
+// the one for the document's file name
+type FormatRequest struct {
+	Language string `json:"language,omitempty" validate:"max=32"`
+}
+
+// FormatDocument formats the document on the server and applies the changes
+// as one edit, keeping what others type meanwhile
+type FormatDocument struct {
+	Data FormatRequest `json:"data"`
+}
+
+// MetadataChange sets document metadata; fields left out keep their value.
+// An empty language or line ending style is detected from the document again.
+type MetadataChange struct {
+	Language    *string  `json:"language,omitempty" validate:"max=32"`
+	TabWidth    *int     `json:"tabWidth,omitempty" validate:"min=1,max=16"`
+	LineEndings *string  `json:"lineEndings,omitempty"`
+	Encoding    *string  `json:"encoding,omitempty" validate:"max=32"`
+	Owner       *string  `json:"owner,omitempty" validate:"max=128"`
+	Tags        []string `json:"tags,omitempty" validate:"max=20"`
+	Description *string  `json:"description,omitempty" validate:"max=2000"`
+}
+
+// SetMetadata changes the document's metadata for everyone
+type SetMetadata struct {
+	Data MetadataChange `json:"data" validate:"required"`
+}
+
+// Encodings a document may declare
+var Encodings = []string{"utf-8", "utf-16le", "utf-16be", "iso-8859-1", "windows-1252"}
+
+var (
+	languageID = regexp.MustCompile(`^[a-z0-9][a-z0-9+#._-]*$`)
+	tagName    = regexp.MustCompile(`^[^\s,]{1,32}$`)
+)
+
+// ValidateContext checks the metadata values are well formed
+func (m *SetMetadata) ValidateContext(ctx ValidationContext) error {
+	d := m.Data
+	if d.Language != nil && *d.Language != "" && !languageID.MatchString(*d.Language) {
+		return &ValidationError{Field: "data.language", Reason: "must be a lowercase language identifier"}
+	}
+	if d.LineEndings != nil && *d.LineEndings != "" && *d.LineEndings != "lf" && *d.LineEndings != "crlf" {
+		return &ValidationError{Field: "data.lineEndings", Reason: "must be lf or crlf"}
+	}
+	if d.Encoding != nil && !contains(Encodings, *d.Encoding) {
+		return &ValidationError{Field: "data.encoding", Reason: "must be one of " + strings.Join(Encodings, ", ")}
+	}
+	for _, tag := range d.Tags {
+		if !tagName.MatchString(strings.TrimSpace(tag)) {
+			return &ValidationError{Field: "data.tags", Reason: "must be words of at most 32 characters"}
+		}
+	}
+	return nil
+}
+
+// contains reports whether list holds s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+var hexColor = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+
+// ValidateContext checks the profile changes something and the color is a hex color
+func (m *SetProfile) ValidateContext(ctx ValidationContext) error {
+	if m.Data.DisplayName == "" && m.Data.Color == "" {
+		return &ValidationError{Field: "data", Reason: "must set displayName or color"}
+	}
+	if m.Data.Color != "" && !hexColor.MatchString(m.Data.Color) {
+		return &ValidationError{Field: "data.color", Reason: "must be a #RRGGBB color"}
+	}
+	return nil
+}
+
+// ValidateContext checks the cursor lies within the document
+func (m *CursorPosition) ValidateContext(ctx ValidationContext) error {
+	if m.Position > ctx.DocumentLength {
+		return &ValidationError{
+			Field:  "position",
+			Reason: fmt.Sprintf("must be at most document length %d", ctx.DocumentLength),
+		}
+	}
+	return nil
+}
+
+// ValidateContext checks the selection is ordered and lies within the document
+func (m *SelectionChange) ValidateContext(ctx ValidationContext) error {
+	if m.Data.Start > m.Data.End {
+		return &ValidationError{Field: "data.start", Reason: "must not be after data.end"}
+	}
+	if m.Data.End > ctx.DocumentLength {
+		return &ValidationError{
+			Field:  "data.end",
+			Reason: fmt.Sprintf("must be at most document length %d", ctx.DocumentLength),
+		}
+	}
+	return nil
+}
+
+func init() {
+	Register("hello", "Protocol handshake declaring version and capabilities", func() interface{} { return &HelloMessage{} })
+	Register("text_update", "Full document content after a local edit", func() interface{} { return &TextUpdate{} })
+	Register("request_document", "Request the current document state", func() interface{} { return &RequestDocument{} })
+	Register("save_document", "Persist the document", func() interface{} { return &SaveDocument{} })
+	Register("typing_start", "The user started typing", func() interface{} { return &TypingStart{} })
+	Register("typing_stop", "The user stopped typing", func() interface{} { return &TypingStop{} })
+	Register("cursor_position", "Caret offset in the document", func() interface{} { return &CursorPosition{} })
+	Register("selection_change", "Selected character range", func() interface{} { return &SelectionChange{} })
+	Register("ping", "Application level keepalive", func() interface{} { return &Ping{} })
+	Register("set_profile", "Change the user's display name or color", func() interface{} { return &SetProfile{} })
+	Register("follow", "Follow another user's viewport and cursor", func() interface{} { return &Follow{} })
+	Register("unfollow", "Stop following", func() interface{} { return &Unfollow{} })
+	Register("viewport", "Visible line range and active file, forwarded to followers", func() interface{} { return &Viewport{} })
+	Register("comment_create", "Open a comment thread on a character range", func() interface{} { return &CommentCreate{} })
+	Register("comment_reply", "Reply to a comment thread", func() interface{} { return &CommentReply{} })
+	Register("comment_edit", "Change the body of one of your comments", func() interface{} { return &CommentEdit{} })
+	Register("comment_resolve", "Resolve or reopen a comment thread", func() interface{} { return &CommentResolve{} })
+	Register("comment_delete", "Delete a comment thread, or one of your comments in it", func() interface{} { return &CommentDelete{} })
+	Register("set_mode", "Switch between editing and suggesting", func() interface{} { return &SetMode{} })
+	Register("suggest", "Propose a change without applying it", func() interface{} { return &Suggest{} })
+	Register("suggestion_accept", "Apply a suggested change to the document", func() interface{} { return &SuggestionAccept{} })
+	Register("suggestion_reject", "Discard a suggested change", func() interface{} { return &SuggestionReject{} })
+	Register("chat_message", "Post to the document's chat", func() interface{} { return &ChatMessage{} })
+	Register("lock_region", "Reserve a range so only you can edit it", func() interface{} { return &LockRegion{} })
+	Register("unlock_region", "Release one of your region locks", func() interface{} { return &UnlockRegion{} })
+	Register("subscribe", "Join another document on this connection", func() interface{} { return &Subscribe{} })
+	Register("unsubscribe", "Leave one of the connection's documents", func() interface{} { return &Unsubscribe{} })
+	Register("file_create", "Create a file or folder in the workspace", func() interface{} { return &FileCreate{} })
+	Register("file_rename", "Rename a workspace file or folder", func() interface{} { return &FileRename{} })
+	Register("file_move", "Move a workspace file or folder into another folder", func() interface{} { return &FileMove{} })
+	Register("file_delete", "Delete a workspace file, or a folder and its contents", func() interface{} { return &FileDelete{} })
+	Register("file_open", "Open a workspace file alongside those already open", func() interface{} { return &FileOpen{} })
+	Register("file_close", "Close an open workspace file", func() interface{} { return &FileClose{} })
+	Register("run_code", "Run the document in a sandbox", func() interface{} { return &RunCode{} })
+	Register("cancel_execution", "Stop a running program", func() interface{} { return &CancelExecution{} })
+	Register("terminal_start", "Start the workspace's shared terminal and drive it", func() interface{} { return &TerminalStart{} })
+	Register("terminal_subscribe", "Watch the workspace's shared terminal", func() interface{} { return &TerminalSubscribe{} })
+	Register("terminal_unsubscribe", "Stop watching the shared terminal", func() interface{} { return &TerminalUnsubscribe{} })
+	Register("terminal_input", "Type into the shared terminal, as its driver", func() interface{} { return &TerminalInput{} })
+	Register("terminal_resize", "Resize the shared terminal, as its driver", func() interface{} { return &TerminalResize{} })
+	Register("terminal_set_driver", "Hand the terminal's driver role to another user, or take it when free", func() interface{} { return &TerminalSetDriver{} })
+	Register("terminal_stop", "Close the shared terminal, as its driver", func() interface{} { return &TerminalStop{} })
+	Register("git_configure", "Set the workspace's git repository and the folder its files map to", func() interface{} { return &GitConfigure{} })
+	Register("git_map_file", "Map a workspace file to a path in the repository", func() interface{} { return &GitMapFile{} })
+	Register("git_commit", "Commit the workspace's files on the current branch", func() interface{} { return &GitCommit{} })
+	Register("git_diff", "Show how the workspace's files differ from HEAD", func() interface{} { return &GitDiff{} })
+	Register("git_branches", "List the repository's branches", func() interface{} { return &GitBranches{} })
+	Register("git_checkout", "Check out a branch into the workspace, or create one", func() interface{} { return &GitCheckout{} })
+	Register("completion", "Ask the language server for completions at an offset", func() interface{} { return &Completion{} })
+	Register("hover", "Ask the language server about the symbol at an offset", func() interface{} { return &Hover{} })
+	Register("definition", "Ask the language server where a symbol is defined", func() interface{} { return &Definition{} })
+	Register("format_document", "Format the document with the server's formatter", func() interface{} { return &FormatDocument{} })
+	Register("set_metadata", "Change the document's language, indentation, tags and other metadata", func() interface{} { return &SetMetadata{} })
+	Register("search", "Search a document or the workspace", func() interface{} { return &Search{} })
+	Register("replace_all", "Replace every match of a search as one edit", func() interface{} { return &ReplaceAll{} })
+	Register("heartbeat", "Presence heartbeat, reporting whether the user was active", func() interface{} { return &Heartbeat{} })
+}
@@ -0,0 +1,96 @@
+// Package protocol defines the versioned wire protocol spoken between editor clients and the server
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	// VersionLegacy is assumed for clients that never send a hello handshake
+	VersionLegacy = 1
+
+	// VersionCurrent is the newest protocol version the server speaks
+	VersionCurrent = 2
+
+	// MinSupportedVersion is the oldest protocol version the server still accepts
+	MinSupportedVersion = VersionLegacy
+)
+
+// ErrUnsupportedVersion is returned when a client declares a protocol version the server cannot speak
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// Capability names an optional protocol feature that client and server agree on
+type Capability string
+
+const (
+	CapBinary      Capability = "binary"      // Binary websocket frames
+	CapCompression Capability = "compression" // permessage-deflate compressed frames
+	CapPresenceV2  Capability = "presence_v2" // Presence diffs instead of whole user lists
+	CapBatch       Capability = "batch"       // Several messages per frame, newline-delimited JSON or concatenated MessagePack
+)
+
+// ServerCapabilities lists the capabilities implemented by this server build.
+// Capabilities are only ever negotiated if they appear here.
+var ServerCapabilities = []Capability{CapBinary, CapCompression, CapBatch, CapPresenceV2}
+
+// Hello is the handshake payload sent by a client right after connecting
+type Hello struct {
+	ProtocolVersion int      `json:"protocolVersion" validate:"required,min=1"`
+	Capabilities    []string `json:"capabilities,omitempty"`
+}
+
+// Negotiated is the protocol version and capability set agreed for a connection
+type Negotiated struct {
+	ProtocolVersion int          `json:"protocolVersion"`
+	Capabilities    []Capability `json:"capabilities"`
+}
+
+// Legacy returns the negotiated state for clients that skip the handshake
+func Legacy() Negotiated {
+	return Negotiated{
+		ProtocolVersion: VersionLegacy,
+		Capabilities:    []Capability{},
+	}
+}
+
+// Has reports whether a capability was negotiated
+func (n Negotiated) Has(c Capability) bool {
+	for _, have := range n.Capabilities {
+		if have == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate validates the client's hello against what the server supports.
+// The resulting capability set is the intersection of both sides, sorted for stable output.
+func Negotiate(hello Hello, serverCaps []Capability) (Negotiated, error) {
+	if hello.ProtocolVersion < MinSupportedVersion || hello.ProtocolVersion > VersionCurrent {
+		return Negotiated{}, fmt.Errorf("%w: %d (supported %d-%d)",
+			ErrUnsupportedVersion, hello.ProtocolVersion, MinSupportedVersion, VersionCurrent)
+	}
+
+	supported := make(map[Capability]bool, len(serverCaps))
+	for _, c := range serverCaps {
+		supported[c] = true
+	}
+
+	agreed := []Capability{}
+	seen := make(map[Capability]bool)
+	for _, name := range hello.Capabilities {
+		c := Capability(name)
+		if supported[c] && !seen[c] {
+			agreed = append(agreed, c)
+			seen[c] = true
+		}
+	}
+	sort.Slice(agreed, func(i, j int) bool { return agreed[i] < agreed[j] })
+
+	return Negotiated{
+		ProtocolVersion: hello.ProtocolVersion,
+		Capabilities:    agreed,
+	}, nil
+}
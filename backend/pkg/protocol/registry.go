@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrUnknownType is returned when a message type has no registered decoder
+var ErrUnknownType = errors.New("unknown message type")
+
+// ValidationContext carries server state needed to validate a message
+type ValidationContext struct {
+	DocumentLength int
+}
+
+// ContextValidator is implemented by messages whose validity depends on server state
+type ContextValidator interface {
+	ValidateContext(ctx ValidationContext) error
+}
+
+// ValidationError describes a message field that failed validation
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid field %q: %s", e.Field, e.Reason)
+}
+
+// messageType describes a registered message type
+type messageType struct {
+	name        string
+	description string
+	factory     func() interface{}
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]messageType)
+)
+
+// Register adds a message type to the decoding registry.
+// factory must return a pointer to a fresh struct for the message.
+func Register(name, description string, factory func() interface{}) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := registry[name]; exists {
+		panic("protocol: message type registered twice: " + name)
+	}
+	registry[name] = messageType{name: name, description: description, factory: factory}
+}
+
+// Types returns the names of all registered message types in sorted order
+func Types() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Envelope holds the fields every message may carry besides its payload
+type Envelope struct {
+	Type string
+
+	// Document the message is about; empty for the connection's default
+	DocumentID string
+}
+
+// Decode parses a raw message in the given wire format into its registered struct
+// and validates its fields. Context dependent checks are left to ContextValidator.
+func Decode(codec Codec, raw []byte) (string, interface{}, error) {
+	env, payload, err := DecodeEnvelope(codec, raw)
+	return env.Type, payload, err
+}
+
+// DecodeEnvelope is Decode that also returns the message's envelope fields
+func DecodeEnvelope(codec Codec, raw []byte) (Envelope, interface{}, error) {
+	var fields map[string]interface{}
+	if err := codec.Unmarshal(raw, &fields); err != nil {
+		return Envelope{}, nil, fmt.Errorf("malformed message: %w", err)
+	}
+
+	msgType, _ := fields["type"].(string)
+	if msgType == "" {
+		return Envelope{}, nil, &ValidationError{Field: "type", Reason: "is required"}
+	}
+	env := Envelope{Type: msgType}
+	env.DocumentID, _ = fields["documentId"].(string)
+
+	registryMu.RLock()
+	mt, ok := registry[msgType]
+	registryMu.RUnlock()
+	if !ok {
+		return env, nil, fmt.Errorf("%w: %s", ErrUnknownType, msgType)
+	}
+
+	payload := mt.factory()
+	if err := codec.Unmarshal(raw, payload); err != nil {
+		return env, nil, &ValidationError{Field: "", Reason: err.Error()}
+	}
+	if err := validateStruct(payload, fields, ""); err != nil {
+		return env, nil, err
+	}
+
+	return env, payload, nil
+}
+
+// Validate runs the context dependent checks of a decoded message, if it has any
+func Validate(payload interface{}, ctx ValidationContext) error {
+	if v, ok := payload.(ContextValidator); ok {
+		return v.ValidateContext(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package protocol
+
+//go:generate go run ../../cmd/protocol-schema -o ../../../frontend/public/schema/messages.json
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// SchemaID identifies the generated schema document
+const SchemaID = "https://collaborative-editor.local/schema/messages.json"
+
+// JSONSchema returns a JSON Schema describing every registered client message,
+// so the frontend and bots can validate messages before sending them.
+func JSONSchema() ([]byte, error) {
+	defs := make(map[string]interface{})
+	oneOf := []interface{}{}
+
+	for _, name := range Types() {
+		registryMu.RLock()
+		mt := registry[name]
+		registryMu.RUnlock()
+		schema := typeSchema(reflect.TypeOf(mt.factory()).Elem())
+
+		properties := schema["properties"].(map[string]interface{})
+		properties["type"] = map[string]interface{}{"const": name}
+		schema["required"] = append([]string{"type"}, schema["required"].([]string)...)
+		schema["title"] = name
+		schema["description"] = mt.description
+
+		defs[name] = schema
+		oneOf = append(oneOf, map[string]interface{}{"$ref": "#/$defs/" + name})
+	}
+
+	doc := map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$id":     SchemaID,
+		"title":   "Collaborative editor client messages",
+		"oneOf":   oneOf,
+		"$defs":   defs,
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// typeSchema maps a Go type onto its JSON Schema representation
+func typeSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema describes a struct's serialized fields and their validate rules
+func structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := jsonName(field)
+		if name == "" {
+			continue
+		}
+
+		prop := typeSchema(field.Type)
+		rules := parseRules(field.Tag.Get("validate"))
+		if rules.required {
+			required = append(required, name)
+		}
+
+		switch prop["type"] {
+		case "integer", "number":
+			if rules.min != nil {
+				prop["minimum"] = *rules.min
+			}
+			if rules.max != nil {
+				prop["maximum"] = *rules.max
+			}
+		case "string":
+			if rules.min != nil {
+				prop["minLength"] = *rules.min
+			}
+			if rules.max != nil {
+				prop["maxLength"] = *rules.max
+			}
+		case "array":
+			if rules.min != nil {
+				prop["minItems"] = *rules.min
+			}
+			if rules.max != nil {
+				prop["maxItems"] = *rules.max
+			}
+		}
+
+		properties[name] = prop
+	}
+
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
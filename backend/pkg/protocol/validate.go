@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// fieldRules are the constraints parsed from a `validate` struct tag
+type fieldRules struct {
+	required bool
+	min      *int64
+	max      *int64
+}
+
+// parseRules parses tags like `validate:"required,min=0"`
+func parseRules(tag string) fieldRules {
+	var rules fieldRules
+	for _, part := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "required":
+			rules.required = true
+		case "min", "max":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				panic(fmt.Sprintf("protocol: bad %s rule %q", key, value))
+			}
+			if key == "min" {
+				rules.min = &n
+			} else {
+				rules.max = &n
+			}
+		}
+	}
+	return rules
+}
+
+// jsonName returns the JSON key of a struct field, or "" if the field is not serialized
+func jsonName(f reflect.StructField) string {
+	if !f.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// validateStruct checks the tagged rules of a decoded struct.
+// raw holds the object's original keys so required fields can be told apart from zero values.
+func validateStruct(v interface{}, raw map[string]interface{}, prefix string) error {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		name := jsonName(field)
+		if name == "" {
+			continue
+		}
+
+		path := prefix + name
+		rules := parseRules(field.Tag.Get("validate"))
+		rawValue, present := raw[name]
+		if present && rawValue == nil {
+			present = false
+		}
+
+		if rules.required && !present {
+			return &ValidationError{Field: path, Reason: "is required"}
+		}
+
+		// A nil pointer is an optional field left out; the rules apply to what a set one points to
+		fv := rv.Field(i)
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				continue
+			}
+			fv = fv.Elem()
+		}
+
+		switch fv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if rules.min != nil && fv.Int() < *rules.min {
+				return &ValidationError{Field: path, Reason: fmt.Sprintf("must be at least %d", *rules.min)}
+			}
+			if rules.max != nil && fv.Int() > *rules.max {
+				return &ValidationError{Field: path, Reason: fmt.Sprintf("must be at most %d", *rules.max)}
+			}
+
+		case reflect.String, reflect.Slice:
+			if rules.min != nil && int64(fv.Len()) < *rules.min {
+				return &ValidationError{Field: path, Reason: fmt.Sprintf("length must be at least %d", *rules.min)}
+			}
+			if rules.max != nil && int64(fv.Len()) > *rules.max {
+				return &ValidationError{Field: path, Reason: fmt.Sprintf("length must be at most %d", *rules.max)}
+			}
+
+		case reflect.Struct:
+			if !present {
+				continue
+			}
+			nested, ok := rawValue.(map[string]interface{})
+			if !ok {
+				return &ValidationError{Field: path, Reason: "must be an object"}
+			}
+			if err := validateStruct(fv.Addr().Interface(), nested, path+"."); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
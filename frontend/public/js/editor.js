@@ -3,8 +3,26 @@ const state = {
     wsUrl: null, // WebSocket URL
     ws: null, // WebSocket instance
     clientId: null, // Our client ID
+    userKey: null, // Stable identity across connections, so we keep our color
+    username: null, // Our display name
+    color: null, // Our color
+    profileSent: false, // Saved profile restored on this connection
+    following: null, // User whose viewport we follow
+    followers: [], // Users following us
     documentId: null, // Current document ID
+    workspaceId: null, // Workspace we are in, if any
+    files: new Map(), // Workspace files and folders by ID
+    openFileId: null, // Workspace file shown in the editor
+    pendingSelection: null, // Range to select once the open file arrives
+    executionId: null, // The document's program running now, if any
+    terminal: null, // The workspace's shared terminal, if one is running
+    terminalText: '', // Terminal output shown, without escape sequences
+    terminalReplay: [], // Timers of the recording being replayed
+    git: null, // The workspace's repository, if one is configured
+    gitCheckout: null, // Branch being checked out, to force if refused
+    subscriptions: [], // Documents this socket is subscribed to
     documentVersion: 0,
+    serverContents: [''], // Contents the server may have: the last it sent us and those we sent since
     activeUsers: new Map(), // Map of active users
     typingUsers: new Set(), // Set of users currently typing
     isUpdatingFromRemote: false, // Flag to prevent echoing updates
@@ -13,8 +31,30 @@ const state = {
     reconnectDelay: 2000, // Initial delay for reconnection
     remoteCursors: new Map(), // ADD THIS
     remoteSelections: new Map(), // ADD THIS
+    protocolVersion: 1, // Negotiated protocol version (1 until the server answers hello)
+    capabilities: [], // Negotiated capabilities
+    lastActivity: 0, // Time of the last local interaction, for presence heartbeats
+    heartbeatTimer: null, // Presence heartbeat interval
+    authorKey: null, // Identifies our comments across connections
+    comments: new Map(), // Comment threads by ID
+    mode: 'editing', // 'suggesting' records our edits as suggestions
+    suggestions: new Map(), // Pending suggestions by ID
+    locks: new Map(), // Region locks by ID
+    diagnostics: [], // The language server's diagnostics of the document
+    codeRequest: 0, // ID of the latest completion, hover or definition request
 };
 
+// Protocol version and capabilities this client speaks
+const PROTOCOL_VERSION = 2;
+const CLIENT_CAPABILITIES = ['batch', 'compression', 'presence_v2'];
+
+// How often we tell the server we are still here
+const HEARTBEAT_INTERVAL = 30000;
+
+// How many of our updates a remote edit may have been made without, and
+// still be fitted around them
+const MAX_SERVER_CONTENTS = 8;
+
 // UI Elements
 const elements = {
     editor: null, // Textarea element
@@ -26,9 +66,36 @@ const elements = {
     userCount: null, // User count element
     typingIndicators: null, // Typing indicators element
     notification: null, // Notification element
-    lastSaved: null // Last saved element
+    lastSaved: null, // Last saved element
+    colorPicker: null, // Color picker element
+    commentAdd: null, // Comment on selection button
+    commentThreads: null, // Comment threads element
+    modeToggle: null, // Editing/suggesting toggle
+    suggestionList: null, // Suggestions element
+    lockAdd: null, // Lock selection button
+    lockList: null, // Region locks element
+    chatLog: null, // Chat messages element
+    chatInput: null, // Chat input
+    chatExport: null, // Chat export link
+    workspace: null, // Workspace panel
+    fileTree: null, // Workspace files element
+    searchQuery: null, // Search input
+    replaceText: null, // Replacement input
+    searchResults: null, // Search matches element
+    runOutput: null, // Program output element
+    runStatus: null, // Run status line
+    terminalOutput: null, // Shared terminal screen
+    terminalStatus: null, // Shared terminal status line
+    gitStatus: null, // Repository status line
+    gitOutput: null, // Diff and commit output
+    codeInfo: null, // Completions, hover and definitions element
+    diagnosticList: null // Diagnostics element
 };
 
+// Local storage keys
+const USER_KEY_STORAGE = 'collab-user-key';
+const PROFILE_STORAGE = 'collab-profile';
+
 // User colors palette
 const colors = ['#FF6B6B', '#4ECDC4', '#45B7D1', '#96CEB4', '#FFEAA7', '#DDA0DD', '#98D8C8', '#FFA07A'];
 
@@ -44,6 +111,29 @@ function initElements() {
     elements.typingIndicators = document.getElementById('typingIndicators');
     elements.notification = document.getElementById('notification');
     elements.lastSaved = document.getElementById('lastSaved');
+    elements.colorPicker = document.getElementById('colorPicker');
+    elements.commentAdd = document.getElementById('commentAdd');
+    elements.commentThreads = document.getElementById('commentThreads');
+    elements.modeToggle = document.getElementById('modeToggle');
+    elements.suggestionList = document.getElementById('suggestionList');
+    elements.lockAdd = document.getElementById('lockAdd');
+    elements.lockList = document.getElementById('lockList');
+    elements.chatLog = document.getElementById('chatLog');
+    elements.chatInput = document.getElementById('chatInput');
+    elements.chatExport = document.getElementById('chatExport');
+    elements.workspace = document.getElementById('workspace');
+    elements.fileTree = document.getElementById('fileTree');
+    elements.searchQuery = document.getElementById('searchQuery');
+    elements.replaceText = document.getElementById('replaceText');
+    elements.searchResults = document.getElementById('searchResults');
+    elements.runOutput = document.getElementById('runOutput');
+    elements.runStatus = document.getElementById('runStatus');
+    elements.terminalOutput = document.getElementById('terminalOutput');
+    elements.terminalStatus = document.getElementById('terminalStatus');
+    elements.gitStatus = document.getElementById('gitStatus');
+    elements.gitOutput = document.getElementById('gitOutput');
+    elements.codeInfo = document.getElementById('codeInfo');
+    elements.diagnosticList = document.getElementById('diagnosticList');
 }
 
 // Initialize application
@@ -51,23 +141,41 @@ function init() {
     initElements();
 
     const urlParams = new URLSearchParams(window.location.search);
-    state.documentId = urlParams.get('doc') || 'default-doc';
-    elements.docId.textContent = state.documentId;
+    state.workspaceId = urlParams.get('workspace');
+    if (state.workspaceId) {
+        // Files are opened from the tree once it arrives
+        state.openFileId = urlParams.get('file');
+        elements.workspace.hidden = false;
+        document.getElementById('terminal').hidden = false;
+        document.getElementById('git').hidden = false;
+        loadRecordings();
+        document.getElementById('searchScope').hidden = false;
+        elements.docId.textContent = state.workspaceId;
+    } else {
+        state.documentId = urlParams.get('doc') || 'default-doc';
+        showDocument(state.documentId);
+    }
 
     // Start with correct initial count
     elements.userCount.textContent = '1 user online';
 
-    state.wsUrl = `ws://localhost:8080/ws?doc=${state.documentId}`;
-    console.log('Initializing with URL:', state.wsUrl);
+    state.userKey = localStorage.getItem(USER_KEY_STORAGE);
+    if (!state.userKey) {
+        state.userKey = crypto.randomUUID();
+        localStorage.setItem(USER_KEY_STORAGE, state.userKey);
+    }
 
     connect();
     setupEventListeners();
+    loadLanguages();
 }
 
 // WebSocket connection
 function connect() {
     updateConnectionStatus('reconnecting', `Connecting... (Attempt ${state.reconnectAttempts + 1})`);
 
+    state.wsUrl = socketUrl();
+    console.log('Connecting to:', state.wsUrl);
     state.ws = new WebSocket(state.wsUrl);
 
     state.ws.onopen = handleWebSocketOpen; // Handle connection open
@@ -76,12 +184,34 @@ function connect() {
     state.ws.onclose = handleWebSocketClose; // Handle connection close
 }
 
+// The socket URL joins our workspace and open file, or our document
+function socketUrl() {
+    const user = `user=${encodeURIComponent(state.userKey)}`;
+    if (!state.workspaceId) {
+        return `ws://localhost:8080/ws?doc=${state.documentId}&${user}`;
+    }
+    const file = state.openFileId ? `&file=${encodeURIComponent(state.openFileId)}` : '';
+    return `ws://localhost:8080/ws?workspace=${encodeURIComponent(state.workspaceId)}${file}&${user}`;
+}
+
+// Point the info bar and chat export at a document
+function showDocument(documentId) {
+    elements.docId.textContent = documentId;
+    elements.chatExport.href = `/api/documents/${encodeURIComponent(documentId)}/chat?format=text`;
+}
+
 // WebSocket event handlers
 function handleWebSocketOpen() {
     console.log('WebSocket connected');
     state.reconnectAttempts = 0;
+    state.profileSent = false;
+    // The workspace's terminal, if any, is sent again on joining
+    state.terminal = null;
+    renderTerminal();
     updateConnectionStatus('connected', 'Connected');
+    sendHello();
     requestDocumentState();
+    startHeartbeat();
 }
 
 function handleWebSocketMessage(event) {
@@ -103,9 +233,17 @@ function handleWebSocketError(error) {
     updateConnectionStatus('disconnected', 'Connection error');
 }
 
-function handleWebSocketClose() {
+function handleWebSocketClose(event) {
     console.log('WebSocket disconnected');
     updateConnectionStatus('disconnected', 'Disconnected');
+    clearInterval(state.heartbeatTimer);
+
+    // 1002 means the server rejected our protocol version, reconnecting will not help
+    if (event.code === 1002) {
+        state.reconnectAttempts = state.maxReconnectAttempts;
+        showNotification(`Editor is out of date, please reload the page (${event.reason})`, 'leave');
+    }
+
     handleReconnect();
 }
 
@@ -131,6 +269,9 @@ function updateConnectionStatus(status, text) {
 function handleMessage(msg) {
     console.log('Received:', msg);
 
+    // Late messages about a file we already closed
+    if (msg.documentId && state.documentId && msg.documentId !== state.documentId) return;
+
     switch (msg.type) {
         case 'init':
             handleInit(msg);
@@ -150,6 +291,24 @@ function handleMessage(msg) {
         case 'active_users':
             updateActiveUsers(msg.data || []);
             break;
+        case 'presence_state':
+            updateActiveUsers(msg.data || []);
+            break;
+        case 'presence_update':
+            handlePresenceUpdate(msg);
+            break;
+        case 'profile_update':
+            handleProfileUpdate(msg);
+            break;
+        case 'viewport':
+            handleViewport(msg);
+            break;
+        case 'follow_state':
+            handleFollowState(msg);
+            break;
+        case 'followers':
+            handleFollowers(msg);
+            break;
         case 'typing_start':
             handleTypingStart(msg);
             break;
@@ -168,6 +327,107 @@ function handleMessage(msg) {
         case 'cursor_remove':
             handleCursorRemove(msg);
                 break;
+        case 'comment_update':
+            handleCommentUpdate(msg);
+            break;
+        case 'comment_anchors':
+            handleCommentAnchors(msg);
+            break;
+        case 'mode_state':
+            handleModeState(msg);
+            break;
+        case 'suggestion_update':
+            handleSuggestionUpdate(msg);
+            break;
+        case 'suggestion_anchors':
+            handleSuggestionAnchors(msg);
+            break;
+        case 'lock_update':
+            handleLockUpdate(msg);
+            break;
+        case 'lock_anchors':
+            handleLockAnchors(msg);
+            break;
+        case 'execution_started':
+            handleExecutionStarted(msg);
+            break;
+        case 'execution_output':
+            handleExecutionOutput(msg);
+            break;
+        case 'execution_finished':
+            handleExecutionFinished(msg);
+            break;
+        case 'terminal_state':
+            handleTerminalState(msg.data || {});
+            break;
+        case 'terminal_output':
+            handleTerminalOutput(msg.data || {});
+            break;
+        case 'terminal_exited':
+            handleTerminalExited(msg.data || {});
+            break;
+        case 'git_state':
+            handleGitState(msg.data || {});
+            break;
+        case 'git_diff':
+            renderGitDiff(msg.data?.diff || {});
+            break;
+        case 'git_branches':
+            renderGitBranches(msg.data?.branches || []);
+            break;
+        case 'git_committed':
+            handleGitCommitted(msg);
+            break;
+        case 'git_checked_out':
+            handleGitCheckedOut(msg);
+            break;
+        case 'diagnostics':
+            state.diagnostics = msg.data?.diagnostics || [];
+            renderDiagnostics();
+            break;
+        case 'completion_result':
+            if (msg.data?.requestId === String(state.codeRequest)) renderCompletions(msg.data.items || []);
+            break;
+        case 'hover_result':
+            if (msg.data?.requestId === String(state.codeRequest)) {
+                elements.codeInfo.textContent = msg.data.contents || 'Nothing known here';
+            }
+            break;
+        case 'definition_result':
+            if (msg.data?.requestId === String(state.codeRequest)) renderDefinitions(msg.data.locations || []);
+            break;
+        case 'metadata_update':
+            if (msg.data?.metadata) renderMetadata(msg.data.metadata);
+            break;
+        case 'format_result':
+            handleFormatResult(msg.data || {});
+            break;
+        case 'search_results':
+            renderSearchResults(msg.data?.matches || [], msg.data?.truncated);
+            break;
+        case 'replace_result':
+            handleReplaceResult(msg);
+            break;
+        case 'subscriptions':
+            state.subscriptions = msg.data?.documents || [];
+            break;
+        case 'workspace_state':
+            state.files = new Map((msg.data?.files || []).map(f => [f.id, f]));
+            renderFiles();
+            break;
+        case 'workspace_update':
+            handleWorkspaceUpdate(msg);
+            break;
+        case 'chat_history':
+            elements.chatLog.innerHTML = '';
+            (msg.data?.messages || []).forEach(appendChatMessage);
+            break;
+        case 'chat_message':
+            handleChatMessage(msg);
+            break;
+        case 'error':
+            handleError(msg);
+            break;
         default:
             console.warn('Unknown message type:', msg.type);
     }
@@ -177,14 +437,210 @@ function handleMessage(msg) {
 function handleInit(msg) {
     state.clientId = msg.clientId;
     elements.clientId.textContent = msg.clientId || '...';
+
+    if (msg.data?.protocolVersion) {
+        state.protocolVersion = msg.data.protocolVersion;
+        state.capabilities = msg.data.capabilities || [];
+    }
+
+    state.authorKey = msg.data?.authorKey || state.authorKey;
+    state.username = msg.data?.username || state.username;
+    state.color = msg.data?.color || state.color;
+    if (state.color) {
+        elements.colorPicker.value = state.color.toLowerCase();
+    }
+
+    // Restore the name and color we picked earlier
+    const saved = JSON.parse(localStorage.getItem(PROFILE_STORAGE) || '{}');
+    if (!state.profileSent && (saved.displayName || saved.color)) {
+        state.profileSent = true;
+        sendMessage({ type: 'set_profile', data: saved });
+    }
+    updateUsersUI();
+}
+
+// Apply a user's new display name or color
+function handleProfileUpdate(msg) {
+    const { userId, username, color } = msg.data || {};
+
+    if (userId === state.clientId) {
+        state.username = username;
+        state.color = color;
+        elements.colorPicker.value = color.toLowerCase();
+        updateUsersUI();
+        return;
+    }
+
+    const user = state.activeUsers.get(userId);
+    if (user) {
+        user.username = username;
+        user.color = color;
+    }
+    [state.remoteCursors, state.remoteSelections].forEach(map => {
+        const entry = map.get(userId);
+        if (entry) {
+            entry.username = username;
+            entry.color = color;
+        }
+    });
+
+    document.getElementById(`cursor-${userId}`)?.remove();
+    document.getElementById(`selection-${userId}`)?.remove();
+    displayRemoteCursors();
+    displayRemoteSelections();
+    updateUsersUI();
+}
+
+// Follow another user's viewport, or stop if we already follow them
+function toggleFollow(userId) {
+    if (state.following === userId) {
+        sendMessage({ type: 'unfollow' });
+    } else {
+        sendMessage({ type: 'follow', data: { userId: userId } });
+    }
+}
+
+function handleFollowState(msg) {
+    const previous = state.following;
+    state.following = msg.data?.following || null;
+
+    if (state.following) {
+        const user = state.activeUsers.get(state.following);
+        showNotification(`Following ${user?.username || state.following}`, 'info');
+    } else if (previous && msg.data?.reason === 'edited') {
+        showNotification('Stopped following because you edited', 'info');
+    } else if (previous && msg.data?.reason === 'left') {
+        showNotification('The user you followed left', 'leave');
+    }
+    updateUsersUI();
+}
+
+function handleFollowers(msg) {
+    const followers = msg.data?.followers || [];
+    const known = new Set(state.followers.map(f => f.userId));
+    followers
+        .filter(f => !known.has(f.userId))
+        .forEach(f => showNotification(`${f.username || f.userId} is following you`, 'join'));
+
+    state.followers = followers;
+    updateUsersUI();
+}
+
+// Scroll to where the followed user is looking
+function handleViewport(msg) {
+    if (msg.clientId !== state.following) return;
+
+    const lineHeight = parseFloat(getComputedStyle(elements.editor).lineHeight) || 20;
+    state.isUpdatingFromRemote = true;
+    elements.editor.scrollTop = (msg.data?.startLine || 0) * lineHeight;
+    state.isUpdatingFromRemote = false;
+}
+
+// Tell our followers which lines we are looking at
+function sendViewport() {
+    const editor = elements.editor;
+    const lineHeight = parseFloat(getComputedStyle(editor).lineHeight) || 20;
+    const startLine = Math.floor(editor.scrollTop / lineHeight);
+    const endLine = startLine + Math.ceil(editor.clientHeight / lineHeight);
+
+    sendMessage({
+        type: 'viewport',
+        data: { startLine: startLine, endLine: endLine, file: state.documentId }
+    });
+}
+
+// Change our display name or color and remember it for next time
+function setProfile(changes) {
+    const saved = JSON.parse(localStorage.getItem(PROFILE_STORAGE) || '{}');
+    localStorage.setItem(PROFILE_STORAGE, JSON.stringify({ ...saved, ...changes }));
+    sendMessage({ type: 'set_profile', data: changes });
+}
+
+function handleError(msg) {
+    console.error('Server error:', msg.data);
+
+    if (msg.data?.code === 'color_taken') {
+        showNotification('That color is taken by another user', 'leave');
+        elements.colorPicker.value = (state.color || '#000000').toLowerCase();
+    }
+
+    if (msg.data?.code === 'suggesting_mode') {
+        showNotification(msg.data.message, 'info');
+    }
+
+    if (msg.data?.code === 'region_locked') {
+        showNotification(msg.data.message, 'leave');
+    }
+
+    if (msg.data?.code === 'not_author') {
+        showNotification('You can only change your own comments', 'leave');
+    }
+
+    if (msg.data?.code === 'uncommitted_changes' && state.gitCheckout) {
+        const branch = state.gitCheckout;
+        state.gitCheckout = null;
+        if (confirm(`Changes not committed will be lost. Check out ${branch} anyway?`)) {
+            sendMessage({ type: 'git_checkout', data: { branch: branch, force: true } });
+        }
+    } else if (msg.data?.code?.startsWith('git_') || GIT_ERRORS.has(msg.data?.code)) {
+        showNotification(msg.data.message, 'leave');
+    }
+
+    if (msg.data?.code === 'unsupported_protocol_version') {
+        // Reconnecting will not help, the page needs to be reloaded
+        state.reconnectAttempts = state.maxReconnectAttempts;
+        showNotification('Editor is out of date, please reload the page', 'leave');
+    }
 }
 
 function handleDocumentState(msg) {
     console.log('Document state received, version:', msg.version);
     state.isUpdatingFromRemote = true;
     elements.editor.value = msg.content || '';
+    state.serverContents = [elements.editor.value];
     state.documentVersion = msg.version || 0;
     state.isUpdatingFromRemote = false;
+
+    if (msg.comments) {
+        state.comments = new Map(msg.comments.map(t => [t.id, t]));
+        renderComments();
+    }
+    if (msg.suggestions) {
+        state.suggestions = new Map(msg.suggestions.map(s => [s.id, s]));
+        renderSuggestions();
+    }
+    if (msg.locks) {
+        state.locks = new Map(msg.locks.map(l => [l.id, l]));
+        renderLocks();
+    }
+    if (msg.metadata) {
+        renderMetadata(msg.metadata);
+    }
+
+    // Everyone else's cursors, selections and typing at this revision
+    if (msg.cursors) {
+        document.querySelectorAll('.remote-cursor, .remote-selection').forEach(el => el.remove());
+        state.remoteCursors.clear();
+        msg.cursors.forEach(c => {
+            state.remoteCursors.set(c.clientId, { position: c.position, username: c.username, color: c.color });
+        });
+        state.remoteSelections.clear();
+        (msg.selections || []).forEach(sel => {
+            state.remoteSelections.set(sel.clientId, { start: sel.start, end: sel.end, username: sel.username, color: sel.color });
+        });
+        state.typingUsers = new Set((msg.typing || []).map(t => t.clientId));
+
+        displayRemoteCursors();
+        displayRemoteSelections();
+        updateUsersUI();
+        updateTypingIndicators();
+    }
+
+    if (state.pendingSelection) {
+        elements.editor.focus();
+        elements.editor.setSelectionRange(state.pendingSelection.start, state.pendingSelection.end);
+        state.pendingSelection = null;
+    }
 }
 
 function handleTextUpdate(msg) {
@@ -197,11 +653,17 @@ function handleTextUpdate(msg) {
     if (msg.clientId !== state.clientId) {
         console.log('Applying remote update');
         state.isUpdatingFromRemote = true;
-        elements.editor.value = msg.content;
+        // An update that comes with its edits keeps what we typed since we last sent
+        if (!msg.data?.edits || !applyRemoteEdits(msg)) {
+            elements.editor.value = msg.content;
+        }
+        state.serverContents = [msg.content];
         // Update local version to match server
         state.documentVersion = msg.version || state.documentVersion + 1;
         state.isUpdatingFromRemote = false;
         console.log('Update applied, new version:', state.documentVersion);
+        renderComments();
+        renderSuggestions();
     } else {
         // Even for our own updates, update the version
         state.documentVersion = msg.version || state.documentVersion + 1;
@@ -209,6 +671,86 @@ function handleTextUpdate(msg) {
     }
 }
 
+// Applies a remote update's edits around the changes the server did not have
+// when it made them. Edits touching our changes are left out, as the server
+// leaves them out when our changes reach it. Returns false if the edits were
+// made against content we do not know.
+function applyRemoteEdits(msg) {
+    let base, edits;
+    for (let i = state.serverContents.length - 1; i >= 0 && base === undefined; i--) {
+        edits = toStringEdits(state.serverContents[i], msg.data.edits);
+        if (applyEdits(state.serverContents[i], edits) === msg.content) {
+            base = state.serverContents[i];
+        }
+    }
+    if (base === undefined) return false;
+
+    const local = elements.editor.value;
+    const change = textChange(base, local);
+    let moved = edits;
+    if (change) {
+        const shift = change.text.length - (change.end - change.start);
+        moved = edits
+            .filter(e => !editsTouch(e, change))
+            .map(e => e.start >= change.end ? { start: e.start + shift, end: e.end + shift, text: e.text } : e);
+    }
+
+    // Our caret and selection move along with the text around them
+    const mapPosition = pos => moved.reduce((p, e) => {
+        if (e.end <= pos) return p + e.text.length - (e.end - e.start);
+        if (e.start < pos) return Math.min(p, e.start + e.text.length);
+        return p;
+    }, pos);
+    const { selectionStart, selectionEnd } = elements.editor;
+    elements.editor.value = applyEdits(local, moved);
+    elements.editor.setSelectionRange(mapPosition(selectionStart), mapPosition(selectionEnd));
+    return true;
+}
+
+// Converts edits with UTF-8 byte offsets into text, ordered by position, to
+// string indices
+function toStringEdits(text, edits) {
+    let bytes = 0, index = 0;
+    const indexOf = offset => {
+        while (bytes < offset && index < text.length) {
+            const code = text.codePointAt(index);
+            bytes += code < 0x80 ? 1 : code < 0x800 ? 2 : code < 0x10000 ? 3 : 4;
+            index += code >= 0x10000 ? 2 : 1;
+        }
+        return index;
+    };
+    return edits.map(e => ({ start: indexOf(e.start), end: indexOf(e.end), text: e.text }));
+}
+
+// Applies ordered, non-overlapping edits to text
+function applyEdits(text, edits) {
+    for (let i = edits.length - 1; i >= 0; i--) {
+        const e = edits[i];
+        text = text.slice(0, e.start) + e.text + text.slice(e.end);
+    }
+    return text;
+}
+
+// Returns the single edit turning one text into another, or null if they are equal
+function textChange(from, to) {
+    if (from === to) return null;
+    let start = 0;
+    while (start < from.length && start < to.length && from[start] === to[start]) start++;
+    let end = 0;
+    while (end < from.length - start && end < to.length - start &&
+           from[from.length - 1 - end] === to[to.length - 1 - end]) end++;
+    return { start, end: from.length - end, text: to.slice(start, to.length - end) };
+}
+
+// Reports whether two edits of the same text touch: they overlap, or one
+// inserts inside or at either end of the other
+function editsTouch(a, b) {
+    if (a.start === a.end || b.start === b.end) {
+        return a.start <= b.end && b.start <= a.end;
+    }
+    return a.start < b.end && b.start < a.end;
+}
+
 function handleUserJoined(msg) {
     const userId = msg.clientId || msg.userId;
 
@@ -256,7 +798,25 @@ function handleTypingStop(msg) {
 
 function handleSaveConfirmation(msg) {
     elements.lastSaved.textContent = `Saved at ${new Date().toLocaleTimeString()}`;
-    showNotification('Document saved', 'info');
+    if (msg.data?.formatError) {
+        showNotification(`Saved without formatting: ${msg.data.formatError}`, 'error');
+    } else if (msg.data?.formatted?.changes > 0) {
+        showNotification('Document formatted and saved', 'info');
+    } else {
+        showNotification('Document saved', 'info');
+    }
+}
+
+function handleFormatResult(result) {
+    if (result.changes === 0 && !result.skipped) {
+        showNotification('Already formatted', 'info');
+        return;
+    }
+    let text = `Formatted with ${result.changes} change${result.changes === 1 ? '' : 's'}`;
+    if (result.skipped > 0) {
+        text += `, ${result.skipped} left out where others were editing`;
+    }
+    showNotification(text, 'info');
 }
 
 // Update active users list
@@ -277,7 +837,8 @@ function updateActiveUsers(users) {
         } else {
             state.activeUsers.set(user.userId, {
                 username: user.username || `User-${user.userId?.substring(0, 4)}`,
-                color: user.color || colors[state.activeUsers.size % colors.length]
+                color: user.color || colors[state.activeUsers.size % colors.length],
+                status: user.status || 'active'
             });
             console.log('Added other user:', user.userId);
         }
@@ -289,6 +850,33 @@ function updateActiveUsers(users) {
     updateUsersUI();
 }
 
+// Apply one user's presence change
+function handlePresenceUpdate(msg) {
+    const event = msg.data?.event;
+    const user = msg.data?.user;
+    if (!user || user.userId === state.clientId) return;
+
+    if (event === 'left') {
+        state.activeUsers.delete(user.userId);
+    } else {
+        state.activeUsers.set(user.userId, {
+            username: user.username || `User-${user.userId.substring(0, 4)}`,
+            color: user.color || colors[state.activeUsers.size % colors.length],
+            status: user.status || 'active'
+        });
+    }
+    updateUsersUI();
+}
+
+// Tell the server we are still here, and whether we did anything since last time
+function startHeartbeat() {
+    clearInterval(state.heartbeatTimer);
+    state.heartbeatTimer = setInterval(() => {
+        const active = document.hasFocus() && Date.now() - state.lastActivity < HEARTBEAT_INTERVAL;
+        sendMessage({ type: 'heartbeat', active: active });
+    }, HEARTBEAT_INTERVAL);
+}
+
 // Update users UI
 function updateUsersUI() {
     const count = state.activeUsers.size + 1; // +1 for self
@@ -304,19 +892,34 @@ function updateUsersUI() {
 
     // Add self first
     if (state.clientId) {
-        const selfAvatar = createUserAvatar('ME', '#6c757d', 'You', true);
+        const selfAvatar = createUserAvatar('ME', state.color || '#6c757d', `You (${state.username || 'click to rename'})`, true);
+        selfAvatar.addEventListener('click', () => {
+            const name = prompt('Display name', state.username || '');
+            if (name && name.trim()) {
+                setProfile({ displayName: name.trim() });
+            }
+        });
         elements.activeUsers.appendChild(selfAvatar);
     }
 
     // Add other users
     state.activeUsers.forEach((user, userId) => {
+        const status = user.status || 'active';
         const avatar = createUserAvatar(
             user.username.substring(0, 2).toUpperCase(),
             user.color,
-            user.username,
+            status === 'active' ? user.username : `${user.username} (${status})`,
             false,
             userId
         );
+        avatar.classList.add(`status-${status}`);
+        if (state.following === userId) {
+            avatar.classList.add('followed');
+        }
+        if (state.followers.some(f => f.userId === userId)) {
+            avatar.classList.add('follower');
+        }
+        avatar.addEventListener('click', () => toggleFollow(userId));
 
         if (state.typingUsers.has(userId)) {
             avatar.classList.add('typing');
@@ -386,11 +989,950 @@ function showNotification(message, type = 'info') {
     }, 3000);
 }
 
+// Apply a comment thread created, changed or deleted by anyone
+function handleCommentUpdate(msg) {
+    const { action, thread } = msg.data || {};
+    if (!thread) return;
+
+    if (action === 'deleted') {
+        state.comments.delete(thread.id);
+    } else {
+        state.comments.set(thread.id, thread);
+    }
+    renderComments();
+}
+
+// Move comment threads to where edits shifted their text
+function handleCommentAnchors(msg) {
+    (msg.data?.anchors || []).forEach(anchor => {
+        const thread = state.comments.get(anchor.id);
+        if (thread) {
+            thread.start = anchor.start;
+            thread.end = anchor.end;
+        }
+    });
+    renderComments();
+}
+
+// Render the comment threads in document order, resolved ones last
+function renderComments() {
+    const threads = [...state.comments.values()].sort((a, b) =>
+        (a.resolved - b.resolved) || (a.start - b.start));
+
+    elements.commentThreads.innerHTML = '';
+    threads.forEach(thread => elements.commentThreads.appendChild(createCommentThread(thread)));
+}
+
+function createCommentThread(thread) {
+    const el = document.createElement('div');
+    el.className = 'comment-thread' + (thread.resolved ? ' resolved' : '');
+
+    const quote = document.createElement('div');
+    quote.className = 'comment-quote';
+    quote.textContent = elements.editor.value.substring(thread.start, thread.end) || '(text deleted)';
+    quote.addEventListener('click', () => {
+        elements.editor.focus();
+        elements.editor.setSelectionRange(thread.start, thread.end);
+    });
+    el.appendChild(quote);
+
+    thread.comments.forEach(comment => {
+        const item = document.createElement('div');
+        item.className = 'comment';
+
+        const author = document.createElement('span');
+        author.className = 'comment-author';
+        author.style.color = comment.color;
+        author.textContent = comment.author;
+        item.appendChild(author);
+
+        const body = document.createElement('span');
+        body.className = 'comment-body';
+        body.textContent = comment.body;
+        item.appendChild(body);
+
+        if (comment.authorKey === state.authorKey) {
+            item.appendChild(commentButton('Edit', () => {
+                const text = prompt('Edit comment', comment.body);
+                if (text && text.trim()) {
+                    sendMessage({ type: 'comment_edit', data: { threadId: thread.id, commentId: comment.id, body: text } });
+                }
+            }));
+            item.appendChild(commentButton('Delete', () => {
+                sendMessage({ type: 'comment_delete', data: { threadId: thread.id, commentId: comment.id } });
+            }));
+        }
+        el.appendChild(item);
+    });
+
+    const actions = document.createElement('div');
+    actions.className = 'comment-actions';
+    actions.appendChild(commentButton('Reply', () => {
+        const text = prompt('Reply');
+        if (text && text.trim()) {
+            sendMessage({ type: 'comment_reply', data: { threadId: thread.id, body: text } });
+        }
+    }));
+    actions.appendChild(commentButton(thread.resolved ? 'Reopen' : 'Resolve', () => {
+        sendMessage({ type: 'comment_resolve', data: { threadId: thread.id, resolved: !thread.resolved } });
+    }));
+    el.appendChild(actions);
+
+    return el;
+}
+
+function commentButton(label, onClick) {
+    const button = document.createElement('button');
+    button.className = 'comment-button';
+    button.textContent = label;
+    button.addEventListener('click', onClick);
+    return button;
+}
+
+function handleChatMessage(msg) {
+    const entry = msg.data;
+    if (!entry) return;
+
+    appendChatMessage(entry);
+    if (entry.authorId !== state.clientId && (entry.mentions || []).some(m => m.userId === state.clientId)) {
+        showNotification(`${entry.author} mentioned you`, 'join');
+    }
+}
+
+function appendChatMessage(entry) {
+    const el = document.createElement('div');
+    el.className = 'chat-message';
+    if ((entry.mentions || []).some(m => m.userId === state.clientId)) {
+        el.classList.add('mentioned');
+    }
+
+    const time = document.createElement('span');
+    time.className = 'chat-time';
+    time.textContent = new Date(entry.createdAt).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+    el.appendChild(time);
+
+    const author = document.createElement('span');
+    author.className = 'comment-author';
+    author.style.color = entry.color;
+    author.textContent = entry.author;
+    el.appendChild(author);
+
+    const body = document.createElement('span');
+    body.className = 'comment-body';
+    body.textContent = entry.body;
+    el.appendChild(body);
+
+    elements.chatLog.appendChild(el);
+    elements.chatLog.scrollTop = elements.chatLog.scrollHeight;
+}
+
+function handleModeState(msg) {
+    state.mode = msg.data?.mode || 'editing';
+    elements.modeToggle.textContent = state.mode === 'suggesting' ? 'Suggesting' : 'Editing';
+    elements.modeToggle.classList.toggle('suggesting', state.mode === 'suggesting');
+    renderSuggestions();
+}
+
+// Apply a suggestion created, extended, accepted, rejected or made obsolete
+function handleSuggestionUpdate(msg) {
+    const { action, suggestion } = msg.data || {};
+    if (!suggestion) return;
+
+    if (action === 'created' || action === 'updated') {
+        state.suggestions.set(suggestion.id, suggestion);
+    } else {
+        state.suggestions.delete(suggestion.id);
+        if (suggestion.authorKey === state.authorKey && action !== 'accepted') {
+            showNotification(`Your suggestion was ${action}`, 'info');
+        }
+    }
+    renderSuggestions();
+}
+
+// Move suggestions to where edits shifted their text
+function handleSuggestionAnchors(msg) {
+    (msg.data?.anchors || []).forEach(anchor => {
+        const suggestion = state.suggestions.get(anchor.id);
+        if (suggestion) {
+            suggestion.start = anchor.start;
+            suggestion.end = anchor.end;
+        }
+    });
+    renderSuggestions();
+}
+
+function renderSuggestions() {
+    elements.suggestionList.innerHTML = '';
+    [...state.suggestions.values()]
+        .sort((a, b) => a.start - b.start)
+        .forEach(suggestion => elements.suggestionList.appendChild(createSuggestion(suggestion)));
+}
+
+function createSuggestion(suggestion) {
+    const el = document.createElement('div');
+    el.className = `suggestion ${suggestion.kind}`;
+    el.style.borderLeftColor = suggestion.color;
+
+    const author = document.createElement('span');
+    author.className = 'comment-author';
+    author.style.color = suggestion.color;
+    author.textContent = suggestion.author;
+    el.appendChild(author);
+
+    const removed = elements.editor.value.substring(suggestion.start, suggestion.end);
+    if (removed) {
+        const del = document.createElement('del');
+        del.textContent = removed;
+        el.appendChild(del);
+    }
+    if (suggestion.content) {
+        const ins = document.createElement('ins');
+        ins.textContent = suggestion.content;
+        el.appendChild(ins);
+    }
+    el.addEventListener('click', () => {
+        elements.editor.focus();
+        elements.editor.setSelectionRange(suggestion.start, suggestion.end);
+    });
+
+    const actions = document.createElement('div');
+    actions.className = 'comment-actions';
+    if (state.mode !== 'suggesting') {
+        actions.appendChild(commentButton('Accept', () => {
+            sendMessage({ type: 'suggestion_accept', data: { suggestionId: suggestion.id } });
+        }));
+    }
+    if (state.mode !== 'suggesting' || suggestion.authorKey === state.authorKey) {
+        actions.appendChild(commentButton('Reject', () => {
+            sendMessage({ type: 'suggestion_reject', data: { suggestionId: suggestion.id } });
+        }));
+    }
+    el.appendChild(actions);
+
+    return el;
+}
+
+// Apply a region lock taken, released or expired
+function handleLockUpdate(msg) {
+    const { action, lock } = msg.data || {};
+    if (!lock) return;
+
+    if (action === 'locked') {
+        state.locks.set(lock.id, lock);
+    } else {
+        state.locks.delete(lock.id);
+        if (lock.ownerId === state.clientId && action === 'expired') {
+            showNotification('Your region lock expired', 'info');
+        }
+    }
+    renderLocks();
+}
+
+// Move locks to where edits shifted their text
+function handleLockAnchors(msg) {
+    (msg.data?.anchors || []).forEach(anchor => {
+        const lock = state.locks.get(anchor.id);
+        if (lock) {
+            lock.start = anchor.start;
+            lock.end = anchor.end;
+        }
+    });
+    renderLocks();
+}
+
+function renderLocks() {
+    elements.lockList.innerHTML = '';
+    [...state.locks.values()]
+        .sort((a, b) => a.start - b.start)
+        .forEach(lock => elements.lockList.appendChild(createLock(lock)));
+}
+
+function createLock(lock) {
+    const el = document.createElement('div');
+    el.className = 'region-lock';
+    el.style.borderLeftColor = lock.color;
+
+    const owner = document.createElement('span');
+    owner.className = 'comment-author';
+    owner.style.color = lock.color;
+    owner.textContent = lock.owner;
+    el.appendChild(owner);
+
+    const text = document.createElement('span');
+    text.className = 'region-lock-text';
+    text.textContent = elements.editor.value.substring(lock.start, lock.end);
+    el.appendChild(text);
+
+    el.addEventListener('click', () => {
+        elements.editor.focus();
+        elements.editor.setSelectionRange(lock.start, lock.end);
+    });
+
+    if (lock.ownerId === state.clientId) {
+        const actions = document.createElement('div');
+        actions.className = 'comment-actions';
+        actions.appendChild(commentButton('Unlock', () => {
+            sendMessage({ type: 'unlock_region', data: { lockId: lock.id } });
+        }));
+        el.appendChild(actions);
+    }
+
+    return el;
+}
+
+// Show the document's metadata and follow its indentation and language
+function renderMetadata(metadata) {
+    const detected = metadata.detected || [];
+    const language = document.getElementById('metaLanguage');
+    language.value = detected.includes('language') ? '' : metadata.language;
+    language.placeholder = `${metadata.language} (detected)`;
+    document.getElementById('metaTabWidth').value = metadata.tabWidth;
+    document.getElementById('metaLineEndings').value = detected.includes('lineEndings') ? '' : metadata.lineEndings;
+    document.getElementById('metaEncoding').value = metadata.encoding;
+    document.getElementById('metaOwner').value = metadata.owner || '';
+    document.getElementById('metaTags').value = (metadata.tags || []).join(', ');
+    document.getElementById('metaDescription').value = metadata.description || '';
+
+    elements.editor.style.tabSize = metadata.tabWidth;
+
+    // Run the document as what it is written in, where the server can
+    const run = document.getElementById('runLanguage');
+    const runAs = metadata.language === 'shellscript' ? 'bash' : metadata.language;
+    if ([...run.options].some(o => o.value === runAs)) {
+        run.value = runAs;
+    }
+}
+
+function applyMetadata() {
+    sendMessage({
+        type: 'set_metadata',
+        data: {
+            language: document.getElementById('metaLanguage').value.trim().toLowerCase(),
+            tabWidth: Number(document.getElementById('metaTabWidth').value) || 4,
+            lineEndings: document.getElementById('metaLineEndings').value,
+            encoding: document.getElementById('metaEncoding').value,
+            owner: document.getElementById('metaOwner').value,
+            tags: document.getElementById('metaTags').value.split(',').map(t => t.trim()).filter(Boolean),
+            description: document.getElementById('metaDescription').value
+        }
+    });
+}
+
+// Offer the languages the server can run
+async function loadLanguages() {
+    try {
+        const response = await fetch('/api/execution/languages');
+        const { languages } = await response.json();
+        const select = document.getElementById('runLanguage');
+        select.innerHTML = '';
+        (languages || []).forEach(name => {
+            const option = document.createElement('option');
+            option.value = name;
+            option.textContent = name;
+            select.appendChild(option);
+        });
+    } catch (error) {
+        console.error('Failed to load languages:', error);
+    }
+}
+
+function handleExecutionStarted(msg) {
+    const user = state.activeUsers.get(msg.clientId);
+    const who = msg.clientId === state.clientId ? 'You' : (user ? user.username : 'Someone');
+    state.executionId = msg.data?.executionId;
+    elements.runOutput.innerHTML = '';
+    elements.runStatus.textContent = `${who} ran this as ${msg.data?.language}…`;
+    document.getElementById('runCancel').hidden = false;
+}
+
+function handleExecutionOutput(msg) {
+    if (msg.data?.executionId !== state.executionId) return;
+    const chunk = document.createElement('span');
+    chunk.className = msg.data.stream;
+    chunk.textContent = msg.data.data;
+    elements.runOutput.appendChild(chunk);
+    elements.runOutput.scrollTop = elements.runOutput.scrollHeight;
+}
+
+function handleExecutionFinished(msg) {
+    const data = msg.data || {};
+    if (data.executionId !== state.executionId) return;
+
+    let status = `Exited with ${data.exitCode} in ${data.durationMs} ms`;
+    if (data.error) status = `Failed: ${data.error}`;
+    else if (data.timedOut) status = 'Stopped: took too long';
+    else if (data.canceled) status = 'Stopped';
+    if (data.truncated) status += ' (output cut short)';
+
+    elements.runStatus.textContent = status;
+    state.executionId = null;
+    document.getElementById('runCancel').hidden = true;
+}
+
+// Escape sequences the terminal screen does not draw: colors, cursor
+// movement, titles and character sets
+const TERMINAL_ESCAPES = /\x1b\[[0-?]*[ -\/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[()][0-9A-Za-z]|\x1b[=>78]/g;
+const MAX_TERMINAL_TEXT = 200000;
+
+// Error codes of git requests shown to the user
+const GIT_ERRORS = new Set([
+    'no_repository', 'invalid_path', 'unknown_branch', 'branch_exists', 'invalid_branch',
+    'nothing_to_commit', 'detached_head'
+]);
+
+// Keys sent to the shell as the sequences a terminal would send
+const TERMINAL_KEYS = {
+    Enter: '\r', Backspace: '\x7f', Tab: '\t', Escape: '\x1b', Delete: '\x1b[3~',
+    ArrowUp: '\x1b[A', ArrowDown: '\x1b[B', ArrowRight: '\x1b[C', ArrowLeft: '\x1b[D',
+    Home: '\x1b[H', End: '\x1b[F'
+};
+
+function watchingTerminal() {
+    return (state.terminal?.watchers || []).some(w => w.userId === state.clientId);
+}
+
+function drivingTerminal() {
+    return !!state.terminal && state.terminal.driver === state.clientId;
+}
+
+function terminalUser(userId) {
+    if (userId === state.clientId) return 'you';
+    const watcher = (state.terminal?.watchers || []).find(w => w.userId === userId);
+    return watcher?.username || state.activeUsers.get(userId)?.username || 'someone';
+}
+
+// Show terminal output as plain text, applying carriage returns and
+// backspaces to the last line
+function writeTerminal(data, replace) {
+    let text = replace ? '' : state.terminalText;
+    for (const ch of data.replace(TERMINAL_ESCAPES, '').replace(/\r\n/g, '\n')) {
+        if (ch === '\r') {
+            text = text.slice(0, text.lastIndexOf('\n') + 1);
+        } else if (ch === '\b') {
+            if (text && !text.endsWith('\n')) text = text.slice(0, -1);
+        } else if (ch !== '\x07') {
+            text += ch;
+        }
+    }
+    state.terminalText = text.slice(-MAX_TERMINAL_TEXT);
+    elements.terminalOutput.textContent = state.terminalText;
+    elements.terminalOutput.scrollTop = elements.terminalOutput.scrollHeight;
+}
+
+function handleTerminalState(data) {
+    if (state.terminal?.terminalId !== data.terminalId) {
+        stopReplay();
+        writeTerminal('', true);
+    }
+    state.terminal = data;
+    renderTerminal();
+}
+
+function handleTerminalOutput(data) {
+    if (data.terminalId !== state.terminal?.terminalId) return;
+    // The scrollback a new watcher gets replaces what the screen showed
+    writeTerminal(data.data || '', data.scrollback);
+}
+
+function handleTerminalExited(data) {
+    if (data.terminalId !== state.terminal?.terminalId) return;
+    state.terminal = null;
+    renderTerminal();
+
+    let status = `Exited with ${data.exitCode}`;
+    if (data.lost) status = 'Lost: the server running it went away';
+    else if (data.idle) status = 'Closed: nobody typed for too long';
+    else if (data.closed) status = 'Closed';
+    elements.terminalStatus.textContent = status;
+    loadRecordings();
+}
+
+function renderTerminal() {
+    const t = state.terminal;
+    const watching = watchingTerminal();
+    const driving = drivingTerminal();
+
+    document.getElementById('terminalStart').hidden = !!t;
+    const watch = document.getElementById('terminalWatch');
+    watch.hidden = !t;
+    watch.textContent = watching ? 'Unwatch' : 'Watch';
+    document.getElementById('terminalDrive').hidden = !watching || !!t.driver;
+    document.getElementById('terminalStop').hidden = !driving;
+    elements.terminalOutput.classList.toggle('driving', driving);
+
+    // The driver hands the role to another watcher, or gives it up
+    const handOver = document.getElementById('terminalHandOver');
+    handOver.hidden = !driving;
+    handOver.innerHTML = '';
+    if (driving) {
+        handOver.appendChild(new Option('Hand over to…', state.clientId));
+        t.watchers.filter(w => w.userId !== state.clientId)
+            .forEach(w => handOver.appendChild(new Option(w.username || w.userId, w.userId)));
+        handOver.appendChild(new Option('Nobody', ''));
+    }
+
+    if (t) {
+        const watchers = t.watchers.length;
+        elements.terminalStatus.textContent =
+            `Started by ${terminalUser(t.startedBy)}, ` +
+            (t.driver ? `driven by ${terminalUser(t.driver)}` : 'nobody driving') +
+            `, ${watchers} watching (${t.cols}×${t.rows})`;
+    }
+}
+
+// Start a shell sized to the terminal screen
+function startTerminal() {
+    const style = getComputedStyle(elements.terminalOutput);
+    const lineHeight = parseFloat(style.lineHeight) || parseFloat(style.fontSize) * 1.2;
+    const charWidth = parseFloat(style.fontSize) * 0.6;
+    const rows = Math.max(1, Math.floor(elements.terminalOutput.clientHeight / lineHeight));
+    const cols = Math.max(1, Math.floor(elements.terminalOutput.clientWidth / charWidth));
+    sendMessage({ type: 'terminal_start', data: { rows: rows, cols: cols } });
+}
+
+// Type into the terminal, as its driver
+function handleTerminalKey(event) {
+    if (!drivingTerminal()) return;
+
+    let input = TERMINAL_KEYS[event.key];
+    if (event.ctrlKey && event.key.length === 1 && /[a-z]/i.test(event.key)) {
+        input = String.fromCharCode(event.key.toUpperCase().charCodeAt(0) - 64);
+    } else if (!input && event.key.length === 1 && !event.ctrlKey && !event.metaKey) {
+        input = event.key;
+    }
+    if (!input) return;
+
+    event.preventDefault();
+    sendMessage({ type: 'terminal_input', data: { input: input } });
+}
+
+// List the workspace's terminal recordings
+async function loadRecordings() {
+    try {
+        const response = await fetch(`/api/workspaces/${encodeURIComponent(state.workspaceId)}/terminal/recordings`);
+        if (!response.ok) return;
+        const recordings = (await response.json()).recordings || [];
+        const select = document.getElementById('terminalRecordings');
+        select.innerHTML = '';
+        recordings.forEach(r => {
+            const started = new Date(r.startedAt).toLocaleTimeString();
+            const label = r.running ? `${started} (running)` : `${started} (${Math.round(r.durationMs / 1000)} s)`;
+            select.appendChild(new Option(label, r.recordingId));
+        });
+        updateRecordingLink();
+    } catch (error) {
+        console.error('Failed to load recordings:', error);
+    }
+}
+
+function recordingUrl(recordingId) {
+    return `/api/workspaces/${encodeURIComponent(state.workspaceId)}/terminal/recordings/${encodeURIComponent(recordingId)}`;
+}
+
+function updateRecordingLink() {
+    const recordingId = document.getElementById('terminalRecordings').value;
+    const link = document.getElementById('terminalDownload');
+    link.hidden = !recordingId;
+    if (recordingId) link.href = recordingUrl(recordingId);
+}
+
+// Replay a recording's output on the terminal screen, as it was timed
+async function replayRecording() {
+    const recordingId = document.getElementById('terminalRecordings').value;
+    if (!recordingId) return;
+    if (state.terminal && watchingTerminal()) {
+        showNotification('Stop watching the terminal to replay a recording', 'info');
+        return;
+    }
+
+    try {
+        const response = await fetch(recordingUrl(recordingId));
+        if (!response.ok) return;
+        const [, ...events] = (await response.text()).split('\n').filter(Boolean).map(line => JSON.parse(line));
+
+        stopReplay();
+        writeTerminal('', true);
+        elements.terminalStatus.textContent = 'Replaying…';
+        events.filter(([, kind]) => kind === 'o').forEach(([seconds, , data]) => {
+            state.terminalReplay.push(setTimeout(() => writeTerminal(data), seconds * 1000));
+        });
+        const last = events.length ? events[events.length - 1][0] : 0;
+        state.terminalReplay.push(setTimeout(() => {
+            elements.terminalStatus.textContent = 'Replay finished';
+        }, last * 1000));
+    } catch (error) {
+        console.error('Failed to replay recording:', error);
+    }
+}
+
+function stopReplay() {
+    state.terminalReplay.forEach(clearTimeout);
+    state.terminalReplay = [];
+}
+
+function handleGitState(data) {
+    const branchChanged = state.git?.branch !== data.branch || state.git?.head !== data.head;
+    state.git = data;
+    elements.gitStatus.textContent = data.head
+        ? `${data.path} on ${data.branch} at ${data.head.slice(0, 7)}`
+        : `${data.path} on ${data.branch}, nothing committed yet`;
+    if (branchChanged) sendMessage({ type: 'git_branches' });
+}
+
+function renderGitDiff(diff) {
+    const changes = (diff.changes || []).map(c => `${c.status} ${c.path}`).join('\n');
+    if (!changes) {
+        elements.gitOutput.textContent = 'No changes';
+        return;
+    }
+    elements.gitOutput.textContent = changes + '\n\n' + (diff.patch || '') +
+        (diff.truncated ? '\n… diff truncated' : '');
+}
+
+function renderGitBranches(branches) {
+    const select = document.getElementById('gitBranch');
+    select.innerHTML = '';
+    branches.forEach(b => {
+        const option = document.createElement('option');
+        option.value = b.name;
+        option.textContent = b.name;
+        option.selected = b.current;
+        select.appendChild(option);
+    });
+}
+
+function gitUser(clientId) {
+    return state.activeUsers.get(clientId)?.username || 'Someone';
+}
+
+function handleGitCommitted(msg) {
+    const commit = msg.data?.commit || {};
+    const summary = `${commit.commit?.slice(0, 7)} ${(commit.message || '').split('\n')[0]}`;
+    elements.gitOutput.textContent = `Committed ${summary} on ${commit.branch} by ${commit.author?.name}`;
+    if (msg.clientId === state.clientId) {
+        document.getElementById('gitMessage').value = '';
+    } else {
+        showNotification(`${gitUser(msg.clientId)} committed ${summary}`, 'info');
+    }
+}
+
+function handleGitCheckedOut(msg) {
+    const data = msg.data || {};
+    const files = (data.files || []).map(f => `${f.action} ${f.path}${f.error ? ': ' + f.error : ''}`);
+    elements.gitOutput.textContent = `Checked out ${data.branch}` + (files.length ? '\n' + files.join('\n') : '');
+    if (msg.clientId === state.clientId) {
+        state.gitCheckout = null;
+    } else {
+        showNotification(`${gitUser(msg.clientId)} checked out ${data.branch}`, 'info');
+    }
+}
+
+// Check out a branch; a refusal over changes not committed asks to force it
+function checkoutBranch(branch, create) {
+    if (!branch) return;
+    state.gitCheckout = branch;
+    sendMessage({ type: 'git_checkout', data: { branch: branch, create: create } });
+}
+
+// Ask the language server about the cursor position
+function requestCode(type) {
+    state.codeRequest++;
+    elements.codeInfo.textContent = '';
+    sendMessage({
+        type: type,
+        data: { offset: elements.editor.selectionStart, requestId: String(state.codeRequest) }
+    });
+}
+
+function renderCompletions(items) {
+    elements.codeInfo.innerHTML = '';
+    if (items.length === 0) {
+        elements.codeInfo.textContent = 'No completions';
+        return;
+    }
+    items.forEach(item => {
+        const el = document.createElement('div');
+        el.className = 'code-item';
+        el.title = item.documentation || '';
+
+        const label = document.createElement('span');
+        label.textContent = item.label;
+        el.appendChild(label);
+
+        const detail = document.createElement('span');
+        detail.className = 'code-detail';
+        detail.textContent = item.detail || '';
+        el.appendChild(detail);
+
+        // Insert like typing, so it reaches everyone as an edit
+        el.addEventListener('click', () => {
+            elements.editor.focus();
+            elements.editor.setRangeText(item.insertText, item.from, item.to, 'end');
+            elements.editor.dispatchEvent(new Event('input'));
+            elements.codeInfo.innerHTML = '';
+        });
+        elements.codeInfo.appendChild(el);
+    });
+}
+
+function renderDefinitions(locations) {
+    elements.codeInfo.innerHTML = '';
+    if (locations.length === 0) {
+        elements.codeInfo.textContent = 'No definition found';
+        return;
+    }
+    locations.forEach(loc => {
+        const el = document.createElement('div');
+        el.className = 'code-item';
+        el.textContent = `${loc.path || loc.uri}:${loc.line + 1}:${loc.character + 1}`;
+        if (loc.from !== undefined) {
+            el.addEventListener('click', () => jumpTo(loc.fileId, loc.from, loc.to));
+        }
+        elements.codeInfo.appendChild(el);
+    });
+    // A single definition in the workspace is where the user wants to go
+    if (locations.length === 1 && locations[0].from !== undefined) {
+        jumpTo(locations[0].fileId, locations[0].from, locations[0].to);
+    }
+}
+
+function renderDiagnostics() {
+    elements.diagnosticList.innerHTML = '';
+    state.diagnostics.forEach(diagnostic => {
+        const el = document.createElement('div');
+        el.className = `diagnostic ${diagnostic.severity}`;
+
+        const location = document.createElement('span');
+        location.className = 'search-location';
+        location.textContent = `${diagnostic.line + 1}:${diagnostic.character + 1}`;
+        el.appendChild(location);
+
+        const message = document.createElement('span');
+        message.textContent = diagnostic.source ? `${diagnostic.message} (${diagnostic.source})` : diagnostic.message;
+        el.appendChild(message);
+
+        el.addEventListener('click', () => jumpTo(null, diagnostic.from, diagnostic.to));
+        elements.diagnosticList.appendChild(el);
+    });
+}
+
+// Select a range, opening its file first if need be
+function jumpTo(fileId, start, end) {
+    if (fileId && fileId !== state.openFileId) {
+        state.pendingSelection = { start: start, end: end };
+        openFile(fileId);
+        return;
+    }
+    elements.editor.focus();
+    elements.editor.setSelectionRange(start, end);
+}
+
+// The search described by the search panel
+function searchQuery() {
+    return {
+        query: elements.searchQuery.value,
+        regex: document.getElementById('searchRegex').checked,
+        caseSensitive: document.getElementById('searchCase').checked,
+        wholeWord: document.getElementById('searchWord').checked,
+        scope: document.getElementById('searchWorkspace').checked ? 'workspace' : 'document'
+    };
+}
+
+function renderSearchResults(matches, truncated) {
+    elements.searchResults.innerHTML = '';
+    if (matches.length === 0) {
+        elements.searchResults.textContent = 'No matches';
+        return;
+    }
+    matches.forEach(match => elements.searchResults.appendChild(createSearchMatch(match)));
+    if (truncated) {
+        const more = document.createElement('div');
+        more.className = 'search-location';
+        more.textContent = `Showing the first ${matches.length} matches`;
+        elements.searchResults.appendChild(more);
+    }
+}
+
+function createSearchMatch(match) {
+    const el = document.createElement('div');
+    el.className = 'search-match';
+
+    const location = document.createElement('span');
+    location.className = 'search-location';
+    location.textContent = `${match.path ? match.path + ':' : ''}${match.line}:${match.column}`;
+    el.appendChild(location);
+
+    const preview = document.createElement('span');
+    preview.className = 'search-preview';
+    preview.textContent = match.preview;
+    el.appendChild(preview);
+
+    el.addEventListener('click', () => jumpTo(match.fileId, match.start, match.end));
+
+    return el;
+}
+
+function handleReplaceResult(msg) {
+    const results = msg.data?.results || [];
+    const replaced = results.reduce((n, r) => n + r.replacements, 0);
+    const files = results.filter(r => r.replacements > 0).length;
+    const failed = results.filter(r => r.error);
+
+    showNotification(`Replaced ${replaced} match${replaced === 1 ? '' : 'es'}` +
+        (msg.data?.workspaceId ? ` in ${files} file${files === 1 ? '' : 's'}` : ''), 'info');
+    if (failed.length > 0) {
+        showNotification(`Could not replace in ${failed.map(r => r.path || r.documentId).join(', ')}`, 'error');
+    }
+    elements.searchResults.innerHTML = '';
+}
+
+// Apply a file or folder created, renamed, moved or deleted
+function handleWorkspaceUpdate(msg) {
+    const { action, file, removed } = msg.data || {};
+    if (!file) return;
+
+    if (action === 'deleted') {
+        (removed || []).forEach(f => state.files.delete(f.id));
+        if (state.openFileId && !state.files.has(state.openFileId)) {
+            showNotification('The open file was deleted', 'leave');
+            closeFile();
+        }
+    } else {
+        state.files.set(file.id, file);
+    }
+    renderFiles();
+}
+
+// Show a workspace file in the editor, closing the one shown before
+function openFile(fileId) {
+    const file = state.files.get(fileId);
+    if (!file || file.kind !== 'file' || fileId === state.openFileId) return;
+
+    closeFile();
+    state.openFileId = fileId;
+    state.documentId = file.documentId;
+    showDocument(filePath(file));
+    sendMessage({ type: 'file_open', data: { fileId: fileId } });
+    renderFiles();
+}
+
+function closeFile() {
+    if (state.openFileId && state.files.has(state.openFileId)) {
+        sendMessage({ type: 'file_close', data: { fileId: state.openFileId } });
+    }
+    state.openFileId = null;
+    state.documentId = null;
+    state.isUpdatingFromRemote = true;
+    elements.editor.value = '';
+    state.isUpdatingFromRemote = false;
+    state.diagnostics = [];
+    renderDiagnostics();
+    elements.codeInfo.innerHTML = '';
+}
+
+// Slash separated path of a workspace file
+function filePath(file) {
+    const parts = [];
+    for (let f = file; f; f = state.files.get(f.parentId)) {
+        parts.unshift(f.name);
+    }
+    return parts.join('/');
+}
+
+function renderFiles() {
+    elements.fileTree.innerHTML = '';
+    const children = parentId => [...state.files.values()]
+        .filter(f => (f.parentId || '') === parentId)
+        .sort((a, b) => (a.kind === b.kind ? a.name.localeCompare(b.name) : a.kind === 'folder' ? -1 : 1));
+
+    const add = (parentId, depth) => children(parentId).forEach(file => {
+        elements.fileTree.appendChild(createFileEntry(file, depth));
+        if (file.kind === 'folder') add(file.id, depth + 1);
+    });
+    add('', 0);
+
+    // Opening the file named in the URL waits for the tree
+    if (state.openFileId && !state.documentId && state.files.has(state.openFileId)) {
+        const fileId = state.openFileId;
+        state.openFileId = null;
+        openFile(fileId);
+    }
+}
+
+function createFileEntry(file, depth) {
+    const el = document.createElement('div');
+    el.className = `file-entry ${file.kind}`;
+    el.classList.toggle('open', file.id === state.openFileId);
+    el.style.paddingLeft = `${8 + depth * 16}px`;
+    el.draggable = true;
+
+    const name = document.createElement('span');
+    name.className = 'file-name';
+    name.textContent = file.name;
+    el.appendChild(name);
+    if (file.kind === 'file') {
+        el.addEventListener('click', () => openFile(file.id));
+    }
+
+    // Drag an entry onto a folder to move it there
+    el.addEventListener('dragstart', (event) => event.dataTransfer.setData('text/plain', file.id));
+    if (file.kind === 'folder') {
+        el.addEventListener('dragover', (event) => event.preventDefault());
+        el.addEventListener('drop', (event) => {
+            event.preventDefault();
+            event.stopPropagation();
+            moveFile(event.dataTransfer.getData('text/plain'), file.id);
+        });
+    }
+
+    const actions = document.createElement('div');
+    actions.className = 'comment-actions';
+    if (file.kind === 'folder') {
+        actions.appendChild(commentButton('+', () => createFile('file', file.id)));
+    }
+    actions.appendChild(commentButton('Rename', () => {
+        const newName = prompt('New name', file.name);
+        if (newName && newName.trim() && newName !== file.name) {
+            sendMessage({ type: 'file_rename', data: { fileId: file.id, name: newName.trim() } });
+        }
+    }));
+    actions.appendChild(commentButton('Delete', () => {
+        const what = file.kind === 'folder' ? `folder ${file.name} and everything in it` : file.name;
+        if (confirm(`Delete ${what}?`)) {
+            sendMessage({ type: 'file_delete', data: { fileId: file.id } });
+        }
+    }));
+    el.appendChild(actions);
+
+    return el;
+}
+
+function createFile(kind, parentId) {
+    const name = prompt(kind === 'folder' ? 'Folder name' : 'File name');
+    if (name && name.trim()) {
+        sendMessage({ type: 'file_create', data: { kind: kind, name: name.trim(), parentId: parentId || '' } });
+    }
+}
+
+function moveFile(fileId, parentId) {
+    const file = state.files.get(fileId);
+    if (file && fileId !== parentId && (file.parentId || '') !== parentId) {
+        sendMessage({ type: 'file_move', data: { fileId: fileId, parentId: parentId } });
+    }
+}
+
 // Setup event listeners
 function setupEventListeners() {
     let typingTimer;
     let isTyping = false;
 
+    // Any interaction counts as activity for presence
+    ['input', 'keydown', 'mousedown', 'scroll'].forEach(event => {
+        elements.editor.addEventListener(event, () => {
+            state.lastActivity = Date.now();
+        });
+    });
+
     elements.editor.addEventListener('input', () => {
         if (state.isUpdatingFromRemote) return;
 
@@ -406,6 +1948,7 @@ function setupEventListeners() {
         clearTimeout(typingTimer);
         typingTimer = setTimeout(() => {
             // Send text with OT version
+            state.serverContents = [...state.serverContents.slice(-MAX_SERVER_CONTENTS + 1), elements.editor.value];
             sendMessage({
                 type: 'text_update',
                 content: elements.editor.value,
@@ -424,6 +1967,185 @@ function setupEventListeners() {
             }
         }, 500);
     });
+    elements.commentAdd.addEventListener('click', () => {
+        const { selectionStart: start, selectionEnd: end } = elements.editor;
+        if (start === end) {
+            showNotification('Select some text to comment on', 'info');
+            return;
+        }
+        const body = prompt('Comment');
+        if (body && body.trim()) {
+            sendMessage({ type: 'comment_create', data: { start: start, end: end, body: body } });
+        }
+    });
+    document.getElementById('newFile').addEventListener('click', () => createFile('file', ''));
+    document.getElementById('newFolder').addEventListener('click', () => createFile('folder', ''));
+
+    // Dropping on the tree itself moves to the root
+    elements.fileTree.addEventListener('dragover', (event) => event.preventDefault());
+    elements.fileTree.addEventListener('drop', (event) => {
+        event.preventDefault();
+        moveFile(event.dataTransfer.getData('text/plain'), '');
+    });
+
+    document.getElementById('runStart').addEventListener('click', () => {
+        const language = document.getElementById('runLanguage').value;
+        if (!language) return;
+        sendMessage({ type: 'run_code', data: { language: language } });
+    });
+    document.getElementById('runCancel').addEventListener('click', () => {
+        if (state.executionId) {
+            sendMessage({ type: 'cancel_execution', data: { executionId: state.executionId } });
+        }
+    });
+
+    document.getElementById('terminalStart').addEventListener('click', startTerminal);
+    document.getElementById('terminalWatch').addEventListener('click', () => {
+        if (watchingTerminal()) {
+            sendMessage({ type: 'terminal_unsubscribe' });
+        } else {
+            stopReplay();
+            sendMessage({ type: 'terminal_subscribe' });
+        }
+    });
+    document.getElementById('terminalDrive').addEventListener('click', () => {
+        sendMessage({ type: 'terminal_set_driver', data: { userId: state.clientId } });
+    });
+    document.getElementById('terminalHandOver').addEventListener('change', (event) => {
+        if (event.target.value !== state.clientId) {
+            sendMessage({ type: 'terminal_set_driver', data: { userId: event.target.value } });
+        }
+    });
+    document.getElementById('terminalStop').addEventListener('click', () => {
+        sendMessage({ type: 'terminal_stop' });
+    });
+    elements.terminalOutput.addEventListener('keydown', handleTerminalKey);
+    elements.terminalOutput.addEventListener('paste', (event) => {
+        if (!drivingTerminal()) return;
+        event.preventDefault();
+        const text = event.clipboardData.getData('text').replace(/\r?\n/g, '\r');
+        for (let i = 0; i < text.length; i += 4096) {
+            sendMessage({ type: 'terminal_input', data: { input: text.slice(i, i + 4096) } });
+        }
+    });
+    document.getElementById('terminalReplay').addEventListener('click', replayRecording);
+    document.getElementById('terminalRecordings').addEventListener('change', updateRecordingLink);
+
+    document.getElementById('gitConfigure').addEventListener('click', () => {
+        const path = prompt('Repository', state.git?.path || state.workspaceId);
+        if (path === null) return;
+        const dir = prompt('Folder of the repository the files go in', state.git?.dir || '');
+        if (dir === null) return;
+        sendMessage({ type: 'git_configure', data: { path: path.trim(), dir: dir.trim(), create: true } });
+    });
+    document.getElementById('gitDiff').addEventListener('click', () => sendMessage({ type: 'git_diff' }));
+    document.getElementById('gitCommit').addEventListener('click', () => {
+        const message = document.getElementById('gitMessage').value.trim();
+        if (!message) {
+            showNotification('Write a commit message first', 'info');
+            return;
+        }
+        sendMessage({ type: 'git_commit', data: { message: message } });
+    });
+    document.getElementById('gitCheckout').addEventListener('click', () => {
+        checkoutBranch(document.getElementById('gitBranch').value, false);
+    });
+    document.getElementById('gitNewBranch').addEventListener('click', () => {
+        const branch = prompt('New branch');
+        if (branch) checkoutBranch(branch.trim(), true);
+    });
+
+    document.getElementById('codeComplete').addEventListener('click', () => requestCode('completion'));
+    document.getElementById('codeHover').addEventListener('click', () => requestCode('hover'));
+    document.getElementById('codeDefinition').addEventListener('click', () => requestCode('definition'));
+    document.getElementById('codeFormat').addEventListener('click', formatDocument);
+    document.getElementById('metadataApply').addEventListener('click', applyMetadata);
+    elements.editor.addEventListener('keydown', (event) => {
+        if (event.key === ' ' && event.ctrlKey) {
+            event.preventDefault();
+            requestCode('completion');
+        } else if (event.key === 'F12') {
+            event.preventDefault();
+            requestCode('definition');
+        } else if (event.key === 'F' && event.shiftKey && event.altKey) {
+            event.preventDefault();
+            formatDocument();
+        } else if (event.key === 's' && (event.ctrlKey || event.metaKey)) {
+            event.preventDefault();
+            saveDocument();
+        }
+    });
+
+    document.getElementById('searchRun').addEventListener('click', () => {
+        if (!elements.searchQuery.value) return;
+        sendMessage({ type: 'search', data: searchQuery() });
+    });
+    elements.searchQuery.addEventListener('keydown', (event) => {
+        if (event.key === 'Enter' && elements.searchQuery.value) {
+            sendMessage({ type: 'search', data: searchQuery() });
+        }
+    });
+    document.getElementById('replaceRun').addEventListener('click', () => {
+        if (!elements.searchQuery.value) return;
+        sendMessage({ type: 'replace_all', data: { ...searchQuery(), replacement: elements.replaceText.value } });
+    });
+
+    elements.lockAdd.addEventListener('click', () => {
+        const { selectionStart: start, selectionEnd: end } = elements.editor;
+        if (start === end) {
+            showNotification('Select some text to lock', 'info');
+            return;
+        }
+        sendMessage({ type: 'lock_region', data: { start: start, end: end } });
+    });
+    elements.chatInput.addEventListener('keydown', (event) => {
+        if (event.key !== 'Enter') return;
+        const body = elements.chatInput.value.trim();
+        if (body) {
+            sendMessage({ type: 'chat_message', data: { body: body } });
+            elements.chatInput.value = '';
+        }
+    });
+
+    elements.modeToggle.addEventListener('click', () => {
+        const mode = state.mode === 'suggesting' ? 'editing' : 'suggesting';
+        sendMessage({ type: 'set_mode', data: { mode: mode } });
+    });
+
+    // While suggesting, edits become suggestions and the text stays as it is
+    elements.editor.addEventListener('beforeinput', (event) => {
+        if (state.mode !== 'suggesting') return;
+        event.preventDefault();
+
+        let { selectionStart: start, selectionEnd: end } = elements.editor;
+        let content = '';
+        switch (event.inputType) {
+            case 'insertText':
+            case 'insertReplacementText':
+            case 'insertFromPaste':
+                content = event.data ?? event.dataTransfer?.getData('text/plain') ?? '';
+                break;
+            case 'insertLineBreak':
+            case 'insertParagraph':
+                content = '\n';
+                break;
+            case 'deleteContentBackward':
+                if (start === end && start > 0) start--;
+                break;
+            case 'deleteContentForward':
+                if (start === end && end < elements.editor.value.length) end++;
+                break;
+            default:
+                return;
+        }
+        if (start === end && !content) return;
+
+        sendMessage({ type: 'suggest', data: { start: start, end: end, content: content } });
+    });
+    elements.colorPicker.addEventListener('change', () => {
+        setProfile({ color: elements.colorPicker.value.toUpperCase() });
+    });
+
     trackCursorPosition();
     console.log('Cursor tracking initialized');
 }
@@ -447,6 +2169,14 @@ function trackCursorPosition() {
     editor.addEventListener('mouseup', () => {
         updateSelection();
     });
+
+    // Followers track our viewport; throttle scroll bursts
+    let viewportTimer;
+    editor.addEventListener('scroll', () => {
+        if (state.isUpdatingFromRemote) return;
+        clearTimeout(viewportTimer);
+        viewportTimer = setTimeout(sendViewport, 100);
+    });
 }
 
 function updateCursorPosition() {
@@ -477,14 +2207,33 @@ function updateSelection() {
 
 // Send message to server
 function sendMessage(msg) {
+    // Document messages name the document they are about, so one socket
+    // can carry several documents
+    const connectionLevel = msg.type === 'hello' || msg.type === 'subscribe' ||
+        msg.type === 'unsubscribe' || msg.type.startsWith('file_');
+    if (state.documentId && !msg.documentId && !connectionLevel) {
+        msg.documentId = state.documentId;
+    }
     if (state.ws && state.ws.readyState === WebSocket.OPEN) {
         state.ws.send(JSON.stringify(msg));
         console.log('Sent:', msg);
     }
 }
 
+// Declare our protocol version and capabilities
+function sendHello() {
+    sendMessage({
+        type: 'hello',
+        data: {
+            protocolVersion: PROTOCOL_VERSION,
+            capabilities: CLIENT_CAPABILITIES
+        }
+    });
+}
+
 // Request document state
 function requestDocumentState() {
+    if (!state.documentId) return;
     sendMessage({
         type: 'request_document',
         documentId: state.documentId
@@ -496,10 +2245,16 @@ function saveDocument() {
     sendMessage({
         type: 'save_document',
         documentId: state.documentId,
-        content: elements.editor.value
+        content: elements.editor.value,
+        format: document.getElementById('formatOnSave').checked
     });
 }
 
+// Format the document on the server; the result arrives as a text update
+function formatDocument() {
+    sendMessage({ type: 'format_document', data: {} });
+}
+
 // Better position calculation using a mirror div
 function getPositionFromIndex(textarea, index) {
     // Create invisible div with same styling as textarea